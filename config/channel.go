@@ -0,0 +1,22 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// TagChannel returns the regexp of TAG_CHANNEL_PATTERN, nil when it is empty, or an error when it is malformed
+// or has no channel capture group
+func (c *Config) TagChannel() (*regexp.Regexp, error) {
+	if c.TagChannelPattern == "" {
+		return nil, nil
+	}
+	re, err := regexp.Compile(c.TagChannelPattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid regex %q: %v", c.TagChannelPattern, err)
+	}
+	if re.SubexpIndex("channel") < 0 {
+		return nil, fmt.Errorf("regex %q has no channel capture group", c.TagChannelPattern)
+	}
+	return re, nil
+}
@@ -0,0 +1,28 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTagChannel(t *testing.T) {
+	c := &Config{}
+	re, err := c.TagChannel()
+	require.NoError(t, err)
+	assert.Nil(t, re)
+
+	c.TagChannelPattern = `-(?P<channel>[a-z]+)$`
+	re, err = c.TagChannel()
+	require.NoError(t, err)
+	assert.Equal(t, "stable", re.FindStringSubmatch("1.2.3-stable")[re.SubexpIndex("channel")])
+
+	c.TagChannelPattern = `-([a-z]+)$`
+	_, err = c.TagChannel()
+	assert.ErrorContains(t, err, "no channel capture group")
+
+	c.TagChannelPattern = `-(?P<channel>[a-z]+$`
+	_, err = c.TagChannel()
+	assert.Error(t, err)
+}
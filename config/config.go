@@ -1,48 +1,430 @@
 package config
 
 import (
+	"fmt"
+	"path"
+	"strings"
 	"time"
 
-	"github.com/caarlos0/env/v10"
 	"github.com/sirupsen/logrus"
 )
 
 type Config struct {
 	// API service configuration
 	APIPort     int    `env:"API_PORT" envDefault:"8080"`
+	GRPCPort    int    `env:"GRPC_PORT" envDefault:"0"` // gRPC service port, 0 disables the gRPC server
 	APIKey      string `env:"API_KEY" envDefault:""`
+	APIAuthMode string `env:"API_AUTH_MODE" envDefault:"api-key"` // api-key or k8s-token
 	KubeConfig  string `env:"KUBECONFIG" envDefault:""`
-	LogLevel    string `env:"LOG_LEVEL" envDefault:""`
 	LogTimezone string `env:"LOG_TIMEZONE" envDefault:"UTC"`
 
+	// File of KEY=VALUE lines overriding the environment, e.g. a mounted ConfigMap key, read again on SIGHUP
+	ConfigFile string `env:"CONFIG_FILE" envDefault:""`
+
+	// Comma separated kubeconfig contexts of the clusters to update, the default configuration when empty
+	KubeContexts string `env:"KUBE_CONTEXTS" envDefault:""`
+
+	// How long to retry connecting to the kubernetes API server at startup
+	K8sClientRetryTimeout time.Duration `env:"K8S_CLIENT_RETRY_TIMEOUT" envDefault:"2m"`
+
 	// Image update configuration
-	UpdaterEnabled      bool          `env:"UPDATER_ENABLED" envDefault:"true"`     // Enable/disable auto updater
-	ImageUpdateInterval time.Duration `env:"IMAGE_UPDATE_INTERVAL" envDefault:"5m"` // Default check interval is 5 minutes
+	UpdaterEnabled  bool          `env:"UPDATER_ENABLED" envDefault:"true"` // Enable/disable auto updater
+	StrictTags      bool          `env:"STRICT_TAGS" envDefault:"false"`    // Treat an allow-tags filter matching no tags as an error
+	CanaryDuration  time.Duration `env:"CANARY_DURATION" envDefault:"10m"`  // How long a canary must stay healthy before promotion
+	StartupDelay    time.Duration `env:"STARTUP_DELAY" envDefault:"0"`      // Wait before the interval of the first check starts, e.g. to confirm a new updater version is healthy
+	DefaultPlatform string        `env:"DEFAULT_PLATFORM" envDefault:""`    // Platform whose digest digest and latest mode track, e.g. linux/amd64
+
+	// Update mode of containers without mode annotation
+	DefaultUpdateMode string `env:"DEFAULT_UPDATE_MODE" envDefault:"release"`
+
+	// ConfigMap, as namespace/name, setting the mode and allow-tags of containers by image, below their annotations
+	PolicyConfigMap string `env:"POLICY_CONFIGMAP" envDefault:""`
+
+	// Skip containers whose image cannot be parsed, or fail the check of their resource with error
+	UnparseableImages string `env:"UNPARSEABLE_IMAGES" envDefault:"skip"` // skip or error
+
+	// Update the first of the containers sharing the name targeted by the container annotation, or fail the check of
+	// their resource with error
+	DuplicateContainerNames string `env:"DUPLICATE_CONTAINER_NAMES" envDefault:"first"` // first or error
+
+	// Pod template annotation receiving new container images, for progressive delivery tools reading the image from it.
+	// With mode instead, the containers are left unchanged and the annotation holds the tracked image
+	TemplateImageAnnotation     string `env:"TEMPLATE_IMAGE_ANNOTATION" envDefault:""`
+	TemplateImageAnnotationMode string `env:"TEMPLATE_IMAGE_ANNOTATION_MODE" envDefault:"also"` // also or instead
+
+	// Also check OpenKruise CloneSets and Advanced StatefulSets, the apps.kruise.io CRDs must be installed
+	EnableKruise bool `env:"ENABLE_KRUISE" envDefault:"false"`
+
+	// Let release mode replace a current tag that is not a version, e.g. nightly, with the latest version
+	AllowSwitchFromUnversioned bool `env:"ALLOW_SWITCH_FROM_UNVERSIONED" envDefault:"false"`
+
+	// Regex whose channel capture group extracts the channel of a version tag, e.g. stable in 1.2.3-stable.
+	// Release mode only selects tags of the channel of the current tag, empty disables channels
+	TagChannelPattern string `env:"TAG_CHANNEL_PATTERN" envDefault:""`
+
+	// Results of the last check of each resource kept for the status endpoint, the least recently checked are dropped first
+	StatusIndexMaxEntries int `env:"STATUS_INDEX_MAX_ENTRIES" envDefault:"10000"`
+
+	// Only report available updates in the available-update annotation, images are never changed
+	ReportOnly bool `env:"REPORT_ONLY" envDefault:"false"`
+
+	// Only check this resource, as kind/namespace/name, e.g. to try out annotations on a single deployment
+	TargetResource string `env:"TARGET_RESOURCE" envDefault:""`
+
+	// Restart the pods when latest mode records the first digest of an image, as done before it was only stored
+	LatestUpdateOnFirstSeen bool `env:"LATEST_UPDATE_ON_FIRST_SEEN" envDefault:"false"`
+
+	// Compare images of API updates by repository, tag and digest, so moving an image to a mirror alone is no change
+	MatchImagesIgnoringRegistry bool `env:"MATCH_IMAGES_IGNORING_REGISTRY" envDefault:"false"`
+
+	// Comma-separated list of image globs never updated whatever their annotations, e.g. istio/proxyv2
+	GlobalImageExcludes string `env:"GLOBAL_IMAGE_EXCLUDES" envDefault:""`
+
+	// Comma-separated list of container names or globs injected by admission webhooks, skipped unless named by the container annotation
+	IgnoredContainerNames string `env:"IGNORED_CONTAINER_NAMES" envDefault:"istio-proxy,istio-init,linkerd-proxy,linkerd-init,vault-agent,vault-agent-init"`
+
+	// Resolve the manifest of a tag selected in release, alphabetical or date mode before applying it, falling back to the next tag
+	VerifyBeforeApply bool `env:"VERIFY_BEFORE_APPLY" envDefault:"false"`
+
+	// Skip paused deployments and statefulsets or daemonsets using the OnDelete update strategy, whose new images would not roll out
+	RespectPaused bool `env:"RESPECT_PAUSED" envDefault:"true"`
+
+	// Write new images in the style of the current one, e.g. nginx:1.2.0 instead of index.docker.io/library/nginx:1.2.0
+	PreserveImageNameStyle bool `env:"PRESERVE_IMAGE_NAME_STYLE" envDefault:"false"`
+	// Naming of new images: full, preserve or short, overrides PRESERVE_IMAGE_NAME_STYLE when set
+	ImageNameStyle string `env:"IMAGE_NAME_STYLE" envDefault:""`
+
+	// Revert updates whose new image fails to pull, watched on every check during the grace period after the update
+	AutoRevertOnPullFailure bool          `env:"AUTO_REVERT_ON_PULL_FAILURE" envDefault:"false"`
+	PullFailureGracePeriod  time.Duration `env:"PULL_FAILURE_GRACE_PERIOD" envDefault:"15m"`
+
+	// Freeze all rollouts when the pods of an update crash loop on the new image during the grace period after the
+	// update, until unfrozen through the API
+	FreezeOnCrashLoop    bool          `env:"FREEZE_ON_CRASHLOOP" envDefault:"false"`
+	CrashLoopGracePeriod time.Duration `env:"CRASHLOOP_GRACE_PERIOD" envDefault:"10m"`
+	// ConfigMap, as namespace/name, the freeze is saved in so it outlives restarts of the updater. Empty uses
+	// k8s-image-updater-freeze in the namespace of the updater.
+	FreezeStateConfigMap string `env:"FREEZE_STATE_CONFIGMAP" envDefault:""`
+
+	// Skip updates undoing an update applied within this window, or redoing one undone since, 0 disables the detection
+	FlapDetectionWindow time.Duration `env:"FLAP_DETECTION_WINDOW" envDefault:"1h"`
+
+	// Hooks run around every rollout, an http(s) URL receiving a POST or a shell command. A failing pre-update hook aborts the update
+	PreUpdateHook     string        `env:"PRE_UPDATE_HOOK" envDefault:""`
+	PostUpdateHook    string        `env:"POST_UPDATE_HOOK" envDefault:""`
+	UpdateHookTimeout time.Duration `env:"UPDATE_HOOK_TIMEOUT" envDefault:"30s"`
+
+	// Hook notified once a resource failed to be written this many consecutive times, 0 disables the notification
+	ApplyFailureHook           string `env:"APPLY_FAILURE_HOOK" envDefault:""`
+	ApplyFailureAlertThreshold int    `env:"APPLY_FAILURE_ALERT_THRESHOLD" envDefault:"3"`
+
+	// Hook notified when FREEZE_ON_CRASHLOOP freezes rollouts
+	FreezeHook string `env:"FREEZE_HOOK" envDefault:""`
+
+	// URL receiving a POST summarizing each check cycle
+	CycleWebhookURL string `env:"CYCLE_WEBHOOK_URL" envDefault:""`
+
+	// Hooks notified of updates instead of POST_UPDATE_HOOK and APPLY_FAILURE_HOOK, as comma-separated name=hook pairs
+	NotifyChannels       string `env:"NOTIFY_CHANNELS" envDefault:""`        // By notify-channel annotation value
+	NotifyNamespaceHooks string `env:"NOTIFY_NAMESPACE_HOOKS" envDefault:""` // By namespace or glob pattern, the first match wins
+
+	// Tag lookups for the require-annotation and min-tag-age annotations, each one is a registry request
+	TagAnnotationLookups  int           `env:"TAG_ANNOTATION_LOOKUPS" envDefault:"10"`   // Tags looked up per container and check
+	TagAnnotationCacheTTL time.Duration `env:"TAG_ANNOTATION_CACHE_TTL" envDefault:"1h"` // How long the annotations and creation time of a tag are cached
+
+	// Signature verification, VERIFY_SIGNATURES=true only rolls out images with a valid cosign signature
+	VerifySignatures    bool   `env:"VERIFY_SIGNATURES" envDefault:"false"`
+	CosignPublicKey     string `env:"COSIGN_PUBLIC_KEY" envDefault:""`      // PEM encoded public key
+	CosignPublicKeyFile string `env:"COSIGN_PUBLIC_KEY_FILE" envDefault:""` // Path of a PEM encoded public key
+
+	// Keyless signatures, verified without a public key against the identity of their Fulcio certificate
+	CosignCertificateIdentity         string `env:"COSIGN_CERTIFICATE_IDENTITY" envDefault:""`           // Subject, e.g. an email or workflow URL
+	CosignCertificateIdentityRegexp   string `env:"COSIGN_CERTIFICATE_IDENTITY_REGEXP" envDefault:""`    // Subject as a regexp
+	CosignCertificateOIDCIssuer       string `env:"COSIGN_CERTIFICATE_OIDC_ISSUER" envDefault:""`        // OIDC issuer, e.g. https://token.actions.githubusercontent.com
+	CosignCertificateOIDCIssuerRegexp string `env:"COSIGN_CERTIFICATE_OIDC_ISSUER_REGEXP" envDefault:""` // OIDC issuer as a regexp
+	CosignRekorURL                    string `env:"COSIGN_REKOR_URL" envDefault:"https://rekor.sigstore.dev"`
+
+	// GitOps write-back configuration, WRITE_BACK_MODE=git commits new images to a repository instead of updating the cluster
+	WriteBackMode           string `env:"WRITE_BACK_MODE" envDefault:""`
+	WriteBackGitRepo        string `env:"WRITE_BACK_GIT_REPO" envDefault:""`
+	WriteBackGitBranch      string `env:"WRITE_BACK_GIT_BRANCH" envDefault:"main"`
+	WriteBackGitPath        string `env:"WRITE_BACK_GIT_PATH" envDefault:""` // Default manifest path, overridden by the write-back-path annotation
+	WriteBackGitUsername    string `env:"WRITE_BACK_GIT_USERNAME" envDefault:""`
+	WriteBackGitPassword    string `env:"WRITE_BACK_GIT_PASSWORD" envDefault:""`
+	WriteBackGitAuthorName  string `env:"WRITE_BACK_GIT_AUTHOR_NAME" envDefault:"k8s-image-updater"`
+	WriteBackGitAuthorEmail string `env:"WRITE_BACK_GIT_AUTHOR_EMAIL" envDefault:"k8s-image-updater@localhost"`
+
+	// Audit log of applied updates, written to stdout when no file is set
+	AuditLogFile       string `env:"AUDIT_LOG_FILE" envDefault:""`
+	AuditLogMaxSizeMB  int    `env:"AUDIT_LOG_MAX_SIZE_MB" envDefault:"100"` // Size at which the file is rotated, 0 disables rotation
+	AuditLogMaxBackups int    `env:"AUDIT_LOG_MAX_BACKUPS" envDefault:"5"`   // Rotated files kept
 
 	// Allowed namespaces configuration
-	AllowedNamespaces string `env:"ALLOWED_NAMESPACES" envDefault:""` // Comma-separated list of allowed namespaces
+	AllowedNamespaces string `env:"ALLOWED_NAMESPACES" envDefault:""` // Comma-separated list of allowed namespaces or glob patterns
+	// List resources namespace by namespace in ALLOWED_NAMESPACES, never cluster-wide, so a Role per namespace suffices
+	NamespacedRBAC    bool   `env:"NAMESPACED_RBAC" envDefault:"false"`
+	AllowedRegistries string `env:"ALLOWED_REGISTRIES" envDefault:""` // Comma-separated list of registry hosts images may come from
+
+	// Registry TLS, applied to every registry request of the auto-updater and the API
+	InsecureRegistries string `env:"REGISTRY_INSECURE" envDefault:""` // Comma-separated list of registry hosts whose TLS certificate is not verified
+	RegistryCAFile     string `env:"REGISTRY_CA_FILE" envDefault:""`  // PEM bundle of CA certificates trusted for registries, in addition to the system roots
+
+	// Tags of a repository kept from its tag list, the last ones listed, 0 keeps all. Registries list tags in
+	// lexical order, so a newer version sorting lower, e.g. 1.10.0 before 1.9.0, may be dropped
+	MaxTags int `env:"MAX_TAGS" envDefault:"0"`
+
+	// Retry a failed tag listing with a single plain /v2/<repo>/tags/list request, for registries not supporting pagination
+	RegistryTagsFallback bool `env:"REGISTRY_TAGS_FALLBACK" envDefault:"false"`
+
+	// Proxy URL of every registry request, overriding HTTP_PROXY and HTTPS_PROXY. Hosts of NO_PROXY are still reached directly
+	RegistryProxy string `env:"REGISTRY_PROXY" envDefault:""`
+
+	// Docker config.json mounted in the pod, consulted for registry credentials after pull secrets and REGISTRY_AUTH_<registry>
+	DockerConfigFile string `env:"DOCKER_CONFIG_FILE" envDefault:""`
+
+	// Registry credentials from REGISTRY_AUTH_<registry>=user:password env vars, used when no pull secret matches
+	RegistryAuth map[string]RegistryCredential
 }
 
 // Annotation keys for image update configuration
 const (
 	// Enable auto update for the resource
 	LabelEnabled = "image-updater.k8s.io/enabled"
-	// Image update mode: digest, release or latest
+	// Image update mode: release, digest, latest, alphabetical, date or review.
+	// This, AnnotationAllowTags and AnnotationMinVersion can be overridden per container with a ".<container>" suffix
 	AnnotationMode = "image-updater.k8s.io/mode"
-	// Container name to update, if not set, update all containers
+	// Container name to update, or a glob pattern such as app-*, if not set, update all containers
 	AnnotationContainer = "image-updater.k8s.io/container"
+	// Comma-separated list of container names or globs injected by admission webhooks into the resource,
+	// skipped like IGNORED_CONTAINER_NAMES
+	AnnotationInjectedContainers = "image-updater.k8s.io/injected-containers"
+	// Channel of NOTIFY_CHANNELS notified of the updates of the resource
+	AnnotationNotifyChannel = "image-updater.k8s.io/notify-channel"
 	// Restart annotation for latest mode
 	AnnotationRestart = "kubectl.kubernetes.io/restartedAt"
+	// Set to false to make an API update to the current image a no-op instead of restarting pods with imagePullPolicy Always
+	AnnotationRestartOnSameImage = "image-updater.k8s.io/restart-on-same-image"
+	// Minimum time between two restarts in latest mode, e.g. 6h, a new digest found sooner waits
+	AnnotationMinRestartInterval = "image-updater.k8s.io/min-restart-interval"
 	// Last known digest for latest mode
 	AnnotationLastDigest = "image-updater.k8s.io/last-digest"
 	// Allow tags regex
 	AnnotationAllowTags = "image-updater.k8s.io/allow-tags"
+	// Tag sort order in alphabetical mode: desc (default) picks the highest tag, asc the lowest
+	AnnotationSortOrder = "image-updater.k8s.io/sort-order"
+	// Go time layout tags are parsed with in date mode, e.g. 2006.01.02
+	AnnotationDateFormat = "image-updater.k8s.io/date-format"
+	// Lowest version release mode may select, e.g. 1.4.0. Release mode never selects a version below the current one either
+	AnnotationMinVersion = "image-updater.k8s.io/min-version"
+	// Pin the digest of the selected tag in release mode, writing repo:tag@digest
+	AnnotationPinDigest = "image-updater.k8s.io/pin-digest"
+	// Keep the tracked tag in digest mode, writing repo:tag@digest instead of repo@digest
+	AnnotationPreserveTag = "image-updater.k8s.io/preserve-tag"
+	// OCI annotation or label, as key=value, that a tag must carry to be selected in release, alphabetical and date mode
+	AnnotationRequireAnnotation = "image-updater.k8s.io/require-annotation"
+	// Maximum relative change of the image size, like 0.5 or 50%, for an update to be applied
+	AnnotationMaxSizeChange = "image-updater.k8s.io/max-size-change"
+	// Comma-separated digests of the approved images, only they are rolled out
+	AnnotationAllowedDigests = "image-updater.k8s.io/allowed-digests"
+	// Minimum age of a tag, as a duration like 48h, to be selected in release, alphabetical and date mode, from its image creation time
+	AnnotationMinTagAge = "image-updater.k8s.io/min-tag-age"
+	// Platform whose digest digest and latest mode track, e.g. linux/arm64, overrides the node architecture and DEFAULT_PLATFORM
+	AnnotationPlatform = "image-updater.k8s.io/platform"
+	// Comma-separated secrets searched for registry credentials before the imagePullSecrets of the pods, in preference order
+	AnnotationPullSecrets = "image-updater.k8s.io/pull-secrets"
+	// Set to true to skip the TLS verification of the registries of the resource, like REGISTRY_INSECURE
+	AnnotationRegistryInsecure = "image-updater.k8s.io/registry-insecure"
+	// Secret in the resource namespace whose ca.crt key holds CA certificates trusted for the registries of the resource
+	AnnotationRegistryCASecret = "image-updater.k8s.io/registry-ca-secret"
+	// Env var holding the image to track, instead of the container image
+	AnnotationImageEnv = "image-updater.k8s.io/image-env"
+	// ConfigMap key holding the image to track, as <configmap>/<key> in the resource namespace, instead of the containers
+	AnnotationConfigMapRef = "image-updater.k8s.io/configmap-ref"
+	// Separator of the images of a ConfigMap key holding several images, e.g. ",", each one updated independently
+	AnnotationConfigMapSeparator = "image-updater.k8s.io/configmap-separator"
+	// Manifest file of the resource in the write-back repository, overrides WRITE_BACK_GIT_PATH
+	AnnotationWriteBackPath = "image-updater.k8s.io/write-back-path"
+	// Image proposed in review mode, waiting to be approved through the API. Removing it cancels the proposal
+	AnnotationPendingImage = "image-updater.k8s.io/pending-image"
+	// Container the pending image is proposed for
+	AnnotationPendingContainer = "image-updater.k8s.io/pending-container"
+	// Last image proposed in review mode, a cancelled proposal is not proposed again
+	AnnotationProposedImage = "image-updater.k8s.io/proposed-image"
+	// Images of the containers before the last update, as container=image pairs, kept to revert a pull failure
+	AnnotationPreviousImage = "image-updater.k8s.io/previous-image"
+	// When the last update was applied
+	AnnotationUpdatedAt = "image-updater.k8s.io/updated-at"
+	// Until when the pods of the last update are watched for crash loops, with FREEZE_ON_CRASHLOOP
+	AnnotationCrashLoopWatchUntil = "image-updater.k8s.io/crashloop-watch-until"
+	// Images reverted because they failed to pull, as container=image pairs, they are not retried
+	AnnotationPullFailedImages = "image-updater.k8s.io/pull-failed-images"
+	// Images an update would roll out with REPORT_ONLY, as container=image pairs, set by the updater
+	AnnotationAvailableUpdate = "image-updater.k8s.io/available-update"
+	// Status of the last check, set by the updater
+	AnnotationStatus = "image-updater.k8s.io/status"
+	// Error of the last failed write of the resource, with the apply-failed status, set by the updater
+	AnnotationApplyError = "image-updater.k8s.io/apply-error"
+	// Name of a canary deployment in the same namespace that receives new images first
+	AnnotationCanary = "image-updater.k8s.io/canary"
+	// How long the canary must stay healthy before promotion, overrides CANARY_DURATION
+	AnnotationCanaryDuration = "image-updater.k8s.io/canary-duration"
+	// Canary progress, set by the updater
+	AnnotationCanaryImages       = "image-updater.k8s.io/canary-images"
+	AnnotationCanaryStartedAt    = "image-updater.k8s.io/canary-started-at"
+	AnnotationCanaryHealthySince = "image-updater.k8s.io/canary-healthy-since"
+	// Images that failed on the canary, they are not retried
+	AnnotationCanaryFailedImages = "image-updater.k8s.io/canary-failed-images"
+)
+
+// Values of the status annotation
+const (
+	// The allow-tags filter removed every tag of the image, or no newer tag has the required annotation
+	StatusNoMatchingTags = "no-matching-tags"
+	// New images are running on the canary, waiting for it to stay healthy
+	StatusCanaryInProgress = "canary-in-progress"
+	// The canary became unhealthy and was rolled back
+	StatusCanaryFailed = "canary-failed"
+	// The image comes from a registry missing from ALLOWED_REGISTRIES
+	StatusRegistryNotAllowed = "registry-not-allowed"
+	// A newer image was proposed in review mode and waits for approval
+	StatusPendingApproval = "pending-approval"
+	// The new image failed to pull and was reverted to the previous image
+	StatusPullFailed = "pull-failed"
+	// An update would undo or redo an update applied within FLAP_DETECTION_WINDOW, it was not applied
+	StatusFlapping = "flapping"
+	// The size of the new image changed by more than the max-size-change annotation allows, it was not applied
+	StatusSizeChangeExceeded = "size-change-exceeded"
+	// No newer image has a digest of the allowed-digests annotation, the current image is kept
+	StatusDigestNotAllowed = "digest-not-allowed"
+	// The image of a container cannot be parsed as an image reference, it is not checked
+	StatusUnparseableImage = "unparseable-image"
+	// Several containers share the name targeted by the container annotation, see DUPLICATE_CONTAINER_NAMES
+	StatusDuplicateContainerName = "duplicate-container-name"
+	// The signature of the new image could not be verified
+	StatusSignatureNotVerified = "signature-not-verified"
+	// Writing the updated resource failed, e.g. it was rejected by an admission webhook
+	StatusApplyFailed = "apply-failed"
+)
+
+// Authentication modes of the HTTP API
+const (
+	// Requests carry API_KEY in the X-API-Key header
+	AuthModeAPIKey = "api-key"
+	// Requests carry a kubernetes bearer token, authorized against the target namespace with RBAC
+	AuthModeK8sToken = "k8s-token"
+)
+
+// Styles of IMAGE_NAME_STYLE naming the images written by the updater
+const (
+	// Registry host and full repository, e.g. index.docker.io/library/nginx
+	ImageNameFull = "full"
+	// Registry and repository as written in the current image
+	ImageNamePreserve = "preserve"
+	// Docker Hub images without registry host and library/ namespace, e.g. nginx, other images in full
+	ImageNameShort = "short"
 )
 
 var GlobalConfig = &Config{}
 
+// AuthMode returns the authentication mode of API_AUTH_MODE, accepted in any case and with underscores, e.g. K8S_TOKEN
+func (c *Config) AuthMode() (string, error) {
+	mode := strings.ReplaceAll(strings.ToLower(strings.TrimSpace(c.APIAuthMode)), "_", "-")
+	switch mode {
+	case "":
+		return AuthModeAPIKey, nil
+	case AuthModeAPIKey, AuthModeK8sToken:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown API auth mode %q, must be %s or %s", c.APIAuthMode, AuthModeAPIKey, AuthModeK8sToken)
+}
+
+// NameStyle returns the style of IMAGE_NAME_STYLE, accepted in any case. When it is empty the style is preserve
+// with PRESERVE_IMAGE_NAME_STYLE and full otherwise
+func (c *Config) NameStyle() (string, error) {
+	style := strings.ToLower(strings.TrimSpace(c.ImageNameStyle))
+	switch style {
+	case "":
+		if c.PreserveImageNameStyle {
+			return ImageNamePreserve, nil
+		}
+		return ImageNameFull, nil
+	case ImageNameFull, ImageNamePreserve, ImageNameShort:
+		return style, nil
+	}
+	return "", fmt.Errorf("unknown image name style %q, must be %s, %s or %s", c.ImageNameStyle, ImageNameFull, ImageNamePreserve, ImageNameShort)
+}
+
+// NamespaceAllowed reports whether the API may operate on the given namespace.
+// Entries of ALLOWED_NAMESPACES are exact names or glob patterns such as team-*
+func (c *Config) NamespaceAllowed(namespace string) bool {
+	if c.AllowedNamespaces == "" {
+		return true
+	}
+	return compileNamespaces(c.AllowedNamespaces).Match(namespace)
+}
+
+// Contexts returns the kubeconfig contexts of KUBE_CONTEXTS, one per cluster
+func (c *Config) Contexts() []string {
+	var contexts []string
+	for _, context := range strings.Split(c.KubeContexts, ",") {
+		if context = strings.TrimSpace(context); context != "" {
+			contexts = append(contexts, context)
+		}
+	}
+	return contexts
+}
+
+// ImageExcludes returns the image glob patterns of GLOBAL_IMAGE_EXCLUDES, or an error for a malformed pattern
+func (c *Config) ImageExcludes() ([]string, error) {
+	var patterns []string
+	for _, pattern := range strings.Split(c.GlobalImageExcludes, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern == "" {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid image pattern %q: %v", pattern, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// RegistryAllowed reports whether images may be pulled from the given registry host
+func (c *Config) RegistryAllowed(registry string) bool {
+	if c.AllowedRegistries == "" {
+		return true
+	}
+	for _, allowed := range strings.Split(c.AllowedRegistries, ",") {
+		if normalizeRegistry(strings.TrimSpace(allowed)) == normalizeRegistry(registry) {
+			return true
+		}
+	}
+	return false
+}
+
+// RegistryInsecure reports whether the TLS certificate of a registry host is not verified
+func (c *Config) RegistryInsecure(registry string) bool {
+	for _, insecure := range strings.Split(c.InsecureRegistries, ",") {
+		if insecure = strings.TrimSpace(insecure); insecure != "" && normalizeRegistry(insecure) == normalizeRegistry(registry) {
+			return true
+		}
+	}
+	return false
+}
+
+// Docker Hub is referred to as both docker.io and index.docker.io
+func normalizeRegistry(registry string) string {
+	registry = strings.ToLower(registry)
+	if registry == "docker.io" || registry == "registry-1.docker.io" {
+		return "index.docker.io"
+	}
+	return registry
+}
+
 func init() {
-	if err := env.Parse(GlobalConfig); err != nil {
+	tuning := &Tunables{}
+	if err := parse(GlobalConfig, tuning); err != nil {
 		logrus.Fatalf("Failed to parse environment variables: %v", err)
 	}
+	tunables.Store(tuning)
 }
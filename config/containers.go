@@ -0,0 +1,32 @@
+package config
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// ContainerMatches reports whether a container name matches the container annotation or API parameter,
+// an exact name or a glob pattern such as app-*. Invalid patterns match no container.
+func ContainerMatches(pattern, name string) bool {
+	if !strings.ContainsAny(pattern, "*?[\\") {
+		return pattern == name
+	}
+	ok, _ := path.Match(pattern, name)
+	return ok
+}
+
+// IgnoredContainers returns the container name patterns of IGNORED_CONTAINER_NAMES, or an error for a malformed pattern
+func (c *Config) IgnoredContainers() ([]string, error) {
+	var patterns []string
+	for _, pattern := range strings.Split(c.IgnoredContainerNames, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern == "" {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid container pattern %q: %v", pattern, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
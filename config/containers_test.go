@@ -0,0 +1,39 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContainerMatches(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"app", "app", true},
+		{"app", "app-sidecar", false},
+		{"app-*", "app-sidecar", true},
+		{"app-*", "app", false},
+		{"app-?", "app-1", true},
+		{"app-[ab]", "app-c", false},
+		{"app-[", "app-[", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+"/"+tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, ContainerMatches(tt.pattern, tt.name))
+		})
+	}
+}
+
+func TestIgnoredContainers(t *testing.T) {
+	c := &Config{IgnoredContainerNames: " istio-proxy, ,*-agent"}
+	patterns, err := c.IgnoredContainers()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"istio-proxy", "*-agent"}, patterns)
+
+	c.IgnoredContainerNames = "istio-proxy,agent-["
+	_, err = c.IgnoredContainers()
+	assert.Error(t, err)
+}
@@ -0,0 +1,26 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Behaviors of DUPLICATE_CONTAINER_NAMES
+const (
+	// Only the first of the containers sharing the target name is updated, the others are skipped
+	DuplicateContainerFirst = "first"
+	// Containers sharing the target name fail the check of their resource, none of them is updated
+	DuplicateContainerError = "error"
+)
+
+// DuplicateContainerMode returns the behavior of DUPLICATE_CONTAINER_NAMES, accepted in any case, first when empty
+func (c *Config) DuplicateContainerMode() (string, error) {
+	mode := strings.ToLower(strings.TrimSpace(c.DuplicateContainerNames))
+	switch mode {
+	case "":
+		return DuplicateContainerFirst, nil
+	case DuplicateContainerFirst, DuplicateContainerError:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown duplicate container name behavior %q, must be %s or %s", c.DuplicateContainerNames, DuplicateContainerFirst, DuplicateContainerError)
+}
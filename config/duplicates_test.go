@@ -0,0 +1,17 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDuplicateContainerMode(t *testing.T) {
+	for value, want := range map[string]string{"": DuplicateContainerFirst, "first": DuplicateContainerFirst, " Error ": DuplicateContainerError} {
+		mode, err := (&Config{DuplicateContainerNames: value}).DuplicateContainerMode()
+		assert.NoError(t, err)
+		assert.Equal(t, want, mode, value)
+	}
+	_, err := (&Config{DuplicateContainerNames: "all"}).DuplicateContainerMode()
+	assert.ErrorContains(t, err, "unknown duplicate container name behavior")
+}
@@ -0,0 +1,36 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Name of the ConfigMap the freeze is saved in when FREEZE_STATE_CONFIGMAP is not set
+const defaultFreezeStateConfigMap = "k8s-image-updater-freeze"
+
+// File holding the namespace of the pod's service account
+var serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// FreezeStateConfigMapRef returns the namespace and name of the ConfigMap the freeze is saved in, by default in the
+// namespace of the updater read from POD_NAMESPACE or its service account. Both are empty when that namespace is not
+// known, e.g. outside a cluster.
+func (c *Config) FreezeStateConfigMapRef() (string, string, error) {
+	if c.FreezeStateConfigMap != "" {
+		namespace, name, ok := strings.Cut(c.FreezeStateConfigMap, "/")
+		if !ok || namespace == "" || name == "" || strings.Contains(name, "/") {
+			return "", "", fmt.Errorf("%q is not namespace/name", c.FreezeStateConfigMap)
+		}
+		return namespace, name, nil
+	}
+	namespace := os.Getenv("POD_NAMESPACE")
+	if namespace == "" {
+		if data, err := os.ReadFile(serviceAccountNamespaceFile); err == nil {
+			namespace = strings.TrimSpace(string(data))
+		}
+	}
+	if namespace == "" {
+		return "", "", nil
+	}
+	return namespace, defaultFreezeStateConfigMap, nil
+}
@@ -0,0 +1,43 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFreezeStateConfigMapRef(t *testing.T) {
+	t.Setenv("POD_NAMESPACE", "")
+	old := serviceAccountNamespaceFile
+	t.Cleanup(func() { serviceAccountNamespaceFile = old })
+	serviceAccountNamespaceFile = filepath.Join(t.TempDir(), "namespace")
+
+	// Outside a cluster the namespace of the updater is not known
+	namespace, name, err := (&Config{}).FreezeStateConfigMapRef()
+	assert.NoError(t, err)
+	assert.Empty(t, namespace+name)
+
+	require.NoError(t, os.WriteFile(serviceAccountNamespaceFile, []byte("kube-system\n"), 0o600))
+	namespace, name, err = (&Config{}).FreezeStateConfigMapRef()
+	assert.NoError(t, err)
+	assert.Equal(t, "kube-system", namespace)
+	assert.Equal(t, "k8s-image-updater-freeze", name)
+
+	t.Setenv("POD_NAMESPACE", "image-updater")
+	namespace, _, err = (&Config{}).FreezeStateConfigMapRef()
+	assert.NoError(t, err)
+	assert.Equal(t, "image-updater", namespace)
+
+	namespace, name, err = (&Config{FreezeStateConfigMap: "ops/freeze"}).FreezeStateConfigMapRef()
+	assert.NoError(t, err)
+	assert.Equal(t, "ops", namespace)
+	assert.Equal(t, "freeze", name)
+
+	for _, value := range []string{"freeze", "/freeze", "ops/", "a/b/c"} {
+		_, _, err := (&Config{FreezeStateConfigMap: value}).FreezeStateConfigMapRef()
+		assert.ErrorContains(t, err, "is not namespace/name", value)
+	}
+}
@@ -0,0 +1,36 @@
+package config
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/monlor/k8s-image-updater/pkg/version"
+)
+
+// ModeRelease is the update mode of containers without mode annotation when DEFAULT_UPDATE_MODE is empty
+const ModeRelease = "release"
+
+// DefaultMode returns DEFAULT_UPDATE_MODE, the update mode of containers without mode annotation,
+// release when empty
+func (c *Config) DefaultMode() (string, error) {
+	mode := strings.ToLower(strings.TrimSpace(c.DefaultUpdateMode))
+	if mode == "" {
+		return ModeRelease, nil
+	}
+	if !slices.Contains(version.Modes, mode) {
+		return "", fmt.Errorf("unknown update mode %q, must be one of %s", c.DefaultUpdateMode, strings.Join(version.Modes, ", "))
+	}
+	return mode, nil
+}
+
+// ResourceMode returns the update mode of a resource annotation, DEFAULT_UPDATE_MODE when empty
+func (c *Config) ResourceMode(annotation string) string {
+	if annotation != "" {
+		return annotation
+	}
+	if mode, err := c.DefaultMode(); err == nil {
+		return mode
+	}
+	return ModeRelease
+}
@@ -0,0 +1,24 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDefaultMode(t *testing.T) {
+	for value, want := range map[string]string{"": "release", "digest": "digest", " Latest ": "latest", "review": "review"} {
+		c := &Config{DefaultUpdateMode: value}
+		mode, err := c.DefaultMode()
+		require.NoError(t, err, value)
+		assert.Equal(t, want, mode, value)
+	}
+
+	c := &Config{DefaultUpdateMode: "newest"}
+	_, err := c.DefaultMode()
+	assert.ErrorContains(t, err, "unknown update mode")
+	// An invalid default is refused at startup, release is used meanwhile
+	assert.Equal(t, "release", c.ResourceMode(""))
+	assert.Equal(t, "date", c.ResourceMode("date"))
+}
@@ -0,0 +1,82 @@
+package config
+
+import (
+	"fmt"
+	"maps"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// namespaceMatcher matches namespaces against a list of exact names and glob patterns
+type namespaceMatcher struct {
+	names    map[string]bool
+	patterns []string
+}
+
+// Compiled matchers by ALLOWED_NAMESPACES value, so changing the config at runtime is picked up
+var namespaceMatchers sync.Map
+
+// compileNamespaces splits a comma-separated list into exact names and glob patterns.
+// Invalid patterns are logged and ignored.
+func compileNamespaces(list string) *namespaceMatcher {
+	if m, ok := namespaceMatchers.Load(list); ok {
+		return m.(*namespaceMatcher)
+	}
+	m := &namespaceMatcher{names: make(map[string]bool)}
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.ContainsAny(entry, "*?[\\") {
+			m.names[entry] = true
+			continue
+		}
+		if _, err := path.Match(entry, ""); err != nil {
+			logrus.Warnf("Ignoring invalid namespace pattern %q: %v", entry, err)
+			continue
+		}
+		m.patterns = append(m.patterns, entry)
+	}
+	actual, _ := namespaceMatchers.LoadOrStore(list, m)
+	return actual.(*namespaceMatcher)
+}
+
+// Match reports whether the namespace equals one of the names or matches one of the patterns
+func (m *namespaceMatcher) Match(namespace string) bool {
+	if m.names[namespace] {
+		return true
+	}
+	for _, pattern := range m.patterns {
+		if ok, _ := path.Match(pattern, namespace); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowedNamespaceEntries returns the exact names, sorted, and the glob patterns of ALLOWED_NAMESPACES
+func (c *Config) AllowedNamespaceEntries() ([]string, []string) {
+	m := compileNamespaces(c.AllowedNamespaces)
+	return slices.Sorted(maps.Keys(m.names)), slices.Clone(m.patterns)
+}
+
+// RBACNamespaces returns the namespaces listed one by one with NAMESPACED_RBAC, the names of ALLOWED_NAMESPACES.
+// Glob patterns are refused, resolving them needs the cluster-wide permission to list namespaces.
+func (c *Config) RBACNamespaces() ([]string, error) {
+	if !c.NamespacedRBAC {
+		return nil, nil
+	}
+	names, patterns := c.AllowedNamespaceEntries()
+	if len(patterns) > 0 {
+		return nil, fmt.Errorf("NAMESPACED_RBAC needs namespace names in ALLOWED_NAMESPACES, not patterns like %s", strings.Join(patterns, ", "))
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("NAMESPACED_RBAC needs the namespaces to update in ALLOWED_NAMESPACES")
+	}
+	return names, nil
+}
@@ -0,0 +1,56 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNamespaceAllowed(t *testing.T) {
+	tests := []struct {
+		name      string
+		allowed   string
+		namespace string
+		want      bool
+	}{
+		{"empty allows all", "", "anything", true},
+		{"exact name", "default,prod", "prod", true},
+		{"exact name does not prefix match", "default,prod", "production", false},
+		{"pattern", "team-*", "team-a", true},
+		{"pattern needs its prefix", "team-*", "other-team", false},
+		{"pattern single character", "env-?", "env-1", true},
+		{"mix exact name", "default, team-*", "default", true},
+		{"mix pattern", "default, team-*", "team-payments", true},
+		{"mix neither", "default, team-*", "kube-system", false},
+		{"invalid pattern ignored", "team-[,default", "default", true},
+		{"invalid pattern matches nothing", "team-[", "team-[", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{AllowedNamespaces: tt.allowed}
+			assert.Equal(t, tt.want, cfg.NamespaceAllowed(tt.namespace))
+		})
+	}
+}
+
+func TestCompileNamespacesCached(t *testing.T) {
+	m := compileNamespaces("default,team-*")
+	assert.Same(t, m, compileNamespaces("default,team-*"))
+	assert.Equal(t, map[string]bool{"default": true}, m.names)
+	assert.Equal(t, []string{"team-*"}, m.patterns)
+}
+
+func TestRBACNamespaces(t *testing.T) {
+	namespaces, err := (&Config{AllowedNamespaces: "team-*"}).RBACNamespaces()
+	assert.NoError(t, err)
+	assert.Nil(t, namespaces)
+
+	namespaces, err = (&Config{NamespacedRBAC: true, AllowedNamespaces: "team-b, team-a"}).RBACNamespaces()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"team-a", "team-b"}, namespaces)
+
+	_, err = (&Config{NamespacedRBAC: true}).RBACNamespaces()
+	assert.ErrorContains(t, err, "ALLOWED_NAMESPACES")
+	_, err = (&Config{NamespacedRBAC: true, AllowedNamespaces: "default,team-*"}).RBACNamespaces()
+	assert.ErrorContains(t, err, "team-*")
+}
@@ -0,0 +1,49 @@
+package config
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// NotifyRoute is a hook notified of the updates of the resources of a namespace, from NOTIFY_NAMESPACE_HOOKS
+type NotifyRoute struct {
+	// Namespace name or glob pattern
+	Namespace string
+	Hook      string
+}
+
+// NotifyChannelHooks returns the hooks of NOTIFY_CHANNELS by channel name, or an error for a malformed entry
+func (c *Config) NotifyChannelHooks() (map[string]string, error) {
+	hooks := make(map[string]string)
+	for _, entry := range strings.Split(c.NotifyChannels, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		channel, hook, ok := strings.Cut(entry, "=")
+		if channel, hook = strings.TrimSpace(channel), strings.TrimSpace(hook); !ok || channel == "" || hook == "" {
+			return nil, fmt.Errorf("invalid channel %q, expected name=hook", entry)
+		}
+		hooks[channel] = hook
+	}
+	return hooks, nil
+}
+
+// NotifyRoutes returns the hooks of NOTIFY_NAMESPACE_HOOKS in order, or an error for a malformed entry
+func (c *Config) NotifyRoutes() ([]NotifyRoute, error) {
+	var routes []NotifyRoute
+	for _, entry := range strings.Split(c.NotifyNamespaceHooks, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		namespace, hook, ok := strings.Cut(entry, "=")
+		if namespace, hook = strings.TrimSpace(namespace), strings.TrimSpace(hook); !ok || namespace == "" || hook == "" {
+			return nil, fmt.Errorf("invalid namespace hook %q, expected namespace=hook", entry)
+		}
+		if _, err := path.Match(namespace, ""); err != nil {
+			return nil, fmt.Errorf("invalid namespace pattern %q: %v", namespace, err)
+		}
+		routes = append(routes, NotifyRoute{Namespace: namespace, Hook: hook})
+	}
+	return routes, nil
+}
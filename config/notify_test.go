@@ -0,0 +1,33 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNotifyRoutes(t *testing.T) {
+	c := &Config{
+		NotifyChannels:       " payments=https://hooks.example.com/a?token=x=y , ,search=notify-search.sh",
+		NotifyNamespaceHooks: "team-a=https://hooks.example.com/team-a,team-*=https://hooks.example.com/teams",
+	}
+	channels, err := c.NotifyChannelHooks()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"payments": "https://hooks.example.com/a?token=x=y", "search": "notify-search.sh"}, channels)
+	routes, err := c.NotifyRoutes()
+	require.NoError(t, err)
+	assert.Equal(t, []NotifyRoute{
+		{Namespace: "team-a", Hook: "https://hooks.example.com/team-a"},
+		{Namespace: "team-*", Hook: "https://hooks.example.com/teams"},
+	}, routes)
+
+	for _, invalid := range []string{"payments", "=https://hooks.example.com", "payments="} {
+		_, err = (&Config{NotifyChannels: invalid}).NotifyChannelHooks()
+		assert.Error(t, err, invalid)
+		_, err = (&Config{NotifyNamespaceHooks: invalid}).NotifyRoutes()
+		assert.Error(t, err, invalid)
+	}
+	_, err = (&Config{NotifyNamespaceHooks: "team-[=https://hooks.example.com"}).NotifyRoutes()
+	assert.Error(t, err)
+}
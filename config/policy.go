@@ -0,0 +1,18 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PolicyConfigMapRef returns the namespace and name of the POLICY_CONFIGMAP, empty when it is not set
+func (c *Config) PolicyConfigMapRef() (string, string, error) {
+	if c.PolicyConfigMap == "" {
+		return "", "", nil
+	}
+	namespace, name, ok := strings.Cut(c.PolicyConfigMap, "/")
+	if !ok || namespace == "" || name == "" || strings.Contains(name, "/") {
+		return "", "", fmt.Errorf("%q is not namespace/name", c.PolicyConfigMap)
+	}
+	return namespace, name, nil
+}
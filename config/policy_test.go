@@ -0,0 +1,23 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPolicyConfigMapRef(t *testing.T) {
+	namespace, name, err := (&Config{}).PolicyConfigMapRef()
+	assert.NoError(t, err)
+	assert.Empty(t, namespace+name)
+
+	namespace, name, err = (&Config{PolicyConfigMap: "image-updater/policy"}).PolicyConfigMapRef()
+	assert.NoError(t, err)
+	assert.Equal(t, "image-updater", namespace)
+	assert.Equal(t, "policy", name)
+
+	for _, value := range []string{"policy", "/policy", "image-updater/", "a/b/c"} {
+		_, _, err := (&Config{PolicyConfigMap: value}).PolicyConfigMapRef()
+		assert.ErrorContains(t, err, "is not namespace/name", value)
+	}
+}
@@ -0,0 +1,63 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Prefix of env vars holding registry credentials as user:password, e.g. REGISTRY_AUTH_docker_io
+const RegistryAuthPrefix = "REGISTRY_AUTH_"
+
+// RegistryCredential is a username and password for a registry
+type RegistryCredential struct {
+	Username string
+	Password string
+}
+
+// String masks the password so credentials can be logged
+func (c RegistryCredential) String() string {
+	return fmt.Sprintf("%s:****", c.Username)
+}
+
+// RegistryCredentials returns the REGISTRY_AUTH_ credentials of a registry host
+func (c *Config) RegistryCredentials(registry string) (RegistryCredential, bool) {
+	cred, ok := c.RegistryAuth[registryAuthKey(registry)]
+	return cred, ok
+}
+
+// ParseRegistryAuth reads REGISTRY_AUTH_<registry> entries of environ, keyed by registryAuthKey
+func ParseRegistryAuth(environ []string) map[string]RegistryCredential {
+	auths := make(map[string]RegistryCredential)
+	for _, kv := range environ {
+		name, value, _ := strings.Cut(kv, "=")
+		registry, ok := strings.CutPrefix(name, RegistryAuthPrefix)
+		if !ok || registry == "" {
+			continue
+		}
+		username, password, ok := strings.Cut(value, ":")
+		if !ok || username == "" || password == "" {
+			logrus.Warnf("Ignoring %s, expected user:password", name)
+			continue
+		}
+		auths[registryAuthKey(registry)] = RegistryCredential{Username: username, Password: password}
+	}
+	return auths
+}
+
+// registryAuthKey turns a registry host or env var suffix into a comparable key.
+// Env var names cannot hold dots, colons or dashes, so registry.example.com:5000 is registry_example_com_5000.
+func registryAuthKey(registry string) string {
+	key := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, strings.ToLower(registry))
+	// Docker Hub is referred to as both docker.io and index.docker.io
+	if key == "docker_io" || key == "registry_1_docker_io" {
+		return "index_docker_io"
+	}
+	return key
+}
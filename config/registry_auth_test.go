@@ -0,0 +1,44 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRegistryAuth(t *testing.T) {
+	c := &Config{RegistryAuth: ParseRegistryAuth([]string{
+		"REGISTRY_AUTH_docker_io=hub:hub-pass",
+		"REGISTRY_AUTH_ghcr_io=gh:token:with:colons",
+		"REGISTRY_AUTH_registry_example_com_5000=example:example-pass",
+		"REGISTRY_AUTH_quay_io=missing-password",
+		"REGISTRY_AUTH_=empty:registry",
+		"PATH=/usr/bin",
+	})}
+
+	assert.Len(t, c.RegistryAuth, 3)
+
+	// Docker Hub aliases share the same credentials
+	for _, registry := range []string{"index.docker.io", "docker.io", "registry-1.docker.io"} {
+		cred, ok := c.RegistryCredentials(registry)
+		assert.True(t, ok, registry)
+		assert.Equal(t, RegistryCredential{Username: "hub", Password: "hub-pass"}, cred)
+	}
+
+	cred, ok := c.RegistryCredentials("ghcr.io")
+	assert.True(t, ok)
+	assert.Equal(t, RegistryCredential{Username: "gh", Password: "token:with:colons"}, cred)
+
+	cred, ok = c.RegistryCredentials("registry.example.com:5000")
+	assert.True(t, ok)
+	assert.Equal(t, "example", cred.Username)
+
+	_, ok = c.RegistryCredentials("quay.io")
+	assert.False(t, ok)
+	_, ok = c.RegistryCredentials("registry.example.com")
+	assert.False(t, ok)
+}
+
+func TestRegistryCredentialStringMasksPassword(t *testing.T) {
+	assert.Equal(t, "user:****", RegistryCredential{Username: "user", Password: "secret"}.String())
+}
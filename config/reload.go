@@ -0,0 +1,150 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/caarlos0/env/v10"
+	"github.com/sirupsen/logrus"
+)
+
+// Tunables are the settings Reload applies to the running process, the other ones are only read at startup.
+// A snapshot is never modified, Reload swaps in a new one
+type Tunables struct {
+	LogLevel string `env:"LOG_LEVEL" envDefault:""`
+
+	// Log one summary line per check cycle instead of a line per resource, warnings and errors are still logged
+	LogSummaryOnly bool `env:"LOG_SUMMARY_ONLY" envDefault:"false"`
+
+	ImageUpdateInterval time.Duration `env:"IMAGE_UPDATE_INTERVAL" envDefault:"5m"` // Default check interval is 5 minutes
+	CheckCycleTimeout   time.Duration `env:"CHECK_CYCLE_TIMEOUT" envDefault:"0"`    // Cancel a check running longer, 0 uses IMAGE_UPDATE_INTERVAL
+	MaxUpdatesPerCycle  int           `env:"MAX_UPDATES_PER_CYCLE" envDefault:"0"`  // Cap on resources rolled out per check, 0 is unlimited
+	UpdatePacingDelay   time.Duration `env:"UPDATE_PACING_DELAY" envDefault:"0"`    // Wait between the rollouts of a check, 0 rolls out back to back
+
+	// Resources of a kind checked against their registries at once, 1 checks them one after another
+	RegistryQueryConcurrency int `env:"REGISTRY_QUERY_CONCURRENCY" envDefault:"1"`
+	// Writes of resources to the cluster running at once
+	ApplyConcurrency int `env:"APPLY_CONCURRENCY" envDefault:"1"`
+}
+
+var tunables atomic.Pointer[Tunables]
+
+// Tuning returns the current snapshot of the reloadable settings
+func Tuning() *Tunables {
+	return tunables.Load()
+}
+
+// SetTuning replaces the reloadable settings, e.g. for tests
+func SetTuning(t *Tunables) {
+	tunables.Store(t)
+}
+
+// parse reads the configuration from the environment, overridden by the entries of CONFIG_FILE
+func parse(cfg *Config, tuning *Tunables) error {
+	environment := env.ToMap(os.Environ())
+	if path := environment["CONFIG_FILE"]; path != "" {
+		entries, err := readConfigFile(path)
+		if err != nil {
+			return err
+		}
+		for key, value := range entries {
+			environment[key] = value
+		}
+	}
+	opts := env.Options{Environment: environment}
+	if err := env.ParseWithOptions(cfg, opts); err != nil {
+		return err
+	}
+	if err := env.ParseWithOptions(tuning, opts); err != nil {
+		return err
+	}
+	environ := make([]string, 0, len(environment))
+	for key, value := range environment {
+		environ = append(environ, key+"="+value)
+	}
+	cfg.RegistryAuth = ParseRegistryAuth(environ)
+	return nil
+}
+
+// readConfigFile reads the KEY=VALUE lines of a config file, skipping empty lines and # comments
+func readConfigFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open config file: %v", err)
+	}
+	defer f.Close()
+
+	entries := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if key = strings.TrimSpace(key); !ok || key == "" {
+			return nil, fmt.Errorf("line %d of config file %s is not KEY=VALUE", n, path)
+		}
+		entries[key] = strings.Trim(strings.TrimSpace(value), `"'`)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read config file: %v", err)
+	}
+	return entries, nil
+}
+
+// Reload reads the environment and CONFIG_FILE again and swaps in the new reloadable settings, returning the
+// settings that changed. Changes to the other settings are logged and ignored until the next restart.
+func Reload() ([]string, error) {
+	next, tuning := &Config{}, &Tunables{}
+	if err := parse(next, tuning); err != nil {
+		return nil, fmt.Errorf("failed to parse configuration: %v", err)
+	}
+	if tuning.ImageUpdateInterval <= 0 {
+		return nil, fmt.Errorf("IMAGE_UPDATE_INTERVAL must be positive, got %s", tuning.ImageUpdateInterval)
+	}
+	for _, name := range changedFields(GlobalConfig, next) {
+		logrus.Warnf("Ignoring change of %s, it only applies after a restart", name)
+	}
+	changed := changedFields(Tuning(), tuning)
+	if len(changed) > 0 {
+		SetTuning(tuning)
+	}
+	return changed, nil
+}
+
+// changedFields returns the env names of the fields of the structs a and b that differ
+func changedFields[T any](a, b *T) []string {
+	var changed []string
+	current, updated := reflect.ValueOf(a).Elem(), reflect.ValueOf(b).Elem()
+	for i := range current.NumField() {
+		if reflect.DeepEqual(current.Field(i).Interface(), updated.Field(i).Interface()) {
+			continue
+		}
+		name := current.Type().Field(i).Tag.Get("env")
+		if name == "" {
+			name = current.Type().Field(i).Name
+		}
+		changed = append(changed, name)
+	}
+	return changed
+}
+
+// ApplyLogLevel sets the logrus level from LOG_LEVEL, or to defaultLevel when it is unset. An invalid level is ignored.
+func (t *Tunables) ApplyLogLevel(defaultLevel logrus.Level) {
+	if t.LogLevel == "" {
+		logrus.SetLevel(defaultLevel)
+		return
+	}
+	level, err := logrus.ParseLevel(t.LogLevel)
+	if err != nil {
+		logrus.Warnf("Invalid log level %s, keeping level %s", t.LogLevel, logrus.GetLevel())
+		return
+	}
+	logrus.SetLevel(level)
+}
@@ -0,0 +1,69 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReload(t *testing.T) {
+	old, oldTuning := *GlobalConfig, Tuning()
+	t.Cleanup(func() {
+		*GlobalConfig = old
+		SetTuning(oldTuning)
+	})
+
+	file := filepath.Join(t.TempDir(), "updater.env")
+	t.Setenv("CONFIG_FILE", file)
+	t.Setenv("IMAGE_UPDATE_INTERVAL", "1m")
+	writeFile := func(content string) {
+		require.NoError(t, os.WriteFile(file, []byte(content), 0o600))
+	}
+
+	// The file overrides the environment
+	writeFile("# tuning\nIMAGE_UPDATE_INTERVAL=30s\nLOG_LEVEL=\"warn\"\n\nAPI_PORT=18080\n")
+	changed, err := Reload()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"IMAGE_UPDATE_INTERVAL", "LOG_LEVEL"}, changed)
+	assert.Equal(t, 30*time.Second, Tuning().ImageUpdateInterval)
+	assert.Equal(t, "warn", Tuning().LogLevel)
+	// Ports only apply after a restart
+	assert.Equal(t, old.APIPort, GlobalConfig.APIPort)
+
+	// Nothing changed since the last reload
+	snapshot := Tuning()
+	changed, err = Reload()
+	require.NoError(t, err)
+	assert.Empty(t, changed)
+	assert.Same(t, snapshot, Tuning())
+
+	writeFile("IMAGE_UPDATE_INTERVAL=0s\n")
+	_, err = Reload()
+	assert.ErrorContains(t, err, "IMAGE_UPDATE_INTERVAL")
+	assert.Equal(t, 30*time.Second, Tuning().ImageUpdateInterval)
+
+	writeFile("IMAGE_UPDATE_INTERVAL\n")
+	_, err = Reload()
+	assert.ErrorContains(t, err, "line 1")
+	assert.Equal(t, 30*time.Second, Tuning().ImageUpdateInterval)
+}
+
+func TestApplyLogLevel(t *testing.T) {
+	oldLevel := logrus.GetLevel()
+	t.Cleanup(func() { logrus.SetLevel(oldLevel) })
+
+	(&Tunables{LogLevel: "warn"}).ApplyLogLevel(logrus.DebugLevel)
+	assert.Equal(t, logrus.WarnLevel, logrus.GetLevel())
+
+	// An invalid level keeps the current one
+	(&Tunables{LogLevel: "loud"}).ApplyLogLevel(logrus.DebugLevel)
+	assert.Equal(t, logrus.WarnLevel, logrus.GetLevel())
+
+	(&Tunables{}).ApplyLogLevel(logrus.DebugLevel)
+	assert.Equal(t, logrus.DebugLevel, logrus.GetLevel())
+}
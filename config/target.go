@@ -0,0 +1,59 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// TargetResource is the single resource the auto-updater checks when TARGET_RESOURCE is set
+type TargetResource struct {
+	Kind      string
+	Namespace string
+	Name      string
+}
+
+// ParseTargetResource parses a target written as kind/namespace/name, e.g. deployment/default/my-app
+func ParseTargetResource(value string) (*TargetResource, error) {
+	parts := strings.Split(value, "/")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return nil, fmt.Errorf("%q is not kind/namespace/name", value)
+	}
+	kind := strings.ToLower(parts[0])
+	switch kind {
+	case "deployment", "statefulset", "daemonset", "cloneset", "advancedstatefulset":
+	default:
+		return nil, fmt.Errorf("unsupported kind %s in %q, kind must be one of: deployment, statefulset, daemonset, cloneset, advancedstatefulset", parts[0], value)
+	}
+	return &TargetResource{Kind: kind, Namespace: parts[1], Name: parts[2]}, nil
+}
+
+// Target returns the resource set by TARGET_RESOURCE, nil when every resource is checked
+func (c *Config) Target() (*TargetResource, error) {
+	if c.TargetResource == "" {
+		return nil, nil
+	}
+	target, err := ParseTargetResource(c.TargetResource)
+	if err == nil && (target.Kind == "cloneset" || target.Kind == "advancedstatefulset") && !c.EnableKruise {
+		return nil, fmt.Errorf("kind %s in %q requires ENABLE_KRUISE", target.Kind, c.TargetResource)
+	}
+	return target, err
+}
+
+// Matches reports whether a resource is the target, a nil target matches every resource
+func (t *TargetResource) Matches(kind, namespace, name string) bool {
+	return t == nil || (t.Kind == kind && t.Namespace == namespace && t.Name == name)
+}
+
+// String formats the target as it is written in TARGET_RESOURCE
+func (t *TargetResource) String() string {
+	return t.Kind + "/" + t.Namespace + "/" + t.Name
+}
+
+// Kinds returns the kinds of resources the auto-updater checks, with the OpenKruise kinds when ENABLE_KRUISE is set
+func (c *Config) Kinds() []string {
+	kinds := []string{"deployment", "statefulset", "daemonset"}
+	if c.EnableKruise {
+		kinds = append(kinds, "cloneset", "advancedstatefulset")
+	}
+	return kinds
+}
@@ -0,0 +1,57 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTargetResource(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    *TargetResource
+		wantErr string
+	}{
+		{"deployment/default/my-app", &TargetResource{Kind: "deployment", Namespace: "default", Name: "my-app"}, ""},
+		{"StatefulSet/db/postgres", &TargetResource{Kind: "statefulset", Namespace: "db", Name: "postgres"}, ""},
+		{"daemonset/kube-system/agent", &TargetResource{Kind: "daemonset", Namespace: "kube-system", Name: "agent"}, ""},
+		{"CloneSet/default/web", &TargetResource{Kind: "cloneset", Namespace: "default", Name: "web"}, ""},
+		{"default/my-app", nil, "not kind/namespace/name"},
+		{"deployment/default/my-app/extra", nil, "not kind/namespace/name"},
+		{"deployment//my-app", nil, "not kind/namespace/name"},
+		{"job/default/backup", nil, "unsupported kind job"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			target, err := ParseTargetResource(tt.value)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, target)
+		})
+	}
+}
+
+func TestTarget(t *testing.T) {
+	target, err := (&Config{}).Target()
+	require.NoError(t, err)
+	assert.Nil(t, target)
+	assert.True(t, target.Matches("deployment", "default", "my-app"))
+
+	target, err = (&Config{TargetResource: "deployment/default/my-app"}).Target()
+	require.NoError(t, err)
+	assert.Equal(t, "deployment/default/my-app", target.String())
+	assert.True(t, target.Matches("deployment", "default", "my-app"))
+	assert.False(t, target.Matches("statefulset", "default", "my-app"))
+	assert.False(t, target.Matches("deployment", "prod", "my-app"))
+	assert.False(t, target.Matches("deployment", "default", "other"))
+
+	_, err = (&Config{TargetResource: "cloneset/default/web"}).Target()
+	assert.ErrorContains(t, err, "requires ENABLE_KRUISE")
+	target, err = (&Config{TargetResource: "cloneset/default/web", EnableKruise: true}).Target()
+	require.NoError(t, err)
+	assert.Equal(t, "cloneset", target.Kind)
+}
@@ -0,0 +1,26 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Modes of TEMPLATE_IMAGE_ANNOTATION_MODE
+const (
+	// New images are written to the containers and the template annotation
+	TemplateImageAlso = "also"
+	// New images are only written to the template annotation, the containers are left to the delivery tool
+	TemplateImageInstead = "instead"
+)
+
+// TemplateImageMode returns the mode of TEMPLATE_IMAGE_ANNOTATION_MODE, accepted in any case, also when empty
+func (c *Config) TemplateImageMode() (string, error) {
+	mode := strings.ToLower(strings.TrimSpace(c.TemplateImageAnnotationMode))
+	switch mode {
+	case "":
+		return TemplateImageAlso, nil
+	case TemplateImageAlso, TemplateImageInstead:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown template image annotation mode %q, must be %s or %s", c.TemplateImageAnnotationMode, TemplateImageAlso, TemplateImageInstead)
+}
@@ -0,0 +1,17 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTemplateImageMode(t *testing.T) {
+	for value, want := range map[string]string{"": TemplateImageAlso, "also": TemplateImageAlso, " Instead ": TemplateImageInstead} {
+		mode, err := (&Config{TemplateImageAnnotationMode: value}).TemplateImageMode()
+		assert.NoError(t, err)
+		assert.Equal(t, want, mode, value)
+	}
+	_, err := (&Config{TemplateImageAnnotationMode: "replace"}).TemplateImageMode()
+	assert.ErrorContains(t, err, "unknown template image annotation mode")
+}
@@ -0,0 +1,26 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Behaviors of UNPARSEABLE_IMAGES
+const (
+	// Containers whose image cannot be parsed are skipped with the unparseable-image status
+	UnparseableImageSkip = "skip"
+	// Containers whose image cannot be parsed fail the check of their resource, with the unparseable-image status
+	UnparseableImageError = "error"
+)
+
+// UnparseableImageMode returns the behavior of UNPARSEABLE_IMAGES, accepted in any case, skip when empty
+func (c *Config) UnparseableImageMode() (string, error) {
+	mode := strings.ToLower(strings.TrimSpace(c.UnparseableImages))
+	switch mode {
+	case "":
+		return UnparseableImageSkip, nil
+	case UnparseableImageSkip, UnparseableImageError:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown unparseable image behavior %q, must be %s or %s", c.UnparseableImages, UnparseableImageSkip, UnparseableImageError)
+}
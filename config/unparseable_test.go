@@ -0,0 +1,17 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnparseableImageMode(t *testing.T) {
+	for value, want := range map[string]string{"": UnparseableImageSkip, "skip": UnparseableImageSkip, " Error ": UnparseableImageError} {
+		mode, err := (&Config{UnparseableImages: value}).UnparseableImageMode()
+		assert.NoError(t, err)
+		assert.Equal(t, want, mode, value)
+	}
+	_, err := (&Config{UnparseableImages: "ignore"}).UnparseableImageMode()
+	assert.ErrorContains(t, err, "unknown unparseable image behavior")
+}
@@ -2,16 +2,37 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
 
 	"github.com/gin-gonic/gin"
 	"github.com/monlor/k8s-image-updater/config"
 	"github.com/monlor/k8s-image-updater/pkg/api"
+	"github.com/monlor/k8s-image-updater/pkg/audit"
+	"github.com/monlor/k8s-image-updater/pkg/grpcapi"
+	"github.com/monlor/k8s-image-updater/pkg/k8s"
+	"github.com/monlor/k8s-image-updater/pkg/registry"
 	"github.com/monlor/k8s-image-updater/pkg/updater"
+	"github.com/monlor/k8s-image-updater/pkg/verify"
+	"github.com/monlor/k8s-image-updater/pkg/version"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 )
 
 func main() {
+	showVersion := flag.Bool("version", false, "Print version information and exit")
+	flag.Parse()
+	if *showVersion {
+		fmt.Println(version.Get())
+		os.Exit(0)
+	}
+
 	// Set log format
 	if gin.Mode() == gin.ReleaseMode {
 		logrus.SetFormatter(&logrus.JSONFormatter{})
@@ -21,37 +42,103 @@ func main() {
 		})
 	}
 
-	// Set log level based on GIN_MODE
-	if config.GlobalConfig.LogLevel != "" {
-		level, err := logrus.ParseLevel(config.GlobalConfig.LogLevel)
-		if err != nil {
-			logrus.Warnf("Invalid log level %s, using default level", config.GlobalConfig.LogLevel)
-		} else {
-			logrus.SetLevel(level)
-		}
-	} else {
-		if gin.Mode() == gin.ReleaseMode {
-			logrus.SetLevel(logrus.InfoLevel)
-		} else {
-			logrus.SetLevel(logrus.DebugLevel)
-		}
+	// Set log level, defaulting based on GIN_MODE
+	defaultLevel := logrus.DebugLevel
+	if gin.Mode() == gin.ReleaseMode {
+		defaultLevel = logrus.InfoLevel
+	}
+	config.Tuning().ApplyLogLevel(defaultLevel)
+
+	logrus.Infof("Starting %s", version.Get())
+
+	for host, cred := range config.GlobalConfig.RegistryAuth {
+		logrus.Infof("Loaded credentials %s for registry %s from env", cred, host)
+	}
+
+	if err := registry.ConfigureTransport(config.GlobalConfig); err != nil {
+		logrus.Fatalf("Failed to configure registry transport: %v", err)
+	}
+
+	if err := audit.Init(config.GlobalConfig); err != nil {
+		logrus.Fatalf("Failed to open audit log: %v", err)
 	}
 
 	// Create and start the auto-updater if enabled
 	ctx := context.Background()
+	var imageUpdater *updater.Updater
+	var updaters []*updater.Updater
 	if config.GlobalConfig.UpdaterEnabled {
 		logrus.Info("Auto-updater is enabled")
-		imageUpdater, err := updater.NewUpdater()
+		var err error
+		updaters, err = updater.NewUpdaters()
 		if err != nil {
 			logrus.Fatalf("Failed to create image updater: %v", err)
 		}
-		go imageUpdater.Start(ctx)
+		for _, u := range updaters {
+			go u.Start(ctx)
+		}
+		imageUpdater = updaters[0]
 	} else {
 		logrus.Info("Auto-updater is disabled, only API service will be available")
 	}
+	go reloadOnSIGHUP(updaters, defaultLevel)
+
+	// Images set through the API and gRPC are verified like the images the updater rolls out
+	verifier, err := verify.New(config.GlobalConfig)
+	if err != nil {
+		logrus.Fatalf("Failed to create signature verifier: %v", err)
+	}
+	apiVerifier := updater.NewUpdaterWithClient(nil)
+	apiVerifier.SetVerifier(verifier)
+
+	// Start gRPC server if enabled
+	if config.GlobalConfig.GRPCPort > 0 {
+		// With KUBE_CONTEXTS set the gRPC server serves the first cluster
+		k8sClient, err := k8s.GetClusterClientWithRetry("", config.GlobalConfig.K8sClientRetryTimeout)
+		if err != nil {
+			logrus.Fatalf("Failed to create kubernetes client: %v", err)
+		}
+		if imageUpdater == nil {
+			// The gRPC Check RPC needs the update logic even when the auto-updater is disabled
+			imageUpdater = updater.NewUpdaterWithClient(k8sClient)
+			imageUpdater.SetVerifier(verifier)
+		}
+		grpcAddr := fmt.Sprintf(":%d", config.GlobalConfig.GRPCPort)
+		lis, err := net.Listen("tcp", grpcAddr)
+		if err != nil {
+			logrus.Fatalf("Failed to listen on %s: %v", grpcAddr, err)
+		}
+		grpcServer := grpcapi.NewGRPCServer(grpcapi.NewServer(k8sClient, imageUpdater))
+		logrus.Infof("Starting gRPC server on %s", grpcAddr)
+		go func() {
+			if err := grpcServer.Serve(lis); err != nil {
+				logrus.Fatalf("Failed to start gRPC server: %v", err)
+			}
+		}()
+	}
+
+	// The resolve endpoint only uses the registry side of the updater
+	if imageUpdater != nil {
+		api.SetResolver(imageUpdater)
+	} else {
+		api.SetResolver(updater.NewUpdaterWithClient(nil))
+	}
+	// The update and approve endpoints verify signatures with the updater, the client of each request reads its secrets
+	api.SetVerifier(apiVerifier)
+
+	if _, err := config.GlobalConfig.AuthMode(); err != nil {
+		logrus.Fatalf("Invalid API_AUTH_MODE: %v", err)
+	}
 
 	// Create Gin router
 	r := gin.Default()
+	r.Use(api.RequestIDMiddleware())
+
+	// Prometheus metrics, served without authentication
+	r.GET("/metrics", gin.WrapH(promhttp.Handler()))
+
+	// Build information, served without authentication
+	r.GET("/version", api.Version)
 
 	// Create API route group with authentication
 	apiV1 := r.Group("/api/v1")
@@ -59,6 +146,13 @@ func main() {
 	{
 		// Register routes under the authenticated group
 		apiV1.GET("/update", api.UpdateImage)
+		apiV1.POST("/restart", api.RestartResource)
+		apiV1.POST("/approve", api.ApproveImage)
+		apiV1.GET("/resources", api.ListResources)
+		apiV1.GET("/inventory", api.Inventory)
+		apiV1.GET("/status", api.GetStatus)
+		apiV1.GET("/resolve", api.ResolveImage)
+		apiV1.POST("/unfreeze", api.Unfreeze)
 	}
 
 	// Start server
@@ -68,3 +162,29 @@ func main() {
 		logrus.Fatalf("Failed to start server: %v", err)
 	}
 }
+
+// reloadOnSIGHUP reloads the configuration on every SIGHUP, applying a new log level and check interval
+func reloadOnSIGHUP(updaters []*updater.Updater, defaultLevel logrus.Level) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		changed, err := config.Reload()
+		if err != nil {
+			logrus.Errorf("Failed to reload configuration: %v", err)
+			continue
+		}
+		if len(changed) == 0 {
+			logrus.Info("Reloaded configuration, nothing changed")
+			continue
+		}
+		logrus.Infof("Reloaded configuration, changed %s", strings.Join(changed, ", "))
+		if slices.Contains(changed, "LOG_LEVEL") {
+			config.Tuning().ApplyLogLevel(defaultLevel)
+		}
+		if slices.Contains(changed, "IMAGE_UPDATE_INTERVAL") {
+			for _, u := range updaters {
+				u.ResetInterval()
+			}
+		}
+	}
+}
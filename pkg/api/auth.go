@@ -0,0 +1,138 @@
+package api
+
+import (
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/monlor/k8s-image-updater/pkg/audit"
+)
+
+// Key of the kubernetes user of the request in the gin context, set in the k8s-token auth mode
+const userKey = "user"
+
+// Key of the kinds the user of the request may list in the gin context, set in the k8s-token auth mode when the
+// request reads several kinds
+const kindsKey = "kinds"
+
+// Endpoints only reading resources, authorized with the list verb, the others change resources and need update
+var readOnlyEndpoints = map[string]bool{
+	"resources": true,
+	"status":    true,
+	"inventory": true,
+}
+
+// Endpoints reading no cluster resource, open to any authenticated user
+var unscopedEndpoints = map[string]bool{
+	"resolve": true,
+}
+
+// authorizeToken authenticates the bearer token of the request with a TokenReview and authorizes its user
+// on the kind and namespace of the request with a SubjectAccessReview, in the cluster of the request
+func authorizeToken(c *gin.Context) {
+	token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if token = strings.TrimSpace(token); !ok || token == "" {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Missing bearer token"})
+		return
+	}
+
+	kind := normalizeKind(c.DefaultQuery("kind", "deployment"))
+	if !validateKind(c, kind) {
+		c.Abort()
+		return
+	}
+	// The token is only reviewed in one cluster, so the status of every cluster is not returned for it
+	if path.Base(c.FullPath()) == "status" && c.Query("cluster") == "" && len(config.GlobalConfig.Contexts()) > 1 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "cluster is required when several clusters are configured"})
+		return
+	}
+	client, ok := clusterClient(c)
+	if !ok {
+		c.Abort()
+		return
+	}
+
+	user, authenticated, err := client.ReviewToken(c.Request.Context(), token)
+	if err != nil {
+		logger(c).Errorf("Token review failed: %v", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to review token"})
+		return
+	}
+	if !authenticated {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+		return
+	}
+
+	endpoint := path.Base(c.FullPath())
+	if unscopedEndpoints[endpoint] {
+		c.Set(userKey, user.Username)
+		c.Next()
+		return
+	}
+	verb := "update"
+	if readOnlyEndpoints[endpoint] {
+		verb = "list"
+	}
+	namespace := c.Query("namespace")
+	// The inventory, and the status without kind, return every kind. The kinds the user may not list are left out.
+	kinds := []string{kind}
+	multiKind := endpoint == "inventory" || (endpoint == "status" && c.Query("kind") == "")
+	if multiKind {
+		kinds = config.GlobalConfig.Kinds()
+	}
+	var allowedKinds []string
+	var message string
+	for _, kind := range kinds {
+		allowed, reason, err := client.Authorize(c.Request.Context(), user, namespace, verb, kind)
+		if err != nil {
+			logger(c).Errorf("Access review failed: %v", err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to review access"})
+			return
+		}
+		if allowed {
+			allowedKinds = append(allowedKinds, kind)
+		} else if message == "" {
+			message = deniedMessage(user.Username, verb, kind, namespace, reason)
+		}
+	}
+	if len(allowedKinds) == 0 {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": message})
+		return
+	}
+
+	if multiKind {
+		c.Set(kindsKey, allowedKinds)
+	}
+	c.Set(userKey, user.Username)
+	c.Next()
+}
+
+// deniedMessage tells why a user may not perform a verb on a kind
+func deniedMessage(user, verb, kind, namespace, reason string) string {
+	message := "User " + user + " cannot " + verb + " " + kind + "s"
+	if namespace != "" {
+		message += " in namespace " + namespace
+	}
+	if reason != "" {
+		message += ": " + reason
+	}
+	return message
+}
+
+// kindAllowed reports whether the user of the request may read the resources of a kind. Outside the k8s-token
+// auth mode, and for requests of a single kind authorized as a whole, every kind is.
+func kindAllowed(c *gin.Context, kind string) bool {
+	kinds, ok := c.Get(kindsKey)
+	return !ok || slices.Contains(kinds.([]string), kind)
+}
+
+// actor identifies the caller in the audit log, by its kubernetes user or a hash of its API key
+func actor(c *gin.Context) string {
+	if user := c.GetString(userKey); user != "" {
+		return "api:" + user
+	}
+	return audit.APIKeyActor("api", c.GetHeader("X-API-Key"))
+}
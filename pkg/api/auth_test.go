@@ -0,0 +1,223 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/monlor/k8s-image-updater/pkg/audit"
+	"github.com/monlor/k8s-image-updater/pkg/status"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// Serve the handlers behind AuthMiddleware in the k8s-token auth mode. The fake API server accepts the token
+// "deployer-token" of a service account allowed to list and update deployments in the default namespace.
+func newTokenAuthTestRouter(t *testing.T, objects ...runtime.Object) *gin.Engine {
+	oldMode := config.GlobalConfig.APIAuthMode
+	config.GlobalConfig.APIAuthMode = "K8S_TOKEN"
+	t.Cleanup(func() { config.GlobalConfig.APIAuthMode = oldMode })
+
+	_, clientset := newTestRouter(t, objects...)
+	clientset.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authenticationv1.TokenReview)
+		if review.Spec.Token == "deployer-token" {
+			review.Status.Authenticated = true
+			review.Status.User = authenticationv1.UserInfo{
+				Username: "system:serviceaccount:default:deployer",
+				Groups:   []string{"system:serviceaccounts"},
+			}
+		}
+		return true, review, nil
+	})
+	clientset.PrependReactor("create", "subjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+		attributes := review.Spec.ResourceAttributes
+		review.Status.Allowed = review.Spec.User == "system:serviceaccount:default:deployer" &&
+			attributes.Namespace == "default" && attributes.Group == "apps" && attributes.Resource == "deployments" &&
+			(attributes.Verb == "list" || attributes.Verb == "update")
+		if !review.Status.Allowed {
+			review.Status.Reason = "no RBAC policy matched"
+		}
+		return true, review, nil
+	})
+
+	r := gin.New()
+	r.Use(RequestIDMiddleware())
+	apiV1 := r.Group("/api/v1")
+	apiV1.Use(AuthMiddleware())
+	apiV1.GET("/update", UpdateImage)
+	apiV1.GET("/resources", ListResources)
+	apiV1.GET("/resolve", ResolveImage)
+	apiV1.GET("/status", GetStatus)
+	apiV1.GET("/inventory", Inventory)
+	return r
+}
+
+func TestAuthMiddlewareK8sToken(t *testing.T) {
+	r := newTokenAuthTestRouter(t, &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app", Image: "ghcr.io/org/app:1.0.0"}},
+		}}},
+	})
+
+	oldKey := config.GlobalConfig.APIKey
+	config.GlobalConfig.APIKey = "test-key"
+	t.Cleanup(func() { config.GlobalConfig.APIKey = oldKey })
+	SetResolver(&fakeResolver{})
+	t.Cleanup(func() { SetResolver(nil) })
+
+	tests := []struct {
+		name     string
+		url      string
+		header   string
+		wantCode int
+	}{
+		// The API key is sent along with every request, it is ignored in the k8s-token auth mode
+		{name: "missing token", url: "/api/v1/resources?namespace=default", wantCode: http.StatusUnauthorized},
+		{name: "invalid token", url: "/api/v1/resources?namespace=default", header: "Bearer other-token", wantCode: http.StatusUnauthorized},
+		{name: "list allowed", url: "/api/v1/resources?namespace=default", header: "Bearer deployer-token", wantCode: http.StatusOK},
+		{name: "update allowed", url: "/api/v1/update?namespace=default&service=app&image=ghcr.io/org/app:1.1.0", header: "Bearer deployer-token", wantCode: http.StatusOK},
+		{name: "other namespace denied", url: "/api/v1/resources?namespace=kube-system", header: "Bearer deployer-token", wantCode: http.StatusForbidden},
+		{name: "all namespaces denied", url: "/api/v1/resources", header: "Bearer deployer-token", wantCode: http.StatusForbidden},
+		{name: "other kind denied", url: "/api/v1/resources?namespace=default&kind=sts", header: "Bearer deployer-token", wantCode: http.StatusForbidden},
+		{name: "unknown kind", url: "/api/v1/resources?namespace=default&kind=pod", header: "Bearer deployer-token", wantCode: http.StatusBadRequest},
+		// Resolving an image reads no resource, any authenticated user may
+		{name: "resolve missing token", url: "/api/v1/resolve?image=nginx:1.25.0", wantCode: http.StatusUnauthorized},
+		{name: "resolve authenticated", url: "/api/v1/resolve?image=nginx:1.25.0", header: "Bearer deployer-token", wantCode: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, tt.url, nil)
+			req.Header.Set("X-API-Key", "test-key")
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			r.ServeHTTP(w, req)
+			assert.Equal(t, tt.wantCode, w.Code, w.Body.String())
+		})
+	}
+}
+
+func TestAuthMiddlewareK8sTokenAuditActor(t *testing.T) {
+	var buf bytes.Buffer
+	previous := audit.SetLogger(audit.NewWriterLogger(&buf))
+	t.Cleanup(func() { audit.SetLogger(previous) })
+
+	r := newTokenAuthTestRouter(t, &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app", Image: "ghcr.io/org/app:1.0.0"}},
+		}}},
+	})
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/update?namespace=default&service=app&image=ghcr.io/org/app:1.1.0", nil)
+	req.Header.Set("Authorization", "Bearer deployer-token")
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var entry audit.Entry
+	require.NoError(t, json.Unmarshal([]byte(strings.TrimSpace(buf.String())), &entry))
+	assert.Equal(t, "api:system:serviceaccount:default:deployer", entry.Actor)
+}
+
+func TestAuthMiddlewareK8sTokenStatusKinds(t *testing.T) {
+	previous := status.SetIndex(status.NewIndex(0))
+	t.Cleanup(func() { status.SetIndex(previous) })
+	status.Set(status.Result{Kind: "deployment", Namespace: "default", Name: "web"})
+	status.Set(status.Result{Kind: "statefulset", Namespace: "default", Name: "db"})
+	status.Set(status.Result{Kind: "daemonset", Namespace: "default", Name: "agent"})
+	r := newTokenAuthTestRouter(t)
+
+	get := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		req.Header.Set("Authorization", "Bearer deployer-token")
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	// Without kind only the kinds the user may list are returned
+	w := get("/api/v1/status?namespace=default")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp statusResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Len(t, resp.Items, 1)
+	assert.Equal(t, "web", resp.Items[0].Name)
+
+	assert.Equal(t, http.StatusForbidden, get("/api/v1/status?namespace=default&kind=statefulset").Code)
+	assert.Equal(t, http.StatusForbidden, get("/api/v1/status?namespace=kube-system").Code)
+}
+
+func TestAuthMiddlewareK8sTokenStatusClusters(t *testing.T) {
+	previous := status.SetIndex(status.NewIndex(0))
+	t.Cleanup(func() { status.SetIndex(previous) })
+	status.Set(status.Result{Cluster: "prod", Kind: "deployment", Namespace: "default", Name: "web"})
+	status.Set(status.Result{Cluster: "staging", Kind: "deployment", Namespace: "default", Name: "web"})
+	oldContexts := config.GlobalConfig.KubeContexts
+	config.GlobalConfig.KubeContexts = "prod,staging"
+	t.Cleanup(func() { config.GlobalConfig.KubeContexts = oldContexts })
+	r := newTokenAuthTestRouter(t)
+
+	get := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		req.Header.Set("Authorization", "Bearer deployer-token")
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	// The token is only authorized in one cluster, the status of all of them is refused
+	assert.Equal(t, http.StatusBadRequest, get("/api/v1/status?namespace=default").Code)
+
+	w := get("/api/v1/status?namespace=default&cluster=staging")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp statusResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Len(t, resp.Items, 1)
+	assert.Equal(t, "staging", resp.Items[0].Cluster)
+}
+
+func TestAuthMiddlewareK8sTokenInventory(t *testing.T) {
+	enabled := map[string]string{config.LabelEnabled: "true"}
+	template := corev1.PodTemplateSpec{Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "nginx:1.26"}}}}
+	r := newTokenAuthTestRouter(t,
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", Labels: enabled}, Spec: appsv1.DeploymentSpec{Template: template}},
+		&appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default", Labels: enabled}, Spec: appsv1.StatefulSetSpec{Template: template}},
+	)
+
+	get := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		req.Header.Set("Authorization", "Bearer deployer-token")
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	// Listing deployments is enough for the export, which leaves out the statefulsets
+	w := get("/api/v1/inventory?namespace=default")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp struct {
+		Items []inventoryResource `json:"items"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Len(t, resp.Items, 1)
+	assert.Equal(t, "web", resp.Items[0].Name)
+
+	assert.Equal(t, http.StatusForbidden, get("/api/v1/inventory?namespace=kube-system").Code)
+}
@@ -0,0 +1,35 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/monlor/k8s-image-updater/pkg/updater"
+)
+
+// Unfreeze lets the auto-updater roll out updates again once FREEZE_ON_CRASHLOOP froze them
+func Unfreeze(c *gin.Context) {
+	state, err := updater.Unfreeze()
+	if err != nil {
+		logger(c).Errorf("Failed to unfreeze rollouts: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"ok":      false,
+			"message": err.Error(),
+		})
+		return
+	}
+	if state == nil {
+		c.JSON(http.StatusOK, gin.H{
+			"ok":      true,
+			"message": "Rollouts are not frozen",
+		})
+		return
+	}
+	logger(c).Infof("Rollouts unfrozen by %s, frozen since %s: %s", actor(c), state.Since.UTC().Format(time.RFC3339), state.Reason)
+	c.JSON(http.StatusOK, gin.H{
+		"ok":      true,
+		"message": "Rollouts unfrozen",
+		"freeze":  state,
+	})
+}
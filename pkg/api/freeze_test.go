@@ -0,0 +1,34 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnfreeze(t *testing.T) {
+	r, _ := newTestRouter(t)
+
+	// Rollouts are only frozen by the auto-updater, unfreezing is a no-op otherwise
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/unfreeze", nil))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var body struct {
+		OK      bool            `json:"ok"`
+		Message string          `json:"message"`
+		Freeze  json.RawMessage `json:"freeze"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.True(t, body.OK)
+	assert.Equal(t, "Rollouts are not frozen", body.Message)
+	assert.Nil(t, body.Freeze)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/status", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"frozen":null`)
+}
@@ -1,20 +1,46 @@
 package api
 
 import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
 	"net/http"
-	"slices"
-	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/monlor/k8s-image-updater/config"
+	"github.com/monlor/k8s-image-updater/pkg/audit"
 	"github.com/monlor/k8s-image-updater/pkg/k8s"
-	"github.com/sirupsen/logrus"
+	"github.com/monlor/k8s-image-updater/pkg/registry"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 )
 
+// getClient creates the kubernetes client of a cluster used by the handlers, replaced in tests
+var getClient = k8s.GetClusterClient
+
+// clusterClient creates the client of the cluster query parameter, the default cluster if not given,
+// writing the error response if it fails
+func clusterClient(c *gin.Context) (*k8s.Client, bool) {
+	client, err := getClient(c.Query("cluster"))
+	if errors.Is(err, k8s.ErrUnknownCluster) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	return client, true
+}
+
+// AuthMiddleware authenticates requests with the API key, or with a kubernetes token in the k8s-token auth mode
 func AuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
+		if mode, _ := config.GlobalConfig.AuthMode(); mode == config.AuthModeK8sToken {
+			authorizeToken(c)
+			return
+		}
+		// Compared in constant time so the key cannot be guessed from response times
 		apiKey := c.GetHeader("X-API-Key")
-		if apiKey != config.GlobalConfig.APIKey {
+		if subtle.ConstantTimeCompare([]byte(apiKey), []byte(config.GlobalConfig.APIKey)) != 1 {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid API key"})
 			c.Abort()
 			return
@@ -23,68 +49,374 @@ func AuthMiddleware() gin.HandlerFunc {
 	}
 }
 
+// Check the namespace is allowed and the kind supported, writing the error response if not
+func validateTarget(c *gin.Context, namespace, kind string) bool {
+	// Validate namespace
+	if !config.GlobalConfig.NamespaceAllowed(namespace) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"ok":      false,
+			"message": "Namespace " + namespace + " not allowed!",
+		})
+		c.Abort()
+		return false
+	}
+
+	return validateKind(c, kind)
+}
+
+// normalizeKind lowercases a kind and resolves its aliases, unknown kinds are returned lowercased
+func normalizeKind(kind string) string {
+	return k8s.NormalizeKind(kind)
+}
+
+// Check the kind is supported, writing the error response if not
+func validateKind(c *gin.Context, kind string) bool {
+	if err := k8s.ValidateKind(kind); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+	return true
+}
+
 func UpdateImage(c *gin.Context) {
 	// Get values from query parameters
 	namespace := c.Query("namespace")
 	service := c.Query("service")
-	kind := strings.ToLower(c.DefaultQuery("kind", "deployment")) // default value is deployment
+	kind := normalizeKind(c.DefaultQuery("kind", "deployment")) // default value is deployment
 	image := c.Query("image")
 	container := c.Query("container")
+	// Repeated image parameters update several containers, each paired with the container parameter at its position
+	images, containers := c.QueryArray("image"), c.QueryArray("container")
+	dryRun := c.Query("dryRun") == "true"
+	restartOnSameImage := c.Query("restartOnSameImage")
+	// With matchRepository the image only names a repository, or a trailing part of it, and the new tag
+	matchRepository := c.Query("matchRepository") == "true"
+	// Instead of the image, a tag for the current image of the container or an image template
+	tag, imageTemplate := c.Query("tag"), c.Query("imageTemplate")
+	templated := tag != "" || imageTemplate != ""
 
 	// Validate required parameters
-	if namespace == "" || service == "" || image == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "namespace, service, and image are required"})
+	if namespace == "" || service == "" || (image == "" && !templated) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "namespace, service, and image, tag or imageTemplate are required"})
+		return
+	}
+	if templated && (image != "" || matchRepository) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "tag and imageTemplate cannot be combined with image or matchRepository"})
+		return
+	}
+	if restartOnSameImage != "" && restartOnSameImage != "true" && restartOnSameImage != "false" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "restartOnSameImage must be true or false"})
+		return
+	}
+	if matchRepository && (len(images) > 1 || container != "") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "matchRepository takes a single image and no container"})
+		return
+	}
+	if (len(images) > 1 || len(containers) > 1) && len(containers) != len(images) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "each image needs a container parameter when updating several containers"})
 		return
 	}
 
-	// Validate namespace
-	if config.GlobalConfig.AllowedNamespaces != "" {
-		allowedNamespaces := strings.Split(config.GlobalConfig.AllowedNamespaces, ",")
-		if !slices.Contains(allowedNamespaces, namespace) {
-			c.JSON(http.StatusForbidden, gin.H{
+	if !validateTarget(c, namespace, kind) {
+		return
+	}
+
+	if !imagesAllowed(c, images) {
+		return
+	}
+
+	client, ok := clusterClient(c)
+	if !ok {
+		return
+	}
+
+	if templated {
+		if imageTemplate == "" {
+			imageTemplate = k8s.DefaultImageTemplate
+		}
+		resolved, resolveErr := client.ResolveImageTemplate(kind, namespace, service, container, imageTemplate, tag)
+		if resolveErr != nil {
+			logger(c).Errorf("Failed to resolve image template %s of %s %s/%s: %v", imageTemplate, kind, namespace, service, resolveErr)
+			status := http.StatusInternalServerError
+			if errors.Is(resolveErr, k8s.ErrInvalidImageTemplate) {
+				status = http.StatusBadRequest
+			} else if apierrors.IsNotFound(resolveErr) {
+				status = http.StatusNotFound
+			}
+			c.JSON(status, gin.H{
 				"ok":      false,
-				"message": "Namespace " + namespace + " not allowed!",
+				"message": resolveErr.Error(),
 			})
-			c.Abort()
+			return
+		}
+		image, images = resolved, []string{resolved}
+		if !imagesAllowed(c, images) {
 			return
 		}
 	}
 
-	// Validate resource type
-	if kind != "deployment" && kind != "statefulset" && kind != "daemonset" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "kind must be one of: deployment, statefulset, daemonset"})
-		return
+	if matchRepository {
+		matches, matchErr := client.MatchRepositoryContainers(kind, namespace, service, image)
+		if matchErr != nil {
+			logger(c).Errorf("Failed to match image %s in %s %s/%s: %v", image, kind, namespace, service, matchErr)
+			status := http.StatusInternalServerError
+			if errors.Is(matchErr, k8s.ErrNoMatchingContainers) || apierrors.IsNotFound(matchErr) {
+				status = http.StatusNotFound
+			}
+			c.JSON(status, gin.H{
+				"ok":      false,
+				"message": matchErr.Error(),
+			})
+			return
+		}
+		containers, images = nil, nil
+		for _, m := range matches {
+			containers, images = append(containers, m.Name), append(images, m.Image)
+		}
+		container, image = containers[0], images[0]
+		// The resolved images are on the registry of the running containers
+		if !imagesAllowed(c, images) {
+			return
+		}
 	}
 
-	client, err := k8s.GetClient()
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if !imagesVerified(c, client, kind, namespace, service, images) {
 		return
 	}
 
-	var result string
-	var updateErr error
+	if len(images) > 1 {
+		updateImages(c, client, kind, namespace, service, containers, images, dryRun, restartOnSameImage)
+		return
+	}
 
-	switch kind {
-	case "deployment":
-		result, updateErr = client.UpdateDeploymentImage(namespace, service, container, image)
-	case "statefulset":
-		result, updateErr = client.UpdateStatefulSetImage(namespace, service, container, image)
-	case "daemonset":
-		result, updateErr = client.UpdateDaemonSetImage(namespace, service, container, image)
+	// A dry run only reports the action the update would take
+	if dryRun {
+		plan, planErr := client.PlanImageUpdate(kind, namespace, service, container, image, restartOnSameImage)
+		if planErr != nil {
+			logger(c).Errorf("Failed to plan update of %s %s/%s: %v", kind, namespace, service, planErr)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"ok":      false,
+				"message": planErr.Error(),
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"ok":      true,
+			"dryRun":  true,
+			"message": plan.DryRunMessage(),
+			"plan":    plan,
+		})
+		return
 	}
 
+	plan, updateErr := client.ApplyImageUpdate(kind, namespace, service, container, image, restartOnSameImage)
 	if updateErr != nil {
-		logrus.Errorf("Failed to update %s %s/%s: %v", kind, namespace, service, updateErr)
+		logger(c).Errorf("Failed to update %s %s/%s: %v", kind, namespace, service, updateErr)
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"ok":      false,
 			"message": updateErr.Error(),
 		})
 		return
 	}
+	logger(c).Info(plan.Message())
+	audit.LogPlan(actor(c), plan)
+
+	c.JSON(http.StatusOK, gin.H{
+		"ok":            true,
+		"message":       plan.Message(),
+		"action":        plan.Outcome(),
+		"previousImage": plan.CurrentImage,
+		"newImage":      plan.Image,
+		"diff":          plan.Diff,
+	})
+}
+
+// Check the registries of images are allowed, writing the error response if not
+func imagesAllowed(c *gin.Context, images []string) bool {
+	for _, image := range images {
+		if !registry.ImageRegistryAllowed(image) {
+			c.JSON(http.StatusForbidden, gin.H{
+				"ok":      false,
+				"message": "Registry of image " + image + " not allowed!",
+			})
+			return false
+		}
+	}
+	return true
+}
+
+// containerResult is the outcome for one container of an update of several containers
+type containerResult struct {
+	Container     string `json:"container"`
+	Action        string `json:"action,omitempty"`
+	PreviousImage string `json:"previousImage,omitempty"`
+	NewImage      string `json:"newImage"`
+	// Fields of the pod template changed for the container
+	Diff    []k8s.SpecChange `json:"diff,omitempty"`
+	Message string           `json:"message,omitempty"`
+	Error   string           `json:"error,omitempty"`
+}
+
+// updateImages updates several containers of a resource in a single write, or none when one of them cannot be
+// updated, and writes the result of each container
+func updateImages(c *gin.Context, client *k8s.Client, kind, namespace, service string, containers, images []string, dryRun bool, restartOnSameImage string) {
+	updates := make([]k8s.ContainerImage, len(images))
+	for i := range images {
+		updates[i] = k8s.ContainerImage{Name: containers[i], Image: images[i]}
+	}
+
+	var plans []k8s.ContainerPlan
+	var err error
+	if dryRun {
+		plans, err = client.PlanImageUpdates(kind, namespace, service, updates, restartOnSameImage)
+	} else {
+		plans, err = client.ApplyImageUpdates(kind, namespace, service, updates, restartOnSameImage)
+	}
+
+	// Planned containers are not updated when the write itself fails
+	writeFailed := err != nil && !errors.Is(err, k8s.ErrContainersNotUpdated)
+	results := make([]containerResult, len(plans))
+	for i, p := range plans {
+		results[i] = containerResult{Container: p.Name, NewImage: p.Image}
+		switch {
+		case p.Err != nil:
+			results[i].Error = p.Err.Error()
+		case writeFailed:
+			results[i].Container, results[i].PreviousImage, results[i].Error = p.Plan.Container, p.Plan.CurrentImage, err.Error()
+		case dryRun:
+			results[i].Container, results[i].Action, results[i].PreviousImage = p.Plan.Container, p.Plan.Action, p.Plan.CurrentImage
+			results[i].Message = p.Plan.DryRunMessage()
+		default:
+			results[i].Container, results[i].Action, results[i].PreviousImage = p.Plan.Container, p.Plan.Outcome(), p.Plan.CurrentImage
+			results[i].Message, results[i].Diff = p.Plan.Message(), p.Plan.Diff
+		}
+	}
+
+	if err != nil {
+		logger(c).Errorf("Failed to update %s %s/%s: %v", kind, namespace, service, err)
+		status := http.StatusInternalServerError
+		if errors.Is(err, k8s.ErrContainersNotUpdated) {
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, gin.H{
+			"ok":         false,
+			"message":    err.Error(),
+			"containers": results,
+		})
+		return
+	}
+
+	if dryRun {
+		c.JSON(http.StatusOK, gin.H{
+			"ok":         true,
+			"dryRun":     true,
+			"message":    fmt.Sprintf("Would update %d containers of %s %s/%s", len(plans), kind, namespace, service),
+			"containers": results,
+		})
+		return
+	}
+
+	for _, p := range plans {
+		logger(c).Info(p.Plan.Message())
+		audit.LogPlan(actor(c), p.Plan)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"ok":         true,
+		"message":    fmt.Sprintf("Updated %d containers of %s %s/%s", len(plans), kind, namespace, service),
+		"containers": results,
+	})
+}
+
+// RestartResource triggers a rollout of a resource without changing its image
+func RestartResource(c *gin.Context) {
+	namespace := c.Query("namespace")
+	service := c.Query("service")
+	kind := normalizeKind(c.DefaultQuery("kind", "deployment"))
+
+	if namespace == "" || service == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "namespace and service are required"})
+		return
+	}
+
+	if !validateTarget(c, namespace, kind) {
+		return
+	}
+
+	client, ok := clusterClient(c)
+	if !ok {
+		return
+	}
+
+	restartedAt, restartErr := client.RestartResource(kind, namespace, service)
+	if restartErr != nil {
+		logger(c).Errorf("Failed to restart %s %s/%s: %v", kind, namespace, service, restartErr)
+		status := http.StatusInternalServerError
+		if apierrors.IsNotFound(restartErr) {
+			status = http.StatusNotFound
+		}
+		c.JSON(status, gin.H{
+			"ok":      false,
+			"message": restartErr.Error(),
+		})
+		return
+	}
+
+	logger(c).Infof("Restarted %s %s/%s at %s", kind, namespace, service, restartedAt)
+	audit.Log(audit.Entry{
+		Actor:     actor(c),
+		Action:    audit.ActionRestart,
+		Kind:      kind,
+		Namespace: namespace,
+		Name:      service,
+		Mode:      audit.ModeManual,
+	})
+	c.JSON(http.StatusOK, gin.H{
+		"ok":          true,
+		"message":     "Restarted " + kind + " " + namespace + "/" + service,
+		"restartedAt": restartedAt,
+	})
+}
+
+// ApproveImage applies the image proposed in review mode for a resource
+func ApproveImage(c *gin.Context) {
+	namespace := c.Query("namespace")
+	service := c.Query("service")
+	kind := normalizeKind(c.DefaultQuery("kind", "deployment"))
+
+	if namespace == "" || service == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "namespace and service are required"})
+		return
+	}
+
+	if !validateTarget(c, namespace, kind) {
+		return
+	}
+
+	client, ok := clusterClient(c)
+	if !ok {
+		return
+	}
+
+	// The proposed image is verified like the images of the update endpoint, on the resource the approval writes
+	plan, approveErr := client.ApprovePendingImage(c.Request.Context(), kind, namespace, service, workloadVerifier(client, kind, namespace, service))
+	if approveErr != nil {
+		logger(c).Errorf("Failed to approve pending image of %s %s/%s: %v", kind, namespace, service, approveErr)
+		status := verifyErrorStatus(approveErr)
+		if errors.Is(approveErr, k8s.ErrNoPendingImage) || errors.Is(approveErr, k8s.ErrNoContainers) {
+			status = http.StatusConflict
+		}
+		c.JSON(status, gin.H{
+			"ok":      false,
+			"message": approveErr.Error(),
+		})
+		return
+	}
 
+	logger(c).Infof("Approved pending image: %s", plan.Message())
+	audit.LogPlan(actor(c), plan)
 	c.JSON(http.StatusOK, gin.H{
 		"ok":      true,
-		"message": result,
+		"message": plan.Message(),
+		"plan":    plan,
 	})
 }
@@ -0,0 +1,748 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/monlor/k8s-image-updater/pkg/audit"
+	"github.com/monlor/k8s-image-updater/pkg/k8s"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// Serve the handlers against a fake clientset holding the given objects
+func newTestRouter(t *testing.T, objects ...runtime.Object) (*gin.Engine, *fake.Clientset) {
+	gin.SetMode(gin.TestMode)
+	clientset := fake.NewSimpleClientset(objects...)
+	oldGetClient := getClient
+	getClient = func(string) (*k8s.Client, error) { return k8s.NewClient(clientset), nil }
+	t.Cleanup(func() { getClient = oldGetClient })
+
+	r := gin.New()
+	r.Use(RequestIDMiddleware())
+	r.GET("/api/v1/update", UpdateImage)
+	r.POST("/api/v1/restart", RestartResource)
+	r.POST("/api/v1/approve", ApproveImage)
+	r.GET("/api/v1/resources", ListResources)
+	r.GET("/api/v1/inventory", Inventory)
+	r.GET("/api/v1/status", GetStatus)
+	r.GET("/api/v1/resolve", ResolveImage)
+	r.POST("/api/v1/unfreeze", Unfreeze)
+	return r, clientset
+}
+
+func TestRestartResource(t *testing.T) {
+	meta := metav1.ObjectMeta{Name: "app", Namespace: "default"}
+	r, clientset := newTestRouter(t,
+		&appsv1.Deployment{ObjectMeta: meta},
+		&appsv1.StatefulSet{ObjectMeta: meta},
+		&appsv1.DaemonSet{ObjectMeta: meta},
+	)
+
+	getRestartedAt := map[string]func() string{
+		"deployment": func() string {
+			obj, err := clientset.AppsV1().Deployments("default").Get(context.Background(), "app", metav1.GetOptions{})
+			require.NoError(t, err)
+			return obj.Spec.Template.Annotations["kubectl.kubernetes.io/restartedAt"]
+		},
+		"statefulset": func() string {
+			obj, err := clientset.AppsV1().StatefulSets("default").Get(context.Background(), "app", metav1.GetOptions{})
+			require.NoError(t, err)
+			return obj.Spec.Template.Annotations["kubectl.kubernetes.io/restartedAt"]
+		},
+		"daemonset": func() string {
+			obj, err := clientset.AppsV1().DaemonSets("default").Get(context.Background(), "app", metav1.GetOptions{})
+			require.NoError(t, err)
+			return obj.Spec.Template.Annotations["kubectl.kubernetes.io/restartedAt"]
+		},
+	}
+
+	for kind, restartedAt := range getRestartedAt {
+		t.Run(kind, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/restart?namespace=default&service=app&kind="+kind, nil))
+			require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+			var body struct {
+				OK          bool   `json:"ok"`
+				RestartedAt string `json:"restartedAt"`
+			}
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+			assert.True(t, body.OK)
+			_, err := time.Parse(time.RFC3339, body.RestartedAt)
+			assert.NoError(t, err)
+			assert.Equal(t, body.RestartedAt, restartedAt())
+		})
+
+		t.Run(kind+" not found", func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/restart?namespace=default&service=missing&kind="+kind, nil))
+			assert.Equal(t, http.StatusNotFound, w.Code)
+		})
+	}
+}
+
+func TestRestartResourceValidation(t *testing.T) {
+	r, _ := newTestRouter(t)
+
+	tests := []struct {
+		name  string
+		query string
+		want  int
+	}{
+		{"missing service", "namespace=default", http.StatusBadRequest},
+		{"unsupported kind", "namespace=default&service=app&kind=job", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/restart?"+tt.query, nil))
+			assert.Equal(t, tt.want, w.Code)
+		})
+	}
+}
+
+func TestClusterParam(t *testing.T) {
+	meta := metav1.ObjectMeta{Name: "app", Namespace: "default"}
+	clientsets := map[string]*fake.Clientset{
+		"staging": fake.NewSimpleClientset(&appsv1.Deployment{ObjectMeta: meta}),
+		"prod":    fake.NewSimpleClientset(&appsv1.Deployment{ObjectMeta: meta}),
+	}
+	r, _ := newTestRouter(t)
+	getClient = func(cluster string) (*k8s.Client, error) {
+		if cluster == "" {
+			cluster = "staging"
+		}
+		if clientsets[cluster] == nil {
+			return nil, fmt.Errorf("%w: %s", k8s.ErrUnknownCluster, cluster)
+		}
+		return k8s.NewClient(clientsets[cluster]), nil
+	}
+	restarted := func(cluster string) bool {
+		deploy, err := clientsets[cluster].AppsV1().Deployments("default").Get(context.Background(), "app", metav1.GetOptions{})
+		require.NoError(t, err)
+		return deploy.Spec.Template.Annotations["kubectl.kubernetes.io/restartedAt"] != ""
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/restart?namespace=default&service=app&cluster=prod", nil))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.True(t, restarted("prod"))
+	assert.False(t, restarted("staging"))
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/restart?namespace=default&service=app", nil))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.True(t, restarted("staging"))
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/restart?namespace=default&service=app&cluster=dev", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "unknown cluster")
+}
+
+func TestKindAliases(t *testing.T) {
+	meta := metav1.ObjectMeta{Name: "app", Namespace: "default"}
+	template := corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+		Containers: []corev1.Container{{Name: "app", Image: "nginx:1.26"}},
+	}}
+	r, _ := newTestRouter(t,
+		&appsv1.Deployment{ObjectMeta: meta, Spec: appsv1.DeploymentSpec{Template: template}},
+		&appsv1.StatefulSet{ObjectMeta: meta, Spec: appsv1.StatefulSetSpec{Template: template}},
+		&appsv1.DaemonSet{ObjectMeta: meta, Spec: appsv1.DaemonSetSpec{Template: template}},
+	)
+
+	tests := []struct {
+		kind string
+		want string
+	}{
+		{"Deployment", "deployment"},
+		{"deploy", "deployment"},
+		{"Deployments", "deployment"},
+		{"sts", "statefulset"},
+		{"StatefulSets", "statefulset"},
+		{"ds", "daemonset"},
+		{"DAEMONSETS", "daemonset"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.kind, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/update?namespace=default&service=app&image=nginx:1.27&dryRun=true&kind="+tt.kind, nil))
+			require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+			var body struct {
+				Plan k8s.ImagePlan `json:"plan"`
+			}
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+			assert.Equal(t, tt.want, body.Plan.Kind)
+		})
+	}
+
+	t.Run("unsupported", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/update?namespace=default&service=app&image=nginx:1.27&kind=jobs", nil))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), "deployment, statefulset, daemonset")
+	})
+}
+
+func TestUpdateImageAllowedRegistries(t *testing.T) {
+	r, clientset := newTestRouter(t, &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app", Image: "ghcr.io/org/app:1.0.0"}},
+		}}},
+	})
+	oldRegistries := config.GlobalConfig.AllowedRegistries
+	config.GlobalConfig.AllowedRegistries = "ghcr.io"
+	t.Cleanup(func() { config.GlobalConfig.AllowedRegistries = oldRegistries })
+
+	tests := []struct {
+		image     string
+		wantCode  int
+		wantImage string
+	}{
+		{"evil.example.com/org/app:2.0.0", http.StatusForbidden, "ghcr.io/org/app:1.0.0"},
+		{"ghcr.io/org/app:1.1.0", http.StatusOK, "ghcr.io/org/app:1.1.0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/update?namespace=default&service=app&image="+tt.image, nil))
+			assert.Equal(t, tt.wantCode, w.Code, w.Body.String())
+
+			deploy, err := clientset.AppsV1().Deployments("default").Get(context.Background(), "app", metav1.GetOptions{})
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantImage, deploy.Spec.Template.Spec.Containers[0].Image)
+		})
+	}
+}
+
+func TestUpdateImageDryRun(t *testing.T) {
+	r, clientset := newTestRouter(t, &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Name: "app", Image: "ghcr.io/org/app:1.0.0"},
+				{Name: "cache", Image: "redis:latest", ImagePullPolicy: corev1.PullAlways},
+			},
+		}}},
+	})
+
+	tests := []struct {
+		query      string
+		wantCode   int
+		wantAction string
+	}{
+		{"image=ghcr.io/org/app:1.1.0", http.StatusOK, k8s.ImageActionUpdate},
+		{"image=ghcr.io/org/app:1.0.0", http.StatusOK, k8s.ImageActionUpToDate},
+		{"image=redis:latest&container=cache", http.StatusOK, k8s.ImageActionRestart},
+		{"image=ghcr.io/org/app:1.1.0&container=missing", http.StatusInternalServerError, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			clientset.ClearActions()
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/update?namespace=default&service=app&dryRun=true&"+tt.query, nil))
+			require.Equal(t, tt.wantCode, w.Code, w.Body.String())
+
+			if tt.wantAction != "" {
+				var body struct {
+					DryRun bool          `json:"dryRun"`
+					Plan   k8s.ImagePlan `json:"plan"`
+				}
+				require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+				assert.True(t, body.DryRun)
+				assert.Equal(t, tt.wantAction, body.Plan.Action)
+			}
+
+			// Only reads reach the cluster
+			for _, action := range clientset.Actions() {
+				assert.Equal(t, "get", action.GetVerb())
+			}
+		})
+	}
+
+	deploy, err := clientset.AppsV1().Deployments("default").Get(context.Background(), "app", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "ghcr.io/org/app:1.0.0", deploy.Spec.Template.Spec.Containers[0].Image)
+	assert.Empty(t, deploy.Spec.Template.Annotations)
+}
+
+func TestUpdateImageAction(t *testing.T) {
+	tests := []struct {
+		query             string
+		wantAction        string
+		wantPreviousImage string
+		wantNewImage      string
+	}{
+		{"image=ghcr.io/org/app:1.1.0", k8s.ImageOutcomeUpdated, "ghcr.io/org/app:1.0.0", "ghcr.io/org/app:1.1.0"},
+		{"image=redis:latest&container=cache", k8s.ImageOutcomeRestarted, "redis:latest", "redis:latest"},
+		{"image=redis:latest&container=cache&restartOnSameImage=false", k8s.ImageOutcomeNoOp, "redis:latest", "redis:latest"},
+		{"image=ghcr.io/org/app:1.0.0", k8s.ImageOutcomeNoOp, "ghcr.io/org/app:1.0.0", "ghcr.io/org/app:1.0.0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			r, _ := newTestRouter(t, &appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+				Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{Name: "app", Image: "ghcr.io/org/app:1.0.0"},
+						{Name: "cache", Image: "redis:latest", ImagePullPolicy: corev1.PullAlways},
+					},
+				}}},
+			})
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/update?namespace=default&service=app&"+tt.query, nil))
+			require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+			var body struct {
+				Ok            bool   `json:"ok"`
+				Message       string `json:"message"`
+				Action        string `json:"action"`
+				PreviousImage string `json:"previousImage"`
+				NewImage      string `json:"newImage"`
+			}
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+			assert.True(t, body.Ok)
+			assert.NotEmpty(t, body.Message)
+			assert.Equal(t, tt.wantAction, body.Action)
+			assert.Equal(t, tt.wantPreviousImage, body.PreviousImage)
+			assert.Equal(t, tt.wantNewImage, body.NewImage)
+		})
+	}
+}
+
+func TestUpdateImageDiff(t *testing.T) {
+	newDeployment := func() *appsv1.Deployment {
+		return &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+			Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+				Containers: []corev1.Container{
+					{Name: "app", Image: "ghcr.io/org/app:1.0.0"},
+					{Name: "cache", Image: "redis:latest", ImagePullPolicy: corev1.PullAlways},
+				},
+			}}},
+		}
+	}
+	restartPath := "spec.template.metadata.annotations[kubectl.kubernetes.io/restartedAt]"
+	type response struct {
+		Diff       []k8s.SpecChange `json:"diff"`
+		Containers []struct {
+			Container string           `json:"container"`
+			Diff      []k8s.SpecChange `json:"diff"`
+		} `json:"containers"`
+	}
+	update := func(t *testing.T, query string) response {
+		r, _ := newTestRouter(t, newDeployment())
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/update?namespace=default&service=app&"+query, nil))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var body response
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		return body
+	}
+
+	t.Run("image change", func(t *testing.T) {
+		body := update(t, "image=ghcr.io/org/app:1.1.0")
+		assert.Equal(t, []k8s.SpecChange{
+			{Path: "spec.template.spec.containers[app].image", Old: "ghcr.io/org/app:1.0.0", New: "ghcr.io/org/app:1.1.0"},
+		}, body.Diff)
+	})
+
+	t.Run("restart", func(t *testing.T) {
+		body := update(t, "image=redis:latest&container=cache")
+		require.Len(t, body.Diff, 1)
+		assert.Equal(t, restartPath, body.Diff[0].Path)
+		// The restart annotation was added
+		assert.Empty(t, body.Diff[0].Old)
+		_, err := time.Parse(time.RFC3339, body.Diff[0].New)
+		assert.NoError(t, err)
+	})
+
+	t.Run("no-op", func(t *testing.T) {
+		body := update(t, "image=ghcr.io/org/app:1.0.0")
+		assert.Empty(t, body.Diff)
+	})
+
+	t.Run("several containers", func(t *testing.T) {
+		body := update(t, "container=app&image=ghcr.io/org/app:1.1.0&container=cache&image=redis:latest")
+		require.Len(t, body.Containers, 2)
+		assert.Equal(t, []k8s.SpecChange{
+			{Path: "spec.template.spec.containers[app].image", Old: "ghcr.io/org/app:1.0.0", New: "ghcr.io/org/app:1.1.0"},
+		}, body.Containers[0].Diff)
+		// The cache container keeps its image, the same write restarts it
+		require.Len(t, body.Containers[1].Diff, 1)
+		assert.Equal(t, restartPath, body.Containers[1].Diff[0].Path)
+	})
+
+	t.Run("several containers restart", func(t *testing.T) {
+		body := update(t, "container=app&image=ghcr.io/org/app:1.0.0&container=cache&image=redis:latest")
+		require.Len(t, body.Containers, 2)
+		assert.Empty(t, body.Containers[0].Diff)
+		require.Len(t, body.Containers[1].Diff, 1)
+		assert.Equal(t, restartPath, body.Containers[1].Diff[0].Path)
+	})
+}
+
+func TestUpdateImageRestartOnSameImageValidation(t *testing.T) {
+	r, _ := newTestRouter(t)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/update?namespace=default&service=app&image=redis:latest&restartOnSameImage=never", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "restartOnSameImage")
+}
+
+func TestUpdateImageMultipleContainers(t *testing.T) {
+	newDeployment := func() *appsv1.Deployment {
+		return &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+			Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+				Containers: []corev1.Container{
+					{Name: "app", Image: "ghcr.io/org/app:1.0.0"},
+					{Name: "sidecar", Image: "ghcr.io/org/sidecar:1.0.0"},
+				},
+			}}},
+		}
+	}
+	type result struct {
+		Container     string `json:"container"`
+		Action        string `json:"action"`
+		PreviousImage string `json:"previousImage"`
+		NewImage      string `json:"newImage"`
+		Error         string `json:"error"`
+	}
+	var body struct {
+		Ok         bool     `json:"ok"`
+		Containers []result `json:"containers"`
+	}
+	images := func(t *testing.T, clientset *fake.Clientset) []string {
+		deploy, err := clientset.AppsV1().Deployments("default").Get(context.Background(), "app", metav1.GetOptions{})
+		require.NoError(t, err)
+		return []string{deploy.Spec.Template.Spec.Containers[0].Image, deploy.Spec.Template.Spec.Containers[1].Image}
+	}
+	writes := func(clientset *fake.Clientset) int {
+		count := 0
+		for _, action := range clientset.Actions() {
+			if action.GetVerb() == "patch" || action.GetVerb() == "update" {
+				count++
+			}
+		}
+		return count
+	}
+
+	t.Run("all containers", func(t *testing.T) {
+		r, clientset := newTestRouter(t, newDeployment())
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/update?namespace=default&service=app"+
+			"&container=app&image=ghcr.io/org/app:1.1.0&container=sidecar&image=ghcr.io/org/sidecar:2.0.0", nil))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		assert.True(t, body.Ok)
+		assert.Equal(t, []result{
+			{Container: "app", Action: k8s.ImageOutcomeUpdated, PreviousImage: "ghcr.io/org/app:1.0.0", NewImage: "ghcr.io/org/app:1.1.0"},
+			{Container: "sidecar", Action: k8s.ImageOutcomeUpdated, PreviousImage: "ghcr.io/org/sidecar:1.0.0", NewImage: "ghcr.io/org/sidecar:2.0.0"},
+		}, body.Containers)
+		assert.Equal(t, []string{"ghcr.io/org/app:1.1.0", "ghcr.io/org/sidecar:2.0.0"}, images(t, clientset))
+		assert.Equal(t, 1, writes(clientset))
+	})
+
+	t.Run("partial failure", func(t *testing.T) {
+		r, clientset := newTestRouter(t, newDeployment())
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/update?namespace=default&service=app"+
+			"&container=app&image=ghcr.io/org/app:1.1.0&container=missing&image=ghcr.io/org/missing:2.0.0", nil))
+		require.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		assert.False(t, body.Ok)
+		require.Len(t, body.Containers, 2)
+		assert.Empty(t, body.Containers[0].Error)
+		assert.Equal(t, "missing", body.Containers[1].Container)
+		assert.Contains(t, body.Containers[1].Error, "container missing not found")
+		// Nothing is written when a container cannot be updated
+		assert.Equal(t, []string{"ghcr.io/org/app:1.0.0", "ghcr.io/org/sidecar:1.0.0"}, images(t, clientset))
+		assert.Zero(t, writes(clientset))
+	})
+
+	t.Run("write failure", func(t *testing.T) {
+		r, clientset := newTestRouter(t, newDeployment())
+		clientset.PrependReactor("patch", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			return true, nil, errors.New("etcd unavailable")
+		})
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/update?namespace=default&service=app"+
+			"&container=app&image=ghcr.io/org/app:1.1.0&container=sidecar&image=ghcr.io/org/sidecar:2.0.0", nil))
+		require.Equal(t, http.StatusInternalServerError, w.Code, w.Body.String())
+
+		// No container is reported as updated
+		body.Containers = nil
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		assert.False(t, body.Ok)
+		require.Len(t, body.Containers, 2)
+		for _, container := range body.Containers {
+			assert.Empty(t, container.Action, container.Container)
+			assert.Contains(t, container.Error, "etcd unavailable", container.Container)
+		}
+		assert.Equal(t, []string{"ghcr.io/org/app:1.0.0", "ghcr.io/org/sidecar:1.0.0"}, images(t, clientset))
+	})
+
+	t.Run("same container twice", func(t *testing.T) {
+		r, clientset := newTestRouter(t, newDeployment())
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/update?namespace=default&service=app"+
+			"&container=app&image=ghcr.io/org/app:1.1.0&container=a*&image=ghcr.io/org/app:1.2.0", nil))
+		require.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+		assert.Contains(t, w.Body.String(), "more than once")
+		assert.Zero(t, writes(clientset))
+	})
+
+	t.Run("unpaired image", func(t *testing.T) {
+		r, _ := newTestRouter(t, newDeployment())
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/update?namespace=default&service=app"+
+			"&container=app&image=ghcr.io/org/app:1.1.0&image=ghcr.io/org/sidecar:2.0.0", nil))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("unpaired container", func(t *testing.T) {
+		// The second container is refused rather than dropped
+		r, clientset := newTestRouter(t, newDeployment())
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/update?namespace=default&service=app"+
+			"&image=ghcr.io/org/app:1.1.0&container=app&container=sidecar", nil))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Zero(t, writes(clientset))
+	})
+}
+
+func TestUpdateImageMatchRepository(t *testing.T) {
+	newDeployment := func(images ...string) *appsv1.Deployment {
+		deploy := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"}}
+		for i, image := range images {
+			deploy.Spec.Template.Spec.Containers = append(deploy.Spec.Template.Spec.Containers,
+				corev1.Container{Name: fmt.Sprintf("c%d", i), Image: image})
+		}
+		return deploy
+	}
+	images := func(t *testing.T, clientset *fake.Clientset) []string {
+		deploy, err := clientset.AppsV1().Deployments("default").Get(context.Background(), "app", metav1.GetOptions{})
+		require.NoError(t, err)
+		var images []string
+		for _, c := range deploy.Spec.Template.Spec.Containers {
+			images = append(images, c.Image)
+		}
+		return images
+	}
+
+	t.Run("single container", func(t *testing.T) {
+		r, clientset := newTestRouter(t, newDeployment("ghcr.io/org/app:1.0.0", "mirror.example.com/library/nginx:1.24"))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/update?namespace=default&service=app&image=nginx:1.25&matchRepository=true", nil))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var body struct {
+			Action        string `json:"action"`
+			PreviousImage string `json:"previousImage"`
+			NewImage      string `json:"newImage"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		assert.Equal(t, k8s.ImageOutcomeUpdated, body.Action)
+		assert.Equal(t, "mirror.example.com/library/nginx:1.24", body.PreviousImage)
+		assert.Equal(t, "mirror.example.com/library/nginx:1.25", body.NewImage)
+		assert.Equal(t, []string{"ghcr.io/org/app:1.0.0", "mirror.example.com/library/nginx:1.25"}, images(t, clientset))
+	})
+
+	t.Run("several containers", func(t *testing.T) {
+		r, clientset := newTestRouter(t, newDeployment("ghcr.io/org/app:1.0.0", "ghcr.io/org/app:1.0.0-debug", "ghcr.io/org/other:1.0.0"))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/update?namespace=default&service=app&image=org/app:1.1.0&matchRepository=true", nil))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Contains(t, w.Body.String(), "Updated 2 containers")
+		assert.Equal(t, []string{"ghcr.io/org/app:1.1.0", "ghcr.io/org/app:1.1.0", "ghcr.io/org/other:1.0.0"}, images(t, clientset))
+	})
+
+	t.Run("no match", func(t *testing.T) {
+		r, clientset := newTestRouter(t, newDeployment("ghcr.io/org/app:1.0.0"))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/update?namespace=default&service=app&image=nginx:1.25&matchRepository=true", nil))
+		assert.Equal(t, http.StatusNotFound, w.Code, w.Body.String())
+		assert.Equal(t, []string{"ghcr.io/org/app:1.0.0"}, images(t, clientset))
+	})
+
+	t.Run("with container", func(t *testing.T) {
+		r, _ := newTestRouter(t, newDeployment("ghcr.io/org/app:1.0.0"))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/update?namespace=default&service=app&container=c0&image=app:1.1.0&matchRepository=true", nil))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
+
+func TestUpdateImageTemplate(t *testing.T) {
+	newDeployment := func() *appsv1.Deployment {
+		return &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+			Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+				Containers: []corev1.Container{
+					{Name: "app", Image: "myrepo/app:v1.0.0@sha256:0000000000000000000000000000000000000000000000000000000000000000"},
+					{Name: "sidecar", Image: "ghcr.io/org/sidecar:1.0.0"},
+				},
+			}}},
+		}
+	}
+	images := func(t *testing.T, clientset *fake.Clientset) []string {
+		deploy, err := clientset.AppsV1().Deployments("default").Get(context.Background(), "app", metav1.GetOptions{})
+		require.NoError(t, err)
+		return []string{deploy.Spec.Template.Spec.Containers[0].Image, deploy.Spec.Template.Spec.Containers[1].Image}
+	}
+
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+		wantImages []string
+	}{
+		{"tag", "tag=v1.1.0", http.StatusOK,
+			[]string{"myrepo/app:v1.1.0", "ghcr.io/org/sidecar:1.0.0"}},
+		{"tag of container", "container=sidecar&tag=2.0.0", http.StatusOK,
+			[]string{"myrepo/app:v1.0.0@sha256:0000000000000000000000000000000000000000000000000000000000000000", "ghcr.io/org/sidecar:2.0.0"}},
+		{"template", "imageTemplate=myrepo/app:v{tag}&tag=1.2.0", http.StatusOK,
+			[]string{"myrepo/app:v1.2.0", "ghcr.io/org/sidecar:1.0.0"}},
+		{"template of current image", "container=side*&imageTemplate={image}:{tag}-alpine&tag=1.1.0", http.StatusOK,
+			[]string{"myrepo/app:v1.0.0@sha256:0000000000000000000000000000000000000000000000000000000000000000", "ghcr.io/org/sidecar:1.1.0-alpine"}},
+		{"template without tag", "imageTemplate=myrepo/app:v{tag}", http.StatusBadRequest, nil},
+		{"invalid image", "tag=not%20valid", http.StatusBadRequest, nil},
+		{"with image", "tag=v1.1.0&image=myrepo/app:v1.1.0", http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, clientset := newTestRouter(t, newDeployment())
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/update?namespace=default&service=app&"+tt.query, nil))
+			require.Equal(t, tt.wantStatus, w.Code, w.Body.String())
+			if tt.wantImages != nil {
+				assert.Equal(t, tt.wantImages, images(t, clientset))
+			} else {
+				assert.Equal(t, []string{"myrepo/app:v1.0.0@sha256:0000000000000000000000000000000000000000000000000000000000000000", "ghcr.io/org/sidecar:1.0.0"}, images(t, clientset))
+			}
+		})
+	}
+}
+
+func TestUpdateImageAudit(t *testing.T) {
+	var buf bytes.Buffer
+	previous := audit.SetLogger(audit.NewWriterLogger(&buf))
+	t.Cleanup(func() { audit.SetLogger(previous) })
+
+	r, _ := newTestRouter(t, &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app", Image: "ghcr.io/org/app:1.0.0"}},
+		}}},
+	})
+
+	for _, query := range []string{
+		"image=ghcr.io/org/app:1.1.0",
+		// Up to date and dry runs are not recorded
+		"image=ghcr.io/org/app:1.1.0",
+		"image=ghcr.io/org/app:1.2.0&dryRun=true",
+	} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/update?namespace=default&service=app&"+query, nil)
+		req.Header.Set("X-API-Key", "test-key")
+		r.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 1)
+	var entry audit.Entry
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &entry))
+	assert.False(t, entry.Time.IsZero())
+	entry.Time = time.Time{}
+	assert.Equal(t, audit.Entry{
+		Actor:     audit.APIKeyActor("api", "test-key"),
+		Action:    audit.ActionUpdate,
+		Kind:      "deployment",
+		Namespace: "default",
+		Name:      "app",
+		Container: "app",
+		OldImage:  "ghcr.io/org/app:1.0.0",
+		NewImage:  "ghcr.io/org/app:1.1.0",
+		Mode:      audit.ModeManual,
+	}, entry)
+}
+
+func TestApproveImage(t *testing.T) {
+	var buf bytes.Buffer
+	previous := audit.SetLogger(audit.NewWriterLogger(&buf))
+	t.Cleanup(func() { audit.SetLogger(previous) })
+
+	r, clientset := newTestRouter(t, &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default", Annotations: map[string]string{
+			config.AnnotationMode:             "review",
+			config.AnnotationPendingImage:     "ghcr.io/org/sidecar:1.1.0",
+			config.AnnotationPendingContainer: "sidecar",
+			config.AnnotationProposedImage:    "ghcr.io/org/sidecar:1.1.0",
+			config.AnnotationStatus:           config.StatusPendingApproval,
+		}},
+		Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Name: "app", Image: "ghcr.io/org/app:1.0.0"},
+				{Name: "sidecar", Image: "ghcr.io/org/sidecar:1.0.0"},
+			},
+		}}},
+	})
+	approve := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/approve?namespace=default&service=app", nil))
+		return w
+	}
+
+	w := approve()
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	deploy, err := clientset.AppsV1().Deployments("default").Get(context.Background(), "app", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "ghcr.io/org/app:1.0.0", deploy.Spec.Template.Spec.Containers[0].Image)
+	assert.Equal(t, "ghcr.io/org/sidecar:1.1.0", deploy.Spec.Template.Spec.Containers[1].Image)
+	assert.NotContains(t, deploy.Annotations, config.AnnotationPendingImage)
+	assert.NotContains(t, deploy.Annotations, config.AnnotationPendingContainer)
+	assert.NotContains(t, deploy.Annotations, config.AnnotationStatus)
+	// The proposal is remembered so the updater does not propose it again
+	assert.Equal(t, "ghcr.io/org/sidecar:1.1.0", deploy.Annotations[config.AnnotationProposedImage])
+
+	var entry audit.Entry
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+	assert.Equal(t, "ghcr.io/org/sidecar:1.0.0", entry.OldImage)
+	assert.Equal(t, "ghcr.io/org/sidecar:1.1.0", entry.NewImage)
+
+	// Nothing is pending anymore
+	w = approve()
+	assert.Equal(t, http.StatusConflict, w.Code, w.Body.String())
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/approve?namespace=default&service=missing", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code, w.Body.String())
+}
@@ -0,0 +1,112 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/monlor/k8s-image-updater/pkg/updater"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// inventoryResource is a resource enabled for auto-update with the settings it is checked with
+type inventoryResource struct {
+	Kind       string               `json:"kind"`
+	Namespace  string               `json:"namespace"`
+	Name       string               `json:"name"`
+	Status     string               `json:"status,omitempty"`
+	LastDigest string               `json:"lastDigest,omitempty"`
+	Containers []inventoryContainer `json:"containers"`
+}
+
+// inventoryContainer is a container with its mode and allow-tags, resolved from the annotations and the policy
+type inventoryContainer struct {
+	Name      string `json:"name"`
+	Image     string `json:"image"`
+	Mode      string `json:"mode"`
+	AllowTags string `json:"allowTags,omitempty"`
+}
+
+// Inventory lists all the resources enabled for auto-update with their effective settings, for audits, as JSON or
+// as YAML with format=yaml
+func Inventory(c *gin.Context) {
+	namespace := c.Query("namespace")
+	format := c.DefaultQuery("format", "json")
+	if format != "json" && format != "yaml" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be json or yaml"})
+		return
+	}
+	if namespace != "" && !config.GlobalConfig.NamespaceAllowed(namespace) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"ok":      false,
+			"message": "Namespace " + namespace + " not allowed!",
+		})
+		return
+	}
+	if namespace == "" && config.GlobalConfig.NamespacedRBAC {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "namespace is required with NAMESPACED_RBAC"})
+		return
+	}
+
+	client, ok := clusterClient(c)
+	if !ok {
+		return
+	}
+	policy, err := updater.ReadPolicy(c.Request.Context(), client)
+	if err != nil {
+		logger(c).Errorf("Failed to build inventory: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"ok": false, "message": err.Error()})
+		return
+	}
+
+	items := []inventoryResource{}
+	for _, kind := range config.GlobalConfig.Kinds() {
+		if !kindAllowed(c, kind) {
+			continue
+		}
+		opts := metav1.ListOptions{LabelSelector: config.LabelEnabled + "=true", Limit: maxListLimit}
+		for {
+			page, err := client.ListResources(c.Request.Context(), kind, namespace, opts)
+			if err != nil {
+				logger(c).Errorf("Failed to list %ss: %v", kind, err)
+				c.JSON(http.StatusInternalServerError, gin.H{"ok": false, "message": err.Error()})
+				return
+			}
+			for _, resource := range page.Items {
+				if !config.GlobalConfig.NamespaceAllowed(resource.Namespace) {
+					continue
+				}
+				item := inventoryResource{
+					Kind:       resource.Kind,
+					Namespace:  resource.Namespace,
+					Name:       resource.Name,
+					Status:     resource.Status,
+					LastDigest: resource.Annotations[config.AnnotationLastDigest],
+					Containers: []inventoryContainer{},
+				}
+				for _, container := range resource.Containers {
+					mode, allowTags := policy.ContainerSettings(resource.Annotations, container.Name, container.Image)
+					item.Containers = append(item.Containers, inventoryContainer{Name: container.Name, Image: container.Image, Mode: mode, AllowTags: allowTags})
+				}
+				items = append(items, item)
+			}
+			if page.Continue == "" {
+				break
+			}
+			opts.Continue = page.Continue
+		}
+	}
+
+	body := gin.H{"ok": true, "items": items}
+	if format == "json" {
+		c.JSON(http.StatusOK, body)
+		return
+	}
+	out, err := yaml.Marshal(body)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"ok": false, "message": err.Error()})
+		return
+	}
+	c.Data(http.StatusOK, "application/yaml", out)
+}
@@ -0,0 +1,154 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/monlor/k8s-image-updater/pkg/k8s"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"sigs.k8s.io/yaml"
+)
+
+func TestInventory(t *testing.T) {
+	old := config.GlobalConfig.PolicyConfigMap
+	config.GlobalConfig.PolicyConfigMap = "image-updater/policy"
+	t.Cleanup(func() { config.GlobalConfig.PolicyConfigMap = old })
+
+	enabled := map[string]string{config.LabelEnabled: "true"}
+	r, _ := newTestRouter(t,
+		&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default", Labels: enabled, Annotations: map[string]string{
+				config.AnnotationMode:                 "release",
+				config.AnnotationAllowTags + ".cache": "regexp:^7\\.",
+				config.AnnotationStatus:               config.StatusNoMatchingTags,
+			}},
+			Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{Containers: []corev1.Container{
+				{Name: "app", Image: "ghcr.io/org/app:1.0.0"},
+				{Name: "cache", Image: "redis:7.0.0"},
+			}}}},
+		},
+		&appsv1.DaemonSet{
+			ObjectMeta: metav1.ObjectMeta{Name: "agent", Namespace: "monitoring", Labels: enabled, Annotations: map[string]string{
+				config.AnnotationLastDigest: "sha256:0123456789abcdef",
+			}},
+			Spec: appsv1.DaemonSetSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{Containers: []corev1.Container{
+				{Name: "agent", Image: "ghcr.io/org/agent:main"},
+			}}}},
+		},
+		// Not enabled for auto-update
+		&appsv1.StatefulSet{
+			ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default"},
+			Spec: appsv1.StatefulSetSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{Containers: []corev1.Container{
+				{Name: "db", Image: "postgres:16"},
+			}}}},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "policy", Namespace: "image-updater"},
+			Data:       map[string]string{"policy.yaml": "rules:\n  - image: ghcr.io/org/*\n    mode: latest\n"},
+		},
+	)
+	wantItems := []inventoryResource{
+		{Kind: "deployment", Namespace: "default", Name: "app", Status: config.StatusNoMatchingTags, Containers: []inventoryContainer{
+			// The annotation of the resource overrides the policy
+			{Name: "app", Image: "ghcr.io/org/app:1.0.0", Mode: "release"},
+			{Name: "cache", Image: "redis:7.0.0", Mode: "release", AllowTags: "regexp:^7\\."},
+		}},
+		{Kind: "daemonset", Namespace: "monitoring", Name: "agent", LastDigest: "sha256:0123456789abcdef", Containers: []inventoryContainer{
+			{Name: "agent", Image: "ghcr.io/org/agent:main", Mode: "latest"},
+		}},
+	}
+	type response struct {
+		Ok    bool                `json:"ok"`
+		Items []inventoryResource `json:"items"`
+	}
+
+	t.Run("yaml", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/inventory?format=yaml", nil))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Equal(t, "application/yaml", w.Header().Get("Content-Type"))
+		assert.Contains(t, w.Body.String(), "lastDigest: sha256:0123456789abcdef")
+
+		var body response
+		require.NoError(t, yaml.UnmarshalStrict(w.Body.Bytes(), &body))
+		assert.True(t, body.Ok)
+		assert.Equal(t, wantItems, body.Items)
+	})
+
+	t.Run("json", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/inventory?format=json&namespace=monitoring", nil))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var body response
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		assert.Equal(t, wantItems[1:], body.Items)
+	})
+
+	t.Run("invalid format", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/inventory?format=xml", nil))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("invalid policy", func(t *testing.T) {
+		config.GlobalConfig.PolicyConfigMap = "image-updater/missing"
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/inventory", nil))
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		assert.Contains(t, w.Body.String(), "policy ConfigMap image-updater/missing")
+	})
+}
+
+func TestInventoryKruise(t *testing.T) {
+	old := config.GlobalConfig.EnableKruise
+	config.GlobalConfig.EnableKruise = true
+	t.Cleanup(func() { config.GlobalConfig.EnableKruise = old })
+
+	r, clientset := newTestRouter(t)
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		k8s.KruiseResources[k8s.KindCloneSet]:            "CloneSetList",
+		k8s.KruiseResources[k8s.KindAdvancedStatefulSet]: "StatefulSetList",
+	}, &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "apps.kruise.io/v1alpha1",
+		"kind":       "CloneSet",
+		"metadata": map[string]interface{}{
+			"name":      "web",
+			"namespace": "default",
+			"labels":    map[string]interface{}{config.LabelEnabled: "true"},
+		},
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"spec": map[string]interface{}{
+					"containers": []interface{}{map[string]interface{}{"name": "app", "image": "nginx:1.26"}},
+				},
+			},
+		},
+	}})
+	getClient = func(string) (*k8s.Client, error) {
+		client := k8s.NewClient(clientset)
+		client.SetDynamicClient(dynamicClient)
+		return client, nil
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/inventory", nil))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var body struct {
+		Items []inventoryResource `json:"items"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	require.Len(t, body.Items, 1)
+	assert.Equal(t, k8s.KindCloneSet, body.Items[0].Kind)
+	assert.Equal(t, "nginx:1.26", body.Items[0].Containers[0].Image)
+}
@@ -0,0 +1,53 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// RequestIDHeader carries the ID correlating a request with the server logs
+const RequestIDHeader = "X-Request-ID"
+
+// Keys of the request ID and its logger in the gin context
+const (
+	requestIDKey = "requestID"
+	loggerKey    = "logger"
+)
+
+// Client supplied IDs are only kept when they are short and cannot break a log line
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// RequestIDMiddleware propagates the X-Request-ID header, or generates one, echoes it in the response
+// and attaches a logger carrying it to the request
+func RequestIDMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestID := c.GetHeader(RequestIDHeader)
+		if !validRequestID.MatchString(requestID) {
+			requestID = newRequestID()
+		}
+		c.Set(requestIDKey, requestID)
+		c.Set(loggerKey, logrus.WithField("request_id", requestID))
+		c.Header(RequestIDHeader, requestID)
+		c.Next()
+	}
+}
+
+// logger returns the logger of the request, carrying its ID when the middleware is used
+func logger(c *gin.Context) *logrus.Entry {
+	if entry, ok := c.Value(loggerKey).(*logrus.Entry); ok {
+		return entry
+	}
+	return logrus.NewEntry(logrus.StandardLogger())
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		logrus.Warnf("Failed to generate request ID: %v", err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,63 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestIDMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(RequestIDMiddleware())
+	r.GET("/id", func(c *gin.Context) {
+		c.String(http.StatusOK, c.GetString(requestIDKey))
+	})
+
+	t.Run("propagated", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/id", nil)
+		req.Header.Set(RequestIDHeader, "client-id-1")
+		r.ServeHTTP(w, req)
+		assert.Equal(t, "client-id-1", w.Header().Get(RequestIDHeader))
+		assert.Equal(t, "client-id-1", w.Body.String())
+	})
+
+	for name, header := range map[string]string{"generated": "", "replaced": "bad id\nwith newline"} {
+		t.Run(name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/id", nil)
+			req.Header.Set(RequestIDHeader, header)
+			r.ServeHTTP(w, req)
+			id := w.Header().Get(RequestIDHeader)
+			assert.Len(t, id, 32)
+			assert.Equal(t, id, w.Body.String())
+		})
+	}
+}
+
+func TestUpdateImageLogsRequestID(t *testing.T) {
+	hook := logtest.NewGlobal()
+	t.Cleanup(hook.Reset)
+
+	r, _ := newTestRouter(t)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/update?namespace=default&service=missing&image=nginx:1.0.0", nil)
+	req.Header.Set(RequestIDHeader, "trace-42")
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusInternalServerError, w.Code, w.Body.String())
+	assert.Equal(t, "trace-42", w.Header().Get(RequestIDHeader))
+
+	entry := hook.LastEntry()
+	require.NotNil(t, entry)
+	assert.Equal(t, logrus.ErrorLevel, entry.Level)
+	assert.Contains(t, entry.Message, "default/missing")
+	assert.Equal(t, "trace-42", entry.Data["request_id"])
+}
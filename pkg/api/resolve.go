@@ -0,0 +1,74 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/monlor/k8s-image-updater/pkg/updater"
+)
+
+// imageResolver selects the image the updater would roll out, set by SetResolver
+type imageResolver interface {
+	Resolve(ctx context.Context, image string, opts updater.ResolveOptions) (string, error)
+}
+
+var resolver imageResolver
+
+// SetResolver sets the updater ResolveImage selects images with
+func SetResolver(r imageResolver) {
+	resolver = r
+}
+
+// ResolveImage returns the image the updater would select for an image in a mode, without reading or changing
+// any cluster resource, e.g. for a CI pipeline rendering manifests
+func ResolveImage(c *gin.Context) {
+	image := c.Query("image")
+	if image == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "image is required"})
+		return
+	}
+	if resolver == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "image resolution is not available"})
+		return
+	}
+
+	opts := updater.ResolveOptions{
+		Mode:        c.DefaultQuery("mode", "release"),
+		AllowTags:   c.Query("allowTags"),
+		MinVersion:  c.Query("minVersion"),
+		PinDigest:   c.Query("pinDigest") == "true",
+		PreserveTag: c.Query("preserveTag") == "true",
+		SortOrder:   c.Query("sortOrder"),
+		DateFormat:  c.Query("dateFormat"),
+		Platform:    c.Query("platform"),
+	}
+	if opts.Mode == "date" && opts.DateFormat == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "dateFormat is required in date mode"})
+		return
+	}
+	resolved, err := resolver.Resolve(c.Request.Context(), image, opts)
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, updater.ErrUnknownMode):
+			status = http.StatusBadRequest
+		case errors.Is(err, updater.ErrRegistryNotAllowed):
+			status = http.StatusForbidden
+		case errors.Is(err, updater.ErrNoMatchingTags):
+			status = http.StatusNotFound
+		}
+		logger(c).Errorf("Failed to resolve image %s in %s mode: %v", image, opts.Mode, err)
+		c.JSON(status, gin.H{"ok": false, "message": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"ok":            true,
+		"image":         image,
+		"mode":          opts.Mode,
+		"resolvedImage": resolved,
+		"changed":       resolved != image,
+	})
+}
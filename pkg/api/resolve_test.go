@@ -0,0 +1,80 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/monlor/k8s-image-updater/pkg/updater"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeResolver struct {
+	opts updater.ResolveOptions
+	err  error
+}
+
+func (f *fakeResolver) Resolve(ctx context.Context, image string, opts updater.ResolveOptions) (string, error) {
+	f.opts = opts
+	if f.err != nil {
+		return "", f.err
+	}
+	if opts.Mode == "release" {
+		return "nginx:1.27.0", nil
+	}
+	return image, nil
+}
+
+func TestResolveImage(t *testing.T) {
+	r, clientset := newTestRouter(t)
+	fake := &fakeResolver{}
+	SetResolver(fake)
+	t.Cleanup(func() { SetResolver(nil) })
+	resolve := func(query string) (int, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/resolve"+query, nil))
+		var resp map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return w.Code, resp
+	}
+
+	code, resp := resolve("?image=nginx:1.25.0")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "nginx:1.27.0", resp["resolvedImage"])
+	assert.Equal(t, "release", resp["mode"])
+	assert.Equal(t, true, resp["changed"])
+
+	code, resp = resolve("?image=nginx:stable&mode=digest&allowTags=stable&preserveTag=true&platform=linux/arm64")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "nginx:stable", resp["resolvedImage"])
+	assert.Equal(t, false, resp["changed"])
+	assert.Equal(t, updater.ResolveOptions{Mode: "digest", AllowTags: "stable", PreserveTag: true, Platform: "linux/arm64"}, fake.opts)
+
+	code, _ = resolve("")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = resolve("?image=nginx:1.25.0&mode=date")
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	for err, want := range map[error]int{
+		fmt.Errorf("%w nightly", updater.ErrUnknownMode):         http.StatusBadRequest,
+		fmt.Errorf("%w: image x", updater.ErrRegistryNotAllowed): http.StatusForbidden,
+		fmt.Errorf("%w: image x", updater.ErrNoMatchingTags):     http.StatusNotFound,
+		fmt.Errorf("failed to list tags: connection refused"):    http.StatusInternalServerError,
+	} {
+		fake.err = err
+		code, resp = resolve("?image=nginx:1.25.0")
+		assert.Equal(t, want, code, err.Error())
+		assert.Equal(t, false, resp["ok"])
+	}
+
+	SetResolver(nil)
+	code, _ = resolve("?image=nginx:1.25.0")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+
+	// No cluster resource is read
+	assert.Empty(t, clientset.Actions())
+}
@@ -0,0 +1,90 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/monlor/k8s-image-updater/pkg/k8s"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Page size of ListResources when no limit is given, and the largest accepted
+const (
+	defaultListLimit = 100
+	maxListLimit     = 500
+)
+
+// ListResources lists a page of the resources of a kind enabled for auto-update. The mode and status filters
+// apply to the page read from the API server, so a page may hold fewer items than the limit.
+func ListResources(c *gin.Context) {
+	namespace := c.Query("namespace")
+	kind := normalizeKind(c.DefaultQuery("kind", "deployment"))
+	mode := c.Query("mode")
+	status := c.Query("status")
+
+	limit := defaultListLimit
+	if value := c.Query("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 || limit > maxListLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be a number between 1 and " + strconv.Itoa(maxListLimit)})
+			return
+		}
+	}
+
+	// Without namespace all namespaces are listed, leaving out those not allowed
+	if namespace != "" && !validateTarget(c, namespace, kind) {
+		return
+	}
+	// Pages come from a single list call, which would be cluster-wide
+	if namespace == "" && config.GlobalConfig.NamespacedRBAC {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "namespace is required with NAMESPACED_RBAC"})
+		return
+	}
+	if !validateKind(c, kind) {
+		return
+	}
+
+	client, ok := clusterClient(c)
+	if !ok {
+		return
+	}
+
+	page, listErr := client.ListResources(c.Request.Context(), kind, namespace, metav1.ListOptions{
+		LabelSelector: config.LabelEnabled + "=true",
+		Limit:         int64(limit),
+		Continue:      c.Query("continue"),
+	})
+	if listErr != nil {
+		logger(c).Errorf("Failed to list %ss: %v", kind, listErr)
+		status := http.StatusInternalServerError
+		if apierrors.IsResourceExpired(listErr) || apierrors.IsGone(listErr) {
+			status = http.StatusGone
+		} else if apierrors.IsBadRequest(listErr) {
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, gin.H{
+			"ok":      false,
+			"message": listErr.Error(),
+		})
+		return
+	}
+
+	items := []k8s.Resource{}
+	for _, item := range page.Items {
+		if !config.GlobalConfig.NamespaceAllowed(item.Namespace) {
+			continue
+		}
+		if (mode != "" && item.Mode != mode) || (status != "" && item.Status != status) {
+			continue
+		}
+		items = append(items, item)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"ok":       true,
+		"items":    items,
+		"continue": page.Continue,
+	})
+}
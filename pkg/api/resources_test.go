@@ -0,0 +1,204 @@
+package api
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"testing"
+
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/monlor/k8s-image-updater/pkg/k8s"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	appsv1client "k8s.io/client-go/kubernetes/typed/apps/v1"
+)
+
+// The fake clientset ignores Limit and Continue, pagingClientset paginates deployment lists like the API server
+type pagingClientset struct {
+	*fake.Clientset
+	lists int
+}
+
+func (c *pagingClientset) AppsV1() appsv1client.AppsV1Interface {
+	return pagingAppsV1{c.Clientset.AppsV1(), c}
+}
+
+type pagingAppsV1 struct {
+	appsv1client.AppsV1Interface
+	clientset *pagingClientset
+}
+
+func (a pagingAppsV1) Deployments(namespace string) appsv1client.DeploymentInterface {
+	return pagingDeployments{a.AppsV1Interface.Deployments(namespace), a.clientset}
+}
+
+type pagingDeployments struct {
+	appsv1client.DeploymentInterface
+	clientset *pagingClientset
+}
+
+func (d pagingDeployments) List(ctx context.Context, opts metav1.ListOptions) (*appsv1.DeploymentList, error) {
+	d.clientset.lists++
+	limit, token := opts.Limit, opts.Continue
+	opts.Limit, opts.Continue = 0, ""
+	list, err := d.DeploymentInterface.List(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// The API server returns items in key order
+	slices.SortFunc(list.Items, func(a, b appsv1.Deployment) int {
+		return cmp.Or(cmp.Compare(a.Namespace, b.Namespace), cmp.Compare(a.Name, b.Name))
+	})
+	start := 0
+	if token != "" {
+		if start, err = strconv.Atoi(token); err != nil || start > len(list.Items) {
+			return nil, apierrors.NewResourceExpired("continue token expired")
+		}
+	}
+	end := len(list.Items)
+	if limit > 0 && start+int(limit) < end {
+		end = start + int(limit)
+		list.Continue = strconv.Itoa(end)
+	}
+	list.Items = list.Items[start:end]
+	return list, nil
+}
+
+var _ kubernetes.Interface = &pagingClientset{}
+
+func newTestResource(namespace, name string, annotations map[string]string) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   namespace,
+			Labels:      map[string]string{config.LabelEnabled: "true"},
+			Annotations: annotations,
+		},
+		Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app", Image: "ghcr.io/org/" + name + ":1.0.0"}},
+		}}},
+	}
+}
+
+type listResponse struct {
+	Items    []k8s.Resource `json:"items"`
+	Continue string         `json:"continue"`
+}
+
+func listResources(t *testing.T, r http.Handler, query string) (int, listResponse) {
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/resources?"+query, nil))
+	var body listResponse
+	if w.Code == http.StatusOK {
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	}
+	return w.Code, body
+}
+
+func TestListResourcesPagination(t *testing.T) {
+	var objects []runtime.Object
+	for i := range 25 {
+		annotations := map[string]string{}
+		if i%5 == 0 {
+			annotations[config.AnnotationMode] = "digest"
+			annotations[config.AnnotationStatus] = config.StatusNoMatchingTags
+		}
+		objects = append(objects, newTestResource("default", fmt.Sprintf("app-%02d", i), annotations))
+	}
+	// Not enabled for auto-update
+	disabled := newTestResource("default", "disabled", nil)
+	disabled.Labels = nil
+	objects = append(objects, disabled)
+
+	r, _ := newTestRouter(t)
+	clientset := &pagingClientset{Clientset: fake.NewSimpleClientset(objects...)}
+	getClient = func(string) (*k8s.Client, error) { return k8s.NewClient(clientset), nil }
+
+	var names []string
+	token := ""
+	for {
+		code, page := listResources(t, r, "limit=10&continue="+token)
+		require.Equal(t, http.StatusOK, code)
+		assert.LessOrEqual(t, len(page.Items), 10)
+		for _, item := range page.Items {
+			names = append(names, item.Name)
+		}
+		if token = page.Continue; token == "" {
+			break
+		}
+	}
+	assert.Len(t, names, 25)
+	assert.Equal(t, "app-00", names[0])
+	assert.Equal(t, "app-24", names[24])
+	assert.Equal(t, 3, clientset.lists)
+
+	// Filters apply to each page
+	code, page := listResources(t, r, "limit=10&mode=digest")
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, page.Items, 2)
+	assert.Equal(t, []string{"app-00", "app-05"}, []string{page.Items[0].Name, page.Items[1].Name})
+	assert.Equal(t, config.StatusNoMatchingTags, page.Items[0].Status)
+	assert.Equal(t, "10", page.Continue)
+
+	code, page = listResources(t, r, "limit=10&continue=10&status="+config.StatusNoMatchingTags)
+	require.Equal(t, http.StatusOK, code)
+	assert.Len(t, page.Items, 2)
+
+	code, page = listResources(t, r, "mode=release")
+	require.Equal(t, http.StatusOK, code)
+	assert.Len(t, page.Items, 20)
+	assert.Empty(t, page.Continue)
+	assert.Equal(t, []k8s.ContainerImage{{Name: "app", Image: "ghcr.io/org/app-01:1.0.0"}}, page.Items[0].Containers)
+
+	code, _ = listResources(t, r, "continue=100")
+	assert.Equal(t, http.StatusGone, code)
+}
+
+func TestListResourcesValidation(t *testing.T) {
+	oldAllowed := config.GlobalConfig.AllowedNamespaces
+	config.GlobalConfig.AllowedNamespaces = "default"
+	defer func() { config.GlobalConfig.AllowedNamespaces = oldAllowed }()
+
+	r, _ := newTestRouter(t, newTestResource("default", "app", nil), newTestResource("kube-system", "dns", nil))
+
+	for _, query := range []string{"limit=0", "limit=1000", "limit=abc", "kind=pod"} {
+		code, _ := listResources(t, r, query)
+		assert.Equal(t, http.StatusBadRequest, code, query)
+	}
+	code, _ := listResources(t, r, "namespace=kube-system")
+	assert.Equal(t, http.StatusForbidden, code)
+
+	// Namespaces not allowed are left out of cluster wide lists
+	code, page := listResources(t, r, "")
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, page.Items, 1)
+	assert.Equal(t, "app", page.Items[0].Name)
+}
+
+func TestListResourcesNamespacedRBAC(t *testing.T) {
+	oldAllowed, oldNamespaced := config.GlobalConfig.AllowedNamespaces, config.GlobalConfig.NamespacedRBAC
+	config.GlobalConfig.AllowedNamespaces, config.GlobalConfig.NamespacedRBAC = "default", true
+	defer func() {
+		config.GlobalConfig.AllowedNamespaces, config.GlobalConfig.NamespacedRBAC = oldAllowed, oldNamespaced
+	}()
+
+	r, _ := newTestRouter(t, newTestResource("default", "app", nil))
+	code, _ := listResources(t, r, "")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, page := listResources(t, r, "namespace=default")
+	require.Equal(t, http.StatusOK, code)
+	assert.Len(t, page.Items, 1)
+}
@@ -0,0 +1,42 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/monlor/k8s-image-updater/pkg/status"
+	"github.com/monlor/k8s-image-updater/pkg/updater"
+)
+
+// GetStatus returns the results of the last check of the auto-updater, without querying the cluster or registries.
+// Resources are listed once the auto-updater has checked them.
+func GetStatus(c *gin.Context) {
+	namespace := c.Query("namespace")
+	cluster := c.Query("cluster")
+	kind := normalizeKind(c.Query("kind"))
+
+	if namespace != "" && !config.GlobalConfig.NamespaceAllowed(namespace) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"ok":      false,
+			"message": "Namespace " + namespace + " not allowed!",
+		})
+		return
+	}
+	if kind != "" && !validateKind(c, kind) {
+		return
+	}
+
+	items := []status.Result{}
+	for _, result := range status.List(namespace, kind) {
+		if config.GlobalConfig.NamespaceAllowed(result.Namespace) && (cluster == "" || result.Cluster == cluster) && kindAllowed(c, result.Kind) {
+			items = append(items, result)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"ok":    true,
+		"items": items,
+		// Why rollouts are frozen, null when they are not
+		"frozen": updater.Frozen(),
+	})
+}
@@ -0,0 +1,110 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/monlor/k8s-image-updater/pkg/status"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type statusResponse struct {
+	OK    bool            `json:"ok"`
+	Items []status.Result `json:"items"`
+}
+
+func getStatus(t *testing.T, r http.Handler, query string) (int, statusResponse) {
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/status"+query, nil))
+	var resp statusResponse
+	if w.Code == http.StatusOK {
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	}
+	return w.Code, resp
+}
+
+func TestGetStatus(t *testing.T) {
+	previous := status.SetIndex(status.NewIndex(0))
+	t.Cleanup(func() { status.SetIndex(previous) })
+	oldAllowed := config.GlobalConfig.AllowedNamespaces
+	config.GlobalConfig.AllowedNamespaces = "default,team-*"
+	t.Cleanup(func() { config.GlobalConfig.AllowedNamespaces = oldAllowed })
+	r, _ := newTestRouter(t)
+
+	code, resp := getStatus(t, r, "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.NotNil(t, resp.Items)
+	assert.Empty(t, resp.Items)
+
+	status.Set(status.Result{Kind: "deployment", Namespace: "default", Name: "web", Status: config.StatusPendingApproval,
+		Containers: []status.ContainerResult{{Container: "web", CurrentImage: "web:1.0.0", ProposedImage: "web:1.1.0"}}})
+	status.Set(status.Result{Kind: "statefulset", Namespace: "team-a", Name: "db"})
+	status.Set(status.Result{Kind: "deployment", Namespace: "kube-system", Name: "dns"})
+
+	code, resp = getStatus(t, r, "")
+	assert.Equal(t, http.StatusOK, code)
+	require.Len(t, resp.Items, 2)
+	assert.Equal(t, "web", resp.Items[0].Name)
+	assert.Equal(t, config.StatusPendingApproval, resp.Items[0].Status)
+	assert.Equal(t, "web:1.1.0", resp.Items[0].Containers[0].ProposedImage)
+	assert.Equal(t, "db", resp.Items[1].Name)
+
+	code, resp = getStatus(t, r, "?namespace=team-a")
+	assert.Equal(t, http.StatusOK, code)
+	require.Len(t, resp.Items, 1)
+	assert.Equal(t, "db", resp.Items[0].Name)
+
+	code, resp = getStatus(t, r, "?kind=Deployment")
+	assert.Equal(t, http.StatusOK, code)
+	require.Len(t, resp.Items, 1)
+	assert.Equal(t, "web", resp.Items[0].Name)
+
+	status.Set(status.Result{Cluster: "prod", Kind: "deployment", Namespace: "default", Name: "api"})
+	code, resp = getStatus(t, r, "?cluster=prod")
+	assert.Equal(t, http.StatusOK, code)
+	require.Len(t, resp.Items, 1)
+	assert.Equal(t, "api", resp.Items[0].Name)
+	assert.Equal(t, "prod", resp.Items[0].Cluster)
+
+	code, _ = getStatus(t, r, "?namespace=kube-system")
+	assert.Equal(t, http.StatusForbidden, code)
+	code, _ = getStatus(t, r, "?kind=pod")
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestGetStatusConcurrentWrites(t *testing.T) {
+	previous := status.SetIndex(status.NewIndex(100))
+	t.Cleanup(func() { status.SetIndex(previous) })
+	r, _ := newTestRouter(t)
+
+	var wg sync.WaitGroup
+	for w := range 4 {
+		wg.Add(2)
+		// Writes as the updater loop does while handlers read
+		go func() {
+			defer wg.Done()
+			for n := range 100 {
+				status.Set(status.Result{Kind: "deployment", Namespace: "default", Name: fmt.Sprintf("app-%d-%d", w, n),
+					Containers: []status.ContainerResult{{Container: "app", CurrentImage: "app:1.0.0"}}})
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for range 50 {
+				code, resp := getStatus(t, r, "?namespace=default&kind=deployment")
+				assert.Equal(t, http.StatusOK, code)
+				assert.LessOrEqual(t, len(resp.Items), 100)
+			}
+		}()
+	}
+	wg.Wait()
+
+	_, resp := getStatus(t, r, "")
+	assert.Len(t, resp.Items, 100)
+}
@@ -0,0 +1,65 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/monlor/k8s-image-updater/pkg/k8s"
+	"github.com/monlor/k8s-image-updater/pkg/verify"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// imageVerifier checks the signatures of images before the API rolls them out, set by SetVerifier
+type imageVerifier interface {
+	VerifyImages(ctx context.Context, client *k8s.Client, kind, namespace, name string, images []string) error
+	VerifyWorkloadImages(ctx context.Context, client *k8s.Client, kind, namespace, name string, meta *metav1.ObjectMeta, template *corev1.PodTemplateSpec, images []string) error
+}
+
+var verifier imageVerifier
+
+// SetVerifier sets the updater the update and approve endpoints verify images with, like the updater verifies the
+// images it rolls out
+func SetVerifier(v imageVerifier) {
+	verifier = v
+}
+
+// Check the signatures of images about to be set on a resource, writing the error response if one is not verified
+func imagesVerified(c *gin.Context, client *k8s.Client, kind, namespace, service string, images []string) bool {
+	if verifier == nil {
+		return true
+	}
+	err := verifier.VerifyImages(c.Request.Context(), client, kind, namespace, service, images)
+	if err == nil {
+		return true
+	}
+	logger(c).Errorf("Failed to verify images of %s %s/%s: %v", kind, namespace, service, err)
+	c.JSON(verifyErrorStatus(err), gin.H{
+		"ok":      false,
+		"message": err.Error(),
+	})
+	return false
+}
+
+// Returns the function verifying images on the resource a write reads, nil without a verifier
+func workloadVerifier(client *k8s.Client, kind, namespace, service string) k8s.VerifyFunc {
+	if verifier == nil {
+		return nil
+	}
+	return func(ctx context.Context, meta *metav1.ObjectMeta, template *corev1.PodTemplateSpec, images []string) error {
+		return verifier.VerifyWorkloadImages(ctx, client, kind, namespace, service, meta, template, images)
+	}
+}
+
+// The response status of a failed verification
+func verifyErrorStatus(err error) int {
+	if errors.Is(err, verify.ErrUnverified) {
+		return http.StatusForbidden
+	} else if apierrors.IsNotFound(err) {
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
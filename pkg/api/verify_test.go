@@ -0,0 +1,74 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/monlor/k8s-image-updater/pkg/k8s"
+	"github.com/monlor/k8s-image-updater/pkg/verify"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// fakeVerifier verifies only the listed images
+type fakeVerifier struct {
+	verified map[string]bool
+}
+
+func (f *fakeVerifier) VerifyImages(ctx context.Context, client *k8s.Client, kind, namespace, name string, images []string) error {
+	for _, image := range images {
+		if !f.verified[image] {
+			return fmt.Errorf("refusing to roll out %s: %w", image, verify.ErrUnverified)
+		}
+	}
+	return nil
+}
+
+func (f *fakeVerifier) VerifyWorkloadImages(ctx context.Context, client *k8s.Client, kind, namespace, name string, meta *metav1.ObjectMeta, template *corev1.PodTemplateSpec, images []string) error {
+	return f.VerifyImages(ctx, client, kind, namespace, name, images)
+}
+
+func TestUpdateVerifiesSignatures(t *testing.T) {
+	r, clientset := newTestRouter(t, &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default", Annotations: map[string]string{
+			config.AnnotationPendingImage: "ghcr.io/org/app:1.2.0",
+		}},
+		Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app", Image: "ghcr.io/org/app:1.0.0"}},
+		}}},
+	})
+	SetVerifier(&fakeVerifier{verified: map[string]bool{"ghcr.io/org/app:1.1.0": true}})
+	t.Cleanup(func() { SetVerifier(nil) })
+	image := func() string {
+		deploy, err := clientset.AppsV1().Deployments("default").Get(context.Background(), "app", metav1.GetOptions{})
+		require.NoError(t, err)
+		return deploy.Spec.Template.Spec.Containers[0].Image
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		url        string
+		wantStatus int
+		wantImage  string
+	}{
+		{"unverified update", http.MethodGet, "/api/v1/update?namespace=default&service=app&image=ghcr.io/org/app:1.3.0", http.StatusForbidden, "ghcr.io/org/app:1.0.0"},
+		{"unverified approval", http.MethodPost, "/api/v1/approve?namespace=default&service=app", http.StatusForbidden, "ghcr.io/org/app:1.0.0"},
+		{"verified update", http.MethodGet, "/api/v1/update?namespace=default&service=app&image=ghcr.io/org/app:1.1.0", http.StatusOK, "ghcr.io/org/app:1.1.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(tt.method, tt.url, nil))
+			assert.Equal(t, tt.wantStatus, w.Code, w.Body.String())
+			assert.Equal(t, tt.wantImage, image())
+		})
+	}
+}
@@ -0,0 +1,13 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/monlor/k8s-image-updater/pkg/version"
+)
+
+// Version returns the build information of the running binary
+func Version(c *gin.Context) {
+	c.JSON(http.StatusOK, version.Get())
+}
@@ -0,0 +1,38 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/monlor/k8s-image-updater/pkg/version"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVersion(t *testing.T) {
+	oldVersion, oldCommit, oldBuildDate := version.Version, version.Commit, version.BuildDate
+	version.Version, version.Commit, version.BuildDate = "v1.2.3", "abc1234", "2024-01-02T03:04:05Z"
+	t.Cleanup(func() { version.Version, version.Commit, version.BuildDate = oldVersion, oldCommit, oldBuildDate })
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/version", Version)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/version", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var info version.Info
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &info))
+	assert.Equal(t, version.Info{
+		Version:   "v1.2.3",
+		Commit:    "abc1234",
+		BuildDate: "2024-01-02T03:04:05Z",
+		GoVersion: runtime.Version(),
+		Modes:     []string{"release", "digest", "latest", "alphabetical", "date", "review"},
+	}, info)
+}
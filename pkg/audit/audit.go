@@ -0,0 +1,235 @@
+package audit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/monlor/k8s-image-updater/pkg/k8s"
+	"github.com/sirupsen/logrus"
+)
+
+// ActorAuto is the actor of updates applied by the auto-updater
+const ActorAuto = "auto"
+
+// ModeManual is the mode of updates requested through the API
+const ModeManual = "manual"
+
+// Actions recorded in the audit log
+const (
+	// The image of a container was changed
+	ActionUpdate = "update"
+	// The pods were restarted to pull the same image again
+	ActionRestart = "restart"
+	// The image change was committed to the write-back repository
+	ActionWriteBack = "write-back"
+	// The image was rolled out to the canary deployment
+	ActionCanary = "canary"
+	// The image was promoted from the canary to the primary deployment
+	ActionCanaryPromote = "canary-promote"
+	// The image failed to pull and the previous image was restored
+	ActionRevert = "revert"
+)
+
+// Entry is a single audit record, written as a JSON line
+type Entry struct {
+	Time      time.Time `json:"time"`
+	Actor     string    `json:"actor"`
+	Action    string    `json:"action"`
+	Kind      string    `json:"kind"`
+	Namespace string    `json:"namespace"`
+	Name      string    `json:"name"`
+	Container string    `json:"container,omitempty"`
+	OldImage  string    `json:"oldImage,omitempty"`
+	NewImage  string    `json:"newImage,omitempty"`
+	Mode      string    `json:"mode,omitempty"`
+}
+
+// APIKeyActor identifies a caller by a hash of its API key, the key itself is never written
+func APIKeyActor(source, apiKey string) string {
+	sum := sha256.Sum256([]byte(apiKey))
+	return source + ":" + hex.EncodeToString(sum[:])[:12]
+}
+
+// Logger appends audit entries to a writer, or to a file rotated by size
+type Logger struct {
+	mu  sync.Mutex
+	out io.Writer
+
+	// Set when writing to a file
+	file       *os.File
+	path       string
+	size       int64
+	maxSize    int64
+	maxBackups int
+}
+
+// NewWriterLogger creates a logger writing to w, e.g. stdout
+func NewWriterLogger(w io.Writer) *Logger {
+	return &Logger{out: w}
+}
+
+// NewFileLogger creates a logger appending to path. Once the file exceeds maxSize bytes it is
+// renamed to path.1, older files shifted up to path.<maxBackups>, and a new file is started.
+func NewFileLogger(path string, maxSize int64, maxBackups int) (*Logger, error) {
+	l := &Logger{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Logger) open() error {
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log %s: %v", l.path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat audit log %s: %v", l.path, err)
+	}
+	l.file, l.out, l.size = file, file, info.Size()
+	return nil
+}
+
+func (l *Logger) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return fmt.Errorf("failed to close audit log %s: %v", l.path, err)
+	}
+	// Keep appending to the same file when it cannot be renamed
+	err := l.shiftBackups()
+	if openErr := l.open(); openErr != nil {
+		return openErr
+	}
+	return err
+}
+
+// shiftBackups renames path.N-1 to path.N and path to path.1, overwriting the oldest backup
+func (l *Logger) shiftBackups() error {
+	if l.maxBackups <= 0 {
+		if err := os.Remove(l.path); err != nil {
+			return fmt.Errorf("failed to rotate audit log %s: %v", l.path, err)
+		}
+		return nil
+	}
+	for i := l.maxBackups - 1; i >= 1; i-- {
+		if err := os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to rotate audit log %s: %v", l.path, err)
+		}
+	}
+	if err := os.Rename(l.path, l.path+".1"); err != nil {
+		return fmt.Errorf("failed to rotate audit log %s: %v", l.path, err)
+	}
+	return nil
+}
+
+// Log writes an entry as a single line and syncs it to disk. Failures are logged, they never block an update.
+func (l *Logger) Log(entry Entry) {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now().UTC()
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		logrus.Errorf("Failed to encode audit entry: %v", err)
+		return
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file != nil && l.maxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			logrus.Errorf("Failed to rotate audit log: %v", err)
+		}
+	}
+	n, err := l.out.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		logrus.Errorf("Failed to write audit entry: %v", err)
+		return
+	}
+	if l.file != nil {
+		if err := l.file.Sync(); err != nil {
+			logrus.Errorf("Failed to sync audit log: %v", err)
+		}
+	}
+}
+
+// Close closes the audit log file, if any
+func (l *Logger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+var (
+	stdMu sync.RWMutex
+	std   = NewWriterLogger(os.Stdout)
+)
+
+// Init configures the audit log from AUDIT_LOG_FILE, stdout when it is not set
+func Init(cfg *config.Config) error {
+	if cfg.AuditLogFile == "" {
+		SetLogger(NewWriterLogger(os.Stdout))
+		return nil
+	}
+	l, err := NewFileLogger(cfg.AuditLogFile, int64(cfg.AuditLogMaxSizeMB)<<20, cfg.AuditLogMaxBackups)
+	if err != nil {
+		return err
+	}
+	SetLogger(l)
+	return nil
+}
+
+// SetLogger replaces the audit logger used by Log, returning the previous one
+func SetLogger(l *Logger) *Logger {
+	stdMu.Lock()
+	defer stdMu.Unlock()
+	previous := std
+	std = l
+	return previous
+}
+
+// Log writes an entry to the audit log
+func Log(entry Entry) {
+	stdMu.RLock()
+	l := std
+	stdMu.RUnlock()
+	l.Log(entry)
+}
+
+// LogPlan records an image update applied on request of the API, nothing is recorded when it was up to date
+func LogPlan(actor string, plan *k8s.ImagePlan) {
+	var action string
+	switch plan.Action {
+	case k8s.ImageActionUpdate:
+		action = ActionUpdate
+	case k8s.ImageActionRestart:
+		action = ActionRestart
+	default:
+		return
+	}
+	Log(Entry{
+		Actor:     actor,
+		Action:    action,
+		Kind:      plan.Kind,
+		Namespace: plan.Namespace,
+		Name:      plan.Name,
+		Container: plan.Container,
+		OldImage:  plan.CurrentImage,
+		NewImage:  plan.Image,
+		Mode:      ModeManual,
+	})
+}
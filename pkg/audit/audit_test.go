@@ -0,0 +1,80 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Decode the JSON lines of an audit log
+func readEntries(t *testing.T, data []byte) []Entry {
+	var entries []Entry
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		var entry Entry
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &entry))
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestLoggerWritesJSONLines(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewWriterLogger(&buf)
+	at := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	l.Log(Entry{Time: at, Actor: ActorAuto, Action: ActionUpdate, Kind: "deployment", Namespace: "default", Name: "app", Container: "app", OldImage: "app:1.0.0", NewImage: "app:1.1.0", Mode: "release"})
+	l.Log(Entry{Actor: ActorAuto, Action: ActionRestart, Kind: "deployment", Namespace: "default", Name: "app"})
+
+	entries := readEntries(t, buf.Bytes())
+	require.Len(t, entries, 2)
+	assert.Equal(t, Entry{Time: at, Actor: ActorAuto, Action: ActionUpdate, Kind: "deployment", Namespace: "default", Name: "app", Container: "app", OldImage: "app:1.0.0", NewImage: "app:1.1.0", Mode: "release"}, entries[0])
+	assert.False(t, entries[1].Time.IsZero())
+}
+
+func TestFileLoggerRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	entry := Entry{Time: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), Actor: ActorAuto, Action: ActionUpdate, Kind: "deployment", Namespace: "default", Name: "app", NewImage: "app:1.1.0"}
+	line, err := json.Marshal(entry)
+	require.NoError(t, err)
+
+	// Two entries fit in a file, two backups are kept
+	l, err := NewFileLogger(path, int64(2*(len(line)+1)), 2)
+	require.NoError(t, err)
+	for range 7 {
+		l.Log(entry)
+	}
+	require.NoError(t, l.Close())
+
+	for file, want := range map[string]int{path: 1, path + ".1": 2, path + ".2": 2} {
+		data, err := os.ReadFile(file)
+		require.NoError(t, err)
+		assert.Len(t, readEntries(t, data), want, file)
+	}
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+
+	// Reopening appends to the existing file
+	l, err = NewFileLogger(path, 0, 2)
+	require.NoError(t, err)
+	l.Log(entry)
+	require.NoError(t, l.Close())
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Len(t, readEntries(t, data), 2)
+}
+
+func TestAPIKeyActor(t *testing.T) {
+	actor := APIKeyActor("api", "secret-key")
+	assert.True(t, strings.HasPrefix(actor, "api:"))
+	assert.NotContains(t, actor, "secret-key")
+	assert.Equal(t, actor, APIKeyActor("api", "secret-key"))
+	assert.NotEqual(t, actor, APIKeyActor("api", "other-key"))
+}
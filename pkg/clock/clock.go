@@ -0,0 +1,98 @@
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the current time, replaced by a Fake in tests
+type Clock interface {
+	Now() time.Time
+	// After sends the time on the returned channel once d has elapsed
+	After(d time.Duration) <-chan time.Time
+}
+
+// Real is the system clock
+type Real struct{}
+
+// Now returns the current system time
+func (Real) Now() time.Time {
+	return time.Now()
+}
+
+// After waits for d on the system clock
+func (Real) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// Fake is a clock that only moves when set or advanced
+type Fake struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []waiter
+}
+
+// waiter is a channel returned by After, sent to once the clock reaches its deadline
+type waiter struct {
+	deadline time.Time
+	ch       chan time.Time
+}
+
+// NewFake creates a fake clock stopped at now
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now}
+}
+
+// Now returns the time the clock was last set to
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+// Set moves the clock to now
+func (f *Fake) Set(now time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = now
+	f.fire()
+}
+
+// Advance moves the clock forward by d
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+	f.fire()
+}
+
+// After returns a channel sent to once the clock is set or advanced by d or more
+func (f *Fake) After(d time.Duration) <-chan time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	f.waiters = append(f.waiters, waiter{deadline: f.now.Add(d), ch: ch})
+	f.fire()
+	return ch
+}
+
+// Waiters returns the number of channels returned by After whose deadline is not reached yet, for tests to
+// advance the clock once the code under test waits
+func (f *Fake) Waiters() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.waiters)
+}
+
+// fire sends the time to the waiters whose deadline is reached, with the lock held
+func (f *Fake) fire() {
+	waiting := f.waiters[:0]
+	for _, w := range f.waiters {
+		if w.deadline.After(f.now) {
+			waiting = append(waiting, w)
+		} else {
+			w.ch <- f.now
+		}
+	}
+	f.waiters = waiting
+}
@@ -0,0 +1,53 @@
+package clock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFake(t *testing.T) {
+	start := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	f := NewFake(start)
+	assert.Equal(t, start, f.Now())
+
+	f.Advance(90 * time.Second)
+	assert.Equal(t, start.Add(90*time.Second), f.Now())
+
+	f.Set(start)
+	assert.Equal(t, start, f.Now())
+}
+
+func TestFakeAfter(t *testing.T) {
+	start := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	f := NewFake(start)
+	ch := f.After(time.Minute)
+
+	f.Advance(59 * time.Second)
+	select {
+	case <-ch:
+		t.Fatal("fired before the deadline")
+	default:
+	}
+	assert.Equal(t, 1, f.Waiters())
+
+	f.Advance(time.Second)
+	select {
+	case now := <-ch:
+		assert.Equal(t, start.Add(time.Minute), now)
+	default:
+		t.Fatal("not fired at the deadline")
+	}
+
+	assert.Zero(t, f.Waiters())
+
+	// A deadline already reached fires at once
+	assert.Equal(t, start.Add(time.Minute), <-f.After(0))
+}
+
+func TestReal(t *testing.T) {
+	before := time.Now()
+	now := Real{}.Now()
+	assert.False(t, now.Before(before))
+}
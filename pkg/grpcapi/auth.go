@@ -0,0 +1,121 @@
+package grpcapi
+
+import (
+	"context"
+	"crypto/subtle"
+	"slices"
+	"strings"
+
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/monlor/k8s-image-updater/pkg/audit"
+	"github.com/monlor/k8s-image-updater/pkg/grpcapi/pb"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Keys of the values set in the context of a request in the k8s-token auth mode
+type contextKey int
+
+const (
+	// Kubernetes user of the request
+	userKey contextKey = iota
+	// Kinds the user may list, for ListManaged
+	kindsKey
+)
+
+// AuthInterceptor checks the x-api-key metadata, or the bearer token of the authorization metadata in the
+// k8s-token auth mode, mirroring api.AuthMiddleware
+func (s *Server) AuthInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if mode, _ := config.GlobalConfig.AuthMode(); mode == config.AuthModeK8sToken {
+			ctx, err := s.authorizeToken(ctx, req)
+			if err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}
+		// Compared in constant time so the key cannot be guessed from response times
+		if subtle.ConstantTimeCompare([]byte(requestAPIKey(ctx)), []byte(config.GlobalConfig.APIKey)) != 1 {
+			return nil, status.Error(codes.Unauthenticated, "Invalid API key")
+		}
+		return handler(ctx, req)
+	}
+}
+
+// authorizeToken authenticates the bearer token of a request with a TokenReview and authorizes its user with a
+// SubjectAccessReview: update on the target of Update, list on the target of Check, and list on each kind of
+// ListManaged, which only returns the kinds the user may list
+func (s *Server) authorizeToken(ctx context.Context, req any) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	var token string
+	if values := md.Get("authorization"); len(values) > 0 {
+		token, _ = strings.CutPrefix(values[0], "Bearer ")
+		token = strings.TrimSpace(token)
+	}
+	if token == "" {
+		return nil, status.Error(codes.Unauthenticated, "Missing bearer token")
+	}
+	user, authenticated, err := s.k8sClient.ReviewToken(ctx, token)
+	if err != nil {
+		logrus.Errorf("Token review failed: %v", err)
+		return nil, status.Error(codes.Internal, "Failed to review token")
+	}
+	if !authenticated {
+		return nil, status.Error(codes.Unauthenticated, "Invalid token")
+	}
+
+	verb, namespace, kinds := "list", "", config.GlobalConfig.Kinds()
+	switch r := req.(type) {
+	case *pb.UpdateRequest:
+		verb, namespace, kinds = "update", r.Namespace, []string{normalizeKind(r.Kind)}
+	case *pb.CheckRequest:
+		namespace, kinds = r.Namespace, []string{normalizeKind(r.Kind)}
+	case *pb.ListManagedRequest:
+		namespace = r.Namespace
+	}
+	var allowedKinds []string
+	var denied error
+	for _, kind := range kinds {
+		allowed, reason, err := s.k8sClient.Authorize(ctx, user, namespace, verb, kind)
+		if err != nil {
+			logrus.Errorf("Access review failed: %v", err)
+			return nil, status.Error(codes.Internal, "Failed to review access")
+		}
+		if allowed {
+			allowedKinds = append(allowedKinds, kind)
+			continue
+		}
+		if denied == nil {
+			message := "User " + user.Username + " cannot " + verb + " " + kind + "s"
+			if namespace != "" {
+				message += " in namespace " + namespace
+			}
+			if reason != "" {
+				message += ": " + reason
+			}
+			denied = status.Error(codes.PermissionDenied, message)
+		}
+	}
+	if len(allowedKinds) == 0 {
+		return nil, denied
+	}
+	ctx = context.WithValue(ctx, userKey, user.Username)
+	return context.WithValue(ctx, kindsKey, allowedKinds), nil
+}
+
+// kindAllowed reports whether the user of a request may list a kind, every kind is outside the k8s-token auth mode
+func kindAllowed(ctx context.Context, kind string) bool {
+	kinds, ok := ctx.Value(kindsKey).([]string)
+	return !ok || slices.Contains(kinds, kind)
+}
+
+// actor identifies the caller in the audit log, by its kubernetes user or a hash of its API key
+func actor(ctx context.Context) string {
+	if user, _ := ctx.Value(userKey).(string); user != "" {
+		return "grpc:" + user
+	}
+	return audit.APIKeyActor("grpc", requestAPIKey(ctx))
+}
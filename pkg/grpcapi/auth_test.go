@@ -0,0 +1,77 @@
+package grpcapi
+
+import (
+	"context"
+	"testing"
+
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/monlor/k8s-image-updater/pkg/grpcapi/pb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	appsv1 "k8s.io/api/apps/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestAuthInterceptorK8sToken(t *testing.T) {
+	oldMode, oldKey := config.GlobalConfig.APIAuthMode, config.GlobalConfig.APIKey
+	config.GlobalConfig.APIAuthMode = "k8s-token"
+	// An empty API key must not let requests through
+	config.GlobalConfig.APIKey = ""
+	t.Cleanup(func() { config.GlobalConfig.APIAuthMode, config.GlobalConfig.APIKey = oldMode, oldKey })
+
+	meta := metav1.ObjectMeta{Name: "app", Namespace: "default", Labels: map[string]string{config.LabelEnabled: "true"}}
+	template := corev1.PodTemplateSpec{Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "nginx:1.26"}}}}
+	clientset := fake.NewSimpleClientset(
+		&appsv1.Deployment{ObjectMeta: meta, Spec: appsv1.DeploymentSpec{Template: template}},
+		&appsv1.StatefulSet{ObjectMeta: meta, Spec: appsv1.StatefulSetSpec{Template: template}},
+	)
+	// The token "deployer-token" belongs to a service account allowed to list and update deployments in default
+	clientset.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authenticationv1.TokenReview)
+		if review.Spec.Token == "deployer-token" {
+			review.Status.Authenticated = true
+			review.Status.User = authenticationv1.UserInfo{Username: "system:serviceaccount:default:deployer"}
+		}
+		return true, review, nil
+	})
+	clientset.PrependReactor("create", "subjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+		attributes := review.Spec.ResourceAttributes
+		review.Status.Allowed = attributes.Namespace == "default" && attributes.Group == "apps" && attributes.Resource == "deployments"
+		return true, review, nil
+	})
+	client := newTestClient(t, clientset)
+	withToken := func(token string) context.Context {
+		return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+token)
+	}
+
+	_, err := client.ListManaged(context.Background(), &pb.ListManagedRequest{Namespace: "default"})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = client.ListManaged(withToken("other-token"), &pb.ListManagedRequest{Namespace: "default"})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// Only the kinds the user may list are returned
+	resp, err := client.ListManaged(withToken("deployer-token"), &pb.ListManagedRequest{Namespace: "default"})
+	require.NoError(t, err)
+	require.Len(t, resp.Resources, 1)
+	assert.Equal(t, "deployment", resp.Resources[0].Kind)
+	_, err = client.ListManaged(withToken("deployer-token"), &pb.ListManagedRequest{})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = client.Update(withToken("deployer-token"), &pb.UpdateRequest{Namespace: "default", Service: "app", Kind: "statefulset", Image: "nginx:1.27"})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = client.Update(withToken("deployer-token"), &pb.UpdateRequest{Namespace: "default", Service: "app", Image: "nginx:1.27"})
+	require.NoError(t, err)
+	deploy, err := clientset.AppsV1().Deployments("default").Get(context.Background(), "app", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "nginx:1.27", deploy.Spec.Template.Spec.Containers[0].Image)
+}
@@ -0,0 +1,183 @@
+package grpcapi
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative pb/updater.proto
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/monlor/k8s-image-updater/pkg/audit"
+	"github.com/monlor/k8s-image-updater/pkg/grpcapi/pb"
+	"github.com/monlor/k8s-image-updater/pkg/k8s"
+	"github.com/monlor/k8s-image-updater/pkg/registry"
+	"github.com/monlor/k8s-image-updater/pkg/updater"
+	"github.com/monlor/k8s-image-updater/pkg/verify"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// Server implements the ImageUpdater gRPC service on top of the shared k8s client and updater
+type Server struct {
+	pb.UnimplementedImageUpdaterServer
+	k8sClient *k8s.Client
+	updater   *updater.Updater
+}
+
+func NewServer(k8sClient *k8s.Client, imageUpdater *updater.Updater) *Server {
+	return &Server{
+		k8sClient: k8sClient,
+		updater:   imageUpdater,
+	}
+}
+
+// NewGRPCServer creates a gRPC server with authentication and registers the service
+func NewGRPCServer(srv *Server) *grpc.Server {
+	s := grpc.NewServer(grpc.UnaryInterceptor(srv.AuthInterceptor()))
+	pb.RegisterImageUpdaterServer(s, srv)
+	return s
+}
+
+// requestAPIKey returns the x-api-key metadata of a request
+func requestAPIKey(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if values := md.Get("x-api-key"); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// normalizeKind resolves the kind of a request like the HTTP API, deployment when it is empty
+func normalizeKind(kind string) string {
+	if strings.TrimSpace(kind) == "" {
+		return "deployment"
+	}
+	return k8s.NormalizeKind(kind)
+}
+
+// validateKind checks a normalized kind is one of the HTTP API, or an OpenKruise kind with ENABLE_KRUISE
+func validateKind(kind string) error {
+	if !slices.Contains(config.GlobalConfig.Kinds(), kind) {
+		return status.Errorf(codes.InvalidArgument, "kind must be one of: %s", strings.Join(config.GlobalConfig.Kinds(), ", "))
+	}
+	return nil
+}
+
+// Validate the target of a request, returning the normalized kind
+func validateTarget(namespace, service, kind string) (string, error) {
+	kind = normalizeKind(kind)
+	if namespace == "" || service == "" {
+		return "", status.Error(codes.InvalidArgument, "namespace and service are required")
+	}
+	if !config.GlobalConfig.NamespaceAllowed(namespace) {
+		return "", status.Errorf(codes.PermissionDenied, "Namespace %s not allowed!", namespace)
+	}
+	if err := validateKind(kind); err != nil {
+		return "", err
+	}
+	return kind, nil
+}
+
+// Convert a kubernetes error into a gRPC status
+func toStatus(err error) error {
+	if apierrors.IsNotFound(err) {
+		return status.Error(codes.NotFound, err.Error())
+	}
+	if errors.Is(err, verify.ErrUnverified) {
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+func (s *Server) Check(ctx context.Context, req *pb.CheckRequest) (*pb.CheckResponse, error) {
+	kind, err := validateTarget(req.Namespace, req.Service, req.Kind)
+	if err != nil {
+		return nil, err
+	}
+
+	results, err := s.updater.Check(ctx, kind, req.Namespace, req.Service)
+	if err != nil {
+		logrus.Errorf("Failed to check %s %s/%s: %v", kind, req.Namespace, req.Service, err)
+		return nil, toStatus(err)
+	}
+
+	resp := &pb.CheckResponse{}
+	for _, result := range results {
+		resp.Containers = append(resp.Containers, &pb.ContainerCheck{
+			Container:       result.Container,
+			CurrentImage:    result.CurrentImage,
+			NewImage:        result.NewImage,
+			UpdateAvailable: result.UpdateAvailable,
+			Error:           result.Error,
+		})
+	}
+	return resp, nil
+}
+
+func (s *Server) Update(ctx context.Context, req *pb.UpdateRequest) (*pb.UpdateResponse, error) {
+	if req.Image == "" {
+		return nil, status.Error(codes.InvalidArgument, "namespace, service, and image are required")
+	}
+	kind, err := validateTarget(req.Namespace, req.Service, req.Kind)
+	if err != nil {
+		return nil, err
+	}
+	if !registry.ImageRegistryAllowed(req.Image) {
+		return nil, status.Errorf(codes.PermissionDenied, "Registry of image %s not allowed!", req.Image)
+	}
+
+	if s.updater != nil {
+		if err := s.updater.VerifyImages(ctx, s.k8sClient, kind, req.Namespace, req.Service, []string{req.Image}); err != nil {
+			logrus.Errorf("Failed to verify image of %s %s/%s: %v", kind, req.Namespace, req.Service, err)
+			return nil, toStatus(err)
+		}
+	}
+
+	plan, err := s.k8sClient.ApplyImageUpdate(kind, req.Namespace, req.Service, req.Container, req.Image, "")
+	if err != nil {
+		logrus.Errorf("Failed to update %s %s/%s: %v", kind, req.Namespace, req.Service, err)
+		return nil, toStatus(err)
+	}
+	audit.LogPlan(actor(ctx), plan)
+
+	return &pb.UpdateResponse{Ok: true, Message: plan.Message()}, nil
+}
+
+func (s *Server) ListManaged(ctx context.Context, req *pb.ListManagedRequest) (*pb.ListManagedResponse, error) {
+	if req.Namespace != "" && !config.GlobalConfig.NamespaceAllowed(req.Namespace) {
+		return nil, status.Errorf(codes.PermissionDenied, "Namespace %s not allowed!", req.Namespace)
+	}
+
+	resources, err := s.updater.ListManaged(ctx, req.Namespace)
+	if err != nil {
+		logrus.Errorf("Failed to list managed resources: %v", err)
+		return nil, toStatus(err)
+	}
+
+	resp := &pb.ListManagedResponse{}
+	for _, resource := range resources {
+		if !kindAllowed(ctx, resource.Kind) {
+			continue
+		}
+		managed := &pb.ManagedResource{
+			Kind:      resource.Kind,
+			Namespace: resource.Namespace,
+			Name:      resource.Name,
+			Mode:      resource.Mode,
+		}
+		for _, container := range resource.Containers {
+			managed.Containers = append(managed.Containers, &pb.Container{
+				Name:  container.Name,
+				Image: container.Image,
+			})
+		}
+		resp.Resources = append(resp.Resources, managed)
+	}
+	return resp, nil
+}
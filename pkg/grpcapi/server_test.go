@@ -0,0 +1,255 @@
+package grpcapi
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	ggcrregistry "github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/monlor/k8s-image-updater/pkg/grpcapi/pb"
+	"github.com/monlor/k8s-image-updater/pkg/k8s"
+	"github.com/monlor/k8s-image-updater/pkg/registry"
+	"github.com/monlor/k8s-image-updater/pkg/updater"
+	"github.com/monlor/k8s-image-updater/pkg/verify"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// Start an in-memory registry serving the given tags of a single repository
+func newTestRegistry(t *testing.T, repository string, tags ...string) string {
+	server := httptest.NewServer(ggcrregistry.New(ggcrregistry.Logger(log.New(io.Discard, "", 0))))
+	t.Cleanup(server.Close)
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	img, err := random.Image(256, 1)
+	require.NoError(t, err)
+	for _, tag := range tags {
+		ref, err := name.ParseReference(host + "/" + repository + ":" + tag)
+		require.NoError(t, err)
+		require.NoError(t, remote.Write(ref, img))
+	}
+	return host
+}
+
+func newTestClient(t *testing.T, clientset *fake.Clientset) pb.ImageUpdaterClient {
+	k8sClient := k8s.NewClient(clientset)
+	return serveTestClient(t, NewServer(k8sClient, updater.NewUpdaterWithClient(k8sClient)))
+}
+
+// Serve a server in memory and return a client connected to it
+func serveTestClient(t *testing.T, server *Server) pb.ImageUpdaterClient {
+	srv := NewGRPCServer(server)
+
+	lis := bufconn.Listen(1024 * 1024)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return pb.NewImageUpdaterClient(conn)
+}
+
+func TestServer(t *testing.T) {
+	oldKey := config.GlobalConfig.APIKey
+	config.GlobalConfig.APIKey = "test-key"
+	defer func() { config.GlobalConfig.APIKey = oldKey }()
+
+	host := newTestRegistry(t, "app", "1.0.0", "1.1.0")
+	clientset := fake.NewSimpleClientset(&appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "app",
+			Namespace:   "default",
+			Labels:      map[string]string{config.LabelEnabled: "true"},
+			Annotations: map[string]string{config.AnnotationMode: "release"},
+		},
+		Spec: appsv1.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "app", Image: host + "/app:1.0.0"}},
+				},
+			},
+		},
+	})
+	client := newTestClient(t, clientset)
+
+	t.Run("rejects missing api key", func(t *testing.T) {
+		_, err := client.ListManaged(context.Background(), &pb.ListManagedRequest{})
+		assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	})
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-api-key", "test-key")
+
+	t.Run("list managed", func(t *testing.T) {
+		resp, err := client.ListManaged(ctx, &pb.ListManagedRequest{})
+		require.NoError(t, err)
+		require.Len(t, resp.Resources, 1)
+		assert.Equal(t, "deployment", resp.Resources[0].Kind)
+		assert.Equal(t, "release", resp.Resources[0].Mode)
+		assert.Equal(t, host+"/app:1.0.0", resp.Resources[0].Containers[0].Image)
+	})
+
+	t.Run("check", func(t *testing.T) {
+		resp, err := client.Check(ctx, &pb.CheckRequest{Namespace: "default", Service: "app"})
+		require.NoError(t, err)
+		require.Len(t, resp.Containers, 1)
+		assert.True(t, resp.Containers[0].UpdateAvailable)
+		assert.Equal(t, host+"/app:1.1.0", resp.Containers[0].NewImage)
+
+		// Checking must not modify the resource
+		deploy, err := clientset.AppsV1().Deployments("default").Get(ctx, "app", metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, host+"/app:1.0.0", deploy.Spec.Template.Spec.Containers[0].Image)
+	})
+
+	t.Run("check not found", func(t *testing.T) {
+		_, err := client.Check(ctx, &pb.CheckRequest{Namespace: "default", Service: "missing"})
+		assert.Equal(t, codes.NotFound, status.Code(err))
+	})
+
+	t.Run("update", func(t *testing.T) {
+		resp, err := client.Update(ctx, &pb.UpdateRequest{Namespace: "default", Service: "app", Image: "nginx:1.27"})
+		require.NoError(t, err)
+		assert.True(t, resp.Ok)
+
+		deploy, err := clientset.AppsV1().Deployments("default").Get(ctx, "app", metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, "nginx:1.27", deploy.Spec.Template.Spec.Containers[0].Image)
+	})
+
+	t.Run("update invalid kind", func(t *testing.T) {
+		_, err := client.Update(ctx, &pb.UpdateRequest{Namespace: "default", Service: "app", Kind: "job", Image: "nginx:1.27"})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+
+	t.Run("update kind alias", func(t *testing.T) {
+		// Kinds are resolved like in the HTTP API
+		resp, err := client.Update(ctx, &pb.UpdateRequest{Namespace: "default", Service: "app", Kind: "Deploy", Image: "nginx:1.27.1"})
+		require.NoError(t, err)
+		assert.True(t, resp.Ok)
+	})
+
+	t.Run("update disallowed registry", func(t *testing.T) {
+		oldRegistries := config.GlobalConfig.AllowedRegistries
+		config.GlobalConfig.AllowedRegistries = "ghcr.io"
+		defer func() { config.GlobalConfig.AllowedRegistries = oldRegistries }()
+
+		_, err := client.Update(ctx, &pb.UpdateRequest{Namespace: "default", Service: "app", Image: "nginx:1.28"})
+		assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	})
+}
+
+// rejectingVerifier verifies no image
+type rejectingVerifier struct{}
+
+func (rejectingVerifier) Verify(ctx context.Context, image string, registryClient *registry.RegistryClient) error {
+	return fmt.Errorf("%w: %s", verify.ErrUnverified, image)
+}
+
+func TestUpdateVerifiesSignatures(t *testing.T) {
+	oldKey := config.GlobalConfig.APIKey
+	config.GlobalConfig.APIKey = "test-key"
+	defer func() { config.GlobalConfig.APIKey = oldKey }()
+
+	clientset := fake.NewSimpleClientset(&appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app", Image: "ghcr.io/org/app:1.0.0"}},
+		}}},
+	})
+	k8sClient := k8s.NewClient(clientset)
+	imageUpdater := updater.NewUpdaterWithClient(k8sClient)
+	imageUpdater.SetVerifier(rejectingVerifier{})
+	client := serveTestClient(t, NewServer(k8sClient, imageUpdater))
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-api-key", "test-key")
+	_, err := client.Update(ctx, &pb.UpdateRequest{Namespace: "default", Service: "app", Image: "ghcr.io/org/app:1.1.0"})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	deploy, err := clientset.AppsV1().Deployments("default").Get(context.Background(), "app", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "ghcr.io/org/app:1.0.0", deploy.Spec.Template.Spec.Containers[0].Image)
+}
+
+func TestServerKruiseWorkloads(t *testing.T) {
+	oldKey, oldKruise := config.GlobalConfig.APIKey, config.GlobalConfig.EnableKruise
+	config.GlobalConfig.APIKey = "test-key"
+	t.Cleanup(func() { config.GlobalConfig.APIKey, config.GlobalConfig.EnableKruise = oldKey, oldKruise })
+
+	host := newTestRegistry(t, "app", "1.0.0", "1.1.0")
+	cloneSetGVR := k8s.KruiseResources[k8s.KindCloneSet]
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		cloneSetGVR: "CloneSetList",
+		k8s.KruiseResources[k8s.KindAdvancedStatefulSet]: "StatefulSetList",
+	}, &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "apps.kruise.io/v1alpha1",
+		"kind":       "CloneSet",
+		"metadata": map[string]interface{}{
+			"name":        "web",
+			"namespace":   "default",
+			"labels":      map[string]interface{}{config.LabelEnabled: "true"},
+			"annotations": map[string]interface{}{config.AnnotationMode: "release"},
+		},
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"spec": map[string]interface{}{
+					"containers": []interface{}{map[string]interface{}{"name": "app", "image": host + "/app:1.0.0"}},
+				},
+			},
+		},
+	}})
+	k8sClient := k8s.NewClient(fake.NewSimpleClientset())
+	k8sClient.SetDynamicClient(dynamicClient)
+	client := serveTestClient(t, NewServer(k8sClient, updater.NewUpdaterWithClient(k8sClient)))
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-api-key", "test-key")
+
+	// Without ENABLE_KRUISE the kind is refused instead of ignored
+	config.GlobalConfig.EnableKruise = false
+	_, err := client.Check(ctx, &pb.CheckRequest{Namespace: "default", Service: "web", Kind: "cloneset"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	config.GlobalConfig.EnableKruise = true
+	list, err := client.ListManaged(ctx, &pb.ListManagedRequest{})
+	require.NoError(t, err)
+	require.Len(t, list.Resources, 1)
+	assert.Equal(t, k8s.KindCloneSet, list.Resources[0].Kind)
+
+	check, err := client.Check(ctx, &pb.CheckRequest{Namespace: "default", Service: "web", Kind: "cloneset"})
+	require.NoError(t, err)
+	require.Len(t, check.Containers, 1)
+	assert.Equal(t, host+"/app:1.1.0", check.Containers[0].NewImage)
+
+	_, err = client.Update(ctx, &pb.UpdateRequest{Namespace: "default", Service: "web", Kind: "cloneset", Image: "nginx:1.27"})
+	require.NoError(t, err)
+	web, err := k8sClient.GetKruiseWorkload(ctx, k8s.KindCloneSet, "default", "web")
+	require.NoError(t, err)
+	assert.Equal(t, "nginx:1.27", web.Template.Spec.Containers[0].Image)
+}
@@ -0,0 +1,278 @@
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/sirupsen/logrus"
+)
+
+// Phases of an update a hook runs in
+const (
+	PhasePreUpdate  = "pre-update"
+	PhasePostUpdate = "post-update"
+	// The resource failed to be written APPLY_FAILURE_ALERT_THRESHOLD consecutive times
+	PhaseApplyFailed = "apply-failed"
+	// Rollouts were frozen because the pods of an update crash loop
+	PhaseFrozen = "frozen"
+)
+
+// ErrRejected is returned when a hook answers with a non-2xx status or exits with an error
+var ErrRejected = errors.New("update hook rejected the update")
+
+// Largest part of a hook response or output included in errors
+const maxOutput = 1024
+
+// Payload describes the update a hook runs for, sent as JSON
+type Payload struct {
+	Phase     string   `json:"phase"`
+	Kind      string   `json:"kind"`
+	Namespace string   `json:"namespace"`
+	Name      string   `json:"name"`
+	Changes   []Change `json:"changes"`
+	// Value of the notify-channel annotation of the resource, routing the post-update and apply-failed phases
+	Channel string `json:"channel,omitempty"`
+	// Last error and number of consecutive failures in the apply-failed phase, why rollouts are frozen in the frozen phase
+	Error    string `json:"error,omitempty"`
+	Failures int    `json:"failures,omitempty"`
+}
+
+// Change is a container image replaced, or restarted in latest mode, by the update
+type Change struct {
+	Action    string `json:"action"`
+	Container string `json:"container"`
+	OldImage  string `json:"oldImage"`
+	NewImage  string `json:"newImage"`
+	Mode      string `json:"mode,omitempty"`
+}
+
+// CycleSummary summarizes a check cycle, posted to CYCLE_WEBHOOK_URL after it
+type CycleSummary struct {
+	Cluster   string    `json:"cluster,omitempty"`
+	StartTime time.Time `json:"startTime"`
+	// Duration of the cycle in seconds
+	Duration float64 `json:"duration"`
+	// Resources enabled for auto-update that were checked
+	Checked int           `json:"checked"`
+	Updated []CycleUpdate `json:"updated"`
+	// Errors logged while checking or writing resources
+	Errors []string `json:"errors"`
+}
+
+// CycleUpdate is a resource the cycle rolled out, with the images it changed
+type CycleUpdate struct {
+	Kind      string   `json:"kind"`
+	Namespace string   `json:"namespace"`
+	Name      string   `json:"name"`
+	Changes   []Change `json:"changes"`
+}
+
+// Hooks runs the commands or URLs configured by PRE_UPDATE_HOOK and POST_UPDATE_HOOK around rollouts,
+// APPLY_FAILURE_HOOK when writes keep failing and FREEZE_HOOK when rollouts are frozen. Notifications of a resource can be routed to other hooks
+// by channel or namespace. CYCLE_WEBHOOK_URL receives a summary of every check cycle.
+type Hooks struct {
+	pre         string
+	post        string
+	applyFailed string
+	frozen      string
+	cycle       string
+	channels    map[string]string
+	routes      []config.NotifyRoute
+	timeout     time.Duration
+	client      *http.Client
+}
+
+// New creates the hooks configured by PRE_UPDATE_HOOK, POST_UPDATE_HOOK, APPLY_FAILURE_HOOK, FREEZE_HOOK,
+// NOTIFY_CHANNELS, NOTIFY_NAMESPACE_HOOKS and CYCLE_WEBHOOK_URL, or nil when none is set
+func New(cfg *config.Config) (*Hooks, error) {
+	channels, err := cfg.NotifyChannelHooks()
+	if err != nil {
+		return nil, fmt.Errorf("invalid NOTIFY_CHANNELS: %v", err)
+	}
+	routes, err := cfg.NotifyRoutes()
+	if err != nil {
+		return nil, fmt.Errorf("invalid NOTIFY_NAMESPACE_HOOKS: %v", err)
+	}
+	if cfg.PreUpdateHook == "" && cfg.PostUpdateHook == "" && cfg.ApplyFailureHook == "" && cfg.FreezeHook == "" && cfg.CycleWebhookURL == "" && len(channels) == 0 && len(routes) == 0 {
+		return nil, nil
+	}
+	if cfg.CycleWebhookURL != "" {
+		if _, err := url.ParseRequestURI(cfg.CycleWebhookURL); err != nil || !isURL(cfg.CycleWebhookURL) {
+			return nil, fmt.Errorf("invalid CYCLE_WEBHOOK_URL, must be an http:// or https:// URL")
+		}
+	}
+	hooks := []string{cfg.PreUpdateHook, cfg.PostUpdateHook, cfg.ApplyFailureHook, cfg.FreezeHook}
+	for _, hook := range channels {
+		hooks = append(hooks, hook)
+	}
+	for _, route := range routes {
+		hooks = append(hooks, route.Hook)
+	}
+	for _, hook := range hooks {
+		if isURL(hook) {
+			if _, err := url.ParseRequestURI(hook); err != nil {
+				return nil, fmt.Errorf("invalid update hook URL: %v", err)
+			}
+		}
+	}
+	return &Hooks{
+		pre:         cfg.PreUpdateHook,
+		post:        cfg.PostUpdateHook,
+		applyFailed: cfg.ApplyFailureHook,
+		frozen:      cfg.FreezeHook,
+		cycle:       cfg.CycleWebhookURL,
+		channels:    channels,
+		routes:      routes,
+		timeout:     cfg.UpdateHookTimeout,
+		client:      &http.Client{},
+	}, nil
+}
+
+// PreUpdate runs the pre-update hook, an error means the update must not be applied
+func (h *Hooks) PreUpdate(ctx context.Context, payload Payload) error {
+	payload.Phase = PhasePreUpdate
+	return h.run(ctx, h.pre, payload)
+}
+
+// PostUpdate runs the post-update hook once the update was applied
+func (h *Hooks) PostUpdate(ctx context.Context, payload Payload) error {
+	payload.Phase = PhasePostUpdate
+	return h.run(ctx, h.notifyHook(payload, h.post), payload)
+}
+
+// ApplyFailed notifies the apply-failure hook that writes of a resource keep failing
+func (h *Hooks) ApplyFailed(ctx context.Context, payload Payload) error {
+	payload.Phase = PhaseApplyFailed
+	return h.run(ctx, h.notifyHook(payload, h.applyFailed), payload)
+}
+
+// Frozen notifies the freeze hook that rollouts were frozen. The freeze covers every resource, it is not routed
+// by channel or namespace.
+func (h *Hooks) Frozen(ctx context.Context, payload Payload) error {
+	payload.Phase = PhaseFrozen
+	return h.run(ctx, h.frozen, payload)
+}
+
+// CycleDone posts the summary of a check cycle to CYCLE_WEBHOOK_URL
+func (h *Hooks) CycleDone(ctx context.Context, summary CycleSummary) error {
+	if h.cycle == "" {
+		return nil
+	}
+	if summary.Updated == nil {
+		summary.Updated = []CycleUpdate{}
+	}
+	if summary.Errors == nil {
+		summary.Errors = []string{}
+	}
+	body, err := json.Marshal(summary)
+	if err != nil {
+		return fmt.Errorf("failed to encode cycle summary: %v", err)
+	}
+	if h.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.timeout)
+		defer cancel()
+	}
+	return h.call(ctx, h.cycle, "cycle", body)
+}
+
+// notifyHook returns the hook notified of an update of a resource: the hook of its channel, else of its namespace,
+// else fallback. An unknown channel is logged and ignored.
+func (h *Hooks) notifyHook(payload Payload, fallback string) string {
+	if payload.Channel != "" {
+		if hook, ok := h.channels[payload.Channel]; ok {
+			return hook
+		}
+		logrus.Warnf("Unknown notify channel %q of %s %s/%s, not in NOTIFY_CHANNELS", payload.Channel, payload.Kind, payload.Namespace, payload.Name)
+	}
+	for _, route := range h.routes {
+		if matched, _ := path.Match(route.Namespace, payload.Namespace); matched {
+			return route.Hook
+		}
+	}
+	return fallback
+}
+
+func (h *Hooks) run(ctx context.Context, hook string, payload Payload) error {
+	if hook == "" {
+		return nil
+	}
+	if payload.Changes == nil {
+		payload.Changes = []Change{}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to encode hook payload: %v", err)
+	}
+	if h.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.timeout)
+		defer cancel()
+	}
+	if isURL(hook) {
+		return h.call(ctx, hook, payload.Phase, body)
+	}
+	return h.exec(ctx, hook, payload, body)
+}
+
+// call posts the payload to a URL, the hook rejects the update with a non-2xx status
+func (h *Hooks) call(ctx context.Context, hook, phase string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create %s hook request: %v", phase, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call %s hook: %v", phase, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		out, _ := io.ReadAll(io.LimitReader(resp.Body, maxOutput))
+		if message := strings.TrimSpace(string(out)); message != "" {
+			return fmt.Errorf("%w: %s hook returned %s: %s", ErrRejected, phase, resp.Status, message)
+		}
+		return fmt.Errorf("%w: %s hook returned %s", ErrRejected, phase, resp.Status)
+	}
+	return nil
+}
+
+// exec runs a shell command with the payload on stdin and in HOOK_* env vars, it rejects the update with a non-zero exit
+func (h *Hooks) exec(ctx context.Context, hook string, payload Payload, body []byte) error {
+	cmd := exec.CommandContext(ctx, "sh", "-c", hook)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Env = append(os.Environ(),
+		"HOOK_PHASE="+payload.Phase,
+		"HOOK_KIND="+payload.Kind,
+		"HOOK_NAMESPACE="+payload.Namespace,
+		"HOOK_NAME="+payload.Name,
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		if len(out) > maxOutput {
+			out = out[len(out)-maxOutput:]
+		}
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return fmt.Errorf("%w: %s hook %v: %s", ErrRejected, payload.Phase, err, strings.TrimSpace(string(out)))
+		}
+		return fmt.Errorf("failed to run %s hook: %v", payload.Phase, err)
+	}
+	return nil
+}
+
+func isURL(hook string) bool {
+	return strings.HasPrefix(hook, "http://") || strings.HasPrefix(hook, "https://")
+}
@@ -0,0 +1,188 @@
+package hooks
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testPayload = Payload{
+	Kind:      "deployment",
+	Namespace: "default",
+	Name:      "app",
+	Changes:   []Change{{Action: "update", Container: "app", OldImage: "app:1.0.0", NewImage: "app:1.1.0", Mode: "release"}},
+}
+
+func TestNew(t *testing.T) {
+	h, err := New(&config.Config{})
+	require.NoError(t, err)
+	assert.Nil(t, h)
+
+	h, err = New(&config.Config{PostUpdateHook: "echo done"})
+	require.NoError(t, err)
+	assert.NotNil(t, h)
+
+	h, err = New(&config.Config{ApplyFailureHook: "echo failed"})
+	require.NoError(t, err)
+	assert.NotNil(t, h)
+	assert.NoError(t, h.PreUpdate(context.Background(), Payload{}))
+
+	h, err = New(&config.Config{FreezeHook: "echo frozen"})
+	require.NoError(t, err)
+	assert.NotNil(t, h)
+	_, err = New(&config.Config{FreezeHook: "http://[::1"})
+	assert.Error(t, err)
+
+	h, err = New(&config.Config{CycleWebhookURL: "https://monitoring.example.com/cycles"})
+	require.NoError(t, err)
+	assert.NotNil(t, h)
+	_, err = New(&config.Config{CycleWebhookURL: "echo cycle"})
+	assert.ErrorContains(t, err, "CYCLE_WEBHOOK_URL")
+
+	_, err = New(&config.Config{PreUpdateHook: "http://[::1"})
+	assert.Error(t, err)
+	_, err = New(&config.Config{ApplyFailureHook: "http://[::1"})
+	assert.Error(t, err)
+
+	h, err = New(&config.Config{NotifyChannels: "team-a=https://hooks.example.com/a"})
+	require.NoError(t, err)
+	assert.NotNil(t, h)
+	_, err = New(&config.Config{NotifyChannels: "team-a=http://[::1"})
+	assert.Error(t, err)
+	_, err = New(&config.Config{NotifyNamespaceHooks: "team-a"})
+	assert.Error(t, err)
+}
+
+func TestNotifyRouting(t *testing.T) {
+	var received []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload Payload
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+		received = append(received, payload.Phase+" "+r.URL.Path)
+	}))
+	t.Cleanup(server.Close)
+	h, err := New(&config.Config{
+		PreUpdateHook:        server.URL + "/pre",
+		PostUpdateHook:       server.URL + "/default",
+		ApplyFailureHook:     server.URL + "/failures",
+		NotifyChannels:       "payments=" + server.URL + "/payments, search=" + server.URL + "/search",
+		NotifyNamespaceHooks: "team-a=" + server.URL + "/team-a,team-*=" + server.URL + "/teams",
+	})
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	tests := []struct {
+		name      string
+		namespace string
+		channel   string
+		want      string
+	}{
+		{name: "channel", namespace: "default", channel: "payments", want: "/payments"},
+		{name: "channel over namespace", namespace: "team-a", channel: "search", want: "/search"},
+		{name: "namespace", namespace: "team-a", want: "/team-a"},
+		{name: "namespace pattern", namespace: "team-b", want: "/teams"},
+		{name: "unknown channel", namespace: "team-b", channel: "billing", want: "/teams"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			received = nil
+			payload := testPayload
+			payload.Namespace, payload.Channel = tt.namespace, tt.channel
+			require.NoError(t, h.PreUpdate(ctx, payload))
+			require.NoError(t, h.PostUpdate(ctx, payload))
+			require.NoError(t, h.ApplyFailed(ctx, payload))
+			// The pre-update hook gates rollouts and is never routed
+			assert.Equal(t, []string{"pre-update /pre", "post-update " + tt.want, "apply-failed " + tt.want}, received)
+		})
+	}
+
+	// Unrouted notifications go to the default hooks
+	received = nil
+	require.NoError(t, h.PostUpdate(ctx, testPayload))
+	require.NoError(t, h.ApplyFailed(ctx, testPayload))
+	assert.Equal(t, []string{"post-update /default", "apply-failed /failures"}, received)
+}
+
+func TestHTTPHook(t *testing.T) {
+	var received []Payload
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		var payload Payload
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+		received = append(received, payload)
+		w.WriteHeader(status)
+		w.Write([]byte("smoke test failed"))
+	}))
+	t.Cleanup(server.Close)
+	h, err := New(&config.Config{PreUpdateHook: server.URL + "/pre", PostUpdateHook: server.URL + "/post", UpdateHookTimeout: time.Second})
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	require.NoError(t, h.PreUpdate(ctx, testPayload))
+	require.NoError(t, h.PostUpdate(ctx, testPayload))
+	require.Len(t, received, 2)
+	assert.Equal(t, PhasePreUpdate, received[0].Phase)
+	assert.Equal(t, PhasePostUpdate, received[1].Phase)
+	assert.Equal(t, testPayload.Changes, received[0].Changes)
+
+	// A non-2xx status vetoes the update
+	status = http.StatusConflict
+	err = h.PreUpdate(ctx, testPayload)
+	assert.ErrorIs(t, err, ErrRejected)
+	assert.ErrorContains(t, err, "409 Conflict: smoke test failed")
+}
+
+func TestHTTPHookTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The request is only cancelled once its body has been read
+		io.Copy(io.Discard, r.Body)
+		<-r.Context().Done()
+	}))
+	t.Cleanup(server.Close)
+	h, err := New(&config.Config{PreUpdateHook: server.URL, UpdateHookTimeout: 50 * time.Millisecond})
+	require.NoError(t, err)
+
+	err = h.PreUpdate(context.Background(), testPayload)
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, ErrRejected)
+}
+
+func TestCommandHook(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "payload.json")
+	h, err := New(&config.Config{
+		PreUpdateHook:     `test "$HOOK_NAMESPACE/$HOOK_NAME" = default/app && cat > ` + out,
+		PostUpdateHook:    "echo smoke test failed; exit 3",
+		UpdateHookTimeout: 5 * time.Second,
+	})
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	require.NoError(t, h.PreUpdate(ctx, testPayload))
+	data, err := os.ReadFile(out)
+	require.NoError(t, err)
+	var payload Payload
+	require.NoError(t, json.Unmarshal(data, &payload))
+	assert.Equal(t, PhasePreUpdate, payload.Phase)
+	assert.Equal(t, testPayload.Changes, payload.Changes)
+
+	err = h.PostUpdate(ctx, testPayload)
+	assert.ErrorIs(t, err, ErrRejected)
+	assert.ErrorContains(t, err, "smoke test failed")
+
+	// No hook configured for a phase always succeeds
+	h, err = New(&config.Config{PostUpdateHook: "exit 1"})
+	require.NoError(t, err)
+	assert.NoError(t, h.PreUpdate(ctx, testPayload))
+}
@@ -0,0 +1,55 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/monlor/k8s-image-updater/config"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ErrNoPendingImage is returned when approving a resource without an image proposed in review mode
+var ErrNoPendingImage = errors.New("no pending image")
+
+// VerifyFunc checks the images about to be set on a resource, given the resource as read for the write
+type VerifyFunc func(ctx context.Context, meta *metav1.ObjectMeta, template *corev1.PodTemplateSpec, images []string) error
+
+// ApprovePendingImage applies the image proposed in review mode to its container and clears the proposal,
+// returning the applied plan. A non-nil verify checks the pending image of the resource being written, so the
+// approval fails when it does not pass.
+func (c *Client) ApprovePendingImage(ctx context.Context, kind, namespace, name string, verify VerifyFunc) (*ImagePlan, error) {
+	meta, template, update, err := c.getResource(ctx, kind, namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	image := meta.Annotations[config.AnnotationPendingImage]
+	if image == "" {
+		return nil, fmt.Errorf("%w for %s %s/%s", ErrNoPendingImage, kind, namespace, name)
+	}
+	plan, err := planImageUpdate(kind, namespace, name, template, meta.Annotations[config.AnnotationPendingContainer], image, true)
+	if err != nil {
+		return nil, err
+	}
+	if verify != nil {
+		if err := verify(ctx, meta, template, []string{image}); err != nil {
+			return nil, err
+		}
+	}
+
+	for i := range template.Spec.Containers {
+		if template.Spec.Containers[i].Name == plan.Container {
+			template.Spec.Containers[i].Image = image
+		}
+	}
+	delete(meta.Annotations, config.AnnotationPendingImage)
+	delete(meta.Annotations, config.AnnotationPendingContainer)
+	if meta.Annotations[config.AnnotationStatus] == config.StatusPendingApproval {
+		delete(meta.Annotations, config.AnnotationStatus)
+	}
+	if err := update(); err != nil {
+		return nil, fmt.Errorf("failed to approve image of %s: %v", kind, err)
+	}
+	return plan, nil
+}
@@ -0,0 +1,58 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ReviewToken authenticates a bearer token with a TokenReview, returning the user it belongs to
+// and false when the API server does not accept it
+func (c *Client) ReviewToken(ctx context.Context, token string) (authenticationv1.UserInfo, bool, error) {
+	review, err := c.clientset.AuthenticationV1().TokenReviews().Create(ctx, &authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{Token: token},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return authenticationv1.UserInfo{}, false, fmt.Errorf("failed to review token: %v", err)
+	}
+	return review.Status.User, review.Status.Authenticated, nil
+}
+
+// KindResource returns the API group and resource of a kind, the OpenKruise kinds being in apps.kruise.io
+func KindResource(kind string) (string, string) {
+	if gvr, ok := KruiseResources[kind]; ok {
+		return gvr.Group, gvr.Resource
+	}
+	return "apps", kind + "s"
+}
+
+// Authorize checks with a SubjectAccessReview whether a user may perform a verb on the resources of a kind,
+// an empty namespace meaning all namespaces. The reason of the API server is returned along with the decision.
+func (c *Client) Authorize(ctx context.Context, user authenticationv1.UserInfo, namespace, verb, kind string) (bool, string, error) {
+	group, resource := KindResource(kind)
+	extra := make(map[string]authorizationv1.ExtraValue, len(user.Extra))
+	for key, values := range user.Extra {
+		extra[key] = authorizationv1.ExtraValue(values)
+	}
+	review, err := c.clientset.AuthorizationV1().SubjectAccessReviews().Create(ctx, &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User:   user.Username,
+			UID:    user.UID,
+			Groups: user.Groups,
+			Extra:  extra,
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace: namespace,
+				Verb:      verb,
+				Group:     group,
+				Resource:  resource,
+			},
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return false, "", fmt.Errorf("failed to review access: %v", err)
+	}
+	return review.Status.Allowed, review.Status.Reason, nil
+}
@@ -0,0 +1,158 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/monlor/k8s-image-updater/pkg/registry"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// ErrContainersNotUpdated is returned when some containers of an update of several containers cannot be updated,
+// none of them is changed then
+var ErrContainersNotUpdated = errors.New("containers not updated")
+
+// ErrNoMatchingContainers is returned when no container of a resource runs the repository of a partial image
+var ErrNoMatchingContainers = errors.New("no container matches the repository")
+
+// ContainerPlan is the plan for a container, named or matched by a pattern, of an update of several containers.
+// Err tells why it has none.
+type ContainerPlan struct {
+	ContainerImage
+	Plan *ImagePlan
+	Err  error
+}
+
+// planImageUpdates decides how to set the images of several containers of a pod template, failing with
+// ErrContainersNotUpdated when a container cannot be planned or is given twice
+func planImageUpdates(kind, namespace, name string, template *corev1.PodTemplateSpec, updates []ContainerImage, restartOnSameImage bool) ([]ContainerPlan, error) {
+	plans := make([]ContainerPlan, len(updates))
+	seen := make(map[string]bool)
+	var failed []string
+	for i, update := range updates {
+		plans[i].ContainerImage = update
+		plan, err := planImageUpdate(kind, namespace, name, template, update.Name, update.Image, restartOnSameImage)
+		if err == nil && seen[plan.Container] {
+			err = fmt.Errorf("container %s is updated more than once", plan.Container)
+		}
+		if err != nil {
+			plans[i].Err = err
+			failed = append(failed, update.Name)
+			continue
+		}
+		seen[plan.Container] = true
+		plans[i].Plan = plan
+	}
+	if len(failed) > 0 {
+		return plans, fmt.Errorf("%w in %s %s/%s: %s", ErrContainersNotUpdated, kind, namespace, name, strings.Join(failed, ", "))
+	}
+	return plans, nil
+}
+
+// PlanImageUpdates decides what ApplyImageUpdates would do, without changing the resource
+func (c *Client) PlanImageUpdates(kind, namespace, service string, updates []ContainerImage, restartOnSameImage string) ([]ContainerPlan, error) {
+	meta, template, _, err := c.getResource(context.Background(), kind, namespace, service)
+	if err != nil {
+		return nil, err
+	}
+	restart, err := restartsOnSameImage(meta.Annotations, restartOnSameImage)
+	if err != nil {
+		return nil, err
+	}
+	return planImageUpdates(kind, namespace, service, template, updates, restart)
+}
+
+// ApplyImageUpdates sets the images of several containers of a resource in a single write, returning the
+// plan of each container. When a container cannot be updated none is.
+func (c *Client) ApplyImageUpdates(kind, namespace, service string, updates []ContainerImage, restartOnSameImage string) ([]ContainerPlan, error) {
+	meta, template, update, err := c.getResource(context.Background(), kind, namespace, service)
+	if err != nil {
+		return nil, err
+	}
+	restart, err := restartsOnSameImage(meta.Annotations, restartOnSameImage)
+	if err != nil {
+		return nil, err
+	}
+	plans, err := planImageUpdates(kind, namespace, service, template, updates, restart)
+	if err != nil {
+		return plans, err
+	}
+
+	original := template.DeepCopy()
+	var patches []containerImagePatch
+	needsRestart := false
+	for _, p := range plans {
+		switch p.Plan.Action {
+		case ImageActionRestart:
+			needsRestart = true
+		case ImageActionUpdate:
+			for i := range template.Spec.Containers {
+				if template.Spec.Containers[i].Name == p.Plan.Container {
+					patches = append(patches, containerImagePatch{i, p.Plan.Container, p.Image})
+				}
+			}
+		}
+	}
+	if len(patches) > 0 {
+		// The restarted containers keep their image, and may not pull it again when only the others change, so the
+		// restart annotation goes in the same patch
+		var restart []jsonPatchOperation
+		if needsRestart {
+			annotated := template.Annotations != nil
+			restartedAt := restartPodTemplate(template, c.clock.Now())
+			restart = append(restart, annotationOperation(annotated, config.AnnotationRestart, restartedAt))
+		}
+		if err := c.patchContainerImages(context.Background(), kind, namespace, service, patches, restart...); err != nil {
+			return plans, err
+		}
+		for _, p := range patches {
+			setContainerImage(template, p.container, p.image)
+		}
+	} else if needsRestart {
+		restartPodTemplate(template, c.clock.Now())
+		if err := update(); err != nil {
+			return plans, fmt.Errorf("failed to restart %s: %v", kind, err)
+		}
+	}
+
+	// The image of each container is its change, a restart of the pods goes to the containers restarted for it
+	diff := templateDiff(original, template)
+	for i, p := range plans {
+		for _, change := range diff {
+			if change.Path == imagePath(p.Plan.Container) || (p.Plan.Action == ImageActionRestart && change.Path == annotationPath(config.AnnotationRestart)) {
+				plans[i].Plan.Diff = append(plans[i].Plan.Diff, change)
+			}
+		}
+	}
+	return plans, nil
+}
+
+// matchRepositoryContainers returns the containers of a pod template whose image repository ends with the one of a
+// partial image, with the full image to set resolved from the image they run
+func matchRepositoryContainers(kind, namespace, name string, template *corev1.PodTemplateSpec, image string) ([]ContainerImage, error) {
+	var matches []ContainerImage
+	if template != nil {
+		for _, c := range template.Spec.Containers {
+			if resolved, ok := registry.MatchRepository(c.Image, image); ok {
+				matches = append(matches, ContainerImage{Name: c.Name, Image: resolved})
+			}
+		}
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("%w of %s in %s %s/%s", ErrNoMatchingContainers, image, kind, namespace, name)
+	}
+	return matches, nil
+}
+
+// MatchRepositoryContainers resolves a partial image such as nginx:1.25 to the full image of each container of a
+// resource running that repository, for ApplyImageUpdates
+func (c *Client) MatchRepositoryContainers(kind, namespace, service, image string) ([]ContainerImage, error) {
+	_, template, _, err := c.getResource(context.Background(), kind, namespace, service)
+	if err != nil {
+		return nil, err
+	}
+	return matchRepositoryContainers(kind, namespace, service, template, image)
+}
@@ -2,34 +2,74 @@ package k8s
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/monlor/k8s-image-updater/config"
+	"github.com/monlor/k8s-image-updater/pkg/clock"
+	"github.com/monlor/k8s-image-updater/pkg/registry"
+	"github.com/sirupsen/logrus"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
 type Client struct {
-	clientset *kubernetes.Clientset
+	clientset kubernetes.Interface
+	// Reads and writes OpenKruise workloads, nil when ENABLE_KRUISE is not set
+	dynamic dynamic.Interface
+	// Time written to the restart annotation
+	clock clock.Clock
 }
 
-func GetClient() (*Client, error) {
-	var k8sConfig *rest.Config
-	var err error
+// NewClient wraps an existing clientset, e.g. a fake clientset in tests
+func NewClient(clientset kubernetes.Interface) *Client {
+	return &Client{clientset: clientset, clock: clock.Real{}}
+}
+
+// SetDynamicClient sets the client of OpenKruise workloads, e.g. a fake dynamic client in tests
+func (c *Client) SetDynamicClient(client dynamic.Interface) {
+	c.dynamic = client
+}
+
+// SetClock replaces the clock of the client, e.g. with a fake clock in tests
+func (c *Client) SetClock(clk clock.Clock) {
+	c.clock = clk
+}
+
+// ErrNoContainers is returned when updating the image of a resource whose pod template has no containers
+var ErrNoContainers = errors.New("no containers in resource")
+
+// Delays between connection attempts of GetClientWithRetry, doubling up to the maximum
+var (
+	retryInitialDelay = 500 * time.Millisecond
+	retryMaxDelay     = 30 * time.Second
+)
+
+// retryClock times the connection attempts of GetClientWithRetry, replaced in tests
+var retryClock clock.Clock = clock.Real{}
 
+// buildConfig finds the kubernetes configuration, replaced in tests
+var buildConfig = buildRestConfig
+
+func buildRestConfig() (*rest.Config, error) {
 	// 1. First try to use KubeConfig from configuration file
 	if config.GlobalConfig.KubeConfig != "" {
-		k8sConfig, err = clientcmd.BuildConfigFromFlags("", config.GlobalConfig.KubeConfig)
+		k8sConfig, err := clientcmd.BuildConfigFromFlags("", config.GlobalConfig.KubeConfig)
 		if err == nil {
-			goto CREATE_CLIENT
+			return k8sConfig, nil
 		}
 	}
 
@@ -37,26 +77,73 @@ func GetClient() (*Client, error) {
 	if home := os.Getenv("HOME"); home != "" {
 		kubeconfig := filepath.Join(home, ".kube", "config")
 		if _, err := os.Stat(kubeconfig); err == nil {
-			k8sConfig, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+			k8sConfig, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
 			if err == nil {
-				goto CREATE_CLIENT
+				return k8sConfig, nil
 			}
 		}
 	}
 
 	// 3. Finally try to use InClusterConfig
-	k8sConfig, err = rest.InClusterConfig()
+	k8sConfig, err := rest.InClusterConfig()
 	if err != nil {
 		return nil, fmt.Errorf("failed to create kubernetes config: no valid configuration found")
 	}
+	return k8sConfig, nil
+}
+
+func GetClient() (*Client, error) {
+	return newClient(buildConfig)
+}
+
+// newClient creates a client from the configuration returned by build
+func newClient(build func() (*rest.Config, error)) (*Client, error) {
+	k8sConfig, err := build()
+	if err != nil {
+		return nil, err
+	}
 
-CREATE_CLIENT:
 	clientset, err := kubernetes.NewForConfig(k8sConfig)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create kubernetes client: %v", err)
 	}
+	client := NewClient(clientset)
+	if config.GlobalConfig.EnableKruise {
+		if client.dynamic, err = dynamic.NewForConfig(k8sConfig); err != nil {
+			return nil, fmt.Errorf("failed to create dynamic kubernetes client: %v", err)
+		}
+	}
+	return client, nil
+}
 
-	return &Client{clientset: clientset}, nil
+// GetClientWithRetry creates a client and checks the API server is reachable, retrying with
+// exponential backoff until the timeout so a pod started during cluster bootstrap does not crash-loop
+func GetClientWithRetry(timeout time.Duration) (*Client, error) {
+	return connectWithRetry(GetClient, timeout)
+}
+
+// connectWithRetry creates a client with connect until its API server is reachable or the timeout expires
+func connectWithRetry(connect func() (*Client, error), timeout time.Duration) (*Client, error) {
+	deadline := retryClock.Now().Add(timeout)
+	delay := retryInitialDelay
+	for attempt := 1; ; attempt++ {
+		client, err := connect()
+		if err == nil {
+			if _, err = client.clientset.Discovery().ServerVersion(); err != nil {
+				err = fmt.Errorf("failed to reach kubernetes API server: %v", err)
+			}
+		}
+		if err == nil {
+			return client, nil
+		}
+
+		if retryClock.Now().Add(delay).After(deadline) {
+			return nil, fmt.Errorf("giving up after %d attempts: %v", attempt, err)
+		}
+		logrus.Warnf("Kubernetes client not ready (attempt %d), retrying in %s: %v", attempt, delay, err)
+		<-retryClock.After(delay)
+		delay = min(delay*2, retryMaxDelay)
+	}
 }
 
 // Get image tag from image string
@@ -70,208 +157,384 @@ func getImageTag(image string) string {
 // Check if restart is needed
 func shouldRestart(currentImage string, newImage string, pullPolicy corev1.PullPolicy) bool {
 	// Restart is needed if image is the same and pull policy is Always
-	return currentImage == newImage && pullPolicy == corev1.PullAlways
+	return registry.SameImage(currentImage, newImage) && pullPolicy == corev1.PullAlways
 }
 
-// Restart Deployment
-func (c *Client) restartDeployment(deploy *appsv1.Deployment) error {
-	// Ensure annotations exist
-	if deploy.Spec.Template.Annotations == nil {
-		deploy.Spec.Template.Annotations = make(map[string]string)
+// restartsOnSameImage tells whether an update to the current image restarts the pods, from override, the
+// restartOnSameImage API parameter, or else the restart-on-same-image annotation of the resource. It does by default.
+func restartsOnSameImage(annotations map[string]string, override string) (bool, error) {
+	value, source := override, "restartOnSameImage parameter"
+	if value == "" {
+		value, source = annotations[config.AnnotationRestartOnSameImage], config.AnnotationRestartOnSameImage+" annotation"
 	}
-
-	// Add or update restart annotation
-	deploy.Spec.Template.Annotations["kubectl.kubernetes.io/restartedAt"] = time.Now().Format(time.RFC3339)
-
-	_, err := c.clientset.AppsV1().Deployments(deploy.Namespace).Update(context.Background(), deploy, metav1.UpdateOptions{})
-	return err
+	if value == "" {
+		return true, nil
+	}
+	restart, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q, expected true or false", source, value)
+	}
+	return restart, nil
 }
 
-// Restart StatefulSet
-func (c *Client) restartStatefulSet(sts *appsv1.StatefulSet) error {
-	// Ensure annotations exist
-	if sts.Spec.Template.Annotations == nil {
-		sts.Spec.Template.Annotations = make(map[string]string)
-	}
+// Actions of an image update
+const (
+	// Restart the pods to pull the same image again, it has imagePullPolicy Always
+	ImageActionRestart = "restart"
+	// Change the image of the container
+	ImageActionUpdate = "update"
+	// Nothing to do
+	ImageActionUpToDate = "up-to-date"
+)
 
-	// Add or update restart annotation
-	sts.Spec.Template.Annotations["kubectl.kubernetes.io/restartedAt"] = time.Now().Format(time.RFC3339)
+// Outcomes of an applied image update, reported by the update API
+const (
+	ImageOutcomeUpdated   = "image-updated"
+	ImageOutcomeRestarted = "restarted"
+	ImageOutcomeNoOp      = "no-op"
+)
 
-	_, err := c.clientset.AppsV1().StatefulSets(sts.Namespace).Update(context.Background(), sts, metav1.UpdateOptions{})
-	return err
+// ImagePlan is the action an image update decided on for a container, before it is applied
+type ImagePlan struct {
+	Kind         string `json:"kind"`
+	Namespace    string `json:"namespace"`
+	Name         string `json:"name"`
+	Container    string `json:"container"`
+	CurrentImage string `json:"currentImage"`
+	Image        string `json:"image"`
+	Action       string `json:"action"`
+	// Fields of the pod template the applied plan changed
+	Diff []SpecChange `json:"diff,omitempty"`
 }
 
-// Restart DaemonSet
-func (c *Client) restartDaemonSet(ds *appsv1.DaemonSet) error {
-	// Ensure annotations exist
-	if ds.Spec.Template.Annotations == nil {
-		ds.Spec.Template.Annotations = make(map[string]string)
+// Message describes the plan once applied
+func (p *ImagePlan) Message() string {
+	switch p.Action {
+	case ImageActionRestart:
+		return fmt.Sprintf("Updated %s %s/%s (container: %s) by restarting to fetch latest image %s", p.Kind, p.Namespace, p.Name, p.Container, p.Image)
+	case ImageActionUpdate:
+		return fmt.Sprintf("Updated %s %s/%s (container: %s) with image %s", p.Kind, p.Namespace, p.Name, p.Container, p.Image)
+	default:
+		return fmt.Sprintf("Image %s is already up to date for %s %s/%s (container: %s)", p.Image, p.Kind, p.Namespace, p.Name, p.Container)
 	}
-
-	// Add or update restart annotation
-	ds.Spec.Template.Annotations["kubectl.kubernetes.io/restartedAt"] = time.Now().Format(time.RFC3339)
-
-	_, err := c.clientset.AppsV1().DaemonSets(ds.Namespace).Update(context.Background(), ds, metav1.UpdateOptions{})
-	return err
 }
 
-func (c *Client) UpdateDeploymentImage(namespace, service, container, image string) (string, error) {
-	deploy, err := c.clientset.AppsV1().Deployments(namespace).Get(context.Background(), service, metav1.GetOptions{})
-	if err != nil {
-		return "", err
+// Outcome describes what applying the plan did
+func (p *ImagePlan) Outcome() string {
+	switch p.Action {
+	case ImageActionRestart:
+		return ImageOutcomeRestarted
+	case ImageActionUpdate:
+		return ImageOutcomeUpdated
+	default:
+		return ImageOutcomeNoOp
 	}
+}
 
-	// If container is empty, use the first container
-	if container == "" && len(deploy.Spec.Template.Spec.Containers) > 0 {
-		container = deploy.Spec.Template.Spec.Containers[0].Name
+// DryRunMessage describes the plan before it is applied
+func (p *ImagePlan) DryRunMessage() string {
+	switch p.Action {
+	case ImageActionRestart:
+		return fmt.Sprintf("Would restart %s %s/%s (container: %s) to fetch latest image %s", p.Kind, p.Namespace, p.Name, p.Container, p.Image)
+	case ImageActionUpdate:
+		return fmt.Sprintf("Would update %s %s/%s (container: %s) from image %s to %s", p.Kind, p.Namespace, p.Name, p.Container, p.CurrentImage, p.Image)
+	default:
+		return p.Message()
 	}
+}
 
-	containerFound := false
-	for i := range deploy.Spec.Template.Spec.Containers {
-		if deploy.Spec.Template.Spec.Containers[i].Name != container {
-			continue
+// getResource fetches a resource, returning its metadata, its pod template and a function writing the resource back
+func (c *Client) getResource(ctx context.Context, kind, namespace, name string) (*metav1.ObjectMeta, *corev1.PodTemplateSpec, func() error, error) {
+	switch kind {
+	case "deployment":
+		deploy, err := c.GetDeployment(ctx, namespace, name)
+		if err != nil {
+			return nil, nil, nil, err
 		}
-		containerFound = true
-
-		// Case 1: Image is the same and pull policy is Always, need to restart
-		if deploy.Spec.Template.Spec.Containers[i].Image == image && deploy.Spec.Template.Spec.Containers[i].ImagePullPolicy == corev1.PullAlways {
-			if err := c.restartDeployment(deploy); err != nil {
-				return "", fmt.Errorf("failed to restart deployment: %v", err)
-			}
-			return fmt.Sprintf("Updated deployment %s/%s (container: %s) by restarting to fetch latest image %s", namespace, service, container, image), nil
+		return &deploy.ObjectMeta, &deploy.Spec.Template, func() error { return c.UpdateDeployment(deploy) }, nil
+	case "statefulset":
+		sts, err := c.GetStatefulSet(ctx, namespace, name)
+		if err != nil {
+			return nil, nil, nil, err
 		}
-
-		// Case 2: Image is different, need to update image
-		if deploy.Spec.Template.Spec.Containers[i].Image != image {
-			deploy.Spec.Template.Spec.Containers[i].Image = image
-			_, err = c.clientset.AppsV1().Deployments(namespace).Update(context.Background(), deploy, metav1.UpdateOptions{})
-			if err != nil {
-				return "", err
-			}
-			return fmt.Sprintf("Updated deployment %s/%s (container: %s) with image %s", namespace, service, container, image), nil
+		return &sts.ObjectMeta, &sts.Spec.Template, func() error { return c.UpdateStatefulSet(sts) }, nil
+	case "daemonset":
+		ds, err := c.GetDaemonSet(ctx, namespace, name)
+		if err != nil {
+			return nil, nil, nil, err
 		}
+		return &ds.ObjectMeta, &ds.Spec.Template, func() error { return c.UpdateDaemonSet(ds) }, nil
+	case KindCloneSet, KindAdvancedStatefulSet:
+		workload, err := c.GetKruiseWorkload(ctx, kind, namespace, name)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return &workload.ObjectMeta, &workload.Template, func() error { return c.UpdateKruiseWorkload(workload) }, nil
+	default:
+		return nil, nil, nil, fmt.Errorf("unsupported kind: %s", kind)
 	}
+}
 
-	if !containerFound {
-		return "", fmt.Errorf("container %s not found in deployment", container)
-	}
+// GetWorkload fetches a resource of any kind, returning its metadata and pod template
+func (c *Client) GetWorkload(ctx context.Context, kind, namespace, name string) (*metav1.ObjectMeta, *corev1.PodTemplateSpec, error) {
+	meta, template, _, err := c.getResource(ctx, kind, namespace, name)
+	return meta, template, err
+}
 
-	return fmt.Sprintf("Image %s is already up to date for deployment %s/%s (container: %s)", image, namespace, service, container), nil
+// getPodTemplate fetches a resource, returning its pod template and a function writing the resource back
+func (c *Client) getPodTemplate(ctx context.Context, kind, namespace, name string) (*corev1.PodTemplateSpec, func() error, error) {
+	_, template, update, err := c.getResource(ctx, kind, namespace, name)
+	return template, update, err
 }
 
-func (c *Client) UpdateStatefulSetImage(namespace, service, container, image string) (string, error) {
-	sts, err := c.clientset.AppsV1().StatefulSets(namespace).Get(context.Background(), service, metav1.GetOptions{})
-	if err != nil {
-		return "", err
+// Set the restart annotation of a pod template to now, returning its value
+func restartPodTemplate(template *corev1.PodTemplateSpec, now time.Time) string {
+	// Ensure annotations exist
+	if template.Annotations == nil {
+		template.Annotations = make(map[string]string)
 	}
 
+	// Add or update restart annotation
+	restartedAt := now.Format(time.RFC3339)
+	template.Annotations[config.AnnotationRestart] = restartedAt
+	return restartedAt
+}
+
+// Decide how to set the image of a container in a pod template, the first container if none is given
+func planImageUpdate(kind, namespace, name string, template *corev1.PodTemplateSpec, container, image string, restartOnSameImage bool) (*ImagePlan, error) {
+	if template == nil || len(template.Spec.Containers) == 0 {
+		return nil, fmt.Errorf("%w %s %s/%s", ErrNoContainers, kind, namespace, name)
+	}
 	// If container is empty, use the first container
-	if container == "" && len(sts.Spec.Template.Spec.Containers) > 0 {
-		container = sts.Spec.Template.Spec.Containers[0].Name
+	if container == "" {
+		container = template.Spec.Containers[0].Name
+	}
+	container, err := matchContainer(template, container)
+	if err != nil {
+		return nil, fmt.Errorf("%v in %s", err, kind)
 	}
 
-	containerFound := false
-	for i := range sts.Spec.Template.Spec.Containers {
-		if sts.Spec.Template.Spec.Containers[i].Name != container {
+	for _, c := range template.Spec.Containers {
+		if c.Name != container {
 			continue
 		}
-		containerFound = true
-
-		// Case 1: Image is the same and pull policy is Always, need to restart
-		if sts.Spec.Template.Spec.Containers[i].Image == image && sts.Spec.Template.Spec.Containers[i].ImagePullPolicy == corev1.PullAlways {
-			if err := c.restartStatefulSet(sts); err != nil {
-				return "", fmt.Errorf("failed to restart statefulset: %v", err)
+		plan := &ImagePlan{
+			Kind:         kind,
+			Namespace:    namespace,
+			Name:         name,
+			Container:    container,
+			CurrentImage: c.Image,
+			Image:        image,
+			Action:       ImageActionUpToDate,
+		}
+		if shouldRestart(c.Image, image, c.ImagePullPolicy) {
+			// Case 1: Image is the same and pull policy is Always, need to restart unless disabled
+			if restartOnSameImage {
+				plan.Action = ImageActionRestart
 			}
-			return fmt.Sprintf("Updated statefulset %s/%s (container: %s) by restarting to fetch latest image %s", namespace, service, container, image), nil
+		} else if !registry.SameImage(c.Image, image) {
+			// Case 2: Image is different, need to update image
+			plan.Action = ImageActionUpdate
 		}
+		return plan, nil
+	}
+	return nil, fmt.Errorf("container %s not found in %s", container, kind)
+}
 
-		// Case 2: Image is different, need to update image
-		if sts.Spec.Template.Spec.Containers[i].Image != image {
-			sts.Spec.Template.Spec.Containers[i].Image = image
-			_, err = c.clientset.AppsV1().StatefulSets(namespace).Update(context.Background(), sts, metav1.UpdateOptions{})
-			if err != nil {
-				return "", err
-			}
-			return fmt.Sprintf("Updated statefulset %s/%s (container: %s) with image %s", namespace, service, container, image), nil
+// matchContainer resolves a container name or glob pattern to the name of the single container it matches
+func matchContainer(template *corev1.PodTemplateSpec, pattern string) (string, error) {
+	var names []string
+	for _, c := range template.Spec.Containers {
+		if config.ContainerMatches(pattern, c.Name) {
+			names = append(names, c.Name)
 		}
 	}
+	switch len(names) {
+	case 0:
+		return "", fmt.Errorf("container %s not found", pattern)
+	case 1:
+		return names[0], nil
+	default:
+		return "", fmt.Errorf("container pattern %s matches several containers (%s)", pattern, strings.Join(names, ", "))
+	}
+}
 
-	if !containerFound {
-		return "", fmt.Errorf("container %s not found in statefulset", container)
+// PlanImageUpdate decides what UpdateImage would do, without changing the resource. restartOnSameImage
+// overrides the restart-on-same-image annotation when set to true or false.
+func (c *Client) PlanImageUpdate(kind, namespace, service, container, image, restartOnSameImage string) (*ImagePlan, error) {
+	meta, template, _, err := c.getResource(context.Background(), kind, namespace, service)
+	if err != nil {
+		return nil, err
 	}
+	restart, err := restartsOnSameImage(meta.Annotations, restartOnSameImage)
+	if err != nil {
+		return nil, err
+	}
+	return planImageUpdate(kind, namespace, service, template, container, image, restart)
+}
+
+func (c *Client) UpdateDeploymentImage(namespace, service, container, image string) (*ImagePlan, error) {
+	return c.ApplyImageUpdate("deployment", namespace, service, container, image, "")
+}
+
+func (c *Client) UpdateStatefulSetImage(namespace, service, container, image string) (*ImagePlan, error) {
+	return c.ApplyImageUpdate("statefulset", namespace, service, container, image, "")
+}
 
-	return fmt.Sprintf("Image %s is already up to date for statefulset %s/%s (container: %s)", image, namespace, service, container), nil
+func (c *Client) UpdateDaemonSetImage(namespace, service, container, image string) (*ImagePlan, error) {
+	return c.ApplyImageUpdate("daemonset", namespace, service, container, image, "")
 }
 
-func (c *Client) UpdateDaemonSetImage(namespace, service, container, image string) (string, error) {
-	ds, err := c.clientset.AppsV1().DaemonSets(namespace).Get(context.Background(), service, metav1.GetOptions{})
+// ApplyImageUpdate updates the image of a resource, returning the applied plan. restartOnSameImage
+// overrides the restart-on-same-image annotation when set to true or false.
+func (c *Client) ApplyImageUpdate(kind, namespace, service, container, image, restartOnSameImage string) (*ImagePlan, error) {
+	meta, template, update, err := c.getResource(context.Background(), kind, namespace, service)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-
-	// If container is empty, use the first container
-	if container == "" && len(ds.Spec.Template.Spec.Containers) > 0 {
-		container = ds.Spec.Template.Spec.Containers[0].Name
+	restart, err := restartsOnSameImage(meta.Annotations, restartOnSameImage)
+	if err != nil {
+		return nil, err
+	}
+	plan, err := planImageUpdate(kind, namespace, service, template, container, image, restart)
+	if err != nil {
+		return nil, err
 	}
 
-	containerFound := false
-	for i := range ds.Spec.Template.Spec.Containers {
-		if ds.Spec.Template.Spec.Containers[i].Name != container {
-			continue
-		}
-		containerFound = true
-
-		// Case 1: Image is the same and pull policy is Always, need to restart
-		if ds.Spec.Template.Spec.Containers[i].Image == image && ds.Spec.Template.Spec.Containers[i].ImagePullPolicy == corev1.PullAlways {
-			if err := c.restartDaemonSet(ds); err != nil {
-				return "", fmt.Errorf("failed to restart daemonset: %v", err)
-			}
-			return fmt.Sprintf("Updated daemonset %s/%s (container: %s) by restarting to fetch latest image %s", namespace, service, container, image), nil
+	original := template.DeepCopy()
+	switch plan.Action {
+	case ImageActionRestart:
+		restartPodTemplate(template, c.clock.Now())
+		if err := update(); err != nil {
+			return nil, fmt.Errorf("failed to restart %s: %v", kind, err)
 		}
-
-		// Case 2: Image is different, need to update image
-		if ds.Spec.Template.Spec.Containers[i].Image != image {
-			ds.Spec.Template.Spec.Containers[i].Image = image
-			_, err = c.clientset.AppsV1().DaemonSets(namespace).Update(context.Background(), ds, metav1.UpdateOptions{})
-			if err != nil {
-				return "", err
+	case ImageActionUpdate:
+		// Only the image of the container is patched, so concurrent changes of the rest of the resource are kept
+		for i := range template.Spec.Containers {
+			if template.Spec.Containers[i].Name == plan.Container {
+				if err := c.patchContainerImages(context.Background(), kind, namespace, service, []containerImagePatch{{i, plan.Container, image}}); err != nil {
+					return nil, err
+				}
 			}
-			return fmt.Sprintf("Updated daemonset %s/%s (container: %s) with image %s", namespace, service, container, image), nil
 		}
+		setContainerImage(template, plan.Container, image)
 	}
+	plan.Diff = templateDiff(original, template)
+	return plan, nil
+}
 
-	if !containerFound {
-		return "", fmt.Errorf("container %s not found in daemonset", container)
+// jsonPatchOperation is an operation of a JSON patch (RFC 6902)
+type jsonPatchOperation struct {
+	Op    string `json:"op"`
+	Path  string `json:"path"`
+	Value any    `json:"value"`
+}
+
+// annotationOperation sets an annotation of the pod template, adding the annotations when it has none
+func annotationOperation(annotated bool, key, value string) jsonPatchOperation {
+	if !annotated {
+		return jsonPatchOperation{Op: "add", Path: "/spec/template/metadata/annotations", Value: map[string]string{key: value}}
 	}
+	key = strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+	return jsonPatchOperation{Op: "add", Path: "/spec/template/metadata/annotations/" + key, Value: value}
+}
 
-	return fmt.Sprintf("Image %s is already up to date for daemonset %s/%s (container: %s)", image, namespace, service, container), nil
+// containerImagePatch is the new image of the container at index of a pod template
+type containerImagePatch struct {
+	index     int
+	container string
+	image     string
 }
 
-// List all deployments in the cluster
-func (c *Client) ListDeployments(ctx context.Context, opts metav1.ListOptions) ([]appsv1.Deployment, error) {
-	deployments, err := c.clientset.AppsV1().Deployments("").List(ctx, opts)
+// patchContainerImages sets the images of containers of a resource with a single JSON patch. The patch checks
+// the container at each index is still the named one, so it fails instead of changing another container. The
+// extra operations are applied in the same patch.
+func (c *Client) patchContainerImages(ctx context.Context, kind, namespace, name string, images []containerImagePatch, extra ...jsonPatchOperation) error {
+	var operations []jsonPatchOperation
+	for _, image := range images {
+		containerPath := fmt.Sprintf("/spec/template/spec/containers/%d", image.index)
+		operations = append(operations,
+			jsonPatchOperation{Op: "test", Path: containerPath + "/name", Value: image.container},
+			jsonPatchOperation{Op: "replace", Path: containerPath + "/image", Value: image.image},
+		)
+	}
+	operations = append(operations, extra...)
+	patch, err := json.Marshal(operations)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	opts := metav1.PatchOptions{}
+	switch kind {
+	case "deployment":
+		_, err = c.clientset.AppsV1().Deployments(namespace).Patch(ctx, name, types.JSONPatchType, patch, opts)
+	case "statefulset":
+		_, err = c.clientset.AppsV1().StatefulSets(namespace).Patch(ctx, name, types.JSONPatchType, patch, opts)
+	case "daemonset":
+		_, err = c.clientset.AppsV1().DaemonSets(namespace).Patch(ctx, name, types.JSONPatchType, patch, opts)
+	case KindCloneSet, KindAdvancedStatefulSet:
+		var gvr schema.GroupVersionResource
+		if gvr, err = c.kruiseResource(kind); err == nil {
+			_, err = c.dynamic.Resource(gvr).Namespace(namespace).Patch(ctx, name, types.JSONPatchType, patch, opts)
+		}
+	default:
+		return fmt.Errorf("unsupported kind: %s", kind)
 	}
-	return deployments.Items, nil
+	return err
 }
 
-// List all statefulsets in the cluster
-func (c *Client) ListStatefulSets(ctx context.Context, opts metav1.ListOptions) ([]appsv1.StatefulSet, error) {
-	statefulsets, err := c.clientset.AppsV1().StatefulSets("").List(ctx, opts)
+// Restart a resource without changing its image, returning the applied restartedAt timestamp
+func (c *Client) RestartResource(kind, namespace, service string) (string, error) {
+	template, update, err := c.getPodTemplate(context.Background(), kind, namespace, service)
 	if err != nil {
-		return nil, err
+		return "", err
+	}
+	restartedAt := restartPodTemplate(template, c.clock.Now())
+	if err := update(); err != nil {
+		return "", err
 	}
-	return statefulsets.Items, nil
+	return restartedAt, nil
 }
 
-// List all daemonsets in the cluster
-func (c *Client) ListDaemonSets(ctx context.Context, opts metav1.ListOptions) ([]appsv1.DaemonSet, error) {
-	daemonsets, err := c.clientset.AppsV1().DaemonSets("").List(ctx, opts)
+// List the deployments of a namespace, all namespaces if empty
+func (c *Client) ListDeployments(ctx context.Context, namespace string, opts metav1.ListOptions) ([]appsv1.Deployment, error) {
+	return listNamespaced(ctx, c, "deployments", namespace, func(namespace string) ([]appsv1.Deployment, error) {
+		deployments, err := c.clientset.AppsV1().Deployments(namespace).List(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		return deployments.Items, nil
+	})
+}
+
+// List the statefulsets of a namespace, all namespaces if empty
+func (c *Client) ListStatefulSets(ctx context.Context, namespace string, opts metav1.ListOptions) ([]appsv1.StatefulSet, error) {
+	return listNamespaced(ctx, c, "statefulsets", namespace, func(namespace string) ([]appsv1.StatefulSet, error) {
+		statefulsets, err := c.clientset.AppsV1().StatefulSets(namespace).List(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		return statefulsets.Items, nil
+	})
+}
+
+// List the daemonsets of a namespace, all namespaces if empty
+func (c *Client) ListDaemonSets(ctx context.Context, namespace string, opts metav1.ListOptions) ([]appsv1.DaemonSet, error) {
+	return listNamespaced(ctx, c, "daemonsets", namespace, func(namespace string) ([]appsv1.DaemonSet, error) {
+		daemonsets, err := c.clientset.AppsV1().DaemonSets(namespace).List(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		return daemonsets.Items, nil
+	})
+}
+
+// List the pods of a namespace
+func (c *Client) ListPods(ctx context.Context, namespace string, opts metav1.ListOptions) ([]corev1.Pod, error) {
+	pods, err := c.clientset.CoreV1().Pods(namespace).List(ctx, opts)
 	if err != nil {
 		return nil, err
 	}
-	return daemonsets.Items, nil
+	return pods.Items, nil
 }
 
 // Get secret from the cluster
@@ -279,6 +542,23 @@ func (c *Client) GetSecret(ctx context.Context, namespace, name string) (*corev1
 	return c.clientset.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
 }
 
+// Get configmap from the cluster
+func (c *Client) GetConfigMap(ctx context.Context, namespace, name string) (*corev1.ConfigMap, error) {
+	return c.clientset.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+// Update configmap in the cluster
+func (c *Client) UpdateConfigMap(cm *corev1.ConfigMap) error {
+	_, err := c.clientset.CoreV1().ConfigMaps(cm.Namespace).Update(context.Background(), cm, metav1.UpdateOptions{})
+	return err
+}
+
+// Create configmap in the cluster
+func (c *Client) CreateConfigMap(cm *corev1.ConfigMap) error {
+	_, err := c.clientset.CoreV1().ConfigMaps(cm.Namespace).Create(context.Background(), cm, metav1.CreateOptions{})
+	return err
+}
+
 // Update deployment in the cluster
 func (c *Client) UpdateDeployment(deploy *appsv1.Deployment) error {
 	_, err := c.clientset.AppsV1().Deployments(deploy.Namespace).Update(context.Background(), deploy, metav1.UpdateOptions{})
@@ -296,3 +576,33 @@ func (c *Client) UpdateDaemonSet(ds *appsv1.DaemonSet) error {
 	_, err := c.clientset.AppsV1().DaemonSets(ds.Namespace).Update(context.Background(), ds, metav1.UpdateOptions{})
 	return err
 }
+
+// SetAnnotations sets annotations of a resource as stored in the cluster, leaving the rest of it unchanged
+func (c *Client) SetAnnotations(ctx context.Context, kind, namespace, name string, annotations map[string]string) error {
+	meta, _, update, err := c.getResource(ctx, kind, namespace, name)
+	if err != nil {
+		return err
+	}
+	if meta.Annotations == nil {
+		meta.Annotations = make(map[string]string)
+	}
+	for key, value := range annotations {
+		meta.Annotations[key] = value
+	}
+	return update()
+}
+
+// Get deployment from the cluster
+func (c *Client) GetDeployment(ctx context.Context, namespace, name string) (*appsv1.Deployment, error) {
+	return c.clientset.AppsV1().Deployments(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+// Get statefulset from the cluster
+func (c *Client) GetStatefulSet(ctx context.Context, namespace, name string) (*appsv1.StatefulSet, error) {
+	return c.clientset.AppsV1().StatefulSets(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+// Get daemonset from the cluster
+func (c *Client) GetDaemonSet(ctx context.Context, namespace, name string) (*appsv1.DaemonSet, error) {
+	return c.clientset.AppsV1().DaemonSets(namespace).Get(ctx, name, metav1.GetOptions{})
+}
@@ -0,0 +1,419 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/monlor/k8s-image-updater/pkg/clock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// Replace the config builder and retry delays for the duration of a test
+func withConfigBuilder(t *testing.T, builder func() (*rest.Config, error)) {
+	oldBuilder, oldInitial, oldMax := buildConfig, retryInitialDelay, retryMaxDelay
+	buildConfig = builder
+	retryInitialDelay, retryMaxDelay = time.Millisecond, 4*time.Millisecond
+	t.Cleanup(func() {
+		buildConfig, retryInitialDelay, retryMaxDelay = oldBuilder, oldInitial, oldMax
+	})
+}
+
+// Start a fake API server answering the version endpoint
+func newTestAPIServer(t *testing.T) *rest.Config {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/version" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, `{"major":"1","minor":"30","gitVersion":"v1.30.0"}`)
+	}))
+	t.Cleanup(server.Close)
+	return &rest.Config{Host: server.URL}
+}
+
+func TestGetClientWithRetry(t *testing.T) {
+	restConfig := newTestAPIServer(t)
+	attempts := 0
+	withConfigBuilder(t, func() (*rest.Config, error) {
+		attempts++
+		if attempts < 3 {
+			return nil, errors.New("service account token not mounted yet")
+		}
+		return restConfig, nil
+	})
+
+	client, err := GetClientWithRetry(time.Second)
+	require.NoError(t, err)
+	assert.NotNil(t, client)
+	assert.Equal(t, 3, attempts)
+}
+
+func TestGetClientWithRetryUnreachable(t *testing.T) {
+	// The config builds, but nothing is listening on the API server address
+	server := httptest.NewServer(http.NotFoundHandler())
+	host := server.URL
+	server.Close()
+	withConfigBuilder(t, func() (*rest.Config, error) {
+		return &rest.Config{Host: host}, nil
+	})
+
+	_, err := GetClientWithRetry(20 * time.Millisecond)
+	assert.ErrorContains(t, err, "giving up after")
+	assert.ErrorContains(t, err, "failed to reach kubernetes API server")
+}
+
+func TestGetClientWithRetryNoTimeout(t *testing.T) {
+	attempts := 0
+	withConfigBuilder(t, func() (*rest.Config, error) {
+		attempts++
+		return nil, errors.New("no config")
+	})
+
+	_, err := GetClientWithRetry(0)
+	assert.ErrorContains(t, err, "giving up after 1 attempts")
+	assert.Equal(t, 1, attempts)
+}
+
+func TestGetClientWithRetryClock(t *testing.T) {
+	attempts := 0
+	withConfigBuilder(t, func() (*rest.Config, error) {
+		attempts++
+		return nil, errors.New("no config")
+	})
+	fakeClock := clock.NewFake(time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC))
+	oldClock := retryClock
+	retryClock = fakeClock
+	t.Cleanup(func() { retryClock = oldClock })
+
+	// The waits of 1, 2 and 4ms only end once the clock is advanced, the next 4ms would pass the timeout
+	done := make(chan error)
+	go func() {
+		_, err := GetClientWithRetry(10 * time.Millisecond)
+		done <- err
+	}()
+	for {
+		select {
+		case err := <-done:
+			assert.ErrorContains(t, err, "giving up after 4 attempts")
+			assert.Equal(t, 4, attempts)
+			return
+		default:
+			if fakeClock.Waiters() > 0 {
+				fakeClock.Advance(time.Millisecond)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+func TestUpdateImageNoContainers(t *testing.T) {
+	meta := metav1.ObjectMeta{
+		Name:        "app",
+		Namespace:   "default",
+		Annotations: map[string]string{config.AnnotationPendingImage: "nginx:1.27"},
+	}
+	client := NewClient(fake.NewSimpleClientset(
+		&appsv1.Deployment{ObjectMeta: meta},
+		&appsv1.StatefulSet{ObjectMeta: meta},
+		&appsv1.DaemonSet{ObjectMeta: meta},
+	))
+
+	updates := map[string]func(namespace, service, container, image string) (*ImagePlan, error){
+		"deployment":  client.UpdateDeploymentImage,
+		"statefulset": client.UpdateStatefulSetImage,
+		"daemonset":   client.UpdateDaemonSetImage,
+	}
+	for kind, update := range updates {
+		t.Run(kind, func(t *testing.T) {
+			_, err := update("default", "app", "", "nginx:1.27")
+			assert.ErrorIs(t, err, ErrNoContainers)
+			assert.ErrorContains(t, err, kind+" default/app")
+
+			_, err = update("default", "app", "web", "nginx:1.27")
+			assert.ErrorIs(t, err, ErrNoContainers)
+
+			_, err = client.PlanImageUpdate(kind, "default", "app", "", "nginx:1.27", "")
+			assert.ErrorIs(t, err, ErrNoContainers)
+
+			_, err = client.ApprovePendingImage(context.Background(), kind, "default", "app", nil)
+			assert.ErrorIs(t, err, ErrNoContainers)
+		})
+	}
+}
+
+func TestRestartedAtClock(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	client := NewClient(fake.NewSimpleClientset(&appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app", Image: "nginx:latest", ImagePullPolicy: corev1.PullAlways}},
+		}}},
+	}))
+	fakeClock := clock.NewFake(now)
+	client.SetClock(fakeClock)
+	restartedAt := func() string {
+		deploy, err := client.GetDeployment(context.Background(), "default", "app")
+		require.NoError(t, err)
+		return deploy.Spec.Template.Annotations["kubectl.kubernetes.io/restartedAt"]
+	}
+
+	value, err := client.RestartResource("deployment", "default", "app")
+	require.NoError(t, err)
+	assert.Equal(t, "2024-06-01T12:00:00Z", value)
+	assert.Equal(t, value, restartedAt())
+
+	// Updating to the same image with pull policy Always restarts as well
+	fakeClock.Advance(time.Hour)
+	plan, err := client.ApplyImageUpdate("deployment", "default", "app", "", "nginx:latest", "")
+	require.NoError(t, err)
+	assert.Equal(t, ImageActionRestart, plan.Action)
+	assert.Equal(t, "2024-06-01T13:00:00Z", restartedAt())
+}
+
+func TestRestartOnSameImage(t *testing.T) {
+	tests := []struct {
+		name       string
+		annotation string
+		override   string
+		wantAction string
+	}{
+		{"default", "", "", ImageActionRestart},
+		{"annotation disabled", "false", "", ImageActionUpToDate},
+		{"annotation enabled", "true", "", ImageActionRestart},
+		{"parameter overrides annotation", "false", "true", ImageActionRestart},
+		{"parameter disabled", "", "false", ImageActionUpToDate},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			meta := metav1.ObjectMeta{Name: "app", Namespace: "default"}
+			if tt.annotation != "" {
+				meta.Annotations = map[string]string{config.AnnotationRestartOnSameImage: tt.annotation}
+			}
+			client := NewClient(fake.NewSimpleClientset(&appsv1.Deployment{
+				ObjectMeta: meta,
+				Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "app", Image: "nginx:latest", ImagePullPolicy: corev1.PullAlways}},
+				}}},
+			}))
+
+			plan, err := client.ApplyImageUpdate("deployment", "default", "app", "", "nginx:latest", tt.override)
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantAction, plan.Action)
+			deploy, err := client.GetDeployment(context.Background(), "default", "app")
+			require.NoError(t, err)
+			_, restarted := deploy.Spec.Template.Annotations[config.AnnotationRestart]
+			assert.Equal(t, tt.wantAction == ImageActionRestart, restarted)
+			if tt.wantAction == ImageActionUpToDate {
+				assert.Contains(t, plan.Message(), "already up to date")
+			}
+		})
+	}
+
+	t.Run("invalid annotation", func(t *testing.T) {
+		client := NewClient(fake.NewSimpleClientset(&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default", Annotations: map[string]string{config.AnnotationRestartOnSameImage: "sometimes"}},
+			Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "app", Image: "nginx:latest"}},
+			}}},
+		}))
+		_, err := client.UpdateDeploymentImage("default", "app", "", "nginx:latest")
+		assert.ErrorContains(t, err, config.AnnotationRestartOnSameImage)
+	})
+}
+
+func TestPlanImageUpdateIgnoringRegistry(t *testing.T) {
+	old := config.GlobalConfig.MatchImagesIgnoringRegistry
+	t.Cleanup(func() { config.GlobalConfig.MatchImagesIgnoringRegistry = old })
+	client := NewClient(fake.NewSimpleClientset(&appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app", Image: "docker.io/foo/bar:1.0"}},
+		}}},
+	}))
+
+	tests := []struct {
+		ignoreRegistry bool
+		image          string
+		want           string
+	}{
+		{false, "mirror.example.com/foo/bar:1.0", ImageActionUpdate},
+		{true, "mirror.example.com/foo/bar:1.0", ImageActionUpToDate},
+		{true, "mirror.example.com/foo/bar:1.1", ImageActionUpdate},
+		{true, "mirror.example.com/foo/baz:1.0", ImageActionUpdate},
+	}
+	for _, tt := range tests {
+		config.GlobalConfig.MatchImagesIgnoringRegistry = tt.ignoreRegistry
+		plan, err := client.PlanImageUpdate("deployment", "default", "app", "", tt.image, "")
+		require.NoError(t, err)
+		assert.Equal(t, tt.want, plan.Action, "%s ignoring registry %v", tt.image, tt.ignoreRegistry)
+	}
+}
+
+func TestPlanImageUpdateContainerPattern(t *testing.T) {
+	template := &corev1.PodTemplateSpec{Spec: corev1.PodSpec{Containers: []corev1.Container{
+		{Name: "app", Image: "app:1.0"},
+		{Name: "worker-a", Image: "worker:1.0"},
+		{Name: "worker-b", Image: "worker:1.0"},
+		{Name: "proxy-1", Image: "proxy:1.0"},
+	}}}
+
+	tests := []struct {
+		container string
+		want      string
+		wantErr   string
+	}{
+		{container: "", want: "app"},
+		{container: "app", want: "app"},
+		{container: "proxy-*", want: "proxy-1"},
+		{container: "worker-*", wantErr: "matches several containers (worker-a, worker-b)"},
+		{container: "db-*", wantErr: "container db-* not found in deployment"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.container, func(t *testing.T) {
+			plan, err := planImageUpdate("deployment", "default", "app", template, tt.container, "image:2.0", true)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, plan.Container)
+			assert.Equal(t, ImageActionUpdate, plan.Action)
+		})
+	}
+}
+
+func TestApplyImageUpdatePatchesContainer(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app", Image: "app:1.0"}, {Name: "worker", Image: "worker:1.0"}},
+		}}},
+	})
+	var patches []string
+	clientset.PrependReactor("patch", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patch := action.(k8stesting.PatchAction)
+		assert.Equal(t, types.JSONPatchType, patch.GetPatchType())
+		patches = append(patches, string(patch.GetPatch()))
+		return false, nil, nil
+	})
+	clientset.PrependReactor("update", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		t.Errorf("unexpected update of the whole deployment")
+		return false, nil, nil
+	})
+	client := NewClient(clientset)
+
+	plan, err := client.UpdateDeploymentImage("default", "app", "worker", "worker:2.0")
+	require.NoError(t, err)
+	assert.Equal(t, ImageActionUpdate, plan.Action)
+	require.Len(t, patches, 1)
+	assert.JSONEq(t, `[
+		{"op": "test", "path": "/spec/template/spec/containers/1/name", "value": "worker"},
+		{"op": "replace", "path": "/spec/template/spec/containers/1/image", "value": "worker:2.0"}
+	]`, patches[0])
+
+	deploy, err := client.GetDeployment(context.Background(), "default", "app")
+	require.NoError(t, err)
+	assert.Equal(t, "app:1.0", deploy.Spec.Template.Spec.Containers[0].Image)
+	assert.Equal(t, "worker:2.0", deploy.Spec.Template.Spec.Containers[1].Image)
+
+	// The patch fails rather than changing another container moved to the index
+	err = client.patchContainerImages(context.Background(), "deployment", "default", "app", []containerImagePatch{{0, "worker", "worker:3.0"}})
+	assert.Error(t, err)
+	deploy, err = client.GetDeployment(context.Background(), "default", "app")
+	require.NoError(t, err)
+	assert.Equal(t, "app:1.0", deploy.Spec.Template.Spec.Containers[0].Image)
+}
+
+func TestApplyImageUpdatesRestartsWithImageChanges(t *testing.T) {
+	for _, annotations := range []map[string]string{nil, {"team": "web"}} {
+		clientset := fake.NewSimpleClientset(&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+			Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Annotations: annotations},
+				Spec: corev1.PodSpec{Containers: []corev1.Container{
+					{Name: "app", Image: "app:1.0"},
+					{Name: "sidecar", Image: "sidecar:latest", ImagePullPolicy: corev1.PullAlways},
+				}},
+			}},
+		})
+		var patches int
+		clientset.PrependReactor("patch", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			patches++
+			return false, nil, nil
+		})
+		clientset.PrependReactor("update", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			t.Errorf("unexpected update of the whole deployment")
+			return false, nil, nil
+		})
+		client := NewClient(clientset)
+		client.SetClock(clock.NewFake(time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)))
+
+		// The sidecar keeps its image, it is restarted by the same patch changing the image of app
+		plans, err := client.ApplyImageUpdates("deployment", "default", "app", []ContainerImage{
+			{Name: "app", Image: "app:2.0"},
+			{Name: "sidecar", Image: "sidecar:latest"},
+		}, "")
+		require.NoError(t, err)
+		require.Len(t, plans, 2)
+		assert.Equal(t, ImageActionUpdate, plans[0].Plan.Action)
+		assert.Equal(t, ImageActionRestart, plans[1].Plan.Action)
+		require.Len(t, plans[1].Plan.Diff, 1)
+		assert.Equal(t, annotationPath(config.AnnotationRestart), plans[1].Plan.Diff[0].Path)
+		assert.Equal(t, 1, patches)
+
+		deploy, err := client.GetDeployment(context.Background(), "default", "app")
+		require.NoError(t, err)
+		assert.Equal(t, "app:2.0", deploy.Spec.Template.Spec.Containers[0].Image)
+		assert.Equal(t, "2024-06-01T12:00:00Z", deploy.Spec.Template.Annotations[config.AnnotationRestart])
+		if annotations != nil {
+			assert.Equal(t, "web", deploy.Spec.Template.Annotations["team"])
+		}
+	}
+}
+
+func TestApprovePendingImageVerifies(t *testing.T) {
+	client := NewClient(fake.NewSimpleClientset(&appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default", Annotations: map[string]string{
+			config.AnnotationPendingImage: "nginx:1.27",
+		}},
+		Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app", Image: "nginx:1.26"}},
+		}}},
+	}))
+	image := func() string {
+		_, template, err := client.GetWorkload(context.Background(), "deployment", "default", "app")
+		require.NoError(t, err)
+		return template.Spec.Containers[0].Image
+	}
+
+	var verified []string
+	rejected := errors.New("unverified")
+	_, err := client.ApprovePendingImage(context.Background(), "deployment", "default", "app", func(ctx context.Context, meta *metav1.ObjectMeta, template *corev1.PodTemplateSpec, images []string) error {
+		verified = images
+		return rejected
+	})
+	assert.ErrorIs(t, err, rejected)
+	assert.Equal(t, []string{"nginx:1.27"}, verified)
+	assert.Equal(t, "nginx:1.26", image())
+
+	_, err = client.ApprovePendingImage(context.Background(), "deployment", "default", "app", func(ctx context.Context, meta *metav1.ObjectMeta, template *corev1.PodTemplateSpec, images []string) error {
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "nginx:1.27", image())
+}
@@ -0,0 +1,81 @@
+package k8s
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/monlor/k8s-image-updater/config"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// ErrUnknownCluster is returned for a cluster that is not one of the contexts of KUBE_CONTEXTS
+var ErrUnknownCluster = errors.New("unknown cluster")
+
+// Cluster is the client of a cluster, named after its kubeconfig context
+type Cluster struct {
+	Name   string
+	Client *Client
+}
+
+// buildContextConfig builds the configuration of a kubeconfig context, replaced in tests
+var buildContextConfig = buildRestConfigForContext
+
+func buildRestConfigForContext(kubeContext string) (*rest.Config, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	if config.GlobalConfig.KubeConfig != "" {
+		rules.ExplicitPath = config.GlobalConfig.KubeConfig
+	}
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: kubeContext}
+	k8sConfig, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides).ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create kubernetes config of context %s: %v", kubeContext, err)
+	}
+	return k8sConfig, nil
+}
+
+// GetClusterClient creates the client of a cluster of KUBE_CONTEXTS. An empty cluster is the first context,
+// or the default configuration when KUBE_CONTEXTS is not set
+func GetClusterClient(cluster string) (*Client, error) {
+	contexts := config.GlobalConfig.Contexts()
+	if cluster == "" {
+		if len(contexts) == 0 {
+			return GetClient()
+		}
+		cluster = contexts[0]
+	}
+	if !slices.Contains(contexts, cluster) {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownCluster, cluster)
+	}
+	return newClient(func() (*rest.Config, error) { return buildContextConfig(cluster) })
+}
+
+// GetClusterClientWithRetry creates the client of a cluster like GetClusterClient, retrying like GetClientWithRetry
+func GetClusterClientWithRetry(cluster string, timeout time.Duration) (*Client, error) {
+	return connectWithRetry(func() (*Client, error) { return GetClusterClient(cluster) }, timeout)
+}
+
+// GetClustersWithRetry creates a client per context of KUBE_CONTEXTS, retrying each like GetClientWithRetry.
+// Without KUBE_CONTEXTS it returns a single unnamed cluster of the default configuration.
+func GetClustersWithRetry(timeout time.Duration) ([]Cluster, error) {
+	contexts := config.GlobalConfig.Contexts()
+	if len(contexts) == 0 {
+		client, err := GetClientWithRetry(timeout)
+		if err != nil {
+			return nil, err
+		}
+		return []Cluster{{Client: client}}, nil
+	}
+
+	clusters := make([]Cluster, 0, len(contexts))
+	for _, name := range contexts {
+		client, err := GetClusterClientWithRetry(name, timeout)
+		if err != nil {
+			return nil, fmt.Errorf("cluster %s: %v", name, err)
+		}
+		clusters = append(clusters, Cluster{Name: name, Client: client})
+	}
+	return clusters, nil
+}
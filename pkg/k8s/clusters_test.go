@@ -0,0 +1,80 @@
+package k8s
+
+import (
+	"testing"
+	"time"
+
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/rest"
+)
+
+// Serve each kubeconfig context from its own fake API server
+func withContexts(t *testing.T, contexts string) map[string]int {
+	oldContexts, oldBuilder := config.GlobalConfig.KubeContexts, buildContextConfig
+	config.GlobalConfig.KubeContexts = contexts
+	built := make(map[string]int)
+	servers := make(map[string]*rest.Config)
+	buildContextConfig = func(kubeContext string) (*rest.Config, error) {
+		built[kubeContext]++
+		if servers[kubeContext] == nil {
+			servers[kubeContext] = newTestAPIServer(t)
+		}
+		return servers[kubeContext], nil
+	}
+	t.Cleanup(func() {
+		config.GlobalConfig.KubeContexts, buildContextConfig = oldContexts, oldBuilder
+	})
+	return built
+}
+
+func TestGetClusterClient(t *testing.T) {
+	built := withContexts(t, "staging, prod")
+
+	_, err := GetClusterClient("prod")
+	require.NoError(t, err)
+	// The first context is the default cluster
+	_, err = GetClusterClient("")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"staging": 1, "prod": 1}, built)
+
+	_, err = GetClusterClient("dev")
+	assert.ErrorIs(t, err, ErrUnknownCluster)
+}
+
+func TestGetClusterClientWithoutContexts(t *testing.T) {
+	withContexts(t, "")
+	restConfig := newTestAPIServer(t)
+	withConfigBuilder(t, func() (*rest.Config, error) { return restConfig, nil })
+
+	client, err := GetClusterClient("")
+	require.NoError(t, err)
+	assert.NotNil(t, client)
+
+	_, err = GetClusterClient("prod")
+	assert.ErrorIs(t, err, ErrUnknownCluster)
+}
+
+func TestGetClustersWithRetry(t *testing.T) {
+	built := withContexts(t, "staging,prod")
+
+	clusters, err := GetClustersWithRetry(time.Second)
+	require.NoError(t, err)
+	require.Len(t, clusters, 2)
+	assert.Equal(t, "staging", clusters[0].Name)
+	assert.Equal(t, "prod", clusters[1].Name)
+	assert.NotSame(t, clusters[0].Client, clusters[1].Client)
+	assert.Equal(t, map[string]int{"staging": 1, "prod": 1}, built)
+}
+
+func TestGetClustersWithRetryDefault(t *testing.T) {
+	withContexts(t, "")
+	restConfig := newTestAPIServer(t)
+	withConfigBuilder(t, func() (*rest.Config, error) { return restConfig, nil })
+
+	clusters, err := GetClustersWithRetry(time.Second)
+	require.NoError(t, err)
+	require.Len(t, clusters, 1)
+	assert.Empty(t, clusters[0].Name)
+}
@@ -0,0 +1,56 @@
+package k8s
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// SpecChange is a field of the pod template changed by an update, named by its path in the resource,
+// e.g. spec.template.spec.containers[app].image. Old is empty when the field was added.
+type SpecChange struct {
+	Path string `json:"path"`
+	Old  string `json:"old,omitempty"`
+	New  string `json:"new"`
+}
+
+// templateDiff returns the container images and pod template annotations changed or added from before to after
+func templateDiff(before, after *corev1.PodTemplateSpec) []SpecChange {
+	changes := []SpecChange{}
+	images := make(map[string]string)
+	for _, c := range before.Spec.Containers {
+		images[c.Name] = c.Image
+	}
+	for _, c := range after.Spec.Containers {
+		if images[c.Name] != c.Image {
+			changes = append(changes, SpecChange{Path: imagePath(c.Name), Old: images[c.Name], New: c.Image})
+		}
+	}
+	for _, key := range slices.Sorted(maps.Keys(after.Annotations)) {
+		if before.Annotations[key] != after.Annotations[key] {
+			changes = append(changes, SpecChange{Path: annotationPath(key), Old: before.Annotations[key], New: after.Annotations[key]})
+		}
+	}
+	return changes
+}
+
+// imagePath returns the path of the image of a container in a SpecChange
+func imagePath(container string) string {
+	return fmt.Sprintf("spec.template.spec.containers[%s].image", container)
+}
+
+// annotationPath returns the path of an annotation of the pod template in a SpecChange
+func annotationPath(key string) string {
+	return fmt.Sprintf("spec.template.metadata.annotations[%s]", key)
+}
+
+// setContainerImage sets the image of a container of a pod template, once the image was patched in the cluster
+func setContainerImage(template *corev1.PodTemplateSpec, container, image string) {
+	for i := range template.Spec.Containers {
+		if template.Spec.Containers[i].Name == container {
+			template.Spec.Containers[i].Image = image
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package k8s
+
+import (
+	"errors"
+	"slices"
+	"strings"
+)
+
+// ErrUnsupportedKind is returned for a kind the HTTP API cannot update
+var ErrUnsupportedKind = errors.New("kind must be one of: deployment, statefulset, daemonset")
+
+// APIKinds are the kinds of resources the HTTP API updates and lists, the gRPC server adds the OpenKruise kinds
+var APIKinds = []string{"deployment", "statefulset", "daemonset"}
+
+// Aliases of the supported kinds, in the short and plural forms kubectl accepts
+var kindAliases = map[string]string{
+	"deploy":       "deployment",
+	"deployments":  "deployment",
+	"sts":          "statefulset",
+	"statefulsets": "statefulset",
+	"ds":           "daemonset",
+	"daemonsets":   "daemonset",
+}
+
+// NormalizeKind lowercases a kind and resolves its aliases, unknown kinds are returned lowercased
+func NormalizeKind(kind string) string {
+	kind = strings.ToLower(strings.TrimSpace(kind))
+	if canonical, ok := kindAliases[kind]; ok {
+		return canonical
+	}
+	return kind
+}
+
+// ValidateKind checks a normalized kind is one of APIKinds
+func ValidateKind(kind string) error {
+	if !slices.Contains(APIKinds, kind) {
+		return ErrUnsupportedKind
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// Kinds of the OpenKruise workloads updated with ENABLE_KRUISE
+const (
+	KindCloneSet            = "cloneset"
+	KindAdvancedStatefulSet = "advancedstatefulset"
+)
+
+// KruiseResources are the API resources of the OpenKruise workload kinds
+var KruiseResources = map[string]schema.GroupVersionResource{
+	KindCloneSet:            {Group: "apps.kruise.io", Version: "v1alpha1", Resource: "clonesets"},
+	KindAdvancedStatefulSet: {Group: "apps.kruise.io", Version: "v1beta1", Resource: "statefulsets"},
+}
+
+// KruiseWorkload is an OpenKruise workload read with the dynamic client. Its metadata and pod template are
+// decoded to be checked like the built-in kinds, and written back into the object on update.
+type KruiseWorkload struct {
+	Kind string
+	metav1.ObjectMeta
+	Template corev1.PodTemplateSpec
+	Selector *metav1.LabelSelector
+	// Rolling updates are paused, spec.updateStrategy.paused of a CloneSet or
+	// spec.updateStrategy.rollingUpdate.paused of an Advanced StatefulSet
+	Paused bool
+
+	object *unstructured.Unstructured
+}
+
+// kruiseObject holds the fields of an OpenKruise workload the updater reads
+type kruiseObject struct {
+	Metadata metav1.ObjectMeta `json:"metadata"`
+	Spec     struct {
+		Selector       *metav1.LabelSelector  `json:"selector"`
+		Template       corev1.PodTemplateSpec `json:"template"`
+		UpdateStrategy struct {
+			Paused        bool `json:"paused"`
+			RollingUpdate *struct {
+				Paused bool `json:"paused"`
+			} `json:"rollingUpdate"`
+		} `json:"updateStrategy"`
+	} `json:"spec"`
+}
+
+// newKruiseWorkload decodes an OpenKruise workload of the given kind
+func newKruiseWorkload(kind string, object *unstructured.Unstructured) (*KruiseWorkload, error) {
+	var decoded kruiseObject
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(object.Object, &decoded); err != nil {
+		return nil, fmt.Errorf("failed to decode %s %s/%s: %v", kind, object.GetNamespace(), object.GetName(), err)
+	}
+	strategy := decoded.Spec.UpdateStrategy
+	return &KruiseWorkload{
+		Kind:       kind,
+		ObjectMeta: decoded.Metadata,
+		Template:   decoded.Spec.Template,
+		Selector:   decoded.Spec.Selector,
+		Paused:     strategy.Paused || (strategy.RollingUpdate != nil && strategy.RollingUpdate.Paused),
+		object:     object,
+	}, nil
+}
+
+// kruiseResource returns the API resource of an OpenKruise kind, failing when the client has no dynamic client
+func (c *Client) kruiseResource(kind string) (schema.GroupVersionResource, error) {
+	gvr, ok := KruiseResources[kind]
+	if !ok {
+		return gvr, fmt.Errorf("unsupported kind: %s", kind)
+	}
+	if c.dynamic == nil {
+		return gvr, fmt.Errorf("no dynamic client to read %s resources", kind)
+	}
+	return gvr, nil
+}
+
+// ListKruiseWorkloads lists the OpenKruise workloads of a kind in a namespace, all namespaces if empty
+func (c *Client) ListKruiseWorkloads(ctx context.Context, kind, namespace string, opts metav1.ListOptions) ([]KruiseWorkload, error) {
+	gvr, err := c.kruiseResource(kind)
+	if err != nil {
+		return nil, err
+	}
+	return listNamespaced(ctx, c, gvr.Resource, namespace, func(namespace string) ([]KruiseWorkload, error) {
+		list, err := c.dynamic.Resource(gvr).Namespace(namespace).List(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		workloads := make([]KruiseWorkload, 0, len(list.Items))
+		for i := range list.Items {
+			workload, err := newKruiseWorkload(kind, &list.Items[i])
+			if err != nil {
+				return nil, err
+			}
+			workloads = append(workloads, *workload)
+		}
+		return workloads, nil
+	})
+}
+
+// GetKruiseWorkload gets an OpenKruise workload from the cluster
+func (c *Client) GetKruiseWorkload(ctx context.Context, kind, namespace, name string) (*KruiseWorkload, error) {
+	gvr, err := c.kruiseResource(kind)
+	if err != nil {
+		return nil, err
+	}
+	object, err := c.dynamic.Resource(gvr).Namespace(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return newKruiseWorkload(kind, object)
+}
+
+// UpdateKruiseWorkload writes the annotations and pod template of an OpenKruise workload back to the cluster,
+// leaving its other fields as read
+func (c *Client) UpdateKruiseWorkload(w *KruiseWorkload) error {
+	gvr, err := c.kruiseResource(w.Kind)
+	if err != nil {
+		return err
+	}
+	template, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&w.Template)
+	if err != nil {
+		return fmt.Errorf("failed to encode pod template of %s %s/%s: %v", w.Kind, w.Namespace, w.Name, err)
+	}
+	object := w.object.DeepCopy()
+	object.SetAnnotations(w.Annotations)
+	if err := unstructured.SetNestedMap(object.Object, template, "spec", "template"); err != nil {
+		return err
+	}
+	updated, err := c.dynamic.Resource(gvr).Namespace(w.Namespace).Update(context.Background(), object, metav1.UpdateOptions{})
+	if err != nil {
+		return err
+	}
+	w.object = updated
+	return nil
+}
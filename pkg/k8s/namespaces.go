@@ -0,0 +1,89 @@
+package k8s
+
+import (
+	"context"
+	"slices"
+	"strings"
+
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/sirupsen/logrus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// listNamespaced lists the items of a kind in a namespace, or in all namespaces if empty. With NAMESPACED_RBAC
+// all namespaces are the namespaces of ALLOWED_NAMESPACES, listed one by one so a Role in each of them suffices.
+// Otherwise, when RBAC forbids listing them cluster-wide and ALLOWED_NAMESPACES is set, the allowed namespaces
+// are listed one by one as well.
+func listNamespaced[T any](ctx context.Context, c *Client, kind, namespace string, list func(namespace string) ([]T, error)) ([]T, error) {
+	if namespace != metav1.NamespaceAll {
+		return list(namespace)
+	}
+	if config.GlobalConfig.NamespacedRBAC {
+		namespaces, err := config.GlobalConfig.RBACNamespaces()
+		if err != nil {
+			return nil, err
+		}
+		return listEachNamespace(kind, namespaces, list)
+	}
+
+	items, err := list(metav1.NamespaceAll)
+	if err == nil || !apierrors.IsForbidden(err) || config.GlobalConfig.AllowedNamespaces == "" {
+		return items, err
+	}
+	logrus.Debugf("Listing %s in all namespaces is forbidden, listing the allowed namespaces one by one", kind)
+
+	namespaces := c.allowedNamespaces(ctx)
+	items, listErr := listEachNamespace(kind, namespaces, list)
+	// Nothing could be listed, the original error explains why
+	if len(namespaces) == 0 || apierrors.IsForbidden(listErr) {
+		return nil, err
+	}
+	return items, listErr
+}
+
+// listEachNamespace lists the items of a kind in each namespace, skipping those still forbidden. It fails with
+// the forbidden error when none of the namespaces can be listed.
+func listEachNamespace[T any](kind string, namespaces []string, list func(namespace string) ([]T, error)) ([]T, error) {
+	var items []T
+	var inaccessible []string
+	var forbidden error
+	for _, namespace := range namespaces {
+		namespaceItems, err := list(namespace)
+		if apierrors.IsForbidden(err) {
+			inaccessible = append(inaccessible, namespace)
+			forbidden = err
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		items = append(items, namespaceItems...)
+	}
+	if len(inaccessible) > 0 && len(inaccessible) == len(namespaces) {
+		return nil, forbidden
+	}
+	if len(inaccessible) > 0 {
+		logrus.Warnf("Listing %s is forbidden in namespaces %s, they are not updated", kind, strings.Join(inaccessible, ", "))
+	}
+	return items, nil
+}
+
+// allowedNamespaces returns the namespaces of ALLOWED_NAMESPACES, resolving glob patterns against the namespaces
+// of the cluster when they may be listed
+func (c *Client) allowedNamespaces(ctx context.Context) []string {
+	names, patterns := config.GlobalConfig.AllowedNamespaceEntries()
+	if len(patterns) == 0 {
+		return names
+	}
+	list, err := c.clientset.CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		logrus.Warnf("Failed to list namespaces matching %s: %v", strings.Join(patterns, ", "), err)
+		return names
+	}
+	for _, namespace := range list.Items {
+		if config.GlobalConfig.NamespaceAllowed(namespace.Name) && !slices.Contains(names, namespace.Name) {
+			names = append(names, namespace.Name)
+		}
+	}
+	return names
+}
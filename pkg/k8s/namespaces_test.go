@@ -0,0 +1,128 @@
+package k8s
+
+import (
+	"context"
+	"testing"
+
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestListDeploymentsForbiddenClusterWide(t *testing.T) {
+	var objects []runtime.Object
+	for _, namespace := range []string{"team-a", "team-b", "other"} {
+		objects = append(objects,
+			&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace}},
+			&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: namespace}})
+	}
+	clientset := fake.NewSimpleClientset(objects...)
+	// The service account may only list deployments in team-a and other
+	clientset.PrependReactor("list", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if namespace := action.GetNamespace(); namespace == "" || namespace == "team-b" {
+			return true, nil, apierrors.NewForbidden(schema.GroupResource{Group: "apps", Resource: "deployments"}, "", nil)
+		}
+		return false, nil, nil
+	})
+	client := NewClient(clientset)
+
+	oldAllowed := config.GlobalConfig.AllowedNamespaces
+	t.Cleanup(func() { config.GlobalConfig.AllowedNamespaces = oldAllowed })
+
+	tests := []struct {
+		name       string
+		allowed    string
+		want       []string
+		wantForbid bool
+	}{
+		{name: "no allowed namespaces", wantForbid: true},
+		{name: "names", allowed: "team-a,team-b", want: []string{"team-a"}},
+		{name: "patterns", allowed: "team-*,other", want: []string{"other", "team-a"}},
+		{name: "all forbidden", allowed: "team-b", wantForbid: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.GlobalConfig.AllowedNamespaces = tt.allowed
+			deployments, err := client.ListDeployments(context.Background(), metav1.NamespaceAll, metav1.ListOptions{})
+			if tt.wantForbid {
+				assert.True(t, apierrors.IsForbidden(err), err)
+				return
+			}
+			require.NoError(t, err)
+			var namespaces []string
+			for _, deploy := range deployments {
+				namespaces = append(namespaces, deploy.Namespace)
+			}
+			assert.ElementsMatch(t, tt.want, namespaces)
+		})
+	}
+}
+
+func TestNamespacedRBAC(t *testing.T) {
+	var objects []runtime.Object
+	for _, namespace := range []string{"team-a", "team-b", "other"} {
+		meta := metav1.ObjectMeta{Name: "app", Namespace: namespace}
+		objects = append(objects, &appsv1.Deployment{ObjectMeta: meta}, &appsv1.StatefulSet{ObjectMeta: meta}, &appsv1.DaemonSet{ObjectMeta: meta})
+	}
+	clientset := fake.NewSimpleClientset(objects...)
+	// Only Roles in the namespaces are granted, nothing may be read cluster-wide
+	var listed []string
+	clientset.PrependReactor("list", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		listed = append(listed, action.GetResource().Resource+"/"+action.GetNamespace())
+		if action.GetNamespace() == "" {
+			return true, nil, apierrors.NewForbidden(action.GetResource().GroupResource(), "", nil)
+		}
+		return false, nil, nil
+	})
+	client := NewClient(clientset)
+
+	oldAllowed, oldNamespaced := config.GlobalConfig.AllowedNamespaces, config.GlobalConfig.NamespacedRBAC
+	t.Cleanup(func() {
+		config.GlobalConfig.AllowedNamespaces, config.GlobalConfig.NamespacedRBAC = oldAllowed, oldNamespaced
+	})
+	config.GlobalConfig.AllowedNamespaces = "team-a,team-b"
+	config.GlobalConfig.NamespacedRBAC = true
+	ctx := context.Background()
+	namespaces := func(metas ...metav1.ObjectMeta) []string {
+		var result []string
+		for _, meta := range metas {
+			result = append(result, meta.Namespace)
+		}
+		return result
+	}
+
+	deployments, err := client.ListDeployments(ctx, metav1.NamespaceAll, metav1.ListOptions{})
+	require.NoError(t, err)
+	statefulsets, err := client.ListStatefulSets(ctx, metav1.NamespaceAll, metav1.ListOptions{})
+	require.NoError(t, err)
+	daemonsets, err := client.ListDaemonSets(ctx, metav1.NamespaceAll, metav1.ListOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"team-a", "team-b"}, namespaces(deployments[0].ObjectMeta, deployments[1].ObjectMeta))
+	assert.Len(t, statefulsets, 2)
+	assert.Len(t, daemonsets, 2)
+	assert.Equal(t, []string{
+		"deployments/team-a", "deployments/team-b",
+		"statefulsets/team-a", "statefulsets/team-b",
+		"daemonsets/team-a", "daemonsets/team-b",
+	}, listed)
+
+	// A single namespace is listed alone
+	listed = nil
+	deployments, err = client.ListDeployments(ctx, "team-b", metav1.ListOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"team-b"}, namespaces(deployments[0].ObjectMeta))
+	assert.Equal(t, []string{"deployments/team-b"}, listed)
+
+	// Patterns would need to list the namespaces of the cluster
+	config.GlobalConfig.AllowedNamespaces = "team-*"
+	_, err = client.ListDeployments(ctx, metav1.NamespaceAll, metav1.ListOptions{})
+	assert.ErrorContains(t, err, "NAMESPACED_RBAC")
+}
@@ -0,0 +1,106 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/monlor/k8s-image-updater/config"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Resource summarizes a resource enabled for auto-update
+type Resource struct {
+	Kind       string           `json:"kind"`
+	Namespace  string           `json:"namespace"`
+	Name       string           `json:"name"`
+	Mode       string           `json:"mode"`
+	Status     string           `json:"status,omitempty"`
+	Containers []ContainerImage `json:"containers"`
+	// Annotations of the resource, to resolve the settings of its containers
+	Annotations map[string]string `json:"-"`
+}
+
+// ContainerImage is the image of a container
+type ContainerImage struct {
+	Name  string `json:"name"`
+	Image string `json:"image"`
+}
+
+// ResourcePage is a page of resources, Continue is the token of the next page or empty on the last page
+type ResourcePage struct {
+	Items    []Resource
+	Continue string
+}
+
+// ListResources lists a page of resources of a kind in a namespace, all namespaces if empty.
+// opts.Limit and opts.Continue are passed to the API server, which paginates the list.
+func (c *Client) ListResources(ctx context.Context, kind, namespace string, opts metav1.ListOptions) (*ResourcePage, error) {
+	page := &ResourcePage{}
+	switch kind {
+	case "deployment":
+		list, err := c.clientset.AppsV1().Deployments(namespace).List(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range list.Items {
+			page.Items = append(page.Items, newResource(kind, &item.ObjectMeta, &item.Spec.Template))
+		}
+		page.Continue = list.Continue
+	case "statefulset":
+		list, err := c.clientset.AppsV1().StatefulSets(namespace).List(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range list.Items {
+			page.Items = append(page.Items, newResource(kind, &item.ObjectMeta, &item.Spec.Template))
+		}
+		page.Continue = list.Continue
+	case "daemonset":
+		list, err := c.clientset.AppsV1().DaemonSets(namespace).List(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range list.Items {
+			page.Items = append(page.Items, newResource(kind, &item.ObjectMeta, &item.Spec.Template))
+		}
+		page.Continue = list.Continue
+	case KindCloneSet, KindAdvancedStatefulSet:
+		gvr, err := c.kruiseResource(kind)
+		if err != nil {
+			return nil, err
+		}
+		list, err := c.dynamic.Resource(gvr).Namespace(namespace).List(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		for i := range list.Items {
+			workload, err := newKruiseWorkload(kind, &list.Items[i])
+			if err != nil {
+				return nil, err
+			}
+			page.Items = append(page.Items, newResource(kind, &workload.ObjectMeta, &workload.Template))
+		}
+		page.Continue = list.GetContinue()
+	default:
+		return nil, fmt.Errorf("unsupported kind: %s", kind)
+	}
+	return page, nil
+}
+
+func newResource(kind string, meta *metav1.ObjectMeta, template *corev1.PodTemplateSpec) Resource {
+	mode := config.GlobalConfig.ResourceMode(meta.Annotations[config.AnnotationMode])
+	resource := Resource{
+		Kind:        kind,
+		Namespace:   meta.Namespace,
+		Name:        meta.Name,
+		Mode:        mode,
+		Status:      meta.Annotations[config.AnnotationStatus],
+		Containers:  []ContainerImage{},
+		Annotations: meta.Annotations,
+	}
+	for _, container := range template.Spec.Containers {
+		resource.Containers = append(resource.Containers, ContainerImage{Name: container.Name, Image: container.Image})
+	}
+	return resource
+}
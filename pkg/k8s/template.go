@@ -0,0 +1,64 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/monlor/k8s-image-updater/pkg/registry"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// ErrInvalidImageTemplate is returned when an image template does not resolve to a valid image
+var ErrInvalidImageTemplate = errors.New("invalid image template")
+
+// DefaultImageTemplate applies a tag to the current image of the container
+const DefaultImageTemplate = "{image}:{tag}"
+
+// resolveImageTemplate substitutes {image}, the current image of a container without tag and digest as written,
+// and {tag} in an image template
+func resolveImageTemplate(kind string, template *corev1.PodTemplateSpec, container, imageTemplate, tag string) (string, error) {
+	if template == nil || len(template.Spec.Containers) == 0 {
+		return "", fmt.Errorf("%w %s", ErrNoContainers, kind)
+	}
+	if strings.Contains(imageTemplate, "{tag}") && tag == "" {
+		return "", fmt.Errorf("%w %s: a tag is required", ErrInvalidImageTemplate, imageTemplate)
+	}
+	// If container is empty, use the first container
+	if container == "" {
+		container = template.Spec.Containers[0].Name
+	}
+	container, err := matchContainer(template, container)
+	if err != nil {
+		return "", fmt.Errorf("%v in %s", err, kind)
+	}
+
+	var current string
+	for _, c := range template.Spec.Containers {
+		if c.Name == container {
+			current = c.Image
+		}
+	}
+	currentInfo, err := registry.ParseImage(current)
+	if err != nil {
+		return "", fmt.Errorf("%w %s: current image %s of container %s cannot be parsed: %v", ErrInvalidImageTemplate, imageTemplate, current, container, err)
+	}
+	base := registry.BuildImageRefStyle(currentInfo, "", "", config.ImageNamePreserve)
+	image := strings.NewReplacer("{image}", base, "{tag}", tag).Replace(imageTemplate)
+	if _, err := registry.ParseImage(image); err != nil {
+		return "", fmt.Errorf("%w %s: %s is not a valid image: %v", ErrInvalidImageTemplate, imageTemplate, image, err)
+	}
+	return image, nil
+}
+
+// ResolveImageTemplate resolves an image template against the current image of a container of a resource, the
+// first one when container is empty
+func (c *Client) ResolveImageTemplate(kind, namespace, service, container, imageTemplate, tag string) (string, error) {
+	_, template, _, err := c.getResource(context.Background(), kind, namespace, service)
+	if err != nil {
+		return "", err
+	}
+	return resolveImageTemplate(kind, template, container, imageTemplate, tag)
+}
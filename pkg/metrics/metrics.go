@@ -0,0 +1,90 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Prometheus metrics of the updater, served on /metrics
+var (
+	// Images skipped because their signature could not be verified
+	SignatureVerificationFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "image_updater_signature_verification_failures_total",
+		Help: "Number of image updates skipped because the image signature could not be verified",
+	}, []string{"kind", "namespace", "name"})
+
+	// Failed writes of updated resources, e.g. rejected by an admission webhook
+	ApplyFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "image_updater_apply_failures_total",
+		Help: "Number of failed writes of updated resources",
+	}, []string{"kind", "namespace", "name"})
+
+	// Duration of registry requests, by registry host and operation
+	RegistryRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "image_updater_registry_request_duration_seconds",
+		Help:    "Duration of registry requests in seconds",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"registry", "operation"})
+
+	// Requests left before the registry rate limits, from its RateLimit-Remaining header
+	RegistryRateLimitRemaining = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "image_updater_registry_rate_limit_remaining",
+		Help: "Remaining registry requests reported by the last RateLimit-Remaining response header",
+	}, []string{"registry"})
+
+	// When the rate limit of a registry that answered 429 resets, requests to it are held back until then
+	RegistryRateLimitReset = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "image_updater_registry_rate_limit_reset_timestamp_seconds",
+		Help: "Unix time at which the rate limit of a registry that answered 429 resets",
+	}, []string{"registry"})
+
+	// Newer allowed versions than the current image of a container in release or review mode
+	VersionsBehind = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "image_updater_versions_behind",
+		Help: "Number of allowed versions newer than the current image of a container",
+	}, []string{"namespace", "kind", "name", "container"})
+
+	// Whether FREEZE_ON_CRASHLOOP froze rollouts, until they are unfrozen through the API
+	RolloutsFrozen = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "image_updater_rollouts_frozen",
+		Help: "1 while rollouts are frozen because the pods of an update crash loop, 0 otherwise",
+	})
+
+	// Updates skipped for a reason the owner of the resource could easily miss, to alert on silent skips
+	SkippedUpdates = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "image_updater_skipped_total",
+		Help: "Number of image updates skipped, by reason",
+	}, []string{"reason"})
+)
+
+// Reasons of SkippedUpdates
+const (
+	// Latest mode container whose imagePullPolicy is not Always
+	SkipReasonPullPolicy = "pull-policy"
+	// Paused deployment, with RESPECT_PAUSED
+	SkipReasonPaused = "paused"
+	// Statefulset or daemonset using the OnDelete update strategy, with RESPECT_PAUSED
+	SkipReasonOnDelete = "on-delete"
+	// Images that made the canary unhealthy, they are not retried
+	SkipReasonUnhealthy = "unhealthy"
+	// The allow-tags filter matched no tags, or no newer tag has the required annotation
+	SkipReasonNoMatchingTags = "no-matching-tags"
+	// Image matching a GLOBAL_IMAGE_EXCLUDES pattern
+	SkipReasonExcluded = "excluded"
+	// Image of a registry missing from ALLOWED_REGISTRIES
+	SkipReasonRegistryNotAllowed = "registry-not-allowed"
+	// Sidecar injected by an admission webhook, matching IGNORED_CONTAINER_NAMES or the injected-containers annotation
+	SkipReasonInjected = "injected"
+	// Update undoing or redoing an update applied within FLAP_DETECTION_WINDOW
+	SkipReasonFlapping = "flapping"
+	// New image whose size changed by more than the max-size-change annotation allows
+	SkipReasonSizeChange = "size-change"
+	// Container image that cannot be parsed as an image reference
+	SkipReasonUnparseableImage = "unparseable-image"
+	// Container sharing the name targeted by the container annotation with an earlier container
+	SkipReasonDuplicateContainer = "duplicate-container"
+	// No newer image has a digest of the allowed-digests annotation
+	SkipReasonDigestNotAllowed = "digest-not-allowed"
+	// Rollout held back while rollouts are frozen, with FREEZE_ON_CRASHLOOP
+	SkipReasonFrozen = "frozen"
+)
@@ -0,0 +1,90 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// GetImageAnnotations fetches the OCI annotations of an image, merged with the labels of its config.
+// Manifest annotations take precedence over labels, and for multi-platform images the index annotations
+// take precedence over those of the linux/amd64 image.
+func (c *RegistryClient) GetImageAnnotations(ctx context.Context, image string) (map[string]string, error) {
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse image reference: %v", err)
+	}
+
+	desc, err := remote.Get(ref, c.options(ctx, ref.Context().RegistryStr())...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get image descriptor: %w", wrapRegistryError(err))
+	}
+
+	annotations := make(map[string]string)
+	var indexAnnotations map[string]string
+	isIndex := desc.MediaType.IsIndex()
+	if isIndex {
+		index, err := desc.ImageIndex()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read image index of %s: %v", image, err)
+		}
+		manifest, err := index.IndexManifest()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read index manifest of %s: %v", image, err)
+		}
+		indexAnnotations = manifest.Annotations
+	}
+
+	// For an index this resolves the linux/amd64 image
+	img, err := desc.Image()
+	if err != nil {
+		if isIndex {
+			// An index without a linux/amd64 image only has its own annotations
+			maps.Copy(annotations, indexAnnotations)
+			return annotations, nil
+		}
+		return nil, fmt.Errorf("failed to read image %s: %v", image, err)
+	}
+	configFile, err := img.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config of %s: %w", image, wrapRegistryError(err))
+	}
+	maps.Copy(annotations, configFile.Config.Labels)
+	manifest, err := img.Manifest()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest of %s: %v", image, err)
+	}
+	maps.Copy(annotations, manifest.Annotations)
+	maps.Copy(annotations, indexAnnotations)
+	return annotations, nil
+}
+
+// GetCreatedTime fetches the creation time recorded in the config of an image, for multi-platform images
+// the config of the linux/amd64 image. An image without creation time is an error.
+func (c *RegistryClient) GetCreatedTime(ctx context.Context, image string) (time.Time, error) {
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to parse image reference: %v", err)
+	}
+
+	desc, err := remote.Get(ref, c.options(ctx, ref.Context().RegistryStr())...)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to get image descriptor: %w", wrapRegistryError(err))
+	}
+	img, err := desc.Image()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to read image %s: %v", image, err)
+	}
+	configFile, err := img.ConfigFile()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to read config of %s: %w", image, wrapRegistryError(err))
+	}
+	if configFile.Created.IsZero() {
+		return time.Time{}, fmt.Errorf("image %s has no creation time", image)
+	}
+	return configFile.Created.Time, nil
+}
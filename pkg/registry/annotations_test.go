@@ -0,0 +1,101 @@
+package registry
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	ggcrregistry "github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Build a random image with the given config labels and manifest annotations
+func newAnnotatedImage(t *testing.T, labels, annotations map[string]string) v1.Image {
+	img, err := random.Image(256, 1)
+	require.NoError(t, err)
+	img, err = mutate.Config(img, v1.Config{Labels: labels})
+	require.NoError(t, err)
+	return mutate.Annotations(img, annotations).(v1.Image)
+}
+
+func TestGetImageAnnotations(t *testing.T) {
+	server := httptest.NewServer(ggcrregistry.New(ggcrregistry.Logger(log.New(io.Discard, "", 0))))
+	t.Cleanup(server.Close)
+	repository := strings.TrimPrefix(server.URL, "http://") + "/app"
+
+	img := newAnnotatedImage(t,
+		map[string]string{"org.opencontainers.image.stability": "beta", "maintainer": "ops"},
+		map[string]string{"org.opencontainers.image.stability": "stable"},
+	)
+	ref, err := name.ParseReference(repository + ":image")
+	require.NoError(t, err)
+	require.NoError(t, remote.Write(ref, img))
+
+	index := mutate.IndexMediaType(empty.Index, types.OCIImageIndex)
+	index = mutate.AppendManifests(index, mutate.IndexAddendum{
+		Add:        img,
+		Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: "amd64"}},
+	})
+	index = mutate.Annotations(index, map[string]string{"org.opencontainers.image.stability": "rc"}).(v1.ImageIndex)
+	ref, err = name.ParseReference(repository + ":index")
+	require.NoError(t, err)
+	require.NoError(t, remote.WriteIndex(ref, index))
+
+	client := NewRegistryClient("", "")
+	ctx := context.Background()
+
+	// Manifest annotations take precedence over config labels
+	annotations, err := client.GetImageAnnotations(ctx, repository+":image")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"org.opencontainers.image.stability": "stable", "maintainer": "ops"}, annotations)
+
+	// Index annotations take precedence over those of the image
+	annotations, err = client.GetImageAnnotations(ctx, repository+":index")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"org.opencontainers.image.stability": "rc", "maintainer": "ops"}, annotations)
+
+	_, err = client.GetImageAnnotations(ctx, repository+":missing")
+	assert.ErrorIs(t, err, ErrManifestUnknown)
+}
+
+func TestGetCreatedTime(t *testing.T) {
+	server := httptest.NewServer(ggcrregistry.New(ggcrregistry.Logger(log.New(io.Discard, "", 0))))
+	t.Cleanup(server.Close)
+	repository := strings.TrimPrefix(server.URL, "http://") + "/app"
+
+	created := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	img, err := random.Image(256, 1)
+	require.NoError(t, err)
+	createdImg, err := mutate.CreatedAt(img, v1.Time{Time: created})
+	require.NoError(t, err)
+	for tag, image := range map[string]v1.Image{"created": createdImg, "unknown": img} {
+		ref, err := name.ParseReference(repository + ":" + tag)
+		require.NoError(t, err)
+		require.NoError(t, remote.Write(ref, image))
+	}
+
+	client := NewRegistryClient("", "")
+	ctx := context.Background()
+
+	got, err := client.GetCreatedTime(ctx, repository+":created")
+	require.NoError(t, err)
+	assert.True(t, created.Equal(got), got)
+
+	_, err = client.GetCreatedTime(ctx, repository+":unknown")
+	assert.ErrorContains(t, err, "no creation time")
+
+	_, err = client.GetCreatedTime(ctx, repository+":missing")
+	assert.ErrorIs(t, err, ErrManifestUnknown)
+}
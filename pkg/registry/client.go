@@ -2,25 +2,83 @@ package registry
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"net/http"
+	"path"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/hashicorp/go-version"
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/monlor/k8s-image-updater/pkg/metrics"
+	"github.com/sirupsen/logrus"
 )
 
+// Upper bound of tag list pages read for a single repository
+const maxTagPages = 1000
+
 type ImageInfo struct {
 	Registry   string
 	Repository string
 	Tag        string
 	Digest     string
+
+	// Registry and repository as written in the parsed reference, e.g. nginx or library/nginx
+	name string
+}
+
+// Base returns the image without tag and digest, to append a new tag or digest to, named in the IMAGE_NAME_STYLE style
+func (i *ImageInfo) Base() string {
+	return BuildImageRef(i, "", "")
+}
+
+// BuildImageRef writes the reference of an image with a tag, a digest or both, named in the IMAGE_NAME_STYLE style.
+// It is used for the images written by the updater.
+func BuildImageRef(info *ImageInfo, tag, digest string) string {
+	style, err := config.GlobalConfig.NameStyle()
+	if err != nil {
+		style = config.ImageNameFull
+	}
+	return BuildImageRefStyle(info, tag, digest, style)
+}
+
+// BuildImageRefStyle writes the reference of an image with a tag, a digest or both, named in the given style:
+//   - full: the registry host and full repository, e.g. index.docker.io/library/nginx
+//   - preserve: the name as written in the parsed reference, so short names such as nginx stay short
+//   - short: Docker Hub images without registry host and library/ namespace, e.g. nginx or org/app, others in full
+func BuildImageRefStyle(info *ImageInfo, tag, digest, style string) string {
+	ref := info.Registry + "/" + info.Repository
+	switch style {
+	case config.ImageNamePreserve:
+		if info.name != "" {
+			ref = info.name
+		}
+	case config.ImageNameShort:
+		if info.Registry == name.DefaultRegistry {
+			ref = repositoryPath(info.Repository)
+		}
+	}
+	if tag != "" {
+		ref += ":" + tag
+	}
+	if digest != "" {
+		ref += "@" + digest
+	}
+	return ref
 }
 
 type RegistryClient struct {
 	auth authn.Authenticator
+	// Transport of the resource the client is for, from TLSTransport, nil for the shared ones
+	transport http.RoundTripper
 }
 
 func NewRegistryClient(username, password string) *RegistryClient {
@@ -36,6 +94,47 @@ func NewRegistryClient(username, password string) *RegistryClient {
 	return &RegistryClient{auth: auth}
 }
 
+// Username of the credentials of the client, empty for anonymous access
+func (c *RegistryClient) Username() string {
+	if basic, ok := c.auth.(*authn.Basic); ok {
+		return basic.Username
+	}
+	return ""
+}
+
+// Identity names the credentials and transport of the client, for caches of what the client sees: other credentials
+// may see other repositories, and another CA or TLS setting may reach a different registry. The password is hashed.
+func (c *RegistryClient) Identity() string {
+	var username, password string
+	if basic, ok := c.auth.(*authn.Basic); ok {
+		username, password = basic.Username, basic.Password
+	}
+	sum := sha256.Sum256([]byte(username + "\x00" + password))
+	// Transports from TLSTransport are shared by resources with the same TLS settings
+	transport := "default"
+	if c.transport != nil {
+		transport = fmt.Sprintf("%p", c.transport)
+	}
+	return username + "/" + hex.EncodeToString(sum[:8]) + "/" + transport
+}
+
+// WithTransport returns a copy of the client reaching registries through a transport from TLSTransport
+func (c *RegistryClient) WithTransport(transport http.RoundTripper) *RegistryClient {
+	client := *c
+	client.transport = transport
+	return &client
+}
+
+// options of remote requests to a registry host, with the credentials and transport of the client
+func (c *RegistryClient) options(ctx context.Context, registry string) []remote.Option {
+	return []remote.Option{remote.WithAuth(c.auth), remote.WithContext(ctx), remote.WithTransport(c.transportFor(registry))}
+}
+
+// observeDuration records the duration of a registry operation started at start
+func observeDuration(registry, operation string, start time.Time) {
+	metrics.RegistryRequestDuration.WithLabelValues(registry, operation).Observe(time.Since(start).Seconds())
+}
+
 // Parse image name into components
 func ParseImage(image string) (*ImageInfo, error) {
 	ref, err := name.ParseReference(image)
@@ -46,11 +145,20 @@ func ParseImage(image string) (*ImageInfo, error) {
 	registry := ref.Context().Registry.Name()
 	repository := ref.Context().RepositoryStr()
 
+	// The name as written is the reference without digest and tag, a colon before the last slash is a port
+	base, _, _ := strings.Cut(image, "@")
+	var writtenTag string
+	if i := strings.LastIndex(base, ":"); i > strings.LastIndex(base, "/") {
+		base, writtenTag = base[:i], base[i+1:]
+	}
+
 	var tag, digest string
 	if tagRef, ok := ref.(name.Tag); ok {
 		tag = tagRef.TagStr()
 	} else if digestRef, ok := ref.(name.Digest); ok {
 		digest = digestRef.DigestStr()
+		// name.Digest drops the tag of references like repo:tag@digest, keep it
+		tag = writtenTag
 	}
 
 	return &ImageInfo{
@@ -58,29 +166,181 @@ func ParseImage(image string) (*ImageInfo, error) {
 		Repository: repository,
 		Tag:        tag,
 		Digest:     digest,
+		name:       base,
 	}, nil
 }
 
+// SameImage reports whether two image references are the same image. With MATCH_IMAGES_IGNORING_REGISTRY
+// an image and its copy on another registry host, e.g. a mirror, are the same image
+func SameImage(a, b string) bool {
+	return a == b || (config.GlobalConfig.MatchImagesIgnoringRegistry && sameImageIgnoringRegistry(a, b))
+}
+
+// sameImageIgnoringRegistry reports whether two images have the same repository, tag and digest whatever their
+// registry host. Images that cannot be parsed are only the same when equal.
+func sameImageIgnoringRegistry(a, b string) bool {
+	infoA, errA := ParseImage(a)
+	infoB, errB := ParseImage(b)
+	if errA != nil || errB != nil {
+		return a == b
+	}
+	return repositoryPath(infoA.Repository) == repositoryPath(infoB.Repository) && infoA.Tag == infoB.Tag && infoA.Digest == infoB.Digest
+}
+
+// MatchRepository resolves a partial image, a repository or a trailing part of it with a tag or digest such as
+// nginx:1.25 or org/app:v2, against the image of a running container. When the repository of the container ends
+// with the partial one, whatever its registry host, it returns the container image with the tag and digest of the
+// partial image, keeping its name as written.
+func MatchRepository(current, partial string) (string, bool) {
+	currentInfo, err := ParseImage(current)
+	if err != nil {
+		return "", false
+	}
+	partialInfo, err := ParseImage(partial)
+	if err != nil {
+		return "", false
+	}
+	parts := strings.Split(currentInfo.Repository, "/")
+	for i := range parts {
+		suffix := BuildImageRefStyle(&ImageInfo{name: strings.Join(parts[i:], "/")}, partialInfo.Tag, partialInfo.Digest, config.ImageNamePreserve)
+		if sameImageIgnoringRegistry(suffix, partial) {
+			return BuildImageRefStyle(currentInfo, partialInfo.Tag, partialInfo.Digest, config.ImageNamePreserve), true
+		}
+	}
+	return "", false
+}
+
+// repositoryPath drops the library/ namespace Docker Hub adds to official images, which mirrors may not have
+func repositoryPath(repository string) string {
+	return strings.TrimPrefix(repository, "library/")
+}
+
+// ImageRegistryAllowed reports whether the registry of an image is allowed by ALLOWED_REGISTRIES.
+// Images that cannot be parsed are only allowed when no allowlist is configured.
+func ImageRegistryAllowed(image string) bool {
+	if config.GlobalConfig.AllowedRegistries == "" {
+		return true
+	}
+	imageInfo, err := ParseImage(image)
+	if err != nil {
+		return false
+	}
+	return config.GlobalConfig.RegistryAllowed(imageInfo.Registry)
+}
+
+// ImageExcluded returns the GLOBAL_IMAGE_EXCLUDES pattern matching an image, or "" when it is not excluded.
+// Patterns are globs matched against the repository, with and without its registry host, and the full reference,
+// so istio/proxyv2, docker.io/istio/* and istio/proxyv2:1.20.* all match docker.io/istio/proxyv2:1.20.0.
+func ImageExcluded(image string) string {
+	patterns, _ := config.GlobalConfig.ImageExcludes()
+	return MatchImage(patterns, image)
+}
+
+// MatchImage returns the first of the glob patterns matching an image as GLOBAL_IMAGE_EXCLUDES patterns do, or ""
+func MatchImage(patterns []string, image string) string {
+	if len(patterns) == 0 {
+		return ""
+	}
+	candidates := []string{image}
+	if imageInfo, err := ParseImage(image); err == nil {
+		repositories := []string{repositoryPath(imageInfo.Repository), imageInfo.Repository, imageInfo.Registry + "/" + imageInfo.Repository}
+		if imageInfo.Registry == name.DefaultRegistry {
+			repositories = append(repositories, "docker.io/"+imageInfo.Repository, "docker.io/"+repositoryPath(imageInfo.Repository))
+		}
+		for _, repository := range repositories {
+			candidates = append(candidates, repository)
+			if imageInfo.Tag != "" {
+				candidates = append(candidates, repository+":"+imageInfo.Tag)
+			}
+		}
+	}
+	for _, pattern := range patterns {
+		for _, candidate := range candidates {
+			if matched, _ := path.Match(pattern, candidate); matched {
+				return pattern
+			}
+		}
+	}
+	return ""
+}
+
 // Get all available tags for an image
 func (c *RegistryClient) ListTags(ctx context.Context, image string) ([]string, error) {
 	imageInfo, err := ParseImage(image)
 	if err != nil {
 		return nil, err
 	}
+	defer observeDuration(imageInfo.Registry, "list_tags", time.Now())
 
 	repo, err := name.NewRepository(fmt.Sprintf("%s/%s", imageInfo.Registry, imageInfo.Repository))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create repository: %v", err)
 	}
 
-	tags, err := remote.List(repo, remote.WithAuth(c.auth), remote.WithContext(ctx))
+	tags, err := c.listTags(ctx, repo)
+	// Registries not implementing the paginated tag list may still serve a plain one
+	if err != nil && config.GlobalConfig.RegistryTagsFallback && ctx.Err() == nil {
+		fallbackTags, fallbackErr := c.listTagsFallback(ctx, repo)
+		if fallbackErr != nil {
+			return nil, fmt.Errorf("%w, fallback tag list also failed: %v", err, fallbackErr)
+		}
+		logrus.Debugf("Listed tags of %s with the fallback tag list: %v", repo, err)
+		return keepLastTags(fallbackTags, config.GlobalConfig.MaxTags), nil
+	}
+	return tags, err
+}
+
+// listTags reads the tags of a repository page by page
+func (c *RegistryClient) listTags(ctx context.Context, repo name.Repository) ([]string, error) {
+	puller, err := remote.NewPuller(c.options(ctx, repo.RegistryStr())...)
 	if err != nil {
-		return nil, fmt.Errorf("failed to list tags: %v", err)
+		return nil, fmt.Errorf("failed to create puller: %v", err)
+	}
+
+	// Follow the Link header of paginated registries, a repository without tags yields an empty slice
+	lister, err := puller.Lister(ctx, repo)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tags: %w", wrapRegistryError(err))
+	}
+
+	tags := []string{}
+	listed := 0
+	seen := make(map[string]bool)
+	for pages := 0; lister.HasNext(); pages++ {
+		if pages >= maxTagPages {
+			return nil, fmt.Errorf("failed to list tags: %w after %d pages", ErrTooManyPages, pages)
+		}
+		page, err := lister.Next(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list tags: %w", wrapRegistryError(err))
+		}
+		tags = keepLastTags(append(tags, page.Tags...), config.GlobalConfig.MaxTags)
+		listed += len(page.Tags)
+
+		// A registry linking back to a page already read would loop forever
+		if page.Next != "" {
+			if seen[page.Next] {
+				return nil, fmt.Errorf("failed to list tags: page %s was already listed", page.Next)
+			}
+			seen[page.Next] = true
+		}
 	}
 
+	if len(tags) < listed {
+		logrus.Debugf("Kept the last %d of the %d tags of %s, MAX_TAGS reached", len(tags), listed, repo)
+	}
 	return tags, nil
 }
 
+// keepLastTags keeps the last max tags of a tag list, all of them when max is 0. Registries list tags in lexical
+// order, the last ones are the highest. A copy is returned so the dropped tags are not retained.
+func keepLastTags(tags []string, max int) []string {
+	if max <= 0 || len(tags) <= max {
+		return tags
+	}
+	return append([]string(nil), tags[len(tags)-max:]...)
+}
+
 // Get digest for a specific tag
 func (c *RegistryClient) GetDigest(ctx context.Context, image string) (string, error) {
 	ref, err := name.ParseReference(image)
@@ -88,31 +348,120 @@ func (c *RegistryClient) GetDigest(ctx context.Context, image string) (string, e
 		return "", fmt.Errorf("failed to parse image reference: %v", err)
 	}
 
-	desc, err := remote.Get(ref, remote.WithAuth(c.auth), remote.WithContext(ctx))
+	defer observeDuration(ref.Context().RegistryStr(), "get_digest", time.Now())
+	desc, err := remote.Get(ref, c.options(ctx, ref.Context().RegistryStr())...)
 	if err != nil {
-		return "", fmt.Errorf("failed to get image descriptor: %v", err)
+		return "", fmt.Errorf("failed to get image descriptor: %w", wrapRegistryError(err))
 	}
 
 	return desc.Digest.String(), nil
 }
 
+// GetDigestHead returns the digest of a tag with a HEAD request, cheaper than the GET of GetDigest and not
+// counted as a pull by the rate limits of registries like Docker Hub. It falls back to GetDigest when the
+// registry does not answer the HEAD request with a digest.
+func (c *RegistryClient) GetDigestHead(ctx context.Context, image string) (string, error) {
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse image reference: %v", err)
+	}
+
+	start := time.Now()
+	desc, err := remote.Head(ref, c.options(ctx, ref.Context().RegistryStr())...)
+	observeDuration(ref.Context().RegistryStr(), "head_digest", start)
+	if err == nil {
+		return desc.Digest.String(), nil
+	}
+	// A GET would be rejected the same way
+	if err = wrapRegistryError(err); errors.Is(err, ErrUnauthorized) || ctx.Err() != nil {
+		return "", fmt.Errorf("failed to get image descriptor: %w", err)
+	}
+	logrus.Debugf("HEAD request for %s failed, falling back to GET: %v", image, err)
+	return c.GetDigest(ctx, image)
+}
+
+// GetImageSize returns the compressed size of an image in bytes, the sum of the layer sizes of its manifest.
+// A multi-platform image is measured for platform, e.g. linux/arm64, or linux/amd64 when it is empty.
+func (c *RegistryClient) GetImageSize(ctx context.Context, image string, platform string) (int64, error) {
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse image reference: %v", err)
+	}
+	options := c.options(ctx, ref.Context().RegistryStr())
+	if platform != "" {
+		spec, err := v1.ParsePlatform(platform)
+		if err != nil {
+			return 0, fmt.Errorf("invalid platform %s: %v", platform, err)
+		}
+		options = append(options, remote.WithPlatform(*spec))
+	}
+
+	defer observeDuration(ref.Context().RegistryStr(), "image_size", time.Now())
+	img, err := remote.Image(ref, options...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get image: %w", wrapRegistryError(err))
+	}
+	manifest, err := img.Manifest()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read manifest of %s: %v", image, err)
+	}
+
+	var size int64
+	for _, layer := range manifest.Layers {
+		size += layer.Size
+	}
+	return size, nil
+}
+
 // SortAlphabeticalTags sorts tags in descending lexicographical order.
 func SortAlphabeticalTags(tags []string) []string {
 	sort.Sort(sort.Reverse(sort.StringSlice(tags)))
 	return tags
 }
 
+// SortAlphabeticalTagsAsc sorts tags in ascending lexicographical order.
+func SortAlphabeticalTagsAsc(tags []string) []string {
+	sort.Strings(tags)
+	return tags
+}
+
+// SortDateTags sorts tags parsed as dates with a Go time layout from newest to oldest, skipping tags that do not parse.
+func SortDateTags(tags []string, layout string) []string {
+	var dated []string
+	var dates = make(map[string]time.Time)
+	for _, tag := range tags {
+		if date, err := time.Parse(layout, tag); err == nil {
+			dated = append(dated, tag)
+			dates[tag] = date
+		}
+	}
+
+	sort.Slice(dated, func(i, j int) bool {
+		if d1, d2 := dates[dated[i]], dates[dated[j]]; !d1.Equal(d2) {
+			return d1.After(d2)
+		}
+		return dated[i] > dated[j]
+	})
+	return dated
+}
+
+// ParseVersionTag parses a version tag such as v1.2.3 or 1.2.3. Build metadata, as in 1.2.3+build.1, does not
+// change the precedence of a version. Debian-style epochs, as in 2:1.2.3, are not supported.
+func ParseVersionTag(tag string) (*version.Version, error) {
+	if strings.Contains(tag, ":") {
+		return nil, fmt.Errorf("epoch-prefixed version %s is not supported", tag)
+	}
+	return version.NewVersion(strings.TrimPrefix(tag, "v"))
+}
+
 // Sort version tags (e.g., v1.2.3, 1.2.3)
 func SortVersionTags(tags []string) []string {
 	var versions []string
 	var versionMap = make(map[string]*version.Version)
 
 	for _, tag := range tags {
-		// Remove 'v' prefix if exists
-		cleanTag := strings.TrimPrefix(tag, "v")
-
 		// Try to parse as version
-		v, err := version.NewVersion(cleanTag)
+		v, err := ParseVersionTag(tag)
 		if err == nil {
 			versions = append(versions, tag)
 			versionMap[tag] = v
@@ -123,7 +472,7 @@ func SortVersionTags(tags []string) []string {
 		v1 := versionMap[versions[i]]
 		v2 := versionMap[versions[j]]
 
-		// If versions are equal, prefer the one without suffix
+		// If versions are equal, e.g. they only differ by build metadata, prefer the one without suffix
 		if v1.Equal(v2) {
 			// Get original tags
 			t1 := versions[i]
@@ -132,8 +481,8 @@ func SortVersionTags(tags []string) []string {
 			t1 = strings.TrimPrefix(t1, "v")
 			t2 = strings.TrimPrefix(t2, "v")
 			// Check for suffixes
-			hasSuffix1 := strings.Contains(t1, "-")
-			hasSuffix2 := strings.Contains(t2, "-")
+			hasSuffix1 := strings.ContainsAny(t1, "-+")
+			hasSuffix2 := strings.ContainsAny(t2, "-+")
 			if hasSuffix1 != hasSuffix2 {
 				return !hasSuffix1 // Prefer the one without suffix
 			}
@@ -2,9 +2,23 @@ package registry
 
 import (
 	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
 	"testing"
 
+	"github.com/google/go-containerregistry/pkg/name"
+	ggcrregistry "github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/monlor/k8s-image-updater/config"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 // Test for ParseImage function
@@ -31,6 +45,158 @@ func TestParseImage(t *testing.T) {
 	}
 }
 
+// Test that ParseImage keeps the tag of tag+digest references
+func TestParseImageTagAndDigest(t *testing.T) {
+	digest := "sha256:0000000000000000000000000000000000000000000000000000000000000000"
+	tests := []struct {
+		image      string
+		wantTag    string
+		wantDigest string
+	}{
+		{"nginx:1.2.3", "1.2.3", ""},
+		{"nginx@" + digest, "", digest},
+		{"nginx:1.2.3@" + digest, "1.2.3", digest},
+		{"localhost:5000/app@" + digest, "", digest},
+		{"localhost:5000/app:v1@" + digest, "v1", digest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			info, err := ParseImage(tt.image)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantTag, info.Tag)
+			assert.Equal(t, tt.wantDigest, info.Digest)
+		})
+	}
+}
+
+func TestImageInfoBase(t *testing.T) {
+	old := config.GlobalConfig.PreserveImageNameStyle
+	t.Cleanup(func() { config.GlobalConfig.PreserveImageNameStyle = old })
+	digest := "sha256:0000000000000000000000000000000000000000000000000000000000000000"
+
+	tests := []struct {
+		image        string
+		want         string
+		wantPreserve string
+	}{
+		{"nginx", "index.docker.io/library/nginx", "nginx"},
+		{"nginx:1.27", "index.docker.io/library/nginx", "nginx"},
+		{"library/nginx:1.27", "index.docker.io/library/nginx", "library/nginx"},
+		{"docker.io/library/nginx:1.27@" + digest, "index.docker.io/library/nginx", "docker.io/library/nginx"},
+		{"ghcr.io/org/app@" + digest, "ghcr.io/org/app", "ghcr.io/org/app"},
+		{"localhost:5000/app:v1", "localhost:5000/app", "localhost:5000/app"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			info, err := ParseImage(tt.image)
+			require.NoError(t, err)
+			config.GlobalConfig.PreserveImageNameStyle = false
+			assert.Equal(t, tt.want, info.Base())
+			config.GlobalConfig.PreserveImageNameStyle = true
+			assert.Equal(t, tt.wantPreserve, info.Base())
+		})
+	}
+}
+
+func TestBuildImageRef(t *testing.T) {
+	digest := "sha256:0000000000000000000000000000000000000000000000000000000000000000"
+	tests := []struct {
+		image, tag, digest                string
+		wantFull, wantPreserve, wantShort string
+	}{
+		{"nginx", "1.27", "", "index.docker.io/library/nginx:1.27", "nginx:1.27", "nginx:1.27"},
+		{"docker.io/library/nginx:1.26", "1.27", digest, "index.docker.io/library/nginx:1.27@" + digest, "docker.io/library/nginx:1.27@" + digest, "nginx:1.27@" + digest},
+		{"index.docker.io/org/app@" + digest, "", digest, "index.docker.io/org/app@" + digest, "index.docker.io/org/app@" + digest, "org/app@" + digest},
+		{"ghcr.io/org/app:v1", "v2", "", "ghcr.io/org/app:v2", "ghcr.io/org/app:v2", "ghcr.io/org/app:v2"},
+		{"localhost:5000/library/app:v1", "", "", "localhost:5000/library/app", "localhost:5000/library/app", "localhost:5000/library/app"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			info, err := ParseImage(tt.image)
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantFull, BuildImageRefStyle(info, tt.tag, tt.digest, config.ImageNameFull))
+			assert.Equal(t, tt.wantPreserve, BuildImageRefStyle(info, tt.tag, tt.digest, config.ImageNamePreserve))
+			assert.Equal(t, tt.wantShort, BuildImageRefStyle(info, tt.tag, tt.digest, config.ImageNameShort))
+		})
+	}
+
+	// BuildImageRef follows IMAGE_NAME_STYLE, which overrides PRESERVE_IMAGE_NAME_STYLE
+	old := *config.GlobalConfig
+	t.Cleanup(func() { *config.GlobalConfig = old })
+	info, err := ParseImage("docker.io/library/nginx:1.26")
+	require.NoError(t, err)
+	config.GlobalConfig.PreserveImageNameStyle = true
+	assert.Equal(t, "docker.io/library/nginx:1.27", BuildImageRef(info, "1.27", ""))
+	config.GlobalConfig.ImageNameStyle = "Short"
+	assert.Equal(t, "nginx:1.27", BuildImageRef(info, "1.27", ""))
+}
+
+func TestSameImageIgnoringRegistry(t *testing.T) {
+	digest := "sha256:0000000000000000000000000000000000000000000000000000000000000000"
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"docker.io/foo/bar:1.0", "mirror.example.com/foo/bar:1.0", true},
+		{"foo/bar:1.0", "mirror.example.com:5000/foo/bar:1.0", true},
+		{"nginx:1.27", "mirror.example.com/nginx:1.27", true},
+		{"nginx@" + digest, "mirror.example.com/library/nginx@" + digest, true},
+		{"docker.io/foo/bar:1.0", "mirror.example.com/foo/baz:1.0", false},
+		{"docker.io/foo/bar:1.0", "mirror.example.com/other/foo/bar:1.0", false},
+		{"docker.io/foo/bar:1.0", "mirror.example.com/foo/bar:1.1", false},
+		{"foo/bar:1.0", "foo/bar:1.0@" + digest, false},
+		{"INVALID", "INVALID", true},
+		{"INVALID", "invalid", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.a+" "+tt.b, func(t *testing.T) {
+			assert.Equal(t, tt.want, sameImageIgnoringRegistry(tt.a, tt.b))
+		})
+	}
+}
+
+func TestMatchRepository(t *testing.T) {
+	digest := "sha256:0000000000000000000000000000000000000000000000000000000000000000"
+	tests := []struct {
+		current, partial string
+		want             string
+		wantOk           bool
+	}{
+		{"nginx:1.24", "nginx:1.25", "nginx:1.25", true},
+		{"docker.io/library/nginx:1.24", "nginx:1.25", "docker.io/library/nginx:1.25", true},
+		{"mirror.example.com/library/nginx:1.24", "docker.io/nginx:1.25", "mirror.example.com/library/nginx:1.25", true},
+		{"ghcr.io/org/app:v1", "app:v2", "ghcr.io/org/app:v2", true},
+		{"ghcr.io/org/app:v1", "org/app:v2", "ghcr.io/org/app:v2", true},
+		{"ghcr.io/org/app:v1@" + digest, "app:v2", "ghcr.io/org/app:v2", true},
+		{"ghcr.io/org/app:v1", "app@" + digest, "ghcr.io/org/app@" + digest, true},
+		{"localhost:5000/team/app:v1", "team/app:v2", "localhost:5000/team/app:v2", true},
+		{"ghcr.io/org/app:v1", "other/app:v2", "", false},
+		{"ghcr.io/org/myapp:v1", "app:v2", "", false},
+		{"ghcr.io/org/app:v1", "INVALID", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.current+" "+tt.partial, func(t *testing.T) {
+			got, ok := MatchRepository(tt.current, tt.partial)
+			assert.Equal(t, tt.wantOk, ok)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestSameImage(t *testing.T) {
+	old := config.GlobalConfig.MatchImagesIgnoringRegistry
+	t.Cleanup(func() { config.GlobalConfig.MatchImagesIgnoringRegistry = old })
+
+	config.GlobalConfig.MatchImagesIgnoringRegistry = false
+	assert.True(t, SameImage("foo/bar:1.0", "foo/bar:1.0"))
+	assert.False(t, SameImage("foo/bar:1.0", "mirror.example.com/foo/bar:1.0"))
+
+	config.GlobalConfig.MatchImagesIgnoringRegistry = true
+	assert.True(t, SameImage("foo/bar:1.0", "mirror.example.com/foo/bar:1.0"))
+	assert.False(t, SameImage("foo/bar:1.0", "mirror.example.com/foo/bar:1.1"))
+}
+
 // Test for ListTags function
 func TestListTags(t *testing.T) {
 	ctx := context.Background()
@@ -46,6 +212,146 @@ func TestListTags(t *testing.T) {
 	t.Logf("Tags for %s: %v", image, tags)
 }
 
+// Start a fake registry serving the tag list of "app" in pages of pageSize tags.
+// With loop set, the last page links back to the first one.
+func newPaginatedRegistry(t *testing.T, tags []string, pageSize int, loop bool) string {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/v2/app/tags/list", func(w http.ResponseWriter, r *http.Request) {
+		start, _ := strconv.Atoi(r.URL.Query().Get("start"))
+		end := min(start+pageSize, len(tags))
+		if end < len(tags) {
+			w.Header().Set("Link", fmt.Sprintf(`</v2/app/tags/list?start=%d>; rel="next"`, end))
+		} else if loop {
+			w.Header().Set("Link", `</v2/app/tags/list?start=0>; rel="next"`)
+		}
+		page := tags[start:end]
+		quoted := make([]string, len(page))
+		for i, tag := range page {
+			quoted[i] = strconv.Quote(tag)
+		}
+		fmt.Fprintf(w, `{"name":"app","tags":[%s]}`, strings.Join(quoted, ","))
+	})
+	mux.HandleFunc("/v2/empty/tags/list", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"name":"empty","tags":null}`)
+	})
+	mux.HandleFunc("/v2/missing/tags/list", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"errors":[{"code":"NAME_UNKNOWN","message":"repository name not known to registry"}]}`)
+	})
+	mux.HandleFunc("/v2/private/tags/list", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	})
+	mux.HandleFunc("/v2/app/manifests/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"errors":[{"code":"MANIFEST_UNKNOWN","message":"manifest unknown"}]}`)
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+func TestListTagsPaginated(t *testing.T) {
+	var tags []string
+	for i := range 25 {
+		tags = append(tags, fmt.Sprintf("1.0.%d", i))
+	}
+	host := newPaginatedRegistry(t, tags, 10, false)
+	client := NewRegistryClient("", "")
+
+	got, err := client.ListTags(context.Background(), host+"/app:1.0.0")
+	require.NoError(t, err)
+	assert.Equal(t, tags, got)
+}
+
+func TestMaxTags(t *testing.T) {
+	var tags []string
+	for i := range 25 {
+		tags = append(tags, fmt.Sprintf("1.0.%02d", i))
+	}
+	host := newPaginatedRegistry(t, tags, 10, false)
+	client := NewRegistryClient("", "")
+	old := config.GlobalConfig.MaxTags
+	t.Cleanup(func() { config.GlobalConfig.MaxTags = old })
+
+	// The last tags listed are kept across pages
+	config.GlobalConfig.MaxTags = 12
+	got, err := client.ListTags(context.Background(), host+"/app:1.0.00")
+	require.NoError(t, err)
+	assert.Equal(t, tags[13:], got)
+
+	config.GlobalConfig.MaxTags = 30
+	got, err = client.ListTags(context.Background(), host+"/app:1.0.00")
+	require.NoError(t, err)
+	assert.Equal(t, tags, got)
+
+	assert.Equal(t, []string{"b", "c"}, keepLastTags([]string{"a", "b", "c"}, 2))
+	assert.Equal(t, []string{"a", "b", "c"}, keepLastTags([]string{"a", "b", "c"}, 0))
+}
+
+func TestListTagsPageLoop(t *testing.T) {
+	host := newPaginatedRegistry(t, []string{"1.0.0", "1.0.1", "1.0.2"}, 2, true)
+	client := NewRegistryClient("", "")
+
+	_, err := client.ListTags(context.Background(), host+"/app:1.0.0")
+	assert.ErrorContains(t, err, "already listed")
+}
+
+func TestListTagsEmptyRepository(t *testing.T) {
+	host := newPaginatedRegistry(t, nil, 10, false)
+	client := NewRegistryClient("", "")
+
+	got, err := client.ListTags(context.Background(), host+"/empty:latest")
+	require.NoError(t, err)
+	assert.NotNil(t, got)
+	assert.Empty(t, got)
+}
+
+func TestRegistryTypedErrors(t *testing.T) {
+	host := newPaginatedRegistry(t, nil, 10, false)
+	client := NewRegistryClient("", "")
+	ctx := context.Background()
+
+	_, err := client.ListTags(ctx, host+"/missing:latest")
+	assert.ErrorIs(t, err, ErrNameUnknown)
+
+	_, err = client.ListTags(ctx, host+"/private:latest")
+	assert.ErrorIs(t, err, ErrUnauthorized)
+
+	_, err = client.GetDigest(ctx, host+"/app:1.0.0")
+	assert.ErrorIs(t, err, ErrManifestUnknown)
+	assert.ErrorContains(t, err, "manifest unknown")
+}
+
+func TestImageSize(t *testing.T) {
+	server := httptest.NewServer(ggcrregistry.New(ggcrregistry.Logger(log.New(io.Discard, "", 0))))
+	t.Cleanup(server.Close)
+	host := strings.TrimPrefix(server.URL, "http://")
+	img, err := random.Image(1024, 3)
+	require.NoError(t, err)
+	ref, err := name.ParseReference(host + "/app:1.0.0")
+	require.NoError(t, err)
+	require.NoError(t, remote.Write(ref, img))
+	manifest, err := img.Manifest()
+	require.NoError(t, err)
+	var want int64
+	for _, layer := range manifest.Layers {
+		want += layer.Size
+	}
+
+	client := NewRegistryClient("", "")
+	size, err := client.GetImageSize(context.Background(), host+"/app:1.0.0", "")
+	require.NoError(t, err)
+	assert.Equal(t, want, size)
+	assert.Greater(t, size, int64(3*1024))
+
+	_, err = client.GetImageSize(context.Background(), host+"/app:2.0.0", "")
+	assert.ErrorIs(t, err, ErrManifestUnknown)
+}
+
 // Test for GetDigest function
 func TestGetDigest(t *testing.T) {
 	ctx := context.Background()
@@ -70,3 +376,120 @@ func TestSortVersionTags(t *testing.T) {
 
 	t.Logf("Sorted Tags: %v", sortedTags)
 }
+
+func TestVersionTagBuildMetadata(t *testing.T) {
+	build1, err := ParseVersionTag("1.2.3+build.1")
+	require.NoError(t, err)
+	build2, err := ParseVersionTag("1.2.3+build.2")
+	require.NoError(t, err)
+	plain, err := ParseVersionTag("v1.2.3")
+	require.NoError(t, err)
+	// Build metadata is ignored for precedence
+	assert.True(t, build1.Equal(build2))
+	assert.True(t, build1.Equal(plain))
+
+	// Equal versions sort the same whatever the input order, the tag without metadata first
+	tags := []string{"1.2.3+build.1", "1.2.4", "1.2.3", "1.2.3+build.2", "1.2.2+build.9"}
+	want := []string{"1.2.4", "1.2.3", "1.2.3+build.2", "1.2.3+build.1", "1.2.2+build.9"}
+	assert.Equal(t, want, SortVersionTags(tags))
+	slices.Reverse(tags)
+	assert.Equal(t, want, SortVersionTags(tags))
+}
+
+func TestVersionTagEpoch(t *testing.T) {
+	_, err := ParseVersionTag("2:1.2.3")
+	assert.ErrorContains(t, err, "epoch")
+
+	// Epoch-prefixed tags are skipped like any tag that is not a version
+	assert.Equal(t, []string{"1.2.4", "1.2.3"}, SortVersionTags([]string{"1:1.2.5", "1.2.3", "2:0.9.0", "1.2.4"}))
+}
+
+func TestSortAlphabeticalTags(t *testing.T) {
+	assert.Equal(t, []string{"c", "b", "a"}, SortAlphabeticalTags([]string{"b", "c", "a"}))
+	assert.Equal(t, []string{"a", "b", "c"}, SortAlphabeticalTagsAsc([]string{"b", "c", "a"}))
+}
+
+func TestSortDateTags(t *testing.T) {
+	tests := []struct {
+		layout string
+		tags   []string
+		want   []string
+	}{
+		{"2006.01.02", []string{"2024.06.01", "latest", "2023.12.31", "2024.06.15", "v1.0.0"}, []string{"2024.06.15", "2024.06.01", "2023.12.31"}},
+		{"20060102", []string{"20231231", "20240101", "2024-01-02"}, []string{"20240101", "20231231"}},
+		{"02-01-2006", []string{"31-12-2023", "01-01-2024", "15-06-2023"}, []string{"01-01-2024", "31-12-2023", "15-06-2023"}},
+		{"2006-01-02T15-04", []string{"2024-06-01T09-30", "2024-06-01T18-00", "2024-05-31T23-59"}, []string{"2024-06-01T18-00", "2024-06-01T09-30", "2024-05-31T23-59"}},
+		{"build-2006.01.02", []string{"build-2024.01.10", "build-2023.11.02", "2024.02.01"}, []string{"build-2024.01.10", "build-2023.11.02"}},
+		{"2006.01.02", []string{"latest", "main"}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.layout, func(t *testing.T) {
+			assert.Equal(t, tt.want, SortDateTags(tt.tags, tt.layout))
+		})
+	}
+}
+
+func TestImageExcluded(t *testing.T) {
+	oldExcludes := config.GlobalConfig.GlobalImageExcludes
+	defer func() { config.GlobalConfig.GlobalImageExcludes = oldExcludes }()
+
+	config.GlobalConfig.GlobalImageExcludes = ""
+	assert.Empty(t, ImageExcluded("istio/proxyv2:1.20.0"))
+
+	config.GlobalConfig.GlobalImageExcludes = "istio/proxyv2, ghcr.io/infra/*,nginx:1.2*, registry.example.com:5000/*/agent"
+	tests := []struct {
+		image string
+		want  string
+	}{
+		{"istio/proxyv2:1.20.0", "istio/proxyv2"},
+		{"docker.io/istio/proxyv2:1.20.0", "istio/proxyv2"},
+		{"index.docker.io/istio/proxyv2@sha256:" + strings.Repeat("a", 64), "istio/proxyv2"},
+		{"ghcr.io/infra/vault:1.15", "ghcr.io/infra/*"},
+		{"docker.io/library/nginx:1.27", "nginx:1.2*"},
+		{"registry.example.com:5000/team/agent:2.0", "registry.example.com:5000/*/agent"},
+		{"istio/pilot:1.20.0", ""},
+		{"quay.io/istio/proxyv2-extra:1.0", ""},
+		{"ghcr.io/infra/sub/vault:1.15", ""},
+		{"nginx:1.31", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			assert.Equal(t, tt.want, ImageExcluded(tt.image))
+		})
+	}
+
+	// A malformed pattern is reported, the updater refuses to start with it
+	config.GlobalConfig.GlobalImageExcludes = "istio/[proxyv2"
+	_, err := config.GlobalConfig.ImageExcludes()
+	assert.ErrorContains(t, err, "istio/[proxyv2")
+}
+
+func TestImageRegistryAllowed(t *testing.T) {
+	oldRegistries := config.GlobalConfig.AllowedRegistries
+	defer func() { config.GlobalConfig.AllowedRegistries = oldRegistries }()
+
+	config.GlobalConfig.AllowedRegistries = ""
+	assert.True(t, ImageRegistryAllowed("evil.example.com/app:1.0.0"))
+
+	config.GlobalConfig.AllowedRegistries = "ghcr.io, docker.io,localhost:5000"
+	tests := []struct {
+		image string
+		want  bool
+	}{
+		{"ghcr.io/org/app:1.0.0", true},
+		{"nginx:1.27", true},
+		{"index.docker.io/library/nginx:1.27", true},
+		{"localhost:5000/app:1.0.0", true},
+		{"localhost:5001/app:1.0.0", false},
+		{"evil.example.com/app:1.0.0", false},
+		{"ghcr.io.evil.example.com/app:1.0.0", false},
+		{"INVALID image", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			assert.Equal(t, tt.want, ImageRegistryAllowed(tt.image))
+		})
+	}
+}
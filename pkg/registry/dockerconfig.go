@@ -0,0 +1,47 @@
+package registry
+
+import (
+	"fmt"
+	"os"
+
+	dockerconfig "github.com/docker/cli/cli/config"
+	"github.com/docker/cli/cli/config/credentials"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/sirupsen/logrus"
+)
+
+// DockerConfigCredentials returns the username and password of a registry host in a docker config.json file,
+// resolved like the Docker CLI: the credHelpers or credsStore helper first, then auths. The file is read on every
+// call so rotated mounts are picked up. A missing or failing helper falls back to auths.
+func DockerConfigCredentials(path, registryHost string) (string, string, bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", "", false, fmt.Errorf("failed to open docker config %s: %v", path, err)
+	}
+	defer file.Close()
+	configFile, err := dockerconfig.LoadFromReader(file)
+	if err != nil {
+		return "", "", false, fmt.Errorf("failed to parse docker config %s: %v", path, err)
+	}
+
+	// Docker Hub credentials are stored under the v1 index URL
+	key := registryHost
+	if key == name.DefaultRegistry || key == "docker.io" {
+		key = authn.DefaultAuthKey
+	}
+	authConfig, err := configFile.GetAuthConfig(key)
+	if err != nil {
+		logrus.Debugf("Credential helper of registry %s in %s failed, using auths: %v", registryHost, path, err)
+		if authConfig, err = credentials.NewFileStore(configFile).Get(key); err != nil {
+			return "", "", false, fmt.Errorf("failed to read credentials of registry %s from %s: %v", registryHost, path, err)
+		}
+	}
+	if authConfig.Username == "" || authConfig.Password == "" {
+		if authConfig.IdentityToken != "" {
+			logrus.Debugf("Ignoring identity token of registry %s in %s, only username and password are supported", registryHost, path)
+		}
+		return "", "", false, nil
+	}
+	return authConfig.Username, authConfig.Password, true, nil
+}
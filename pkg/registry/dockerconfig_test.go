@@ -0,0 +1,71 @@
+package registry
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDockerConfigCredentials(t *testing.T) {
+	basic := func(userpass string) string { return base64.StdEncoding.EncodeToString([]byte(userpass)) }
+	path := filepath.Join(t.TempDir(), "config.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{
+  "auths": {
+    "ghcr.io": {"auth": "`+basic("gh-user:gh:token")+`"},
+    "https://registry.example.com:5000/v1/": {"username": "example", "password": "example-pass"},
+    "https://index.docker.io/v1/": {"auth": "`+basic("hub:hub-pass")+`"},
+    "quay.io": {"auth": "`+basic("quay:quay-pass")+`"},
+    "token.example.com": {"identitytoken": "refresh-token"}
+  },
+  "credHelpers": {
+    "quay.io": "not-installed-helper",
+    "ecr.example.com": "not-installed-helper"
+  }
+}`), 0o600))
+
+	tests := []struct {
+		registry     string
+		wantUser     string
+		wantPassword string
+		wantOK       bool
+	}{
+		{registry: "ghcr.io", wantUser: "gh-user", wantPassword: "gh:token", wantOK: true},
+		// Keys written as URLs match their host
+		{registry: "registry.example.com:5000", wantUser: "example", wantPassword: "example-pass", wantOK: true},
+		{registry: "index.docker.io", wantUser: "hub", wantPassword: "hub-pass", wantOK: true},
+		// A helper that is not installed falls back to auths
+		{registry: "quay.io", wantUser: "quay", wantPassword: "quay-pass", wantOK: true},
+		{registry: "ecr.example.com"},
+		{registry: "token.example.com"},
+		{registry: "other.io"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.registry, func(t *testing.T) {
+			user, password, ok, err := DockerConfigCredentials(path, tt.registry)
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantOK, ok)
+			assert.Equal(t, tt.wantUser, user)
+			assert.Equal(t, tt.wantPassword, password)
+		})
+	}
+
+	// A credsStore applies to every registry, its auths are still used when it is not installed
+	storePath := filepath.Join(t.TempDir(), "config.json")
+	require.NoError(t, os.WriteFile(storePath, []byte(`{"credsStore":"not-installed-store","auths":{"ghcr.io":{"auth":"`+basic("gh-user:token")+`"}}}`), 0o600))
+	user, password, ok, err := DockerConfigCredentials(storePath, "ghcr.io")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "gh-user", user)
+	assert.Equal(t, "token", password)
+
+	_, _, _, err = DockerConfigCredentials(filepath.Join(t.TempDir(), "missing.json"), "ghcr.io")
+	assert.Error(t, err)
+	invalidPath := filepath.Join(t.TempDir(), "config.json")
+	require.NoError(t, os.WriteFile(invalidPath, []byte(`{"auths":`), 0o600))
+	_, _, _, err = DockerConfigCredentials(invalidPath, "ghcr.io")
+	assert.Error(t, err)
+}
@@ -0,0 +1,60 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// Errors returned by the registry client, check them with errors.Is
+var (
+	// The repository does not exist in the registry
+	ErrNameUnknown = errors.New("repository name not known to registry")
+	// The tag or digest does not exist in the repository
+	ErrManifestUnknown = errors.New("manifest unknown to registry")
+	// The credentials were rejected or lack access to the repository
+	ErrUnauthorized = errors.New("registry authentication required or access denied")
+	// The registry rate limit is exhausted, see RateLimitError for when it resets
+	ErrRateLimited = errors.New("registry rate limit exceeded")
+	// The tag list kept pointing to further pages beyond maxTagPages
+	ErrTooManyPages = errors.New("too many tag list pages")
+)
+
+// Map common registry error codes to the typed errors above, keeping the original message
+func wrapRegistryError(err error) error {
+	var terr *transport.Error
+	if !errors.As(err, &terr) {
+		return err
+	}
+
+	var typed error
+	for _, diag := range terr.Errors {
+		switch diag.Code {
+		case transport.NameUnknownErrorCode:
+			typed = ErrNameUnknown
+		case transport.ManifestUnknownErrorCode:
+			typed = ErrManifestUnknown
+		case transport.UnauthorizedErrorCode, transport.DeniedErrorCode:
+			typed = ErrUnauthorized
+		}
+		if typed != nil {
+			break
+		}
+	}
+	// Some registries answer without an error body
+	if typed == nil {
+		switch terr.StatusCode {
+		case http.StatusUnauthorized, http.StatusForbidden:
+			typed = ErrUnauthorized
+		case http.StatusTooManyRequests:
+			typed = ErrRateLimited
+		}
+	}
+
+	if typed == nil {
+		return err
+	}
+	return fmt.Errorf("%w: %v", typed, err)
+}
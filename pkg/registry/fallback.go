@@ -0,0 +1,54 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// tagList is the response of the /v2/<repo>/tags/list endpoint
+type tagList struct {
+	Name string   `json:"name"`
+	Tags []string `json:"tags"`
+}
+
+// listTagsFallback reads the tags of a repository with a single plain request to /v2/<repo>/tags/list,
+// without the page size and Link header pagination some older registries reject
+func (c *RegistryClient) listTagsFallback(ctx context.Context, repo name.Repository) ([]string, error) {
+	rt, err := transport.NewWithContext(ctx, repo.Registry, c.auth, c.transportFor(repo.RegistryStr()), []string{repo.Scope(transport.PullScope)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to authenticate: %w", wrapRegistryError(err))
+	}
+
+	uri := url.URL{
+		Scheme: repo.Scheme(),
+		Host:   repo.RegistryStr(),
+		Path:   fmt.Sprintf("/v2/%s/tags/list", repo.RepositoryStr()),
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := (&http.Client{Transport: rt}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := transport.CheckError(resp, http.StatusOK); err != nil {
+		return nil, wrapRegistryError(err)
+	}
+
+	var list tagList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("failed to decode tag list: %v", err)
+	}
+	if list.Tags == nil {
+		return []string{}, nil
+	}
+	return list.Tags, nil
+}
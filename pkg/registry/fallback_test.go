@@ -0,0 +1,72 @@
+package registry
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newLegacyRegistry serves a plain tag list that rejects the page size query of the paginated tag list
+func newLegacyRegistry(t *testing.T) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if username, password, ok := r.BasicAuth(); !ok || username != "user" || password != "pass" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="legacy"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.URL.Path == "/v2/":
+			w.Write([]byte("{}"))
+		case r.URL.Path != "/v2/app/tags/list" && r.URL.Path != "/v2/empty/tags/list":
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[{"code":"NAME_UNKNOWN","message":"repository name not known to registry"}]}`))
+		case r.URL.RawQuery != "":
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"errors":[{"code":"UNSUPPORTED","message":"pagination is not supported"}]}`))
+		case r.URL.Path == "/v2/app/tags/list":
+			w.Write([]byte(`{"name":"app","tags":["1.0.0","1.1.0"]}`))
+		default:
+			w.Write([]byte(`{"name":"empty","tags":null}`))
+		}
+	}))
+	t.Cleanup(server.Close)
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+func TestListTagsFallback(t *testing.T) {
+	host := newLegacyRegistry(t)
+	client := NewRegistryClient("user", "pass")
+	ctx := context.Background()
+
+	// Without the fallback the paginated tag list fails
+	_, err := client.ListTags(ctx, host+"/app")
+	require.Error(t, err)
+
+	old := config.GlobalConfig.RegistryTagsFallback
+	config.GlobalConfig.RegistryTagsFallback = true
+	t.Cleanup(func() { config.GlobalConfig.RegistryTagsFallback = old })
+
+	tags, err := client.ListTags(ctx, host+"/app")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1.0.0", "1.1.0"}, tags)
+
+	tags, err = client.ListTags(ctx, host+"/empty")
+	require.NoError(t, err)
+	assert.Empty(t, tags)
+	assert.NotNil(t, tags)
+
+	// Both listings failing return the error of the paginated one
+	_, err = client.ListTags(ctx, host+"/missing")
+	assert.ErrorIs(t, err, ErrNameUnknown)
+	assert.ErrorContains(t, err, "fallback tag list also failed")
+
+	_, err = NewRegistryClient("user", "wrong").ListTags(ctx, host+"/app")
+	assert.ErrorIs(t, err, ErrUnauthorized)
+}
@@ -0,0 +1,90 @@
+package registry
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	ggcrregistry "github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newMethodRecordingRegistry serves an in-memory registry holding app:1.0.0, recording the methods of the
+// manifest requests. With rejectHead set, HEAD requests of manifests are answered with 405.
+func newMethodRecordingRegistry(t *testing.T, rejectHead bool) (string, string, func() []string) {
+	registryHandler := ggcrregistry.New(ggcrregistry.Logger(log.New(io.Discard, "", 0)))
+	var mu sync.Mutex
+	var methods []string
+	var rejecting atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/manifests/") {
+			mu.Lock()
+			methods = append(methods, r.Method)
+			mu.Unlock()
+			if rejecting.Load() && r.Method == http.MethodHead {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+		}
+		registryHandler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	img, err := random.Image(256, 1)
+	require.NoError(t, err)
+	ref, err := name.ParseReference(host + "/app:1.0.0")
+	require.NoError(t, err)
+	require.NoError(t, remote.Write(ref, img))
+	digest, err := img.Digest()
+	require.NoError(t, err)
+
+	mu.Lock()
+	methods = nil
+	mu.Unlock()
+	rejecting.Store(rejectHead)
+	return host, digest.String(), func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), methods...)
+	}
+}
+
+func TestDigestHeadRequest(t *testing.T) {
+	host, want, methods := newMethodRecordingRegistry(t, false)
+	client := NewRegistryClient("", "")
+
+	digest, err := client.GetDigestHead(context.Background(), host+"/app:1.0.0")
+	require.NoError(t, err)
+	assert.Equal(t, want, digest)
+	assert.Equal(t, []string{http.MethodHead}, methods())
+
+	// Without a platform the platform digest is looked up the same way
+	digest, err = client.GetPlatformDigest(context.Background(), host+"/app:1.0.0", "")
+	require.NoError(t, err)
+	assert.Equal(t, want, digest)
+	assert.Equal(t, []string{http.MethodHead, http.MethodHead}, methods())
+}
+
+func TestDigestHeadFallback(t *testing.T) {
+	host, want, methods := newMethodRecordingRegistry(t, true)
+	client := NewRegistryClient("", "")
+
+	digest, err := client.GetDigestHead(context.Background(), host+"/app:1.0.0")
+	require.NoError(t, err)
+	assert.Equal(t, want, digest)
+	assert.Equal(t, []string{http.MethodHead, http.MethodGet}, methods())
+
+	_, err = client.GetDigestHead(context.Background(), host+"/app:missing")
+	assert.ErrorIs(t, err, ErrManifestUnknown)
+}
@@ -0,0 +1,76 @@
+package registry
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	ggcrregistry "github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/monlor/k8s-image-updater/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func histogramSampleCount(t *testing.T, registry, operation string) uint64 {
+	var m dto.Metric
+	require.NoError(t, metrics.RegistryRequestDuration.WithLabelValues(registry, operation).(prometheus.Histogram).Write(&m))
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestRegistryRequestMetrics(t *testing.T) {
+	registryHandler := ggcrregistry.New(ggcrregistry.Logger(log.New(io.Discard, "", 0)))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("RateLimit-Remaining", "76;w=21600")
+		registryHandler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	host := strings.TrimPrefix(server.URL, "http://")
+	img, err := random.Image(256, 1)
+	require.NoError(t, err)
+	ref, err := name.ParseReference(host + "/app:1.0.0")
+	require.NoError(t, err)
+	require.NoError(t, remote.Write(ref, img))
+
+	client := NewRegistryClient("", "")
+	ctx := context.Background()
+	_, err = client.ListTags(ctx, host+"/app")
+	require.NoError(t, err)
+	_, err = client.GetDigest(ctx, host+"/app:1.0.0")
+	require.NoError(t, err)
+	// Failed requests are observed too
+	_, err = client.GetDigest(ctx, host+"/app:missing")
+	require.Error(t, err)
+
+	assert.Equal(t, uint64(1), histogramSampleCount(t, host, "list_tags"))
+	assert.Equal(t, uint64(2), histogramSampleCount(t, host, "get_digest"))
+	assert.Equal(t, 76.0, testutil.ToFloat64(metrics.RegistryRateLimitRemaining.WithLabelValues(host)))
+}
+
+func TestParseRateLimitRemaining(t *testing.T) {
+	tests := []struct {
+		header string
+		want   float64
+		ok     bool
+	}{
+		{"76;w=21600", 76, true},
+		{"100", 100, true},
+		{" 0 ; w=60", 0, true},
+		{"", 0, false},
+		{"unlimited", 0, false},
+	}
+	for _, tt := range tests {
+		remaining, ok := parseRateLimitRemaining(tt.header)
+		assert.Equal(t, tt.ok, ok, tt.header)
+		assert.Equal(t, tt.want, remaining, tt.header)
+	}
+}
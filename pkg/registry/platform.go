@@ -0,0 +1,51 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// GetPlatformDigest returns the digest of the image for a platform like linux/arm64. For a multi-platform
+// image this is the digest of the matching manifest instead of the index, a single-platform image has its
+// own digest. Without platform it is the same as GetDigestHead, the index has to be read otherwise.
+func (c *RegistryClient) GetPlatformDigest(ctx context.Context, image string, platform string) (string, error) {
+	if platform == "" {
+		return c.GetDigestHead(ctx, image)
+	}
+	spec, err := v1.ParsePlatform(platform)
+	if err != nil {
+		return "", fmt.Errorf("invalid platform %s: %v", platform, err)
+	}
+
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse image reference: %v", err)
+	}
+
+	desc, err := remote.Get(ref, c.options(ctx, ref.Context().RegistryStr())...)
+	if err != nil {
+		return "", fmt.Errorf("failed to get image descriptor: %w", wrapRegistryError(err))
+	}
+	if !desc.MediaType.IsIndex() {
+		return desc.Digest.String(), nil
+	}
+
+	index, err := desc.ImageIndex()
+	if err != nil {
+		return "", fmt.Errorf("failed to read image index of %s: %v", image, err)
+	}
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		return "", fmt.Errorf("failed to read index manifest of %s: %v", image, err)
+	}
+	for _, m := range manifest.Manifests {
+		if m.Platform != nil && m.Platform.Satisfies(*spec) {
+			return m.Digest.String(), nil
+		}
+	}
+	return "", fmt.Errorf("image %s has no manifest for platform %s", image, platform)
+}
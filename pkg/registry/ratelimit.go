@@ -0,0 +1,96 @@
+package registry
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/monlor/k8s-image-updater/pkg/clock"
+	"github.com/monlor/k8s-image-updater/pkg/metrics"
+	"github.com/sirupsen/logrus"
+)
+
+// Wait after a 429 response carrying neither Retry-After nor RateLimit-Reset
+const defaultRateLimitBackoff = time.Minute
+
+// Registries that answered 429, requests to them fail without being sent until the limit resets
+var (
+	rateLimitMu    sync.Mutex
+	rateLimitUntil = make(map[string]time.Time)
+	// Time of the rate limit resets, replaced in tests
+	rateLimitClock clock.Clock = clock.Real{}
+)
+
+// RateLimitError is returned for requests to a registry whose rate limit is exhausted, it matches ErrRateLimited
+type RateLimitError struct {
+	Registry string
+	Until    time.Time
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("registry %s is rate limited until %s", e.Registry, e.Until.UTC().Format(time.RFC3339))
+}
+
+func (e *RateLimitError) Is(target error) bool {
+	return target == ErrRateLimited
+}
+
+// rateLimited returns the error of a request to a registry that is still rate limited, nil otherwise
+func rateLimited(registry string) error {
+	rateLimitMu.Lock()
+	defer rateLimitMu.Unlock()
+	until, ok := rateLimitUntil[registry]
+	if !ok {
+		return nil
+	}
+	if !rateLimitClock.Now().Before(until) {
+		delete(rateLimitUntil, registry)
+		return nil
+	}
+	return &RateLimitError{Registry: registry, Until: until}
+}
+
+// recordRateLimit holds back the requests to a registry that answered 429 until its limit resets, from the
+// Retry-After or RateLimit-Reset header, and logs the rate limit headers
+func recordRateLimit(registry string, header http.Header) {
+	now := rateLimitClock.Now()
+	until := now.Add(defaultRateLimitBackoff)
+	if reset, ok := parseRateLimitReset(header, now); ok {
+		until = reset
+	}
+
+	rateLimitMu.Lock()
+	rateLimitUntil[registry] = until
+	rateLimitMu.Unlock()
+	metrics.RegistryRateLimitReset.WithLabelValues(registry).Set(float64(until.Unix()))
+
+	var details []string
+	for _, name := range []string{"RateLimit-Limit", "RateLimit-Remaining", "Retry-After", "RateLimit-Reset"} {
+		if value := header.Get(name); value != "" {
+			details = append(details, name+": "+value)
+		}
+	}
+	logrus.Warnf("Registry %s rate limited requests (%s), not sending requests to it until %s",
+		registry, strings.Join(details, ", "), until.UTC().Format(time.RFC3339))
+}
+
+// parseRateLimitReset reads when a rate limit resets from the Retry-After header, in seconds or as an HTTP date,
+// or from the RateLimit-Reset header in seconds
+func parseRateLimitReset(header http.Header, now time.Time) (time.Time, bool) {
+	if value := strings.TrimSpace(header.Get("Retry-After")); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+			return now.Add(time.Duration(seconds) * time.Second), true
+		}
+		if date, err := http.ParseTime(value); err == nil {
+			return date, true
+		}
+	}
+	value, _, _ := strings.Cut(header.Get("RateLimit-Reset"), ";")
+	if seconds, err := strconv.Atoi(strings.TrimSpace(value)); err == nil && seconds >= 0 {
+		return now.Add(time.Duration(seconds) * time.Second), true
+	}
+	return time.Time{}, false
+}
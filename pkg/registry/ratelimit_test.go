@@ -0,0 +1,91 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/monlor/k8s-image-updater/pkg/clock"
+	"github.com/monlor/k8s-image-updater/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimitedRegistry(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	fakeClock := clock.NewFake(now)
+	oldClock := rateLimitClock
+	rateLimitClock = fakeClock
+	t.Cleanup(func() {
+		rateLimitClock = oldClock
+		rateLimitMu.Lock()
+		clear(rateLimitUntil)
+		rateLimitMu.Unlock()
+	})
+
+	var manifestRequests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/" {
+			return
+		}
+		manifestRequests.Add(1)
+		w.Header().Set("RateLimit-Limit", "100;w=21600")
+		w.Header().Set("RateLimit-Remaining", "0;w=21600")
+		w.Header().Set("Retry-After", "120")
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"errors":[{"code":"TOOMANYREQUESTS","message":"You have reached your pull rate limit"}]}`))
+	}))
+	t.Cleanup(server.Close)
+	host := strings.TrimPrefix(server.URL, "http://")
+	client := NewRegistryClient("", "")
+	ctx := context.Background()
+
+	_, err := client.GetDigest(ctx, host+"/app:1.0.0")
+	require.ErrorIs(t, err, ErrRateLimited)
+	assert.Equal(t, int32(1), manifestRequests.Load())
+	assert.Equal(t, 0.0, testutil.ToFloat64(metrics.RegistryRateLimitRemaining.WithLabelValues(host)))
+	assert.Equal(t, float64(now.Add(2*time.Minute).Unix()), testutil.ToFloat64(metrics.RegistryRateLimitReset.WithLabelValues(host)))
+
+	// Requests are held back until the limit resets
+	fakeClock.Advance(time.Minute)
+	_, err = client.GetDigest(ctx, host+"/app:1.0.0")
+	var rateLimitErr *RateLimitError
+	require.True(t, errors.As(err, &rateLimitErr), "%v", err)
+	assert.Equal(t, now.Add(2*time.Minute), rateLimitErr.Until)
+	assert.Equal(t, int32(1), manifestRequests.Load())
+
+	fakeClock.Advance(time.Minute)
+	_, err = client.GetDigest(ctx, host+"/app:1.0.0")
+	require.ErrorIs(t, err, ErrRateLimited)
+	assert.Equal(t, int32(2), manifestRequests.Load())
+}
+
+func TestParseRateLimitReset(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		header http.Header
+		want   time.Time
+		ok     bool
+	}{
+		{"retry-after seconds", http.Header{"Retry-After": {"30"}}, now.Add(30 * time.Second), true},
+		{"retry-after date", http.Header{"Retry-After": {"Sat, 01 Jun 2024 13:00:00 GMT"}}, now.Add(time.Hour), true},
+		{"ratelimit-reset", http.Header{"Ratelimit-Reset": {"600;w=21600"}}, now.Add(10 * time.Minute), true},
+		{"retry-after first", http.Header{"Retry-After": {"30"}, "Ratelimit-Reset": {"600"}}, now.Add(30 * time.Second), true},
+		{"invalid", http.Header{"Retry-After": {"soon"}}, time.Time{}, false},
+		{"none", http.Header{}, time.Time{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reset, ok := parseRateLimitReset(tt.header, now)
+			assert.Equal(t, tt.ok, ok)
+			assert.True(t, tt.want.Equal(reset), "got %s", reset)
+		})
+	}
+}
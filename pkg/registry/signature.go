@@ -0,0 +1,20 @@
+package registry
+
+import (
+	"context"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// CosignSignatureTag returns the tag cosign stores the signatures of a manifest digest under
+func CosignSignatureTag(digest string) string {
+	return strings.Replace(digest, ":", "-", 1) + ".sig"
+}
+
+// RemoteOptions returns the options of remote requests to the registry of a reference, with the credentials and
+// transport of the client, e.g. for the cosign library
+func (c *RegistryClient) RemoteOptions(ctx context.Context, ref name.Reference) []remote.Option {
+	return c.options(ctx, ref.Context().RegistryStr())
+}
@@ -0,0 +1,169 @@
+package registry
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/monlor/k8s-image-updater/pkg/metrics"
+	"golang.org/x/net/http/httpproxy"
+)
+
+// Transports shared by every registry client, so the auto-updater and the API reach registries the same way
+var (
+	transportMu       sync.RWMutex
+	secureTransport   http.RoundTripper = newTransport(nil, false, http.ProxyFromEnvironment)
+	insecureTransport http.RoundTripper = newTransport(nil, true, http.ProxyFromEnvironment)
+	// REGISTRY_CA_FILE certificates and proxy the transports of resources with their own TLS settings build on
+	transportRootCAs *x509.CertPool
+	transportProxy   = http.ProxyFromEnvironment
+	// Transports of resources with their own TLS settings, by settings
+	tlsTransports = make(map[string]http.RoundTripper)
+)
+
+// ConfigureTransport trusts the REGISTRY_CA_FILE certificates, in addition to the system roots, and sends requests
+// through REGISTRY_PROXY or the proxy of the environment, for all registry clients
+func ConfigureTransport(cfg *config.Config) error {
+	proxy, err := registryProxy(cfg)
+	if err != nil {
+		return err
+	}
+
+	var rootCAs *x509.CertPool
+	if cfg.RegistryCAFile != "" {
+		pem, err := os.ReadFile(cfg.RegistryCAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read registry CA file: %v", err)
+		}
+		if rootCAs, err = x509.SystemCertPool(); err != nil {
+			rootCAs = x509.NewCertPool()
+		}
+		if !rootCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in registry CA file %s", cfg.RegistryCAFile)
+		}
+	}
+
+	transportMu.Lock()
+	defer transportMu.Unlock()
+	secureTransport = newTransport(rootCAs, false, proxy)
+	insecureTransport = newTransport(rootCAs, true, proxy)
+	transportRootCAs, transportProxy = rootCAs, proxy
+	tlsTransports = make(map[string]http.RoundTripper)
+	return nil
+}
+
+// TLSTransport returns the transport of a resource with its own registry TLS settings, skipping TLS verification when
+// insecure, or trusting the certificates of the PEM bundle caPEM in addition to REGISTRY_CA_FILE and the system roots.
+// Resources with the same settings share a transport.
+func TLSTransport(insecure bool, caPEM []byte) (http.RoundTripper, error) {
+	key := fmt.Sprintf("%t/%x", insecure, sha256.Sum256(caPEM))
+	transportMu.Lock()
+	defer transportMu.Unlock()
+	if t, ok := tlsTransports[key]; ok {
+		return t, nil
+	}
+
+	rootCAs := transportRootCAs
+	if len(caPEM) > 0 {
+		if rootCAs != nil {
+			rootCAs = rootCAs.Clone()
+		} else if systemCAs, err := x509.SystemCertPool(); err == nil {
+			rootCAs = systemCAs
+		} else {
+			rootCAs = x509.NewCertPool()
+		}
+		if !rootCAs.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in registry CA bundle")
+		}
+	}
+	t := newTransport(rootCAs, insecure, transportProxy)
+	tlsTransports[key] = t
+	return t, nil
+}
+
+// registryProxy returns the proxy of registry requests, REGISTRY_PROXY for every host outside NO_PROXY if set,
+// otherwise HTTP_PROXY, HTTPS_PROXY and NO_PROXY as read when configuring the transport
+func registryProxy(cfg *config.Config) (func(*http.Request) (*url.URL, error), error) {
+	proxyConfig := httpproxy.FromEnvironment()
+	if cfg.RegistryProxy != "" {
+		// The URL is left out of errors, it may hold credentials
+		proxyURL, err := url.Parse(cfg.RegistryProxy)
+		if err != nil || proxyURL.Host == "" {
+			return nil, fmt.Errorf("invalid REGISTRY_PROXY, must be a URL such as http://proxy.example.com:3128")
+		}
+		proxyConfig.HTTPProxy = cfg.RegistryProxy
+		proxyConfig.HTTPSProxy = cfg.RegistryProxy
+	}
+	proxy := proxyConfig.ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		return proxy(req.URL)
+	}, nil
+}
+
+func newTransport(rootCAs *x509.CertPool, insecure bool, proxy func(*http.Request) (*url.URL, error)) http.RoundTripper {
+	t := remote.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = &tls.Config{RootCAs: rootCAs, InsecureSkipVerify: insecure}
+	t.Proxy = proxy
+	return &rateLimitTransport{inner: t}
+}
+
+// rateLimitTransport records the RateLimit-Remaining header of registry responses, and holds back the
+// requests to a registry that answered 429 until its rate limit resets
+type rateLimitTransport struct {
+	inner http.RoundTripper
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := rateLimited(req.URL.Host); err != nil {
+		return nil, err
+	}
+	resp, err := t.inner.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if remaining, ok := parseRateLimitRemaining(resp.Header.Get("RateLimit-Remaining")); ok {
+		metrics.RegistryRateLimitRemaining.WithLabelValues(req.URL.Host).Set(remaining)
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		recordRateLimit(req.URL.Host, resp.Header)
+	}
+	return resp, nil
+}
+
+// parseRateLimitRemaining reads the request count of a RateLimit-Remaining header, e.g. 76;w=21600 as sent by Docker Hub
+func parseRateLimitRemaining(header string) (float64, bool) {
+	value, _, _ := strings.Cut(header, ";")
+	remaining, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		return 0, false
+	}
+	return remaining, true
+}
+
+// transportFor returns the transport of the client for a registry host, the shared one unless the client has its own.
+// TLS verification is skipped for REGISTRY_INSECURE hosts either way.
+func (c *RegistryClient) transportFor(registry string) http.RoundTripper {
+	if c.transport != nil && !config.GlobalConfig.RegistryInsecure(registry) {
+		return c.transport
+	}
+	return transportFor(registry)
+}
+
+// transportFor returns the shared transport for a registry host, skipping TLS verification for REGISTRY_INSECURE hosts
+func transportFor(registry string) http.RoundTripper {
+	transportMu.RLock()
+	defer transportMu.RUnlock()
+	if config.GlobalConfig.RegistryInsecure(registry) {
+		return insecureTransport
+	}
+	return secureTransport
+}
@@ -0,0 +1,237 @@
+package registry
+
+import (
+	"context"
+	"encoding/pem"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	ggcrregistry "github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Start an in-memory registry behind a self-signed certificate holding app:1.0.0, returning its host and CA file
+func newTLSTestRegistry(t *testing.T) (string, string) {
+	server := httptest.NewUnstartedServer(ggcrregistry.New(ggcrregistry.Logger(log.New(io.Discard, "", 0))))
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	host := strings.TrimPrefix(server.URL, "https://")
+
+	img, err := random.Image(256, 1)
+	require.NoError(t, err)
+	ref, err := name.ParseReference(host + "/app:1.0.0")
+	require.NoError(t, err)
+	require.NoError(t, remote.Write(ref, img, remote.WithTransport(server.Client().Transport)))
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0o600))
+	return host, caFile
+}
+
+func TestRegistryTransport(t *testing.T) {
+	host, caFile := newTLSTestRegistry(t)
+	image := host + "/app:1.0.0"
+
+	oldConfig := *config.GlobalConfig
+	t.Cleanup(func() {
+		*config.GlobalConfig = oldConfig
+		require.NoError(t, ConfigureTransport(config.GlobalConfig))
+	})
+
+	tests := []struct {
+		name     string
+		insecure string
+		caFile   string
+		wantErr  bool
+	}{
+		{name: "untrusted certificate", wantErr: true},
+		{name: "other insecure registry", insecure: "registry.example.com", wantErr: true},
+		{name: "insecure registry", insecure: "registry.example.com," + host},
+		{name: "trusted CA", caFile: caFile},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.GlobalConfig.InsecureRegistries = tt.insecure
+			config.GlobalConfig.RegistryCAFile = tt.caFile
+			require.NoError(t, ConfigureTransport(config.GlobalConfig))
+
+			client := NewRegistryClient("", "")
+			_, err := client.GetDigest(context.Background(), image)
+			_, listErr := client.ListTags(context.Background(), image)
+			if tt.wantErr {
+				assert.ErrorContains(t, err, "certificate")
+				assert.Error(t, listErr)
+			} else {
+				assert.NoError(t, err)
+				assert.NoError(t, listErr)
+			}
+		})
+	}
+}
+
+func TestConfigureTransportInvalidCAFile(t *testing.T) {
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caFile, []byte("not a certificate"), 0o600))
+
+	assert.ErrorContains(t, ConfigureTransport(&config.Config{RegistryCAFile: caFile}), "no certificates")
+	assert.Error(t, ConfigureTransport(&config.Config{RegistryCAFile: filepath.Join(t.TempDir(), "missing.pem")}))
+}
+
+// Start a proxy tunnelling every CONNECT request to target, returning its URL and the hosts it was asked to reach
+func newTestProxy(t *testing.T, target string) (string, func() []string) {
+	var mu sync.Mutex
+	var hosts []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "only CONNECT is supported", http.StatusMethodNotAllowed)
+			return
+		}
+		mu.Lock()
+		hosts = append(hosts, r.Host)
+		mu.Unlock()
+
+		upstream, err := net.Dial("tcp", target)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			upstream.Close()
+			return
+		}
+		_, _ = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go func() {
+			_, _ = io.Copy(upstream, conn)
+			upstream.Close()
+		}()
+		_, _ = io.Copy(conn, upstream)
+		conn.Close()
+	}))
+	t.Cleanup(server.Close)
+	return server.URL, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), hosts...)
+	}
+}
+
+func TestRegistryProxy(t *testing.T) {
+	host, caFile := newTLSTestRegistry(t)
+	// The certificate of the test server is valid for example.com, which only the proxy resolves to it
+	image := "example.com/app:1.0.0"
+
+	oldConfig := *config.GlobalConfig
+	t.Cleanup(func() {
+		*config.GlobalConfig = oldConfig
+		require.NoError(t, ConfigureTransport(config.GlobalConfig))
+	})
+	for _, key := range []string{"HTTP_PROXY", "http_proxy", "HTTPS_PROXY", "https_proxy", "NO_PROXY", "no_proxy"} {
+		t.Setenv(key, "")
+	}
+
+	proxyURL, connected := newTestProxy(t, host)
+	// Nothing listens on this port, requests through it fail
+	deadProxy := "http://127.0.0.1:1"
+
+	tests := []struct {
+		name          string
+		registryProxy string
+		httpsProxy    string
+	}{
+		{name: "REGISTRY_PROXY", registryProxy: proxyURL},
+		{name: "HTTPS_PROXY", httpsProxy: proxyURL},
+		{name: "REGISTRY_PROXY overrides HTTPS_PROXY", registryProxy: proxyURL, httpsProxy: deadProxy},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("HTTPS_PROXY", tt.httpsProxy)
+			config.GlobalConfig.RegistryCAFile = caFile
+			config.GlobalConfig.RegistryProxy = tt.registryProxy
+			require.NoError(t, ConfigureTransport(config.GlobalConfig))
+			before := len(connected())
+
+			client := NewRegistryClient("", "")
+			_, err := client.GetDigest(context.Background(), image)
+			require.NoError(t, err)
+			tags, err := client.ListTags(context.Background(), image)
+			require.NoError(t, err)
+			assert.Equal(t, []string{"1.0.0"}, tags)
+			hosts := connected()[before:]
+			require.NotEmpty(t, hosts)
+			for _, host := range hosts {
+				assert.Equal(t, "example.com:443", host)
+			}
+		})
+	}
+}
+
+func TestConfigureTransportInvalidProxy(t *testing.T) {
+	err := ConfigureTransport(&config.Config{RegistryProxy: "http://user:secret@"})
+	assert.ErrorContains(t, err, "invalid REGISTRY_PROXY")
+	assert.NotContains(t, err.Error(), "secret")
+}
+
+func TestTLSTransport(t *testing.T) {
+	host, caFile := newTLSTestRegistry(t)
+	image := host + "/app:1.0.0"
+	caPEM, err := os.ReadFile(caFile)
+	require.NoError(t, err)
+
+	oldConfig := *config.GlobalConfig
+	t.Cleanup(func() {
+		*config.GlobalConfig = oldConfig
+		require.NoError(t, ConfigureTransport(config.GlobalConfig))
+	})
+	require.NoError(t, ConfigureTransport(config.GlobalConfig))
+
+	trusted, err := TLSTransport(false, caPEM)
+	require.NoError(t, err)
+	// Resources with the same settings share a transport
+	again, err := TLSTransport(false, caPEM)
+	require.NoError(t, err)
+	assert.Same(t, trusted, again)
+	_, err = TLSTransport(false, []byte("not a certificate"))
+	assert.ErrorContains(t, err, "no certificates")
+
+	_, err = NewRegistryClient("", "").GetDigest(context.Background(), image)
+	assert.ErrorContains(t, err, "certificate")
+	_, err = NewRegistryClient("", "").WithTransport(trusted).GetDigest(context.Background(), image)
+	assert.NoError(t, err)
+
+	// REGISTRY_INSECURE hosts skip TLS verification whatever the transport of the client
+	untrusted, err := TLSTransport(false, nil)
+	require.NoError(t, err)
+	config.GlobalConfig.InsecureRegistries = host
+	_, err = NewRegistryClient("", "").WithTransport(untrusted).GetDigest(context.Background(), image)
+	assert.NoError(t, err)
+}
+
+func TestRegistryClientIdentity(t *testing.T) {
+	transport, err := TLSTransport(true, nil)
+	require.NoError(t, err)
+	shared, err := TLSTransport(true, nil)
+	require.NoError(t, err)
+
+	client := NewRegistryClient("user", "secret")
+	assert.Equal(t, client.Identity(), NewRegistryClient("user", "secret").Identity())
+	assert.NotContains(t, client.Identity(), "secret")
+	assert.NotEqual(t, client.Identity(), NewRegistryClient("user", "other").Identity())
+	assert.NotEqual(t, client.Identity(), NewRegistryClient("", "").Identity())
+	assert.NotEqual(t, client.Identity(), client.WithTransport(transport).Identity())
+	assert.Equal(t, client.WithTransport(transport).Identity(), client.WithTransport(shared).Identity())
+}
@@ -0,0 +1,138 @@
+package status
+
+import (
+	"cmp"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/monlor/k8s-image-updater/config"
+)
+
+// Result is the outcome of the last check of a resource
+type Result struct {
+	// Kubeconfig context of the cluster, empty for the default cluster
+	Cluster    string            `json:"cluster,omitempty"`
+	Kind       string            `json:"kind"`
+	Namespace  string            `json:"namespace"`
+	Name       string            `json:"name"`
+	CheckedAt  time.Time         `json:"checkedAt"`
+	Status     string            `json:"status,omitempty"`
+	Containers []ContainerResult `json:"containers"`
+}
+
+// ContainerResult is the image of a container and the image proposed for it, if any
+type ContainerResult struct {
+	Container     string `json:"container"`
+	CurrentImage  string `json:"currentImage"`
+	ProposedImage string `json:"proposedImage,omitempty"`
+}
+
+func key(cluster, kind, namespace, name string) string {
+	return cluster + "/" + kind + "/" + namespace + "/" + name
+}
+
+// Index keeps the last check result of each resource, dropping the least recently checked
+// once it holds maxEntries results
+type Index struct {
+	mu         sync.RWMutex
+	results    map[string]Result
+	maxEntries int
+}
+
+// NewIndex creates an index holding at most maxEntries results, unbounded if maxEntries <= 0
+func NewIndex(maxEntries int) *Index {
+	return &Index{results: make(map[string]Result), maxEntries: maxEntries}
+}
+
+// Set records the result of a check, replacing the previous result of the resource
+func (i *Index) Set(result Result) {
+	if result.CheckedAt.IsZero() {
+		result.CheckedAt = time.Now().UTC()
+	}
+	k := key(result.Cluster, result.Kind, result.Namespace, result.Name)
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if _, ok := i.results[k]; !ok && i.maxEntries > 0 && len(i.results) >= i.maxEntries {
+		oldest := ""
+		for candidate, r := range i.results {
+			if oldest == "" || r.CheckedAt.Before(i.results[oldest].CheckedAt) {
+				oldest = candidate
+			}
+		}
+		delete(i.results, oldest)
+	}
+	i.results[k] = result
+}
+
+// List returns the results matching namespace and kind, an empty filter matches all,
+// sorted by cluster, kind, namespace and name
+func (i *Index) List(namespace, kind string) []Result {
+	i.mu.RLock()
+	results := make([]Result, 0, len(i.results))
+	for _, r := range i.results {
+		if (namespace == "" || r.Namespace == namespace) && (kind == "" || r.Kind == kind) {
+			results = append(results, r)
+		}
+	}
+	i.mu.RUnlock()
+
+	slices.SortFunc(results, func(a, b Result) int {
+		return cmp.Or(cmp.Compare(a.Cluster, b.Cluster), cmp.Compare(a.Kind, b.Kind), cmp.Compare(a.Namespace, b.Namespace), cmp.Compare(a.Name, b.Name))
+	})
+	return results
+}
+
+// Prune drops the results of a cluster checked before t, e.g. of resources deleted or no longer enabled
+func (i *Index) Prune(cluster string, t time.Time) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	for k, r := range i.results {
+		if r.Cluster == cluster && r.CheckedAt.Before(t) {
+			delete(i.results, k)
+		}
+	}
+}
+
+// Len returns the number of results held
+func (i *Index) Len() int {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return len(i.results)
+}
+
+var (
+	stdMu sync.RWMutex
+	std   = NewIndex(config.GlobalConfig.StatusIndexMaxEntries)
+)
+
+// SetIndex replaces the index used by Set, List and Prune, returning the previous one
+func SetIndex(i *Index) *Index {
+	stdMu.Lock()
+	defer stdMu.Unlock()
+	previous := std
+	std = i
+	return previous
+}
+
+func index() *Index {
+	stdMu.RLock()
+	defer stdMu.RUnlock()
+	return std
+}
+
+// Set records the result of a check in the index shared by the updater and the API
+func Set(result Result) {
+	index().Set(result)
+}
+
+// List returns the results of the shared index matching namespace and kind
+func List(namespace, kind string) []Result {
+	return index().List(namespace, kind)
+}
+
+// Prune drops the results of a cluster of the shared index checked before t
+func Prune(cluster string, t time.Time) {
+	index().Prune(cluster, t)
+}
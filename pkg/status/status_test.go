@@ -0,0 +1,93 @@
+package status
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexList(t *testing.T) {
+	i := NewIndex(0)
+	i.Set(Result{Kind: "statefulset", Namespace: "default", Name: "db"})
+	i.Set(Result{Kind: "deployment", Namespace: "team-a", Name: "api"})
+	i.Set(Result{Kind: "deployment", Namespace: "default", Name: "web", Status: "no-matching-tags"})
+	// A new result replaces the previous one of the resource
+	i.Set(Result{Kind: "deployment", Namespace: "default", Name: "web"})
+
+	names := func(results []Result) []string {
+		var names []string
+		for _, r := range results {
+			names = append(names, r.Kind+"/"+r.Namespace+"/"+r.Name)
+		}
+		return names
+	}
+	assert.Equal(t, []string{"deployment/default/web", "deployment/team-a/api", "statefulset/default/db"}, names(i.List("", "")))
+	assert.Equal(t, []string{"deployment/default/web", "statefulset/default/db"}, names(i.List("default", "")))
+	assert.Equal(t, []string{"deployment/default/web"}, names(i.List("default", "deployment")))
+	assert.Empty(t, i.List("other", ""))
+
+	results := i.List("default", "deployment")
+	assert.Empty(t, results[0].Status)
+	assert.False(t, results[0].CheckedAt.IsZero())
+}
+
+func TestIndexBounded(t *testing.T) {
+	i := NewIndex(2)
+	now := time.Now()
+	i.Set(Result{Kind: "deployment", Namespace: "default", Name: "a", CheckedAt: now.Add(-2 * time.Minute)})
+	i.Set(Result{Kind: "deployment", Namespace: "default", Name: "b", CheckedAt: now.Add(-time.Minute)})
+	// Updating a resource already held does not evict another one
+	i.Set(Result{Kind: "deployment", Namespace: "default", Name: "a", CheckedAt: now})
+	assert.Equal(t, 2, i.Len())
+
+	// The least recently checked resource is dropped
+	i.Set(Result{Kind: "deployment", Namespace: "default", Name: "c", CheckedAt: now})
+	require.Equal(t, 2, i.Len())
+	results := i.List("", "")
+	assert.Equal(t, "a", results[0].Name)
+	assert.Equal(t, "c", results[1].Name)
+}
+
+func TestIndexPrune(t *testing.T) {
+	i := NewIndex(0)
+	now := time.Now()
+	i.Set(Result{Kind: "deployment", Namespace: "default", Name: "old", CheckedAt: now.Add(-time.Hour)})
+	i.Set(Result{Kind: "deployment", Namespace: "default", Name: "new", CheckedAt: now})
+	// Results of other clusters are kept
+	i.Set(Result{Cluster: "prod", Kind: "deployment", Namespace: "default", Name: "old", CheckedAt: now.Add(-time.Hour)})
+
+	i.Prune("", now.Add(-time.Minute))
+	results := i.List("", "")
+	require.Len(t, results, 2)
+	assert.Equal(t, "new", results[0].Name)
+	assert.Equal(t, "prod", results[1].Cluster)
+	assert.Equal(t, "old", results[1].Name)
+}
+
+func TestIndexConcurrent(t *testing.T) {
+	i := NewIndex(50)
+	var wg sync.WaitGroup
+	for w := range 4 {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for n := range 200 {
+				i.Set(Result{Kind: "deployment", Namespace: fmt.Sprintf("ns-%d", w), Name: fmt.Sprintf("app-%d", n)})
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for range 200 {
+				for _, r := range i.List(fmt.Sprintf("ns-%d", w), "deployment") {
+					assert.Equal(t, fmt.Sprintf("ns-%d", w), r.Namespace)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 50, i.Len())
+}
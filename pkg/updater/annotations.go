@@ -0,0 +1,197 @@
+package updater
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/monlor/k8s-image-updater/pkg/registry"
+	"github.com/sirupsen/logrus"
+)
+
+// tagCache holds metadata of image tags, like their OCI annotations or creation time, for TAG_ANNOTATION_CACHE_TTL,
+// the checks of every cycle would otherwise fetch them again
+type tagCache[V any] struct {
+	mu      sync.Mutex
+	entries map[string]tagCacheEntry[V]
+}
+
+type tagCacheEntry[V any] struct {
+	value   V
+	expires time.Time
+}
+
+func newTagCache[V any]() *tagCache[V] {
+	return &tagCache[V]{entries: make(map[string]tagCacheEntry[V])}
+}
+
+func (c *tagCache[V]) get(key string, now time.Time) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok || now.After(entry.expires) {
+		var zero V
+		return zero, false
+	}
+	return entry.value, true
+}
+
+func (c *tagCache[V]) set(key string, value V, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Drop expired entries so tags that are no longer checked do not pile up
+	for k, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = tagCacheEntry[V]{value: value, expires: now.Add(config.GlobalConfig.TagAnnotationCacheTTL)}
+}
+
+// parseRequiredAnnotation splits a require-annotation value of the form key=value
+func parseRequiredAnnotation(value string) (string, string, error) {
+	key, val, ok := strings.Cut(value, "=")
+	if !ok || key == "" {
+		return "", "", fmt.Errorf("invalid require-annotation %q, expected key=value", value)
+	}
+	return key, val, nil
+}
+
+// parseDurationAnnotation parses a duration annotation like min-tag-age, 0 when unset
+func parseDurationAnnotation(annotations map[string]string, key string) (time.Duration, error) {
+	value := annotations[key]
+	if value == "" {
+		return 0, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration < 0 {
+		return 0, fmt.Errorf("invalid %s annotation %q, expected a duration like 48h", key, value)
+	}
+	return duration, nil
+}
+
+// lookupTag returns the metadata of image fetched with a registry client from the cache, or fetches it counting the
+// fetch in lookups. It returns false once TAG_ANNOTATION_LOOKUPS tags were fetched.
+func lookupTag[V any](cache *tagCache[V], image string, registryClient *registry.RegistryClient, now time.Time, lookups *int, fetch func() (V, error)) (V, bool, error) {
+	// Another resource's credentials or TLS settings may see a different image
+	key := image + "#" + registryClient.Identity()
+	if value, ok := cache.get(key, now); ok {
+		return value, true, nil
+	}
+	var zero V
+	if *lookups >= config.GlobalConfig.TagAnnotationLookups {
+		return zero, false, nil
+	}
+	*lookups++
+	value, err := fetch()
+	if err != nil {
+		return zero, false, err
+	}
+	cache.set(key, value, now)
+	return value, true, nil
+}
+
+// selectTag returns the first of the sorted tags carrying the required annotation and older than minTagAge,
+// or the first tag without requirement. With VERIFY_BEFORE_APPLY the manifest of the tag must resolve as well,
+// and with allowedDigests its digest must be one of them.
+// Tags sorted after the current tag are never selected, and at most TAG_ANNOTATION_LOOKUPS tags missing from
+// the caches are looked up. An empty tag means no update.
+func (u *Updater) selectTag(ctx context.Context, imageInfo *registry.ImageInfo, sortedTags []string, registryClient *registry.RegistryClient, requiredAnnotation string, minTagAge time.Duration, allowedDigests []string) (string, error) {
+	if len(sortedTags) == 0 {
+		return "", nil
+	}
+	verify := config.GlobalConfig.VerifyBeforeApply
+	if requiredAnnotation == "" && minTagAge == 0 && !verify && allowedDigests == nil {
+		return sortedTags[0], nil
+	}
+	var key, value string
+	if requiredAnnotation != "" {
+		var err error
+		if key, value, err = parseRequiredAnnotation(requiredAnnotation); err != nil {
+			return "", err
+		}
+	}
+
+	lookups := 0
+	tooRecent, unresolved, unapproved := false, false, false
+	for _, tag := range sortedTags {
+		// The current tag is kept whatever its annotations and age, older tags would be a downgrade
+		if tag == imageInfo.Tag {
+			if unapproved {
+				break
+			}
+			return tag, nil
+		}
+
+		image := registry.BuildImageRefStyle(imageInfo, tag, "", config.ImageNameFull)
+		if requiredAnnotation != "" {
+			annotations, ok, err := lookupTag(u.tagAnnotations, image, registryClient, u.clock.Now(), &lookups, func() (map[string]string, error) {
+				return registryClient.GetImageAnnotations(ctx, image)
+			})
+			if err != nil {
+				return "", fmt.Errorf("failed to get annotations of %s: %v", image, err)
+			}
+			if !ok {
+				logrus.Warnf("Looked up %d tags of %s without finding a tag to select, TAG_ANNOTATION_LOOKUPS reached", lookups, imageInfo.Repository)
+				return "", nil
+			}
+			if annotations[key] != value {
+				checkDebugf("Skipping tag %s, annotation %s is %q instead of %q", tag, key, annotations[key], value)
+				continue
+			}
+		}
+
+		if minTagAge > 0 {
+			created, ok, err := lookupTag(u.tagCreated, image, registryClient, u.clock.Now(), &lookups, func() (time.Time, error) {
+				return registryClient.GetCreatedTime(ctx, image)
+			})
+			if err != nil {
+				return "", fmt.Errorf("failed to get creation time of %s: %v", image, err)
+			}
+			if !ok {
+				logrus.Warnf("Looked up %d tags of %s without finding a tag to select, TAG_ANNOTATION_LOOKUPS reached", lookups, imageInfo.Repository)
+				return "", nil
+			}
+			if age := u.clock.Now().Sub(created); age < minTagAge {
+				checkDebugf("Skipping tag %s, created %s ago, less than %s", tag, age.Truncate(time.Second), minTagAge)
+				tooRecent = true
+				continue
+			}
+		}
+
+		// Some registries list tags whose manifest was deleted or is broken
+		if verify || allowedDigests != nil {
+			digest, err := registryClient.GetDigest(ctx, image)
+			if err != nil {
+				if ctx.Err() != nil {
+					return "", ctx.Err()
+				}
+				logrus.Warnf("Skipping tag %s, its manifest does not resolve: %v", tag, err)
+				unresolved = true
+				continue
+			}
+			if !digestAllowed(allowedDigests, digest) {
+				checkDebugf("Skipping tag %s, its digest %s is not allowed by the allowed-digests annotation", tag, shortDigest(digest))
+				unapproved = true
+				continue
+			}
+		}
+		return tag, nil
+	}
+	if unapproved {
+		return "", fmt.Errorf("%w: no newer tag of image %s/%s", ErrDigestNotAllowed, imageInfo.Registry, imageInfo.Repository)
+	}
+	if unresolved {
+		logrus.Warnf("No newer tag of image %s/%s resolves, keeping the current image", imageInfo.Registry, imageInfo.Repository)
+		return "", nil
+	}
+	// Recent tags become eligible once they are old enough
+	if tooRecent {
+		checkInfof("No tag of image %s/%s is older than %s yet", imageInfo.Registry, imageInfo.Repository, minTagAge)
+		return "", nil
+	}
+	return "", fmt.Errorf("%w: no tag of image %s/%s has annotation %s", ErrNoMatchingTags, imageInfo.Registry, imageInfo.Repository, requiredAnnotation)
+}
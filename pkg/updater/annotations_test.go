@@ -0,0 +1,279 @@
+package updater
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	ggcrregistry "github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/monlor/k8s-image-updater/pkg/clock"
+	"github.com/monlor/k8s-image-updater/pkg/registry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const stabilityAnnotation = "org.opencontainers.image.stability"
+
+// Start an in-memory registry counting manifest requests
+func newCountingTestRegistry(t *testing.T) (string, *atomic.Int32) {
+	registryHandler := ggcrregistry.New(ggcrregistry.Logger(log.New(io.Discard, "", 0)))
+	var manifestRequests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/manifests/") {
+			manifestRequests.Add(1)
+		}
+		registryHandler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return strings.TrimPrefix(server.URL, "http://"), &manifestRequests
+}
+
+// Start an in-memory registry counting manifest requests, and push a tag per stability value
+func newAnnotatedTestRegistry(t *testing.T, stability map[string]string) (string, *atomic.Int32) {
+	host, manifestRequests := newCountingTestRegistry(t)
+	for tag, value := range stability {
+		img, err := random.Image(256, 1)
+		require.NoError(t, err)
+		img = mutate.Annotations(img, map[string]string{stabilityAnnotation: value}).(v1.Image)
+		ref, err := name.ParseReference(host + "/app:" + tag)
+		require.NoError(t, err)
+		require.NoError(t, remote.Write(ref, img))
+	}
+	manifestRequests.Store(0)
+	return host, manifestRequests
+}
+
+func TestReleaseModeRequireAnnotation(t *testing.T) {
+	host, manifestRequests := newAnnotatedTestRegistry(t, map[string]string{
+		"1.0.0": "stable",
+		"1.1.0": "stable",
+		"1.2.0": "beta",
+		"1.3.0": "beta",
+	})
+	client := registry.NewRegistryClient("", "")
+	u, _ := newTestUpdater()
+	ctx := context.Background()
+	required := stabilityAnnotation + "=stable"
+
+	// The newest stable tag is selected, looking up the tags from the newest
+	newImage, _, err := u.checkReleaseMode(ctx, host+"/app:1.0.0", client, "", required, 0, "", false, nil)
+	require.NoError(t, err)
+	assert.Equal(t, host+"/app:1.1.0", newImage)
+	assert.Equal(t, int32(3), manifestRequests.Load())
+
+	// The annotations are cached for the next check
+	newImage, _, err = u.checkReleaseMode(ctx, host+"/app:1.0.0", client, "", required, 0, "", false, nil)
+	require.NoError(t, err)
+	assert.Equal(t, host+"/app:1.1.0", newImage)
+	assert.Equal(t, int32(3), manifestRequests.Load())
+
+	// Older tags are never selected, even when the current tag does not carry the annotation
+	newImage, _, err = u.checkReleaseMode(ctx, host+"/app:1.3.0", client, "", required, 0, "", false, nil)
+	require.NoError(t, err)
+	assert.Empty(t, newImage)
+
+	// Without the requirement the newest tag is selected
+	newImage, _, err = u.checkReleaseMode(ctx, host+"/app:1.0.0", client, "", "", 0, "", false, nil)
+	require.NoError(t, err)
+	assert.Equal(t, host+"/app:1.3.0", newImage)
+}
+
+func TestRequireAnnotationCachePerClient(t *testing.T) {
+	host, manifestRequests := newAnnotatedTestRegistry(t, map[string]string{
+		"1.0.0": "stable",
+		"1.1.0": "stable",
+	})
+	u, _ := newTestUpdater()
+	ctx := context.Background()
+	required := stabilityAnnotation + "=stable"
+	transport, err := registry.TLSTransport(true, nil)
+	require.NoError(t, err)
+
+	client := registry.NewRegistryClient("", "")
+	_, _, err = u.checkReleaseMode(ctx, host+"/app:1.0.0", client, "", required, 0, "", false, nil)
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), manifestRequests.Load())
+
+	// The annotations seen with other credentials or TLS settings are not reused
+	for _, other := range []*registry.RegistryClient{registry.NewRegistryClient("user", "secret"), client.WithTransport(transport)} {
+		newImage, _, err := u.checkReleaseMode(ctx, host+"/app:1.0.0", other, "", required, 0, "", false, nil)
+		require.NoError(t, err)
+		assert.Equal(t, host+"/app:1.1.0", newImage)
+	}
+	assert.Equal(t, int32(3), manifestRequests.Load())
+}
+
+func TestRequireAnnotationLookupLimit(t *testing.T) {
+	host, manifestRequests := newAnnotatedTestRegistry(t, map[string]string{
+		"1.0.0": "stable",
+		"1.1.0": "stable",
+		"1.2.0": "beta",
+		"1.3.0": "beta",
+	})
+	oldLookups := config.GlobalConfig.TagAnnotationLookups
+	config.GlobalConfig.TagAnnotationLookups = 2
+	defer func() { config.GlobalConfig.TagAnnotationLookups = oldLookups }()
+	client := registry.NewRegistryClient("", "")
+	u, _ := newTestUpdater()
+	ctx := context.Background()
+	required := stabilityAnnotation + "=stable"
+
+	// Only two tags are looked up per check, the stable tag is not reached
+	newImage, _, err := u.checkReleaseMode(ctx, host+"/app:1.0.0", client, "", required, 0, "", false, nil)
+	require.NoError(t, err)
+	assert.Empty(t, newImage)
+	assert.Equal(t, int32(2), manifestRequests.Load())
+
+	// Cached tags do not count, so the next check gets further
+	newImage, _, err = u.checkReleaseMode(ctx, host+"/app:1.0.0", client, "", required, 0, "", false, nil)
+	require.NoError(t, err)
+	assert.Equal(t, host+"/app:1.1.0", newImage)
+}
+
+func TestRequireAnnotationNoMatch(t *testing.T) {
+	host, _ := newAnnotatedTestRegistry(t, map[string]string{
+		"1.1.0": "beta",
+		"1.2.0": "beta",
+	})
+	client := registry.NewRegistryClient("", "")
+	u, _ := newTestUpdater()
+	ctx := context.Background()
+
+	_, _, err := u.checkReleaseMode(ctx, host+"/app:1.0.0", client, "", stabilityAnnotation+"=stable", 0, "", false, nil)
+	assert.ErrorIs(t, err, ErrNoMatchingTags)
+
+	_, err = u.checkAlphabeticalMode(ctx, host+"/app:1.0.0", client, "", stabilityAnnotation+"=stable", 0, "", nil)
+	assert.ErrorIs(t, err, ErrNoMatchingTags)
+
+	_, _, err = u.checkReleaseMode(ctx, host+"/app:1.0.0", client, "", stabilityAnnotation, 0, "", false, nil)
+	assert.ErrorContains(t, err, "expected key=value")
+}
+
+// Push a random image created at the given time to the reference
+func pushCreatedTestImage(t *testing.T, image string, created time.Time) {
+	img, err := random.Image(256, 1)
+	require.NoError(t, err)
+	img, err = mutate.CreatedAt(img, v1.Time{Time: created})
+	require.NoError(t, err)
+	ref, err := name.ParseReference(image)
+	require.NoError(t, err)
+	require.NoError(t, remote.Write(ref, img))
+}
+
+func TestReleaseModeMinTagAge(t *testing.T) {
+	now := time.Date(2024, 6, 10, 12, 0, 0, 0, time.UTC)
+	host, manifestRequests := newCountingTestRegistry(t)
+	pushCreatedTestImage(t, host+"/app:1.0.0", now.Add(-10*24*time.Hour))
+	pushCreatedTestImage(t, host+"/app:1.1.0", now.Add(-3*24*time.Hour))
+	pushCreatedTestImage(t, host+"/app:1.2.0", now.Add(-47*time.Hour))
+	manifestRequests.Store(0)
+	client := registry.NewRegistryClient("", "")
+	u, _ := newTestUpdater()
+	fakeClock := clock.NewFake(now)
+	u.clock = fakeClock
+	ctx := context.Background()
+
+	// The fresh 1.2.0 is skipped for the aged 1.1.0
+	newImage, _, err := u.checkReleaseMode(ctx, host+"/app:1.0.0", client, "", "", 48*time.Hour, "", false, nil)
+	require.NoError(t, err)
+	assert.Equal(t, host+"/app:1.1.0", newImage)
+	assert.Positive(t, manifestRequests.Load())
+
+	// Every newer tag is too recent, the current image is kept
+	newImage, _, err = u.checkReleaseMode(ctx, host+"/app:1.0.0", client, "", "", 7*24*time.Hour, "", false, nil)
+	require.NoError(t, err)
+	assert.Empty(t, newImage)
+
+	// Creation times are cached, the fresh tag is selected once old enough
+	manifestRequests.Store(0)
+	fakeClock.Advance(time.Hour)
+	newImage, _, err = u.checkReleaseMode(ctx, host+"/app:1.1.0", client, "", "", 48*time.Hour, "", false, nil)
+	require.NoError(t, err)
+	assert.Equal(t, host+"/app:1.2.0", newImage)
+	assert.Zero(t, manifestRequests.Load())
+
+	// Tags that are all too recent in alphabetical mode are not an error either
+	newImage, err = u.checkAlphabeticalMode(ctx, host+"/app:0.9.0", client, "", "", 30*24*time.Hour, "", nil)
+	require.NoError(t, err)
+	assert.Empty(t, newImage)
+}
+
+func TestUpdateContainerMinTagAge(t *testing.T) {
+	now := time.Now()
+	host := newTestRegistry(t, "app")
+	pushCreatedTestImage(t, host+"/app:1.0.0", now.Add(-30*24*time.Hour))
+	pushCreatedTestImage(t, host+"/app:1.1.0", now.Add(-10*24*time.Hour))
+	pushCreatedTestImage(t, host+"/app:1.2.0", now.Add(-time.Hour))
+	u, _ := newTestUpdater()
+	ctx := context.Background()
+
+	deploy := newTestDeployment(map[string]string{config.AnnotationMode: "release", config.AnnotationMinTagAge: "168h"},
+		corev1.Container{Name: "app", Image: host + "/app:1.0.0"})
+	result, err := u.updateContainerIfNeeded(ctx, &deploy.Spec.Template.Spec.Containers[0], &deploy.Annotations, "default", "app", "deployment", &deploy.Spec.Template)
+	require.NoError(t, err)
+	assert.Equal(t, host+"/app:1.1.0", result.NewImage)
+
+	deploy = newTestDeployment(map[string]string{config.AnnotationMode: "release", config.AnnotationMinTagAge: "a week"},
+		corev1.Container{Name: "app", Image: host + "/app:1.0.0"})
+	_, err = u.updateContainerIfNeeded(ctx, &deploy.Spec.Template.Spec.Containers[0], &deploy.Annotations, "default", "app", "deployment", &deploy.Spec.Template)
+	assert.ErrorContains(t, err, config.AnnotationMinTagAge)
+	assert.Equal(t, host+"/app:1.0.0", deploy.Spec.Template.Spec.Containers[0].Image)
+}
+
+func TestVerifyBeforeApply(t *testing.T) {
+	registryHandler := ggcrregistry.New(ggcrregistry.Logger(log.New(io.Discard, "", 0)))
+	// The listed 1.2.0 and 1.1.0-rc.1 tags have no manifest
+	broken := map[string]bool{"1.2.0": true, "1.1.0-rc.1": true}
+	var brokenServed atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if tag, ok := strings.CutPrefix(r.URL.Path, "/v2/app/manifests/"); ok && broken[tag] && brokenServed.Load() {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errors":[{"code":"MANIFEST_UNKNOWN","message":"manifest unknown"}]}`))
+			return
+		}
+		registryHandler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	host := strings.TrimPrefix(server.URL, "http://")
+	for _, tag := range []string{"1.0.0", "1.1.0", "1.2.0", "1.1.0-rc.1"} {
+		pushTestImage(t, host+"/app:"+tag)
+	}
+	brokenServed.Store(true)
+
+	client := registry.NewRegistryClient("", "")
+	u, _ := newTestUpdater()
+	ctx := context.Background()
+
+	// Without verification the phantom tag is selected
+	newImage, _, err := u.checkReleaseMode(ctx, host+"/app:1.0.0", client, "", "", 0, "", false, nil)
+	require.NoError(t, err)
+	assert.Equal(t, host+"/app:1.2.0", newImage)
+
+	oldVerify := config.GlobalConfig.VerifyBeforeApply
+	config.GlobalConfig.VerifyBeforeApply = true
+	t.Cleanup(func() { config.GlobalConfig.VerifyBeforeApply = oldVerify })
+
+	// The next best tag that resolves is selected instead
+	newImage, _, err = u.checkReleaseMode(ctx, host+"/app:1.0.0", client, "", "", 0, "", false, nil)
+	require.NoError(t, err)
+	assert.Equal(t, host+"/app:1.1.0", newImage)
+
+	// No newer tag resolves, the current image is kept
+	newImage, _, err = u.checkReleaseMode(ctx, host+"/app:1.0.0", client, "regexp:^1\\.(0\\.0|2\\.0|1\\.0-rc\\.1)$", "", 0, "", false, nil)
+	require.NoError(t, err)
+	assert.Empty(t, newImage)
+}
@@ -0,0 +1,45 @@
+package updater
+
+import (
+	"context"
+
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/monlor/k8s-image-updater/pkg/metrics"
+	"github.com/sirupsen/logrus"
+)
+
+// recordApplyFailure marks a resource that failed to be written with the apply-failed status and the error,
+// notifying APPLY_FAILURE_HOOK once APPLY_FAILURE_ALERT_THRESHOLD consecutive writes failed
+func (u *Updater) recordApplyFailure(ctx context.Context, p pendingUpdate, applyErr error) {
+	metrics.ApplyFailures.WithLabelValues(p.kind, p.namespace, p.name).Inc()
+	u.mu.Lock()
+	if u.applyFailures == nil {
+		u.applyFailures = make(map[string]int)
+	}
+	u.applyFailures[p.key()]++
+	failures := u.applyFailures[p.key()]
+	u.mu.Unlock()
+
+	// Only the annotations are written, a rejected pod template is left as stored
+	if err := u.k8sClient.SetAnnotations(ctx, p.kind, p.namespace, p.name, map[string]string{
+		config.AnnotationStatus:     config.StatusApplyFailed,
+		config.AnnotationApplyError: applyErr.Error(),
+	}); err != nil {
+		logrus.Errorf("Failed to set apply-failed status of %s %s/%s: %v", p.kind, p.namespace, p.name, err)
+	}
+
+	threshold := config.GlobalConfig.ApplyFailureAlertThreshold
+	if threshold <= 0 || failures != threshold {
+		return
+	}
+	logrus.Warnf("Updating %s %s/%s failed %d consecutive times: %v", p.kind, p.namespace, p.name, failures, applyErr)
+	if u.hooks == nil {
+		return
+	}
+	payload := p.hookPayload()
+	payload.Error = applyErr.Error()
+	payload.Failures = failures
+	if err := u.hooks.ApplyFailed(ctx, payload); err != nil {
+		logrus.Errorf("Apply-failure hook of %s %s/%s failed: %v", p.kind, p.namespace, p.name, err)
+	}
+}
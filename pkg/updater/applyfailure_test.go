@@ -0,0 +1,79 @@
+package updater
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/monlor/k8s-image-updater/pkg/hooks"
+	"github.com/monlor/k8s-image-updater/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestApplyFailureAlert(t *testing.T) {
+	host := newTestRegistry(t, "app", "1.0.0", "1.1.0")
+	oldThreshold := config.GlobalConfig.ApplyFailureAlertThreshold
+	config.GlobalConfig.ApplyFailureAlertThreshold = 3
+	t.Cleanup(func() { config.GlobalConfig.ApplyFailureAlertThreshold = oldThreshold })
+	url, payloads := newHookServer(t, func(string) int { return http.StatusOK })
+	u, clientset := newTestUpdater(newTestDeployment(nil, corev1.Container{Name: "app", Image: host + "/app:1.0.0"}))
+	var err error
+	u.hooks, err = hooks.New(&config.Config{ApplyFailureHook: url})
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	// An admission webhook rejects the new image, writes of the annotations alone are allowed
+	rejecting := true
+	clientset.PrependReactor("update", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		deploy := action.(k8stesting.UpdateAction).GetObject().(*appsv1.Deployment)
+		if rejecting && deploy.Spec.Template.Spec.Containers[0].Image == host+"/app:1.1.0" {
+			return true, nil, errors.New(`admission webhook "policy.example.com" denied the request`)
+		}
+		return false, nil, nil
+	})
+	failures := metrics.ApplyFailures.WithLabelValues("deployment", "default", "app")
+	before := testutil.ToFloat64(failures)
+	stored := func() *appsv1.Deployment {
+		deploy, err := clientset.AppsV1().Deployments("default").Get(ctx, "app", metav1.GetOptions{})
+		require.NoError(t, err)
+		return deploy
+	}
+
+	for i := 1; i <= 4; i++ {
+		require.NoError(t, u.updateDeployments(ctx))
+		deploy := stored()
+		assert.Equal(t, host+"/app:1.0.0", deploy.Spec.Template.Spec.Containers[0].Image)
+		assert.Equal(t, config.StatusApplyFailed, deploy.Annotations[config.AnnotationStatus])
+		assert.Contains(t, deploy.Annotations[config.AnnotationApplyError], "denied the request")
+		assert.Equal(t, before+float64(i), testutil.ToFloat64(failures))
+		if i < 3 {
+			assert.Empty(t, payloads())
+		}
+	}
+
+	// The hook is notified once, when the threshold is reached
+	require.Len(t, payloads(), 1)
+	assert.Equal(t, hooks.PhaseApplyFailed, payloads()[0].Phase)
+	assert.Equal(t, "app", payloads()[0].Name)
+	assert.Equal(t, 3, payloads()[0].Failures)
+	assert.Contains(t, payloads()[0].Error, "denied the request")
+	assert.Equal(t, []hooks.Change{{Action: "update", Container: "app", OldImage: host + "/app:1.0.0", NewImage: host + "/app:1.1.0", Mode: "release"}}, payloads()[0].Changes)
+
+	// A successful write clears the status and resets the count
+	rejecting = false
+	require.NoError(t, u.updateDeployments(ctx))
+	deploy := stored()
+	assert.Equal(t, host+"/app:1.1.0", deploy.Spec.Template.Spec.Containers[0].Image)
+	assert.NotContains(t, deploy.Annotations, config.AnnotationStatus)
+	assert.NotContains(t, deploy.Annotations, config.AnnotationApplyError)
+	assert.Empty(t, u.applyFailures)
+}
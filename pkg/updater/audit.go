@@ -0,0 +1,77 @@
+package updater
+
+import (
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/monlor/k8s-image-updater/pkg/audit"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// containerMode returns the update mode of a container running an image, from its annotations or else the policy,
+// DEFAULT_UPDATE_MODE when none is set
+func containerMode(policy *Policy, annotations map[string]string, containerName, image string) string {
+	return config.GlobalConfig.ResourceMode(policyAnnotation(policy, annotations, config.AnnotationMode, containerName, image))
+}
+
+// auditEntries lists the image changes between two pod templates for the audit log. Restarts of
+// latest mode containers are included for cluster updates, they have nothing to write back.
+func auditEntries(action, kind, namespace, name string, annotations map[string]string, policy *Policy, original, template *corev1.PodTemplateSpec) []audit.Entry {
+	entry := func(container, oldImage, newImage string) audit.Entry {
+		return audit.Entry{
+			Actor:     audit.ActorAuto,
+			Action:    action,
+			Kind:      kind,
+			Namespace: namespace,
+			Name:      name,
+			Container: container,
+			OldImage:  oldImage,
+			NewImage:  newImage,
+			Mode:      containerMode(policy, annotations, container, oldImage),
+		}
+	}
+
+	var entries []audit.Entry
+	for _, change := range imageChanges(original.Spec.Containers, template.Spec.Containers) {
+		entries = append(entries, entry(change.Container, change.OldImage, change.NewImage))
+	}
+	if action != audit.ActionUpdate || original.Annotations[config.AnnotationRestart] == template.Annotations[config.AnnotationRestart] {
+		return entries
+	}
+
+	target := annotations[config.AnnotationContainer]
+	for _, container := range template.Spec.Containers {
+		if (target == "" || config.ContainerMatches(target, container.Name)) && containerMode(policy, annotations, container.Name, container.Image) == "latest" &&
+			!skipsInjectedContainer(annotations, template, container.Name) {
+			restart := entry(container.Name, container.Image, container.Image)
+			restart.Action = audit.ActionRestart
+			entries = append(entries, restart)
+		}
+	}
+	return entries
+}
+
+// canaryAuditEntries lists the images moved from the primary deployment's containers for the audit log
+func canaryAuditEntries(action string, primary *corev1.PodTemplateSpec, namespace, name string, annotations map[string]string, policy *Policy, images map[string]string) []audit.Entry {
+	var entries []audit.Entry
+	for _, container := range primary.Spec.Containers {
+		if image, ok := images[container.Name]; ok {
+			entries = append(entries, audit.Entry{
+				Actor:     audit.ActorAuto,
+				Action:    action,
+				Kind:      "deployment",
+				Namespace: namespace,
+				Name:      name,
+				Container: container.Name,
+				OldImage:  container.Image,
+				NewImage:  image,
+				Mode:      containerMode(policy, annotations, container.Name, container.Image),
+			})
+		}
+	}
+	return entries
+}
+
+func logAuditEntries(entries []audit.Entry) {
+	for _, entry := range entries {
+		audit.Log(entry)
+	}
+}
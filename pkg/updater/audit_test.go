@@ -0,0 +1,69 @@
+package updater
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/monlor/k8s-image-updater/pkg/audit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestAutoUpdateAudit(t *testing.T) {
+	var buf bytes.Buffer
+	previous := audit.SetLogger(audit.NewWriterLogger(&buf))
+	t.Cleanup(func() { audit.SetLogger(previous) })
+
+	host := newTestRegistry(t, "app", "1.0.0", "1.1.0")
+	deploy := newTestDeployment(map[string]string{config.AnnotationMode: "release"},
+		corev1.Container{Name: "app", Image: host + "/app:1.0.0"})
+	u, _ := newTestUpdater(deploy)
+	ctx := context.Background()
+
+	require.NoError(t, u.CheckAndUpdate(ctx))
+	// Nothing left to update, nothing recorded
+	require.NoError(t, u.CheckAndUpdate(ctx))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 1)
+	var entry audit.Entry
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &entry))
+	assert.False(t, entry.Time.IsZero())
+	entry.Time = time.Time{}
+	assert.Equal(t, audit.Entry{
+		Actor:     audit.ActorAuto,
+		Action:    audit.ActionUpdate,
+		Kind:      "deployment",
+		Namespace: "default",
+		Name:      "app",
+		Container: "app",
+		OldImage:  host + "/app:1.0.0",
+		NewImage:  host + "/app:1.1.0",
+		Mode:      "release",
+	}, entry)
+}
+
+func TestAuditEntriesLatestRestart(t *testing.T) {
+	original := &corev1.PodTemplateSpec{Spec: corev1.PodSpec{Containers: []corev1.Container{
+		{Name: "app", Image: "app:latest"},
+		{Name: "sidecar", Image: "sidecar:1.0.0"},
+	}}}
+	template := original.DeepCopy()
+	template.Annotations = map[string]string{config.AnnotationRestart: "2024-01-02T03:04:05Z"}
+	annotations := map[string]string{config.AnnotationMode + ".app": "latest"}
+
+	entries := auditEntries(audit.ActionUpdate, "deployment", "default", "app", annotations, nil, original, template)
+	require.Len(t, entries, 1)
+	assert.Equal(t, audit.ActionRestart, entries[0].Action)
+	assert.Equal(t, "app", entries[0].Container)
+	assert.Equal(t, "latest", entries[0].Mode)
+
+	// A restart has nothing to write back
+	assert.Empty(t, auditEntries(audit.ActionWriteBack, "deployment", "default", "app", annotations, nil, original, template))
+}
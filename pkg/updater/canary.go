@@ -0,0 +1,258 @@
+package updater
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/monlor/k8s-image-updater/pkg/audit"
+	"github.com/monlor/k8s-image-updater/pkg/metrics"
+	"github.com/sirupsen/logrus"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// canaryDecision is the outcome of evaluating an in-progress canary
+type canaryDecision string
+
+const (
+	canaryWait     canaryDecision = "wait"
+	canaryPromote  canaryDecision = "promote"
+	canaryRollback canaryDecision = "rollback"
+)
+
+// canaryState is the progress of a canary, stored in the primary's annotations so restarts resume it
+type canaryState struct {
+	// New image per container name
+	Images map[string]string
+	// When the images were applied to the canary
+	StartedAt time.Time
+	// Since when the canary has been continuously healthy, zero if not yet healthy
+	HealthySince time.Time
+}
+
+// Load the canary state from annotations, returns nil if no canary is in progress
+func loadCanaryState(annotations map[string]string) (*canaryState, error) {
+	raw := annotations[config.AnnotationCanaryImages]
+	if raw == "" {
+		return nil, nil
+	}
+	state := &canaryState{}
+	if err := json.Unmarshal([]byte(raw), &state.Images); err != nil {
+		return nil, fmt.Errorf("invalid %s annotation: %v", config.AnnotationCanaryImages, err)
+	}
+	var err error
+	if state.StartedAt, err = time.Parse(time.RFC3339, annotations[config.AnnotationCanaryStartedAt]); err != nil {
+		return nil, fmt.Errorf("invalid %s annotation: %v", config.AnnotationCanaryStartedAt, err)
+	}
+	if healthySince := annotations[config.AnnotationCanaryHealthySince]; healthySince != "" {
+		if state.HealthySince, err = time.Parse(time.RFC3339, healthySince); err != nil {
+			return nil, fmt.Errorf("invalid %s annotation: %v", config.AnnotationCanaryHealthySince, err)
+		}
+	}
+	return state, nil
+}
+
+// Store the canary state into annotations
+func (s *canaryState) save(annotations map[string]string) {
+	images, _ := json.Marshal(s.Images)
+	annotations[config.AnnotationCanaryImages] = string(images)
+	annotations[config.AnnotationCanaryStartedAt] = s.StartedAt.Format(time.RFC3339)
+	if s.HealthySince.IsZero() {
+		delete(annotations, config.AnnotationCanaryHealthySince)
+	} else {
+		annotations[config.AnnotationCanaryHealthySince] = s.HealthySince.Format(time.RFC3339)
+	}
+}
+
+// Remove the canary progress from annotations
+func clearCanaryState(annotations map[string]string) {
+	delete(annotations, config.AnnotationCanaryImages)
+	delete(annotations, config.AnnotationCanaryStartedAt)
+	delete(annotations, config.AnnotationCanaryHealthySince)
+}
+
+// canaryDuration returns how long the canary must stay healthy before promotion
+func canaryDuration(annotations map[string]string) time.Duration {
+	if value := annotations[config.AnnotationCanaryDuration]; value != "" {
+		duration, err := time.ParseDuration(value)
+		if err == nil {
+			return duration
+		}
+		logrus.Warnf("Invalid %s annotation %q, using default %s", config.AnnotationCanaryDuration, value, config.GlobalConfig.CanaryDuration)
+	}
+	return config.GlobalConfig.CanaryDuration
+}
+
+// deploymentHealth reports whether a deployment is fully rolled out and available,
+// and whether its rollout has failed
+func deploymentHealth(deploy *appsv1.Deployment) (healthy bool, failed bool) {
+	for _, condition := range deploy.Status.Conditions {
+		if condition.Type == appsv1.DeploymentProgressing && condition.Status == corev1.ConditionFalse && condition.Reason == "ProgressDeadlineExceeded" {
+			return false, true
+		}
+	}
+
+	replicas := int32(1)
+	if deploy.Spec.Replicas != nil {
+		replicas = *deploy.Spec.Replicas
+	}
+	healthy = deploy.Status.ObservedGeneration >= deploy.Generation &&
+		deploy.Status.UpdatedReplicas >= replicas &&
+		deploy.Status.AvailableReplicas >= replicas &&
+		deploy.Status.UnavailableReplicas == 0
+	return healthy, false
+}
+
+// decideCanary evaluates the canary against its state, updating HealthySince as a side effect
+func decideCanary(state *canaryState, canary *appsv1.Deployment, now time.Time, duration time.Duration) canaryDecision {
+	// The canary must still run the images under test
+	for _, container := range canary.Spec.Template.Spec.Containers {
+		if image, ok := state.Images[container.Name]; ok && container.Image != image {
+			logrus.Warnf("Canary %s/%s container %s runs %s instead of %s", canary.Namespace, canary.Name, container.Name, container.Image, image)
+			return canaryRollback
+		}
+	}
+
+	healthy, failed := deploymentHealth(canary)
+	switch {
+	case failed:
+		return canaryRollback
+	case !healthy && !state.HealthySince.IsZero():
+		// It was healthy before, so this is not the initial rollout
+		return canaryRollback
+	case !healthy:
+		return canaryWait
+	}
+
+	if state.HealthySince.IsZero() {
+		state.HealthySince = now
+	}
+	if now.Sub(state.HealthySince) >= duration {
+		return canaryPromote
+	}
+	return canaryWait
+}
+
+// changedImages returns the new image per container name for containers whose image changed
+func changedImages(before, after []corev1.Container) map[string]string {
+	images := make(map[string]string)
+	for i := range after {
+		if i < len(before) && before[i].Image != after[i].Image {
+			images[after[i].Name] = after[i].Image
+		}
+	}
+	return images
+}
+
+// Set the given images on the matching containers
+func setContainerImages(containers []corev1.Container, images map[string]string) error {
+	found := 0
+	for i := range containers {
+		if image, ok := images[containers[i].Name]; ok {
+			containers[i].Image = image
+			found++
+		}
+	}
+	if found != len(images) {
+		return fmt.Errorf("not all containers of %v found", slices.Sorted(maps.Keys(images)))
+	}
+	return nil
+}
+
+// startCanary sets new images on the canary deployment and records the progress on the primary's annotations.
+// It returns the write of both deployments and its audit entries, to apply like a rollout, or no write when the
+// images already failed on the canary.
+func (u *Updater) startCanary(ctx context.Context, primary *appsv1.Deployment, images map[string]string) ([]audit.Entry, func() error, error) {
+	canaryName := primary.Annotations[config.AnnotationCanary]
+	encoded, _ := json.Marshal(images)
+	if primary.Annotations[config.AnnotationCanaryFailedImages] == string(encoded) {
+		logrus.Warnf("Images %s already failed on canary %s/%s, not retrying", encoded, primary.Namespace, canaryName)
+		primary.Annotations[config.AnnotationStatus] = config.StatusCanaryFailed
+		countSkipped(ctx, metrics.SkipReasonUnhealthy)
+		return nil, nil, nil
+	}
+
+	canary, err := u.k8sClient.GetDeployment(ctx, primary.Namespace, canaryName)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get canary deployment %s/%s: %v", primary.Namespace, canaryName, err)
+	}
+	if err := setContainerImages(canary.Spec.Template.Spec.Containers, images); err != nil {
+		return nil, nil, fmt.Errorf("canary deployment %s/%s: %v", primary.Namespace, canaryName, err)
+	}
+	entries := canaryAuditEntries(audit.ActionCanary, &primary.Spec.Template, primary.Namespace, primary.Name, primary.Annotations, u.policy.Load(), images)
+
+	state := &canaryState{Images: images, StartedAt: u.clock.Now()}
+	state.save(primary.Annotations)
+	delete(primary.Annotations, config.AnnotationCanaryFailedImages)
+	primary.Annotations[config.AnnotationStatus] = config.StatusCanaryInProgress
+	write := func() error {
+		if err := u.k8sClient.UpdateDeployment(canary); err != nil {
+			return fmt.Errorf("failed to update canary deployment %s/%s: %v", primary.Namespace, canaryName, err)
+		}
+		checkInfof("[canary] Rolled out %s to canary %s/%s of deployment %s", encoded, primary.Namespace, canaryName, primary.Name)
+		// The progress is only recorded once the canary runs the images
+		return u.k8sClient.UpdateDeployment(primary)
+	}
+	return entries, write, nil
+}
+
+// progressCanary evaluates an in-progress canary and promotes or rolls it back when decided. The decision is
+// recorded on the primary, which the caller writes: promoting sets the canary images on the primary, a rollout
+// described by the returned audit entries. Rolling back writes the canary right away.
+func (u *Updater) progressCanary(ctx context.Context, primary *appsv1.Deployment, state *canaryState) ([]audit.Entry, error) {
+	canaryName := primary.Annotations[config.AnnotationCanary]
+	canary, err := u.k8sClient.GetDeployment(ctx, primary.Namespace, canaryName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get canary deployment %s/%s: %v", primary.Namespace, canaryName, err)
+	}
+
+	var entries []audit.Entry
+	decision := decideCanary(state, canary, u.clock.Now(), canaryDuration(primary.Annotations))
+	checkDebugf("Canary %s/%s of deployment %s: %s", primary.Namespace, canaryName, primary.Name, decision)
+
+	switch decision {
+	case canaryPromote:
+		entries = canaryAuditEntries(audit.ActionCanaryPromote, &primary.Spec.Template, primary.Namespace, primary.Name, primary.Annotations, u.policy.Load(), state.Images)
+		if err := setContainerImages(primary.Spec.Template.Spec.Containers, state.Images); err != nil {
+			return nil, fmt.Errorf("deployment %s/%s: %v", primary.Namespace, primary.Name, err)
+		}
+		clearCanaryState(primary.Annotations)
+		delete(primary.Annotations, config.AnnotationStatus)
+		checkInfof("[canary] Canary %s/%s is healthy, promoting %v to deployment %s", primary.Namespace, canaryName, state.Images, primary.Name)
+
+	case canaryRollback:
+		// Put the canary back on the primary's images
+		previous := make(map[string]string, len(state.Images))
+		for _, container := range primary.Spec.Template.Spec.Containers {
+			if _, ok := state.Images[container.Name]; ok {
+				previous[container.Name] = container.Image
+			}
+		}
+		if err := setContainerImages(canary.Spec.Template.Spec.Containers, previous); err != nil {
+			logrus.Errorf("Failed to roll back canary %s/%s: %v", primary.Namespace, canaryName, err)
+		} else if err := u.rollBackCanary(canary); err != nil {
+			logrus.Errorf("Failed to roll back canary %s/%s: %v", primary.Namespace, canaryName, err)
+		}
+		encoded, _ := json.Marshal(state.Images)
+		clearCanaryState(primary.Annotations)
+		primary.Annotations[config.AnnotationCanaryFailedImages] = string(encoded)
+		primary.Annotations[config.AnnotationStatus] = config.StatusCanaryFailed
+		logrus.Warnf("[canary] Canary %s/%s is unhealthy, rolled back %v for deployment %s", primary.Namespace, canaryName, state.Images, primary.Name)
+
+	default:
+		state.save(primary.Annotations)
+		primary.Annotations[config.AnnotationStatus] = config.StatusCanaryInProgress
+	}
+	return entries, nil
+}
+
+// rollBackCanary writes the canary put back on the primary's images, in an APPLY_CONCURRENCY slot
+func (u *Updater) rollBackCanary(canary *appsv1.Deployment) error {
+	defer u.applySlot()()
+	return u.k8sClient.UpdateDeployment(canary)
+}
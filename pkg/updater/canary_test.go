@@ -0,0 +1,220 @@
+package updater
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/monlor/k8s-image-updater/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newCanaryDeployment(image string, status appsv1.DeploymentStatus) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "app-canary", Namespace: "default"},
+		Spec: appsv1.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: image}}},
+			},
+		},
+		Status: status,
+	}
+}
+
+var (
+	healthyStatus   = appsv1.DeploymentStatus{UpdatedReplicas: 1, AvailableReplicas: 1}
+	rollingStatus   = appsv1.DeploymentStatus{UpdatedReplicas: 1, UnavailableReplicas: 1}
+	deadlineExceeds = appsv1.DeploymentStatus{Conditions: []appsv1.DeploymentCondition{{
+		Type:   appsv1.DeploymentProgressing,
+		Status: corev1.ConditionFalse,
+		Reason: "ProgressDeadlineExceeded",
+	}}}
+)
+
+func TestDecideCanary(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	duration := 10 * time.Minute
+
+	tests := []struct {
+		name             string
+		canaryImage      string
+		status           appsv1.DeploymentStatus
+		healthySince     time.Time
+		want             canaryDecision
+		wantHealthySince time.Time
+	}{
+		{"still rolling out", "app:2", rollingStatus, time.Time{}, canaryWait, time.Time{}},
+		{"becomes healthy", "app:2", healthyStatus, time.Time{}, canaryWait, now},
+		{"healthy but not long enough", "app:2", healthyStatus, now.Add(-5 * time.Minute), canaryWait, now.Add(-5 * time.Minute)},
+		{"healthy for the duration", "app:2", healthyStatus, now.Add(-10 * time.Minute), canaryPromote, now.Add(-10 * time.Minute)},
+		{"progress deadline exceeded", "app:2", deadlineExceeds, time.Time{}, canaryRollback, time.Time{}},
+		{"unhealthy after being healthy", "app:2", rollingStatus, now.Add(-5 * time.Minute), canaryRollback, now.Add(-5 * time.Minute)},
+		{"canary image changed", "app:3", healthyStatus, time.Time{}, canaryRollback, time.Time{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := &canaryState{
+				Images:       map[string]string{"app": "app:2"},
+				StartedAt:    now.Add(-time.Hour),
+				HealthySince: tt.healthySince,
+			}
+			decision := decideCanary(state, newCanaryDeployment(tt.canaryImage, tt.status), now, duration)
+			assert.Equal(t, tt.want, decision)
+			assert.Equal(t, tt.wantHealthySince, state.HealthySince)
+		})
+	}
+}
+
+func TestCanaryStateRoundTrip(t *testing.T) {
+	annotations := map[string]string{}
+	state := &canaryState{
+		Images:       map[string]string{"app": "app:2", "worker": "worker:2"},
+		StartedAt:    time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC),
+		HealthySince: time.Date(2024, 6, 1, 12, 5, 0, 0, time.UTC),
+	}
+	state.save(annotations)
+
+	loaded, err := loadCanaryState(annotations)
+	require.NoError(t, err)
+	assert.Equal(t, state, loaded)
+
+	clearCanaryState(annotations)
+	loaded, err = loadCanaryState(annotations)
+	require.NoError(t, err)
+	assert.Nil(t, loaded)
+}
+
+func TestCanaryFlow(t *testing.T) {
+	host := newTestRegistry(t, "app", "1.0.0", "1.1.0")
+	oldImage, newImage := host+"/app:1.0.0", host+"/app:1.1.0"
+	ctx := context.Background()
+
+	setup := func(t *testing.T) (*Updater, func() (*appsv1.Deployment, *appsv1.Deployment), func(appsv1.DeploymentStatus)) {
+		primary := newTestDeployment(map[string]string{
+			config.AnnotationCanary:         "app-canary",
+			config.AnnotationCanaryDuration: "0s",
+		}, corev1.Container{Name: "app", Image: oldImage})
+		u, clientset := newTestUpdater(primary, newCanaryDeployment(oldImage, healthyStatus))
+
+		get := func() (*appsv1.Deployment, *appsv1.Deployment) {
+			primary, err := clientset.AppsV1().Deployments("default").Get(ctx, "app", metav1.GetOptions{})
+			require.NoError(t, err)
+			canary, err := clientset.AppsV1().Deployments("default").Get(ctx, "app-canary", metav1.GetOptions{})
+			require.NoError(t, err)
+			return primary, canary
+		}
+		setStatus := func(status appsv1.DeploymentStatus) {
+			_, canary := get()
+			canary.Status = status
+			_, err := clientset.AppsV1().Deployments("default").Update(ctx, canary, metav1.UpdateOptions{})
+			require.NoError(t, err)
+		}
+
+		// First cycle rolls the new image out to the canary only
+		require.NoError(t, u.updateDeployments(ctx))
+		primary, canary := get()
+		assert.Equal(t, oldImage, primary.Spec.Template.Spec.Containers[0].Image)
+		assert.Equal(t, newImage, canary.Spec.Template.Spec.Containers[0].Image)
+		assert.Equal(t, config.StatusCanaryInProgress, primary.Annotations[config.AnnotationStatus])
+		assert.NotEmpty(t, primary.Annotations[config.AnnotationCanaryImages])
+		return u, get, setStatus
+	}
+
+	t.Run("promote", func(t *testing.T) {
+		u, get, _ := setup(t)
+
+		// Healthy canary with a zero duration is promoted on the next cycle
+		require.NoError(t, u.updateDeployments(ctx))
+		primary, canary := get()
+		assert.Equal(t, newImage, primary.Spec.Template.Spec.Containers[0].Image)
+		assert.Equal(t, newImage, canary.Spec.Template.Spec.Containers[0].Image)
+		assert.NotContains(t, primary.Annotations, config.AnnotationCanaryImages)
+		assert.NotContains(t, primary.Annotations, config.AnnotationStatus)
+	})
+
+	t.Run("frozen", func(t *testing.T) {
+		enableFreezeOnCrashLoop(t, time.Hour)
+		u, get, _ := setup(t)
+		require.True(t, freezeRollouts("test", FreezeState{Reason: "test"}))
+
+		// Promoting is a rollout of the primary, held back while rollouts are frozen
+		require.NoError(t, u.updateDeployments(ctx))
+		primary, _ := get()
+		assert.Equal(t, oldImage, primary.Spec.Template.Spec.Containers[0].Image)
+		assert.NotEmpty(t, primary.Annotations[config.AnnotationCanaryImages])
+
+		// Once unfrozen it is promoted, and the primary's pods are watched like any rollout
+		Unfreeze()
+		require.NoError(t, u.updateDeployments(ctx))
+		primary, _ = get()
+		assert.Equal(t, newImage, primary.Spec.Template.Spec.Containers[0].Image)
+		assert.NotContains(t, primary.Annotations, config.AnnotationCanaryImages)
+		assert.NotEmpty(t, primary.Annotations[config.AnnotationCrashLoopWatchUntil])
+	})
+
+	t.Run("frozen start", func(t *testing.T) {
+		enableFreezeOnCrashLoop(t, time.Hour)
+		primary := newTestDeployment(map[string]string{config.AnnotationCanary: "app-canary"}, corev1.Container{Name: "app", Image: oldImage})
+		u, clientset := newTestUpdater(primary, newCanaryDeployment(oldImage, healthyStatus))
+		require.True(t, freezeRollouts("test", FreezeState{Reason: "test"}))
+
+		// Neither the canary nor the progress on the primary is written
+		require.NoError(t, u.updateDeployments(ctx))
+		canary, err := clientset.AppsV1().Deployments("default").Get(ctx, "app-canary", metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, oldImage, canary.Spec.Template.Spec.Containers[0].Image)
+		primary, err = clientset.AppsV1().Deployments("default").Get(ctx, "app", metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.NotContains(t, primary.Annotations, config.AnnotationCanaryImages)
+	})
+
+	t.Run("report only", func(t *testing.T) {
+		u, get, setStatus := setup(t)
+		enableReportOnly(t)
+
+		// A healthy canary is not promoted, its images are reported instead
+		require.NoError(t, u.updateDeployments(ctx))
+		primary, canary := get()
+		assert.Equal(t, oldImage, primary.Spec.Template.Spec.Containers[0].Image)
+		assert.Equal(t, newImage, canary.Spec.Template.Spec.Containers[0].Image)
+		assert.Equal(t, "app="+newImage, primary.Annotations[config.AnnotationAvailableUpdate])
+		assert.NotEmpty(t, primary.Annotations[config.AnnotationCanaryImages])
+		assert.Equal(t, config.StatusCanaryInProgress, primary.Annotations[config.AnnotationStatus])
+
+		// A failed canary is not rolled back either
+		setStatus(deadlineExceeds)
+		require.NoError(t, u.updateDeployments(ctx))
+		primary, canary = get()
+		assert.Equal(t, newImage, canary.Spec.Template.Spec.Containers[0].Image)
+		assert.NotEmpty(t, primary.Annotations[config.AnnotationCanaryImages])
+	})
+
+	t.Run("rollback", func(t *testing.T) {
+		u, get, setStatus := setup(t)
+		setStatus(deadlineExceeds)
+
+		require.NoError(t, u.updateDeployments(ctx))
+		primary, canary := get()
+		assert.Equal(t, oldImage, primary.Spec.Template.Spec.Containers[0].Image)
+		assert.Equal(t, oldImage, canary.Spec.Template.Spec.Containers[0].Image)
+		assert.Equal(t, config.StatusCanaryFailed, primary.Annotations[config.AnnotationStatus])
+		assert.NotContains(t, primary.Annotations, config.AnnotationCanaryImages)
+
+		// The failed image is not tried again
+		unhealthy := metrics.SkippedUpdates.WithLabelValues(metrics.SkipReasonUnhealthy)
+		before := testutil.ToFloat64(unhealthy)
+		setStatus(healthyStatus)
+		require.NoError(t, u.updateDeployments(ctx))
+		assert.Equal(t, before+1, testutil.ToFloat64(unhealthy))
+		primary, canary = get()
+		assert.Equal(t, oldImage, canary.Spec.Template.Spec.Containers[0].Image)
+		assert.Equal(t, config.StatusCanaryFailed, primary.Annotations[config.AnnotationStatus])
+	})
+}
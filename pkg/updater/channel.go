@@ -0,0 +1,35 @@
+package updater
+
+import (
+	"github.com/monlor/k8s-image-updater/config"
+)
+
+// tagChannel extracts the channel of a tag with TAG_CHANNEL_PATTERN, empty when the tag has none
+func tagChannel(tag string) string {
+	re, _ := config.GlobalConfig.TagChannel()
+	if re == nil {
+		return ""
+	}
+	match := re.FindStringSubmatch(tag)
+	if match == nil {
+		return ""
+	}
+	return match[re.SubexpIndex("channel")]
+}
+
+// filterChannel keeps the tags of the channel of the current tag, e.g. only the -stable tags when running
+// 1.2.3-stable. A current tag without a channel does not restrict the tags.
+func filterChannel(tags []string, currentTag string) []string {
+	channel := tagChannel(currentTag)
+	if channel == "" {
+		return tags
+	}
+	filtered := []string{}
+	for _, tag := range tags {
+		if tagChannel(tag) == channel {
+			filtered = append(filtered, tag)
+		}
+	}
+	checkDebugf("Filtered %d tags to %d of channel %s", len(tags), len(filtered), channel)
+	return filtered
+}
@@ -0,0 +1,56 @@
+package updater
+
+import (
+	"context"
+	"testing"
+
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/monlor/k8s-image-updater/pkg/registry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testTagChannelPattern = `^v?[0-9]+(\.[0-9]+)*-(?P<channel>[a-zA-Z]+)$`
+
+func setTagChannelPattern(t *testing.T, pattern string) {
+	old := config.GlobalConfig.TagChannelPattern
+	config.GlobalConfig.TagChannelPattern = pattern
+	t.Cleanup(func() { config.GlobalConfig.TagChannelPattern = old })
+}
+
+func TestFilterChannel(t *testing.T) {
+	setTagChannelPattern(t, testTagChannelPattern)
+	tags := []string{"1.2.3", "1.2.3-stable", "1.2.4-edge", "v1.3.0-stable", "1.3.0-rc.1", "latest"}
+
+	assert.Equal(t, []string{"1.2.3-stable", "v1.3.0-stable"}, filterChannel(tags, "1.2.3-stable"))
+	assert.Equal(t, []string{"1.2.4-edge"}, filterChannel(tags, "1.2.0-edge"))
+	// A current tag without a channel does not restrict the tags
+	assert.Equal(t, tags, filterChannel(tags, "1.2.3"))
+	assert.Equal(t, tags, filterChannel(tags, "1.3.0-rc.1"))
+
+	setTagChannelPattern(t, "")
+	assert.Equal(t, tags, filterChannel(tags, "1.2.3-stable"))
+}
+
+func TestReleaseModeStaysOnChannel(t *testing.T) {
+	setTagChannelPattern(t, testTagChannelPattern)
+	host := newTestRegistry(t, "app", "1.2.3-stable", "1.2.3-edge", "1.2.4-stable", "1.3.0-edge", "1.3.0")
+	client := registry.NewRegistryClient("", "")
+	u, _ := newTestUpdater()
+	ctx := context.Background()
+
+	newImage, behind, err := u.checkReleaseMode(ctx, host+"/app:1.2.3-stable", client, "", "", 0, "", false, nil)
+	require.NoError(t, err)
+	assert.Equal(t, host+"/app:1.2.4-stable", newImage)
+	assert.Equal(t, 1, behind)
+
+	newImage, _, err = u.checkReleaseMode(ctx, host+"/app:1.2.3-edge", client, "", "", 0, "", false, nil)
+	require.NoError(t, err)
+	assert.Equal(t, host+"/app:1.3.0-edge", newImage)
+
+	// Without a channel pattern the newest version is selected whatever its channel
+	setTagChannelPattern(t, "")
+	newImage, _, err = u.checkReleaseMode(ctx, host+"/app:1.2.3-stable", client, "", "", 0, "", false, nil)
+	require.NoError(t, err)
+	assert.Equal(t, host+"/app:1.3.0", newImage)
+}
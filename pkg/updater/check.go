@@ -0,0 +1,142 @@
+package updater
+
+import (
+	"context"
+	"fmt"
+	"maps"
+
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/monlor/k8s-image-updater/pkg/k8s"
+	"github.com/monlor/k8s-image-updater/pkg/metrics"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// CheckResult describes whether an update is available for a single container
+type CheckResult struct {
+	Container       string
+	CurrentImage    string
+	NewImage        string
+	UpdateAvailable bool
+	Error           string
+}
+
+// ManagedResource describes a resource enabled for auto-update
+type ManagedResource struct {
+	Kind       string
+	Namespace  string
+	Name       string
+	Mode       string
+	Containers []corev1.Container
+}
+
+// Key of the context of Check, which changes no metric
+type checkOnlyKey struct{}
+
+// recordsMetrics reports whether metrics are updated in a context, they are not by the read-only Check
+func recordsMetrics(ctx context.Context) bool {
+	return ctx.Value(checkOnlyKey{}) == nil
+}
+
+// countSkipped counts an update skipped for a reason, unless in Check
+func countSkipped(ctx context.Context, reason string) {
+	if recordsMetrics(ctx) {
+		metrics.SkippedUpdates.WithLabelValues(reason).Inc()
+	}
+}
+
+// Check computes the image updates for a resource without applying them or changing metrics
+func (u *Updater) Check(ctx context.Context, kind, namespace, name string) ([]CheckResult, error) {
+	ctx = context.WithValue(ctx, checkOnlyKey{}, true)
+	w, err := u.getWorkload(ctx, kind, namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	return u.checkPodTemplate(ctx, w.meta().Annotations, namespace, name, kind, w.podTemplate()), nil
+}
+
+// checkPodTemplate runs the update logic against copies of the resource so nothing is mutated
+func (u *Updater) checkPodTemplate(ctx context.Context, annotations map[string]string, namespace, name, kind string, podTemplate *corev1.PodTemplateSpec) []CheckResult {
+	annotations = maps.Clone(annotations)
+	podTemplate = podTemplate.DeepCopy()
+
+	results := make([]CheckResult, 0, len(podTemplate.Spec.Containers))
+	for i := range podTemplate.Spec.Containers {
+		container := &podTemplate.Spec.Containers[i]
+		result := CheckResult{
+			Container:    container.Name,
+			CurrentImage: container.Image,
+		}
+		update, err := u.updateContainerIfNeeded(ctx, container, &annotations, namespace, name, kind, podTemplate)
+		if err != nil {
+			result.Error = err.Error()
+		}
+		result.NewImage = container.Image
+		result.UpdateAvailable = update.Changed
+		results = append(results, result)
+	}
+	return results
+}
+
+// ListManaged lists the resources enabled for auto-update, optionally restricted to a namespace
+func (u *Updater) ListManaged(ctx context.Context, namespace string) ([]ManagedResource, error) {
+	opts := metav1.ListOptions{
+		LabelSelector: config.LabelEnabled + "=true",
+	}
+	var resources []ManagedResource
+
+	deployments, err := u.k8sClient.ListDeployments(ctx, namespace, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list deployments: %v", err)
+	}
+	for _, deploy := range deployments {
+		resources = appendManaged(resources, namespace, "deployment", deploy.ObjectMeta, deploy.Spec.Template.Spec.Containers)
+	}
+
+	statefulsets, err := u.k8sClient.ListStatefulSets(ctx, namespace, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list statefulsets: %v", err)
+	}
+	for _, sts := range statefulsets {
+		resources = appendManaged(resources, namespace, "statefulset", sts.ObjectMeta, sts.Spec.Template.Spec.Containers)
+	}
+
+	daemonsets, err := u.k8sClient.ListDaemonSets(ctx, namespace, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list daemonsets: %v", err)
+	}
+	for _, ds := range daemonsets {
+		resources = appendManaged(resources, namespace, "daemonset", ds.ObjectMeta, ds.Spec.Template.Spec.Containers)
+	}
+
+	if config.GlobalConfig.EnableKruise {
+		for _, kind := range []string{k8s.KindCloneSet, k8s.KindAdvancedStatefulSet} {
+			workloads, err := u.k8sClient.ListKruiseWorkloads(ctx, kind, namespace, opts)
+			if err != nil {
+				return nil, fmt.Errorf("failed to list %s workloads: %v", kind, err)
+			}
+			for _, w := range workloads {
+				resources = appendManaged(resources, namespace, kind, w.ObjectMeta, w.Template.Spec.Containers)
+			}
+		}
+	}
+
+	return resources, nil
+}
+
+func appendManaged(resources []ManagedResource, namespace, kind string, meta metav1.ObjectMeta, containers []corev1.Container) []ManagedResource {
+	if namespace != "" && meta.Namespace != namespace {
+		return resources
+	}
+	if !config.GlobalConfig.NamespaceAllowed(meta.Namespace) {
+		return resources
+	}
+	mode := config.GlobalConfig.ResourceMode(meta.Annotations[config.AnnotationMode])
+	return append(resources, ManagedResource{
+		Kind:       kind,
+		Namespace:  meta.Namespace,
+		Name:       meta.Name,
+		Mode:       mode,
+		Containers: containers,
+	})
+}
@@ -0,0 +1,34 @@
+package updater
+
+import (
+	"context"
+	"testing"
+
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/monlor/k8s-image-updater/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestCheckLeavesMetrics(t *testing.T) {
+	host := newTestRegistry(t, "check", "1.0.0", "1.1.0")
+	u, _ := newTestUpdater(newTestDeployment(map[string]string{
+		config.AnnotationMode:                  "release",
+		config.AnnotationAllowTags + ".pinned": "regexp:^2\\.",
+	}, corev1.Container{Name: "app", Image: host + "/check:1.0.0"}, corev1.Container{Name: "pinned", Image: host + "/check:1.0.0"}))
+	skipped := metrics.SkippedUpdates.WithLabelValues(metrics.SkipReasonNoMatchingTags)
+	before := testutil.ToFloat64(skipped)
+	// Other tests check the same resource
+	metrics.VersionsBehind.DeleteLabelValues("default", "deployment", "app", "app")
+
+	results, err := u.Check(context.Background(), "deployment", "default", "app")
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	assert.True(t, results[0].UpdateAvailable)
+	assert.False(t, results[1].UpdateAvailable)
+
+	assert.Equal(t, before, testutil.ToFloat64(skipped))
+	assert.False(t, metrics.VersionsBehind.DeleteLabelValues("default", "deployment", "app", "app"))
+}
@@ -0,0 +1,47 @@
+package updater
+
+import (
+	"context"
+	"testing"
+
+	"github.com/monlor/k8s-image-updater/pkg/k8s"
+	"github.com/monlor/k8s-image-updater/pkg/status"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestNewUpdatersPerCluster(t *testing.T) {
+	previous := status.SetIndex(status.NewIndex(0))
+	t.Cleanup(func() { status.SetIndex(previous) })
+	host := newTestRegistry(t, "app", "1.0.0", "1.1.0")
+	clientsets := map[string]*fake.Clientset{}
+	var clusters []k8s.Cluster
+	for _, name := range []string{"staging", "prod"} {
+		clientsets[name] = fake.NewSimpleClientset(newTestDeployment(map[string]string{},
+			corev1.Container{Name: "app", Image: host + "/app:1.0.0"}))
+		clusters = append(clusters, k8s.Cluster{Name: name, Client: k8s.NewClient(clientsets[name])})
+	}
+
+	updaters, err := newUpdaters(clusters)
+	require.NoError(t, err)
+	require.Len(t, updaters, 2)
+	ctx := context.Background()
+	for _, u := range updaters {
+		require.NoError(t, u.CheckAndUpdate(ctx))
+	}
+
+	// Every cluster was checked and updated with its own client
+	for name, clientset := range clientsets {
+		deploy, err := clientset.AppsV1().Deployments("default").Get(ctx, "app", metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, host+"/app:1.1.0", deploy.Spec.Template.Spec.Containers[0].Image, name)
+	}
+	// A complete cycle of one cluster does not drop the results of the other
+	results := status.List("default", "deployment")
+	require.Len(t, results, 2)
+	assert.Equal(t, "prod", results[0].Cluster)
+	assert.Equal(t, "staging", results[1].Cluster)
+}
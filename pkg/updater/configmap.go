@@ -0,0 +1,130 @@
+package updater
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/monlor/k8s-image-updater/pkg/audit"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// parseConfigMapRef splits a configmap-ref value of the form <configmap>/<key>
+func parseConfigMapRef(ref string) (string, string, error) {
+	name, key, ok := strings.Cut(ref, "/")
+	if !ok || name == "" || key == "" {
+		return "", "", fmt.Errorf("invalid configmap-ref %q, expected <configmap>/<key>", ref)
+	}
+	return name, key, nil
+}
+
+// configMapUpdate is a new value of the ConfigMap key referenced by a resource, written by applyConfigMapUpdate
+type configMapUpdate struct {
+	configMap *corev1.ConfigMap
+	key       string
+	entries   []audit.Entry
+}
+
+// updateConfigMapImageIfNeeded tracks the image held in the ConfigMap key referenced by a resource, e.g. read by
+// an operator, and returns the ConfigMap with the new images, nil when none is newer. The resource itself is left
+// untouched.
+func (u *Updater) updateConfigMapImageIfNeeded(ctx context.Context, annotations *map[string]string, namespace string, resourceName string, resourceType string, podTemplate *corev1.PodTemplateSpec) (*configMapUpdate, error) {
+	name, key, err := parseConfigMapRef((*annotations)[config.AnnotationConfigMapRef])
+	if err != nil {
+		return nil, err
+	}
+	if u.writeBack != nil {
+		logrus.Warnf("ConfigMap %s/%s of %s %s is not updated, write-back only supports container images", namespace, name, resourceType, resourceName)
+		return nil, nil
+	}
+	if config.GlobalConfig.ReportOnly {
+		checkDebugf("ConfigMap %s/%s of %s %s is not checked, REPORT_ONLY only supports container images", namespace, name, resourceType, resourceName)
+		return nil, nil
+	}
+
+	cm, err := u.k8sClient.GetConfigMap(ctx, namespace, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get configmap %s/%s: %v", namespace, name, err)
+	}
+	value, ok := cm.Data[key]
+	separator := (*annotations)[config.AnnotationConfigMapSeparator]
+	parts := splitImages(value, separator)
+	if !ok || len(parts) == 0 {
+		return nil, fmt.Errorf("configmap %s/%s has no image in key %s", namespace, name, key)
+	}
+	// Each image is updated on its own, a failing one does not hold back the others
+	policy := u.policy.Load()
+	var entries []audit.Entry
+	var errs []error
+	for i, part := range parts {
+		currentImage := strings.TrimSpace(part)
+		if currentImage == "" {
+			continue
+		}
+		if containerMode(policy, *annotations, key, currentImage) == "latest" {
+			logrus.Warnf("Latest mode cannot restart the consumers of configmap %s/%s, skipping %s", namespace, name, currentImage)
+			continue
+		}
+		checkDebugf("Tracking image %s from configmap %s/%s key %s", currentImage, namespace, name, key)
+		tracked := trackedImage{
+			name:  key,
+			image: currentImage,
+			// Spaces around the image are kept, so the value is only changed where an image is
+			set: func(image string) { parts[i] = strings.Replace(part, currentImage, image, 1) },
+		}
+		update, err := u.updateImageIfNeeded(ctx, tracked, annotations, namespace, resourceName, resourceType, podTemplate)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if update.Changed {
+			entries = append(entries, audit.Entry{
+				Actor:     audit.ActorAuto,
+				Action:    audit.ActionUpdate,
+				Kind:      "configmap",
+				Namespace: namespace,
+				Name:      name,
+				Container: key,
+				OldImage:  update.OldImage,
+				NewImage:  update.NewImage,
+				Mode:      containerMode(policy, *annotations, key, update.OldImage),
+			})
+		}
+	}
+	if len(entries) == 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	cm.Data[key] = strings.Join(parts, separator)
+	return &configMapUpdate{configMap: cm, key: key, entries: entries}, errors.Join(errs...)
+}
+
+// applyConfigMapUpdate writes a ConfigMap update as a rollout of the resource referencing it, held back by a freeze,
+// MAX_UPDATES_PER_CYCLE and UPDATE_PACING_DELAY and run between the update hooks like container updates
+func (u *Updater) applyConfigMapUpdate(ctx context.Context, update *configMapUpdate, annotations map[string]string) {
+	cm := update.configMap
+	u.applyUpdate(ctx, true, "configmap", cm.Namespace, cm.Name, annotations, update.entries, func() error {
+		if err := u.k8sClient.UpdateConfigMap(cm); err != nil {
+			return err
+		}
+		for _, entry := range update.entries {
+			checkInfof("Updated configmap %s/%s key %s from %s to %s", cm.Namespace, cm.Name, update.key, entry.OldImage, entry.NewImage)
+		}
+		return nil
+	})
+}
+
+// splitImages splits the value of a ConfigMap key into its images, the whole value without separator.
+// Parts keep the spaces around their image and an empty value has no parts.
+func splitImages(value, separator string) []string {
+	if strings.TrimSpace(value) == "" {
+		return nil
+	}
+	if separator == "" {
+		return []string{value}
+	}
+	return strings.Split(value, separator)
+}
@@ -0,0 +1,147 @@
+package updater
+
+import (
+	"context"
+	"testing"
+
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newTestConfigMap(data map[string]string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "operator-config", Namespace: "default"},
+		Data:       data,
+	}
+}
+
+func TestParseConfigMapRef(t *testing.T) {
+	name, key, err := parseConfigMapRef("operator-config/image")
+	require.NoError(t, err)
+	assert.Equal(t, "operator-config", name)
+	assert.Equal(t, "image", key)
+
+	for _, ref := range []string{"operator-config", "/image", "operator-config/"} {
+		_, _, err := parseConfigMapRef(ref)
+		assert.ErrorContains(t, err, "invalid configmap-ref", ref)
+	}
+}
+
+func TestUpdateConfigMapImage(t *testing.T) {
+	host := newTestRegistry(t, "app", "1.0.0", "1.1.0")
+	deploy := newTestDeployment(map[string]string{config.AnnotationConfigMapRef: "operator-config/image"},
+		corev1.Container{Name: "operator", Image: "operator:1.0.0"})
+	u, clientset := newTestUpdater(deploy, newTestConfigMap(map[string]string{
+		"image": host + "/app:1.0.0",
+		"other": "unchanged",
+	}))
+	ctx := context.Background()
+
+	require.NoError(t, u.CheckAndUpdate(ctx))
+
+	// The new image is written to the ConfigMap, the deployment keeps its containers
+	cm, err := clientset.CoreV1().ConfigMaps("default").Get(ctx, "operator-config", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"image": host + "/app:1.1.0", "other": "unchanged"}, cm.Data)
+	updatedDeploy, err := clientset.AppsV1().Deployments("default").Get(ctx, "app", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "operator:1.0.0", updatedDeploy.Spec.Template.Spec.Containers[0].Image)
+
+	// Up to date on the next check
+	annotations := map[string]string{config.AnnotationConfigMapRef: "operator-config/image"}
+	change, err := u.updateConfigMapImageIfNeeded(ctx, &annotations, "default", "app", "deployment", &deploy.Spec.Template)
+	require.NoError(t, err)
+	assert.Nil(t, change)
+}
+
+func TestUpdateConfigMapImageFrozen(t *testing.T) {
+	host := newTestRegistry(t, "app", "1.0.0", "1.1.0")
+	u, clientset := newTestUpdater(
+		newTestDeployment(map[string]string{config.AnnotationConfigMapRef: "operator-config/image"}, corev1.Container{Name: "operator", Image: "operator:1.0.0"}),
+		newTestConfigMap(map[string]string{"image": host + "/app:1.0.0"}),
+	)
+	ctx := context.Background()
+	require.True(t, freezeRollouts("test", FreezeState{Reason: "test"}))
+	t.Cleanup(func() {
+		Unfreeze()
+		freeze.watches = nil
+	})
+
+	// The ConfigMap is written like a rollout, not while rollouts are frozen
+	require.NoError(t, u.updateDeployments(ctx))
+	cm, err := clientset.CoreV1().ConfigMaps("default").Get(ctx, "operator-config", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, host+"/app:1.0.0", cm.Data["image"])
+
+	Unfreeze()
+	require.NoError(t, u.updateDeployments(ctx))
+	cm, err = clientset.CoreV1().ConfigMaps("default").Get(ctx, "operator-config", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, host+"/app:1.1.0", cm.Data["image"])
+}
+
+func TestUpdateConfigMapImageList(t *testing.T) {
+	host := newTestRegistry(t, "app", "1.0.0", "1.1.0")
+	pushTestImage(t, host+"/web:2.0.0")
+	pushTestImage(t, host+"/web:2.1.0")
+	annotations := map[string]string{
+		config.AnnotationConfigMapRef:       "operator-config/images",
+		config.AnnotationConfigMapSeparator: ",",
+	}
+	u, clientset := newTestUpdater(newTestConfigMap(map[string]string{
+		"images": host + "/app:1.0.0, " + host + "/missing:1.0.0," + host + "/web:2.0.0,",
+	}))
+	ctx := context.Background()
+
+	// Each image is updated independently, the missing repository does not hold back the others
+	change, err := u.updateConfigMapImageIfNeeded(ctx, &annotations, "default", "app", "deployment", &corev1.PodTemplateSpec{})
+	require.NotNil(t, change)
+	assert.Error(t, err)
+	assert.Len(t, change.entries, 2)
+	u.applyConfigMapUpdate(ctx, change, annotations)
+	cm, err := clientset.CoreV1().ConfigMaps("default").Get(ctx, "operator-config", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, host+"/app:1.1.0, "+host+"/missing:1.0.0,"+host+"/web:2.1.0,", cm.Data["images"])
+
+	// Without separator the value is a single image
+	assert.Equal(t, []string{"a:1, b:2"}, splitImages("a:1, b:2", ""))
+	assert.Equal(t, []string{"a:1", " b:2"}, splitImages("a:1, b:2", ","))
+	assert.Empty(t, splitImages(" ", ","))
+}
+
+func TestUpdateConfigMapImageErrors(t *testing.T) {
+	host := newTestRegistry(t, "app", "1.0.0", "1.1.0")
+	u, clientset := newTestUpdater(newTestConfigMap(map[string]string{"image": host + "/app:1.0.0"}))
+	ctx := context.Background()
+	template := &corev1.PodTemplateSpec{}
+
+	tests := []struct {
+		ref     string
+		mode    string
+		wantErr string
+	}{
+		{"missing/image", "", "failed to get configmap default/missing"},
+		{"operator-config/missing", "", "has no image in key missing"},
+		{"operator-config/image", "latest", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ref+tt.mode, func(t *testing.T) {
+			annotations := map[string]string{config.AnnotationConfigMapRef: tt.ref, config.AnnotationMode: tt.mode}
+			change, err := u.updateConfigMapImageIfNeeded(ctx, &annotations, "default", "app", "deployment", template)
+			assert.Nil(t, change)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+
+	// Nothing was written
+	cm, err := clientset.CoreV1().ConfigMaps("default").Get(ctx, "operator-config", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, host+"/app:1.0.0", cm.Data["image"])
+}
@@ -0,0 +1,297 @@
+package updater
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ggcrregistry "github.com/google/go-containerregistry/pkg/registry"
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/monlor/k8s-image-updater/pkg/clock"
+	"github.com/monlor/k8s-image-updater/pkg/hooks"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestCheckAndUpdateSkipsOverlap(t *testing.T) {
+	u, clientset := newTestUpdater()
+	entered, release := make(chan struct{}), make(chan struct{})
+	clientset.PrependReactor("list", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		close(entered)
+		<-release
+		return false, nil, nil
+	})
+	ctx := context.Background()
+
+	done := make(chan error)
+	go func() { done <- u.CheckAndUpdate(ctx) }()
+	<-entered
+
+	// The first check is still listing deployments
+	assert.ErrorIs(t, u.CheckAndUpdate(ctx), ErrCheckInProgress)
+
+	close(release)
+	require.NoError(t, <-done)
+	clientset.ReactionChain = clientset.ReactionChain[1:]
+	assert.NoError(t, u.CheckAndUpdate(ctx))
+}
+
+func TestCheckAndUpdateTimeout(t *testing.T) {
+	// A registry that never answers
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	t.Cleanup(server.Close)
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	setTuning(t, func(tuning *config.Tunables) { tuning.CheckCycleTimeout = 100 * time.Millisecond })
+
+	deploy := newTestDeployment(nil, corev1.Container{Name: "app", Image: host + "/app:1.0.0"})
+	u, _ := newTestUpdater(deploy)
+
+	start := time.Now()
+	err := u.CheckAndUpdate(context.Background())
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), 10*time.Second)
+
+	// The next check is not blocked by the cancelled one
+	assert.ErrorIs(t, u.CheckAndUpdate(context.Background()), context.DeadlineExceeded)
+}
+
+func TestCheckAndUpdateTarget(t *testing.T) {
+	host := newTestRegistry(t, "app", "1.0.0", "1.1.0")
+	container := corev1.Container{Name: "app", Image: host + "/app:1.0.0"}
+	target := newTestDeployment(map[string]string{}, container)
+	other := newTestDeployment(map[string]string{}, container)
+	other.Name = "other"
+	otherNamespace := newTestDeployment(map[string]string{}, container)
+	otherNamespace.Namespace = "prod"
+	sts := &appsv1.StatefulSet{ObjectMeta: *target.ObjectMeta.DeepCopy(), Spec: appsv1.StatefulSetSpec{Template: target.Spec.Template}}
+	u, clientset := newTestUpdater(target, other, otherNamespace, sts)
+	u.target = &config.TargetResource{Kind: "deployment", Namespace: "default", Name: "app"}
+	ctx := context.Background()
+
+	require.NoError(t, u.CheckAndUpdate(ctx))
+	images := map[string]string{}
+	for _, deploy := range []struct{ namespace, name string }{{"default", "app"}, {"default", "other"}, {"prod", "app"}} {
+		obj, err := clientset.AppsV1().Deployments(deploy.namespace).Get(ctx, deploy.name, metav1.GetOptions{})
+		require.NoError(t, err)
+		images[deploy.namespace+"/"+deploy.name] = obj.Spec.Template.Spec.Containers[0].Image
+	}
+	assert.Equal(t, map[string]string{
+		"default/app":   host + "/app:1.1.0",
+		"default/other": host + "/app:1.0.0",
+		"prod/app":      host + "/app:1.0.0",
+	}, images)
+
+	// Other kinds are not even listed
+	for _, action := range clientset.Actions() {
+		assert.Equal(t, "deployments", action.GetResource().Resource)
+	}
+	obj, err := clientset.AppsV1().StatefulSets("default").Get(ctx, "app", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, host+"/app:1.0.0", obj.Spec.Template.Spec.Containers[0].Image)
+}
+
+func TestStartResetInterval(t *testing.T) {
+	setTuning(t, func(tuning *config.Tunables) { tuning.ImageUpdateInterval = time.Hour })
+	u, clientset := newTestUpdater()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		u.Start(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// A reloaded interval applies without waiting for the previous one
+	setTuning(t, func(tuning *config.Tunables) { tuning.ImageUpdateInterval = 10 * time.Millisecond })
+	u.ResetInterval()
+	assert.Eventually(t, func() bool {
+		for _, action := range clientset.Actions() {
+			if action.Matches("list", "deployments") {
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestStartupDelay(t *testing.T) {
+	oldDelay := config.GlobalConfig.StartupDelay
+	config.GlobalConfig.StartupDelay = time.Hour
+	t.Cleanup(func() { config.GlobalConfig.StartupDelay = oldDelay })
+	setTuning(t, func(tuning *config.Tunables) { tuning.ImageUpdateInterval = 10 * time.Millisecond })
+	u, clientset := newTestUpdater()
+	clk := clock.NewFake(time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC))
+	u.clock = clk
+	checked := func() bool {
+		for _, action := range clientset.Actions() {
+			if action.Matches("list", "deployments") {
+				return true
+			}
+		}
+		return false
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		u.Start(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// Many intervals pass without a check until the delay has elapsed
+	clk.Advance(59 * time.Minute)
+	assert.Never(t, checked, 100*time.Millisecond, 10*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		clk.Advance(time.Minute)
+		return checked()
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestCheckAndUpdateListsTagsOncePerRepository(t *testing.T) {
+	registryHandler := ggcrregistry.New(ggcrregistry.Logger(log.New(io.Discard, "", 0)))
+	var tagLists atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/tags/list") {
+			tagLists.Add(1)
+		}
+		registryHandler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	host := strings.TrimPrefix(server.URL, "http://")
+	for _, image := range []string{"app:1.0.0", "app:1.1.0", "db:1.0.0"} {
+		pushTestImage(t, host+"/"+image)
+	}
+
+	var objects []runtime.Object
+	for i := range 3 {
+		deploy := newTestDeployment(map[string]string{}, corev1.Container{Name: "app", Image: host + "/app:1.0.0"})
+		deploy.Name = fmt.Sprintf("app-%d", i)
+		objects = append(objects, deploy)
+	}
+	db := newTestDeployment(map[string]string{}, corev1.Container{Name: "db", Image: host + "/db:1.0.0"})
+	db.Name = "db"
+	objects = append(objects, db)
+	u, clientset := newTestUpdater(objects...)
+	ctx := context.Background()
+
+	// The three deployments sharing app list its tags once
+	require.NoError(t, u.CheckAndUpdate(ctx))
+	assert.Equal(t, int32(2), tagLists.Load())
+	for i := range 3 {
+		deploy, err := clientset.AppsV1().Deployments("default").Get(ctx, fmt.Sprintf("app-%d", i), metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, host+"/app:1.1.0", deploy.Spec.Template.Spec.Containers[0].Image)
+	}
+
+	// The next cycle lists fresh tags
+	pushTestImage(t, host+"/app:1.2.0")
+	require.NoError(t, u.CheckAndUpdate(ctx))
+	assert.Equal(t, int32(4), tagLists.Load())
+	deploy, err := clientset.AppsV1().Deployments("default").Get(ctx, "app-0", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, host+"/app:1.2.0", deploy.Spec.Template.Spec.Containers[0].Image)
+}
+
+func TestLogSummaryOnly(t *testing.T) {
+	host := newTestRegistry(t, "app", "1.0.0", "1.1.0")
+	oldLevel := logrus.GetLevel()
+	setTuning(t, func(tuning *config.Tunables) { tuning.LogSummaryOnly = true })
+	t.Cleanup(func() { logrus.SetLevel(oldLevel) })
+	check := func(level logrus.Level) []*logrus.Entry {
+		logrus.SetLevel(level)
+		upToDate := newTestDeployment(nil, corev1.Container{Name: "app", Image: host + "/app:1.1.0"})
+		upToDate.Name = "up-to-date"
+		u, _ := newTestUpdater(newTestDeployment(nil, corev1.Container{Name: "app", Image: host + "/app:1.0.0"}), upToDate)
+		hook := logtest.NewGlobal()
+		t.Cleanup(hook.Reset)
+		require.NoError(t, u.CheckAndUpdate(context.Background()))
+		return hook.AllEntries()
+	}
+
+	entries := check(logrus.InfoLevel)
+	require.Len(t, entries, 1)
+	assert.Equal(t, logrus.InfoLevel, entries[0].Level)
+	assert.Regexp(t, `^Checked for image updates: checked=2 updated=1 errors=0 duration=\S+$`, entries[0].Message)
+
+	// The debug level keeps the per-resource lines along with the summary
+	var messages []string
+	for _, entry := range check(logrus.DebugLevel) {
+		messages = append(messages, entry.Message)
+	}
+	assert.Contains(t, messages, "Updating deployment default/app")
+	assert.True(t, slices.ContainsFunc(messages, func(message string) bool {
+		return strings.HasPrefix(message, "Checked for image updates: checked=2 updated=1 errors=0")
+	}))
+}
+
+func TestCycleWebhook(t *testing.T) {
+	host := newTestRegistry(t, "app", "1.0.0", "1.1.0")
+	summaries := make(chan map[string]any, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var summary map[string]any
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&summary))
+		summaries <- summary
+	}))
+	t.Cleanup(server.Close)
+
+	updated := newTestDeployment(nil, corev1.Container{Name: "app", Image: host + "/app:1.0.0"})
+	// A registry refusing connections fails the check of the resource
+	failing := newTestDeployment(nil, corev1.Container{Name: "app", Image: "127.0.0.1:1/app:1.0.0"})
+	failing.Name = "failing"
+	u, _ := newTestUpdater(updated, failing)
+	var err error
+	u.hooks, err = hooks.New(&config.Config{CycleWebhookURL: server.URL})
+	require.NoError(t, err)
+
+	// The start and duration of the cycle are read from the updater's clock
+	start := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	u.clock = clock.NewFake(start)
+	require.NoError(t, u.CheckAndUpdate(context.Background()))
+	var summary map[string]any
+	select {
+	case summary = <-summaries:
+	default:
+		t.Fatal("cycle summary not posted")
+	}
+
+	assert.ElementsMatch(t, []string{"startTime", "duration", "checked", "updated", "errors"}, slices.Collect(maps.Keys(summary)))
+	startTime, err := time.Parse(time.RFC3339Nano, summary["startTime"].(string))
+	require.NoError(t, err)
+	assert.Equal(t, start, startTime)
+	assert.Equal(t, 0.0, summary["duration"])
+	assert.Equal(t, 2.0, summary["checked"])
+	assert.Equal(t, []any{map[string]any{
+		"kind": "deployment", "namespace": "default", "name": "app",
+		"changes": []any{map[string]any{"action": "update", "container": "app", "oldImage": host + "/app:1.0.0", "newImage": host + "/app:1.1.0", "mode": "release"}},
+	}}, summary["updated"])
+	require.Len(t, summary["errors"], 1)
+	assert.Contains(t, summary["errors"].([]any)[0], "default/failing")
+}
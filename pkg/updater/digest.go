@@ -0,0 +1,82 @@
+package updater
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Hex characters of a digest kept by shortDigest, and the fewest a stored digest may be shortened to
+const shortDigestLength = 12
+
+// normalizeDigest lowercases a digest and adds the sha256: algorithm when it is missing
+func normalizeDigest(digest string) string {
+	digest = strings.ToLower(strings.TrimSpace(digest))
+	if digest != "" && !strings.Contains(digest, ":") && isHex(digest) {
+		return "sha256:" + digest
+	}
+	return digest
+}
+
+// sameDigest reports whether a stored digest refers to the full digest returned by a registry.
+// The stored digest may lack the algorithm or be shortened, as long as it keeps shortDigestLength hex characters.
+func sameDigest(stored, full string) bool {
+	stored, full = normalizeDigest(stored), normalizeDigest(full)
+	if stored == full {
+		return true
+	}
+	algorithm, hex, ok := strings.Cut(stored, ":")
+	return ok && len(hex) >= shortDigestLength && isHex(hex) && strings.HasPrefix(full, algorithm+":"+hex)
+}
+
+// shortDigest shortens a digest for logging, sha256:0123456789ab. The full digest is always stored.
+func shortDigest(digest string) string {
+	digest = normalizeDigest(digest)
+	algorithm, hex, ok := strings.Cut(digest, ":")
+	if !ok || len(hex) <= shortDigestLength {
+		return digest
+	}
+	return algorithm + ":" + hex[:shortDigestLength]
+}
+
+func isHex(s string) bool {
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// parseAllowedDigests parses the comma-separated digests of the allowed-digests annotation, which may be shortened
+// like a stored digest. It returns nil, allowing every digest, when the annotation is unset.
+func parseAllowedDigests(value string) ([]string, error) {
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+	digests := []string{}
+	for _, field := range strings.Split(value, ",") {
+		digest := normalizeDigest(field)
+		if digest == "" {
+			continue
+		}
+		if _, hex, ok := strings.Cut(digest, ":"); !ok || len(hex) < shortDigestLength || !isHex(hex) {
+			return nil, fmt.Errorf("invalid digest %q in allowed-digests annotation", strings.TrimSpace(field))
+		}
+		digests = append(digests, digest)
+	}
+	return digests, nil
+}
+
+// digestAllowed reports whether a digest returned by a registry is one of the allowed digests, any is when
+// allowedDigests is nil
+func digestAllowed(allowedDigests []string, digest string) bool {
+	if allowedDigests == nil {
+		return true
+	}
+	for _, allowed := range allowedDigests {
+		if sameDigest(allowed, digest) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,290 @@
+package updater
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/monlor/k8s-image-updater/pkg/clock"
+	"github.com/monlor/k8s-image-updater/pkg/registry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const testDigest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+func TestNormalizeDigest(t *testing.T) {
+	hex := strings.TrimPrefix(testDigest, "sha256:")
+	assert.Equal(t, testDigest, normalizeDigest(testDigest))
+	assert.Equal(t, testDigest, normalizeDigest(hex))
+	assert.Equal(t, testDigest, normalizeDigest(" "+strings.ToUpper(testDigest)+"\n"))
+	assert.Equal(t, "sha256:0123456789ab", normalizeDigest("0123456789ab"))
+	assert.Empty(t, normalizeDigest(""))
+	// Not a digest, left as is
+	assert.Equal(t, "not-a-digest", normalizeDigest("not-a-digest"))
+}
+
+func TestSameDigest(t *testing.T) {
+	hex := strings.TrimPrefix(testDigest, "sha256:")
+	tests := []struct {
+		name   string
+		stored string
+		want   bool
+	}{
+		{"full", testDigest, true},
+		{"without algorithm", hex, true},
+		{"uppercase", strings.ToUpper(testDigest), true},
+		{"short", "sha256:0123456789ab", true},
+		{"short without algorithm", "0123456789ab", true},
+		{"too short", "sha256:0123456", false},
+		{"other digest", "sha256:fedcba9876543210", false},
+		{"other algorithm", "sha512:0123456789abcdef", false},
+		{"empty", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, sameDigest(tt.stored, testDigest))
+		})
+	}
+}
+
+func TestShortDigest(t *testing.T) {
+	assert.Equal(t, "sha256:0123456789ab", shortDigest(testDigest))
+	assert.Equal(t, "sha256:0123456789ab", shortDigest(strings.TrimPrefix(testDigest, "sha256:")))
+	assert.Equal(t, "sha256:0123", shortDigest("sha256:0123"))
+	assert.Empty(t, shortDigest(""))
+}
+
+func TestLatestModeRestartedAt(t *testing.T) {
+	host := newTestRegistry(t, "app", "latest")
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	u, _ := newTestUpdater()
+	u.clock = clock.NewFake(now)
+	deploy := newTestDeployment(map[string]string{
+		config.AnnotationMode:       "latest",
+		config.AnnotationLastDigest: testDigest,
+	}, corev1.Container{Name: "app", Image: host + "/app:latest", ImagePullPolicy: corev1.PullAlways})
+
+	result, err := u.updateContainerIfNeeded(context.Background(), &deploy.Spec.Template.Spec.Containers[0], &deploy.Annotations, "default", "app", "deployment", &deploy.Spec.Template)
+	require.NoError(t, err)
+	assert.True(t, result.Changed)
+	assert.Equal(t, actionRestart, result.Action)
+	assert.Equal(t, host+"/app:latest", result.OldImage)
+	assert.Equal(t, host+"/app:latest", result.NewImage)
+	assert.Equal(t, "2024-06-01T12:00:00Z", deploy.Spec.Template.Annotations[config.AnnotationRestart])
+}
+
+func TestLatestModeMinRestartInterval(t *testing.T) {
+	host := newTestRegistry(t, "app", "latest")
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	u, _ := newTestUpdater()
+	u.clock = clock.NewFake(now)
+	check := func(lastRestart, interval string) (*appsv1.Deployment, containerUpdate, error) {
+		deploy := newTestDeployment(map[string]string{
+			config.AnnotationMode:               "latest",
+			config.AnnotationLastDigest:         testDigest,
+			config.AnnotationMinRestartInterval: interval,
+		}, corev1.Container{Name: "app", Image: host + "/app:latest", ImagePullPolicy: corev1.PullAlways})
+		deploy.Spec.Template.Annotations = map[string]string{config.AnnotationRestart: lastRestart}
+		result, err := u.updateContainerIfNeeded(context.Background(), &deploy.Spec.Template.Spec.Containers[0], &deploy.Annotations, "default", "app", "deployment", &deploy.Spec.Template)
+		return deploy, result, err
+	}
+
+	// A restart 2h ago delays the new digest, which is not recorded so a later check restarts
+	deploy, result, err := check("2024-06-01T10:00:00Z", "6h")
+	require.NoError(t, err)
+	assert.False(t, result.Changed)
+	assert.Equal(t, "2024-06-01T10:00:00Z", deploy.Spec.Template.Annotations[config.AnnotationRestart])
+	assert.Equal(t, testDigest, deploy.Annotations[config.AnnotationLastDigest])
+
+	// An older restart, or one the updater cannot parse, allows it
+	for _, lastRestart := range []string{"2024-05-31T12:00:00Z", "yesterday"} {
+		deploy, result, err = check(lastRestart, "6h")
+		require.NoError(t, err)
+		assert.True(t, result.Changed, lastRestart)
+		assert.Equal(t, actionRestart, result.Action)
+		assert.Equal(t, "2024-06-01T12:00:00Z", deploy.Spec.Template.Annotations[config.AnnotationRestart])
+		assert.NotEqual(t, testDigest, deploy.Annotations[config.AnnotationLastDigest])
+	}
+
+	_, _, err = check("2024-06-01T10:00:00Z", "six hours")
+	assert.ErrorContains(t, err, config.AnnotationMinRestartInterval)
+}
+
+func TestLatestModeFirstSeen(t *testing.T) {
+	host := newTestRegistry(t, "app", "latest")
+	u, clientset := newTestUpdater(newTestDeployment(map[string]string{config.AnnotationMode: "latest"},
+		corev1.Container{Name: "app", Image: host + "/app:latest", ImagePullPolicy: corev1.PullAlways}))
+	ctx := context.Background()
+	getDeployment := func() *appsv1.Deployment {
+		deploy, err := clientset.AppsV1().Deployments("default").Get(ctx, "app", metav1.GetOptions{})
+		require.NoError(t, err)
+		return deploy
+	}
+
+	// The digest is stored without restarting the pods
+	require.NoError(t, u.updateDeployments(ctx))
+	deploy := getDeployment()
+	firstDigest := deploy.Annotations[config.AnnotationLastDigest]
+	assert.NotEmpty(t, firstDigest)
+	assert.NotContains(t, deploy.Spec.Template.Annotations, config.AnnotationRestart)
+
+	// A new digest of the tag restarts them
+	newDigest := pushTestImage(t, host+"/app:latest")
+	require.NoError(t, u.updateDeployments(ctx))
+	deploy = getDeployment()
+	assert.Equal(t, newDigest, deploy.Annotations[config.AnnotationLastDigest])
+	assert.NotEqual(t, firstDigest, newDigest)
+	assert.NotEmpty(t, deploy.Spec.Template.Annotations[config.AnnotationRestart])
+}
+
+func TestLatestModeUpdateOnFirstSeen(t *testing.T) {
+	old := config.GlobalConfig.LatestUpdateOnFirstSeen
+	config.GlobalConfig.LatestUpdateOnFirstSeen = true
+	t.Cleanup(func() { config.GlobalConfig.LatestUpdateOnFirstSeen = old })
+	host := newTestRegistry(t, "app", "latest")
+	u, _ := newTestUpdater()
+	deploy := newTestDeployment(map[string]string{config.AnnotationMode: "latest"},
+		corev1.Container{Name: "app", Image: host + "/app:latest", ImagePullPolicy: corev1.PullAlways})
+
+	u.clock = clock.NewFake(time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC))
+
+	// The pods are restarted to pull the first digest seen
+	result, err := u.updateContainerIfNeeded(context.Background(), &deploy.Spec.Template.Spec.Containers[0], &deploy.Annotations, "default", "app", "deployment", &deploy.Spec.Template)
+	require.NoError(t, err)
+	assert.True(t, result.Changed)
+	assert.Equal(t, actionRestart, result.Action)
+	assert.NotEmpty(t, deploy.Annotations[config.AnnotationLastDigest])
+	assert.Equal(t, "2024-06-01T12:00:00Z", deploy.Spec.Template.Annotations[config.AnnotationRestart])
+}
+
+func TestLatestModeShortStoredDigest(t *testing.T) {
+	host := newTestRegistry(t, "app", "latest")
+	ctx := context.Background()
+	digest, err := registry.NewRegistryClient("", "").GetDigest(ctx, host+"/app:latest")
+	require.NoError(t, err)
+	u, _ := newTestUpdater()
+
+	for _, stored := range []string{shortDigest(digest), strings.TrimPrefix(digest, "sha256:")} {
+		deploy := newTestDeployment(map[string]string{
+			config.AnnotationMode:       "latest",
+			config.AnnotationLastDigest: stored,
+		}, corev1.Container{Name: "app", Image: host + "/app:latest", ImagePullPolicy: corev1.PullAlways})
+
+		result, err := u.updateContainerIfNeeded(ctx, &deploy.Spec.Template.Spec.Containers[0], &deploy.Annotations, "default", "app", "deployment", &deploy.Spec.Template)
+		require.NoError(t, err)
+		// The same image is not restarted, the annotation is rewritten with the full digest
+		assert.False(t, result.Changed, stored)
+		assert.Equal(t, actionNone, result.Action, stored)
+		assert.NotContains(t, deploy.Spec.Template.Annotations, config.AnnotationRestart)
+		assert.Equal(t, digest, deploy.Annotations[config.AnnotationLastDigest])
+	}
+}
+
+func TestDigestModePreserveTag(t *testing.T) {
+	host := newTestRegistry(t, "app")
+	digest := pushTestImage(t, host+"/app:stable")
+	ctx := context.Background()
+	u, _ := newTestUpdater()
+	check := func(annotations map[string]string, image string) containerUpdate {
+		deploy := newTestDeployment(annotations, corev1.Container{Name: "app", Image: image})
+		result, err := u.updateContainerIfNeeded(ctx, &deploy.Spec.Template.Spec.Containers[0], &deploy.Annotations, "default", "app", "deployment", &deploy.Spec.Template)
+		require.NoError(t, err)
+		return result
+	}
+	annotations := map[string]string{
+		config.AnnotationMode:        "digest",
+		config.AnnotationAllowTags:   "stable",
+		config.AnnotationPreserveTag: "true",
+	}
+
+	// The tracked tag is kept in front of the digest
+	result := check(annotations, host+"/app:stable")
+	assert.True(t, result.Changed)
+	assert.Equal(t, host+"/app:stable@"+digest, result.NewImage)
+
+	// The digest of a tag+digest reference is still compared
+	assert.False(t, check(annotations, result.NewImage).Changed)
+	newDigest := pushTestImage(t, host+"/app:stable")
+	result = check(annotations, result.NewImage)
+	assert.True(t, result.Changed)
+	assert.Equal(t, host+"/app:stable@"+newDigest, result.NewImage)
+
+	// Without preserve-tag the tag is dropped
+	delete(annotations, config.AnnotationPreserveTag)
+	assert.Equal(t, host+"/app@"+newDigest, check(annotations, host+"/app:stable").NewImage)
+}
+
+func TestParseAllowedDigests(t *testing.T) {
+	digests, err := parseAllowedDigests("")
+	require.NoError(t, err)
+	assert.Nil(t, digests)
+
+	digests, err = parseAllowedDigests(" " + testDigest + ", 0123456789AB,")
+	require.NoError(t, err)
+	assert.Equal(t, []string{testDigest, "sha256:0123456789ab"}, digests)
+	assert.True(t, digestAllowed(digests, testDigest))
+	assert.False(t, digestAllowed(digests, "sha256:"+strings.Repeat("f", 64)))
+	assert.True(t, digestAllowed(nil, testDigest))
+
+	_, err = parseAllowedDigests("sha256:0123")
+	assert.Error(t, err)
+	_, err = parseAllowedDigests("latest")
+	assert.Error(t, err)
+}
+
+func TestAllowedDigests(t *testing.T) {
+	host := newTestRegistry(t, "app", "1.0.0")
+	approved := pushTestImage(t, host+"/app:1.1.0")
+	pushTestImage(t, host+"/app:1.2.0")
+	ctx := context.Background()
+	u, _ := newTestUpdater()
+	check := func(annotations map[string]string, image string) (containerUpdate, map[string]string) {
+		deploy := newTestDeployment(annotations, corev1.Container{Name: "app", Image: image, ImagePullPolicy: corev1.PullAlways})
+		result, err := u.updateContainerIfNeeded(ctx, &deploy.Spec.Template.Spec.Containers[0], &deploy.Annotations, "default", "app", "deployment", &deploy.Spec.Template)
+		require.NoError(t, err)
+		return result, deploy.Annotations
+	}
+
+	// Release mode skips the unapproved 1.2.0 for the newest approved tag
+	result, annotations := check(map[string]string{config.AnnotationMode: "release", config.AnnotationAllowedDigests: approved}, host+"/app:1.0.0")
+	assert.Equal(t, host+"/app:1.1.0", result.NewImage)
+	assert.Empty(t, annotations[config.AnnotationStatus])
+
+	// A shortened digest is enough, and a container annotation overrides the resource one
+	result, _ = check(map[string]string{config.AnnotationMode: "release", config.AnnotationAllowedDigests: testDigest,
+		config.AnnotationAllowedDigests + ".app": strings.TrimPrefix(approved, "sha256:")[:12]}, host+"/app:1.0.0")
+	assert.Equal(t, host+"/app:1.1.0", result.NewImage)
+
+	// No newer tag is approved, the current image is kept
+	result, annotations = check(map[string]string{config.AnnotationMode: "release", config.AnnotationAllowedDigests: testDigest}, host+"/app:1.0.0")
+	assert.False(t, result.Changed)
+	assert.Equal(t, config.StatusDigestNotAllowed, annotations[config.AnnotationStatus])
+
+	// Digest mode only moves to an approved digest
+	digestMode := map[string]string{config.AnnotationMode: "digest", config.AnnotationAllowTags: "1.2.0", config.AnnotationAllowedDigests: approved}
+	result, annotations = check(digestMode, host+"/app:1.2.0")
+	assert.False(t, result.Changed)
+	assert.Equal(t, config.StatusDigestNotAllowed, annotations[config.AnnotationStatus])
+	digestMode[config.AnnotationAllowTags] = "1.1.0"
+	result, _ = check(digestMode, host+"/app:1.1.0")
+	assert.Equal(t, host+"/app@"+approved, result.NewImage)
+
+	// Latest mode does not restart on an unapproved digest, and keeps the last one
+	lastDigest := pushTestImage(t, host+"/app:latest")
+	pushTestImage(t, host+"/app:latest")
+	result, annotations = check(map[string]string{config.AnnotationMode: "latest", config.AnnotationAllowedDigests: approved,
+		config.AnnotationLastDigest: lastDigest}, host+"/app:latest")
+	assert.False(t, result.Changed)
+	assert.Equal(t, lastDigest, annotations[config.AnnotationLastDigest])
+	assert.Equal(t, config.StatusDigestNotAllowed, annotations[config.AnnotationStatus])
+
+	_, err := u.updateContainerIfNeeded(ctx, &corev1.Container{Name: "app", Image: host + "/app:1.0.0"},
+		&map[string]string{config.AnnotationMode: "release", config.AnnotationAllowedDigests: "invalid"}, "default", "app", "deployment", &corev1.PodTemplateSpec{})
+	assert.ErrorContains(t, err, "allowed-digests")
+}
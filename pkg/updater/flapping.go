@@ -0,0 +1,92 @@
+package updater
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/monlor/k8s-image-updater/pkg/audit"
+	"github.com/monlor/k8s-image-updater/pkg/metrics"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// appliedImage is an image update written to a container, kept to detect updates flipping back and forth
+type appliedImage struct {
+	container string
+	from, to  string
+	at        time.Time
+}
+
+// recentAppliedImages returns the images applied to a resource within FLAP_DETECTION_WINDOW, dropping older ones.
+// The caller holds u.mu.
+func (u *Updater) recentAppliedImages(key string) []appliedImage {
+	window := config.GlobalConfig.FlapDetectionWindow
+	var recent []appliedImage
+	for _, applied := range u.appliedImages[key] {
+		if u.clock.Now().Sub(applied.at) < window {
+			recent = append(recent, applied)
+		}
+	}
+	if len(recent) == 0 {
+		delete(u.appliedImages, key)
+	} else {
+		u.appliedImages[key] = recent
+	}
+	return recent
+}
+
+// recordAppliedImages remembers the images a written update changed, when FLAP_DETECTION_WINDOW is set.
+// The caller holds u.mu.
+func (u *Updater) recordAppliedImages(p pendingUpdate) {
+	if config.GlobalConfig.FlapDetectionWindow <= 0 {
+		return
+	}
+	if u.appliedImages == nil {
+		u.appliedImages = make(map[string][]appliedImage)
+	}
+	recent := u.recentAppliedImages(p.key())
+	for _, entry := range p.entries {
+		if entry.Action == audit.ActionUpdate && entry.OldImage != entry.NewImage {
+			recent = append(recent, appliedImage{container: entry.Container, from: entry.OldImage, to: entry.NewImage, at: u.clock.Now()})
+		}
+	}
+	if len(recent) > 0 {
+		u.appliedImages[p.key()] = recent
+	}
+}
+
+// skipFlappingImages puts back the original image of containers whose update would undo an update applied
+// within FLAP_DETECTION_WINDOW, or redo one that was undone since, e.g. by another updater or by hand.
+// The resource gets the flapping status instead.
+func (u *Updater) skipFlappingImages(ctx context.Context, kind string, meta *metav1.ObjectMeta, original, template *corev1.PodTemplateSpec) {
+	if config.GlobalConfig.FlapDetectionWindow <= 0 {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.appliedImages == nil {
+		return
+	}
+	recent := u.recentAppliedImages(fmt.Sprintf("%s/%s/%s", kind, meta.Namespace, meta.Name))
+	for i := range template.Spec.Containers {
+		container := &template.Spec.Containers[i]
+		if i >= len(original.Spec.Containers) || container.Image == original.Spec.Containers[i].Image {
+			continue
+		}
+		for _, applied := range recent {
+			if applied.container != container.Name || (applied.from != container.Image && applied.to != container.Image) {
+				continue
+			}
+			logrus.Warnf("Not updating container %s of %s %s/%s from %s to %s, it was updated from %s to %s %s ago",
+				container.Name, kind, meta.Namespace, meta.Name, original.Spec.Containers[i].Image, container.Image,
+				applied.from, applied.to, u.clock.Now().Sub(applied.at).Truncate(time.Second))
+			container.Image = original.Spec.Containers[i].Image
+			meta.Annotations[config.AnnotationStatus] = config.StatusFlapping
+			countSkipped(ctx, metrics.SkipReasonFlapping)
+			break
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package updater
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/monlor/k8s-image-updater/pkg/audit"
+	"github.com/monlor/k8s-image-updater/pkg/clock"
+	"github.com/monlor/k8s-image-updater/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func setFlapDetectionWindow(t *testing.T, window time.Duration) {
+	old := config.GlobalConfig.FlapDetectionWindow
+	config.GlobalConfig.FlapDetectionWindow = window
+	t.Cleanup(func() { config.GlobalConfig.FlapDetectionWindow = old })
+}
+
+func TestFlappingOscillation(t *testing.T) {
+	setFlapDetectionWindow(t, time.Hour)
+	u, _ := newTestUpdater()
+	clk := clock.NewFake(time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC))
+	u.clock = clk
+
+	// The updater moved the container from A to B
+	u.recordAppliedImages(pendingUpdate{kind: "deployment", namespace: "default", name: "app", entries: []audit.Entry{
+		{Action: audit.ActionUpdate, Container: "app", OldImage: "app:A", NewImage: "app:B"},
+	}})
+
+	checkIn := func(ctx context.Context, current, next string) (string, string) {
+		deploy := newTestDeployment(map[string]string{}, corev1.Container{Name: "app", Image: current})
+		original := deploy.Spec.Template.DeepCopy()
+		deploy.Spec.Template.Spec.Containers[0].Image = next
+		u.skipFlappingImages(ctx, "deployment", &deploy.ObjectMeta, original, &deploy.Spec.Template)
+		return deploy.Spec.Template.Spec.Containers[0].Image, deploy.Annotations[config.AnnotationStatus]
+	}
+	check := func(current, next string) (string, string) {
+		return checkIn(context.Background(), current, next)
+	}
+
+	flapping := metrics.SkippedUpdates.WithLabelValues(metrics.SkipReasonFlapping)
+	before := testutil.ToFloat64(flapping)
+	// Moving back to A within the window is caught
+	image, status := check("app:B", "app:A")
+	assert.Equal(t, "app:B", image)
+	assert.Equal(t, config.StatusFlapping, status)
+	assert.Equal(t, before+1, testutil.ToFloat64(flapping))
+	// The read-only Check changes no metric
+	image, status = checkIn(context.WithValue(context.Background(), checkOnlyKey{}, true), "app:B", "app:A")
+	assert.Equal(t, "app:B", image)
+	assert.Equal(t, config.StatusFlapping, status)
+	assert.Equal(t, before+1, testutil.ToFloat64(flapping))
+
+	// An unrelated image is applied
+	image, status = check("app:B", "app:C")
+	assert.Equal(t, "app:C", image)
+	assert.Empty(t, status)
+
+	// After the window the move is no longer a loop
+	clk.Advance(time.Hour)
+	image, status = check("app:B", "app:A")
+	assert.Equal(t, "app:A", image)
+	assert.Empty(t, status)
+	assert.Empty(t, u.appliedImages)
+}
+
+func TestFlappingRevertedUpdate(t *testing.T) {
+	setFlapDetectionWindow(t, time.Hour)
+	host := newTestRegistry(t, "app", "1.0.0", "1.1.0")
+	deploy := newTestDeployment(map[string]string{config.AnnotationMode: "release"},
+		corev1.Container{Name: "app", Image: host + "/app:1.0.0"})
+	u, clientset := newTestUpdater(deploy)
+	ctx := context.Background()
+
+	require.NoError(t, u.updateDeployments(ctx))
+	stored, err := clientset.AppsV1().Deployments("default").Get(ctx, "app", metav1.GetOptions{})
+	require.NoError(t, err)
+	require.Equal(t, host+"/app:1.1.0", stored.Spec.Template.Spec.Containers[0].Image)
+
+	// Someone else moves the image back, the updater does not fight over it
+	stored.Spec.Template.Spec.Containers[0].Image = host + "/app:1.0.0"
+	_, err = clientset.AppsV1().Deployments("default").Update(ctx, stored, metav1.UpdateOptions{})
+	require.NoError(t, err)
+	require.NoError(t, u.updateDeployments(ctx))
+	stored, err = clientset.AppsV1().Deployments("default").Get(ctx, "app", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, host+"/app:1.0.0", stored.Spec.Template.Spec.Containers[0].Image)
+	assert.Equal(t, config.StatusFlapping, stored.Annotations[config.AnnotationStatus])
+}
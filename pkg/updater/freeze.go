@@ -0,0 +1,270 @@
+package updater
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/monlor/k8s-image-updater/pkg/audit"
+	"github.com/monlor/k8s-image-updater/pkg/hooks"
+	"github.com/monlor/k8s-image-updater/pkg/k8s"
+	"github.com/monlor/k8s-image-updater/pkg/metrics"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Waiting reason of a container restarted again and again
+const crashLoopReason = "CrashLoopBackOff"
+
+// FreezeState tells why FREEZE_ON_CRASHLOOP froze rollouts
+type FreezeState struct {
+	Since     time.Time `json:"since"`
+	Reason    string    `json:"reason"`
+	Cluster   string    `json:"cluster,omitempty"`
+	Kind      string    `json:"kind"`
+	Namespace string    `json:"namespace"`
+	Name      string    `json:"name"`
+}
+
+// Keys of the ConfigMap the freeze is saved in
+const (
+	freezeStateKey   = "state"
+	freezeWatchesKey = "watches"
+)
+
+// The freeze stops the rollouts of every updater, whatever cluster the crash loop is in. Once LoadFreeze is called
+// it is saved in a ConfigMap, so it lasts until it is cleared through the API even across restarts of the updater.
+var freeze struct {
+	sync.Mutex
+	state *FreezeState
+	// Crash loop watches that froze rollouts, they do not freeze them again once unfrozen
+	watches map[string]bool
+	// ConfigMap the freeze is saved in, nil to keep it in memory only
+	client    *k8s.Client
+	namespace string
+	name      string
+}
+
+// LoadFreeze restores the freeze saved in a ConfigMap and saves the changes to it from then on. A missing
+// ConfigMap means rollouts are not frozen, it is created when they first are.
+func LoadFreeze(ctx context.Context, client *k8s.Client, namespace, name string) error {
+	freeze.Lock()
+	defer freeze.Unlock()
+	cm, err := client.GetConfigMap(ctx, namespace, name)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to get configmap %s/%s: %v", namespace, name, err)
+	}
+	var state *FreezeState
+	watches := make(map[string]bool)
+	if err == nil {
+		if raw := cm.Data[freezeStateKey]; raw != "" {
+			state = &FreezeState{}
+			if err := json.Unmarshal([]byte(raw), state); err != nil {
+				return fmt.Errorf("invalid freeze state in configmap %s/%s: %v", namespace, name, err)
+			}
+		}
+		if raw := cm.Data[freezeWatchesKey]; raw != "" {
+			var list []string
+			if err := json.Unmarshal([]byte(raw), &list); err != nil {
+				return fmt.Errorf("invalid freeze watches in configmap %s/%s: %v", namespace, name, err)
+			}
+			for _, watch := range list {
+				watches[watch] = true
+			}
+		}
+	}
+	freeze.state, freeze.watches = state, watches
+	freeze.client, freeze.namespace, freeze.name = client, namespace, name
+	if state != nil {
+		metrics.RolloutsFrozen.Set(1)
+		logrus.Errorf("Rollouts are frozen since %s: %s. Unfreeze them with POST /api/v1/unfreeze", state.Since.UTC().Format(time.RFC3339), state.Reason)
+	} else {
+		metrics.RolloutsFrozen.Set(0)
+	}
+	return nil
+}
+
+// saveFreeze writes the freeze to its ConfigMap, if any. The caller holds the lock.
+func saveFreeze(state *FreezeState, watches map[string]bool) error {
+	if freeze.client == nil {
+		return nil
+	}
+	data := make(map[string]string)
+	if state != nil {
+		raw, err := json.Marshal(state)
+		if err != nil {
+			return err
+		}
+		data[freezeStateKey] = string(raw)
+	}
+	if len(watches) > 0 {
+		raw, err := json.Marshal(slices.Sorted(maps.Keys(watches)))
+		if err != nil {
+			return err
+		}
+		data[freezeWatchesKey] = string(raw)
+	}
+
+	cm, err := freeze.client.GetConfigMap(context.Background(), freeze.namespace, freeze.name)
+	if apierrors.IsNotFound(err) {
+		cm = &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: freeze.namespace, Name: freeze.name}, Data: data}
+		err = freeze.client.CreateConfigMap(cm)
+	} else if err == nil {
+		cm.Data = data
+		err = freeze.client.UpdateConfigMap(cm)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save freeze to configmap %s/%s: %v", freeze.namespace, freeze.name, err)
+	}
+	return nil
+}
+
+// Frozen returns why rollouts are frozen, or nil when they are not
+func Frozen() *FreezeState {
+	freeze.Lock()
+	defer freeze.Unlock()
+	if freeze.state == nil {
+		return nil
+	}
+	state := *freeze.state
+	return &state
+}
+
+// Unfreeze lets rollouts resume, returning the freeze it cleared or nil when rollouts were not frozen. Rollouts
+// stay frozen when clearing the saved freeze fails, a restart would freeze them again.
+func Unfreeze() (*FreezeState, error) {
+	freeze.Lock()
+	defer freeze.Unlock()
+	state := freeze.state
+	if state == nil {
+		return nil, nil
+	}
+	pruneWatches(freeze.watches, time.Now())
+	if err := saveFreeze(nil, freeze.watches); err != nil {
+		return nil, err
+	}
+	freeze.state = nil
+	metrics.RolloutsFrozen.Set(0)
+	return state, nil
+}
+
+// freezeRollouts freezes rollouts for a crash loop watch, unless they already are or the watch froze them before,
+// returning whether it did. A freeze that cannot be saved still holds until the updater restarts.
+func freezeRollouts(watch string, state FreezeState) bool {
+	freeze.Lock()
+	defer freeze.Unlock()
+	if freeze.state != nil || freeze.watches[watch] {
+		return false
+	}
+	if freeze.watches == nil {
+		freeze.watches = make(map[string]bool)
+	}
+	pruneWatches(freeze.watches, state.Since)
+	freeze.watches[watch] = true
+	freeze.state = &state
+	metrics.RolloutsFrozen.Set(1)
+	if err := saveFreeze(freeze.state, freeze.watches); err != nil {
+		logrus.Errorf("Rollouts are only frozen until the updater restarts: %v", err)
+	}
+	return true
+}
+
+// pruneWatches removes the watches whose grace period ended before now, their crash loops freeze nothing anymore.
+// The caller holds the lock.
+func pruneWatches(watches map[string]bool, now time.Time) {
+	for watch := range watches {
+		_, value, ok := strings.Cut(watch, "@")
+		if until, err := time.Parse(time.RFC3339, value); ok && err == nil && now.After(until) {
+			delete(watches, watch)
+		}
+	}
+}
+
+// watchCrashLoops starts watching the pods of a rollout at now for crash loops, during CRASHLOOP_GRACE_PERIOD
+func watchCrashLoops(annotations map[string]string, now time.Time) {
+	if !config.GlobalConfig.FreezeOnCrashLoop {
+		return
+	}
+	annotations[config.AnnotationCrashLoopWatchUntil] = now.Add(config.GlobalConfig.CrashLoopGracePeriod).UTC().Format(time.RFC3339)
+}
+
+// crashLoops returns the containers of the pods in CrashLoopBackOff while running the image set in the template
+func crashLoops(pods []corev1.Pod, template *corev1.PodTemplateSpec) []string {
+	images := make(map[string]string)
+	for _, container := range template.Spec.Containers {
+		images[container.Name] = container.Image
+	}
+	var failing []string
+	for _, pod := range pods {
+		for _, status := range pod.Status.ContainerStatuses {
+			if status.State.Waiting == nil || status.State.Waiting.Reason != crashLoopReason || slices.Contains(failing, status.Name) {
+				continue
+			}
+			if image, ok := images[status.Name]; ok && pullImage(pod, status.Name) == image {
+				failing = append(failing, status.Name)
+			}
+		}
+	}
+	slices.Sort(failing)
+	return failing
+}
+
+// freezeOnCrashLoop watches a resource rolled out less than CRASHLOOP_GRACE_PERIOD ago, and freezes all rollouts
+// when its pods crash loop on the new images, notifying FREEZE_HOOK
+func (u *Updater) freezeOnCrashLoop(ctx context.Context, kind string, meta *metav1.ObjectMeta, template *corev1.PodTemplateSpec, selector *metav1.LabelSelector) error {
+	value := meta.Annotations[config.AnnotationCrashLoopWatchUntil]
+	if value == "" {
+		return nil
+	}
+	until, err := time.Parse(time.RFC3339, value)
+	if !config.GlobalConfig.FreezeOnCrashLoop || err != nil || u.clock.Now().After(until) {
+		// The new images ran fine during the grace period
+		delete(meta.Annotations, config.AnnotationCrashLoopWatchUntil)
+		return nil
+	}
+
+	podSelector, err := metav1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		return fmt.Errorf("invalid selector: %v", err)
+	}
+	pods, err := u.k8sClient.ListPods(ctx, meta.Namespace, metav1.ListOptions{LabelSelector: podSelector.String()})
+	if err != nil {
+		return fmt.Errorf("failed to list pods: %v", err)
+	}
+	failing := crashLoops(pods, template)
+	if len(failing) == 0 {
+		return nil
+	}
+	// A rollout freezes rollouts once. Removing the watch is only saved with the next write of the resource,
+	// which the freeze may hold back, so the watches that froze rollouts are remembered as well.
+	delete(meta.Annotations, config.AnnotationCrashLoopWatchUntil)
+	watch := fmt.Sprintf("%s/%s/%s/%s@%s", u.cluster, kind, meta.Namespace, meta.Name, value)
+
+	reason := fmt.Sprintf("containers %s of %s %s/%s%s crash loop after an update", strings.Join(failing, ", "), kind, meta.Namespace, meta.Name, u.clusterSuffix())
+	if !freezeRollouts(watch, FreezeState{Since: u.clock.Now(), Reason: reason, Cluster: u.cluster, Kind: kind, Namespace: meta.Namespace, Name: meta.Name}) {
+		checkDebugf("Not freezing rollouts again: %s", reason)
+		return nil
+	}
+	logrus.Errorf("Freezing all rollouts: %s. Unfreeze them with POST /api/v1/unfreeze", reason)
+	if u.hooks == nil {
+		return nil
+	}
+	payload := hooks.Payload{Kind: kind, Namespace: meta.Namespace, Name: meta.Name, Error: reason}
+	for _, container := range template.Spec.Containers {
+		if slices.Contains(failing, container.Name) {
+			payload.Changes = append(payload.Changes, hooks.Change{Action: audit.ActionUpdate, Container: container.Name, NewImage: container.Image})
+		}
+	}
+	if err := u.hooks.Frozen(ctx, payload); err != nil {
+		logrus.Errorf("Freeze hook of %s %s/%s failed: %v", kind, meta.Namespace, meta.Name, err)
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+package updater
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/monlor/k8s-image-updater/pkg/clock"
+	"github.com/monlor/k8s-image-updater/pkg/hooks"
+	"github.com/monlor/k8s-image-updater/pkg/k8s"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func enableFreezeOnCrashLoop(t *testing.T, gracePeriod time.Duration) {
+	oldEnabled, oldGracePeriod := config.GlobalConfig.FreezeOnCrashLoop, config.GlobalConfig.CrashLoopGracePeriod
+	config.GlobalConfig.FreezeOnCrashLoop = true
+	config.GlobalConfig.CrashLoopGracePeriod = gracePeriod
+	t.Cleanup(func() {
+		config.GlobalConfig.FreezeOnCrashLoop = oldEnabled
+		config.GlobalConfig.CrashLoopGracePeriod = oldGracePeriod
+		Unfreeze()
+		freeze.watches = nil
+		freeze.client = nil
+	})
+}
+
+func newFreezeTestDeployment(image string) *appsv1.Deployment {
+	deploy := newTestDeployment(map[string]string{config.AnnotationMode: "release"}, corev1.Container{Name: "app", Image: image})
+	deploy.Spec.Selector = &metav1.LabelSelector{MatchLabels: map[string]string{"app": "app"}}
+	return deploy
+}
+
+func TestFreezeOnCrashLoop(t *testing.T) {
+	enableFreezeOnCrashLoop(t, time.Hour)
+	host := newTestRegistry(t, "app", "1.0.0", "1.1.0")
+	u, clientset := newTestUpdater(newFreezeTestDeployment(host + "/app:1.0.0"))
+	url, payloads := newHookServer(t, func(string) int { return http.StatusOK })
+	var err error
+	u.hooks, err = hooks.New(&config.Config{FreezeHook: url})
+	require.NoError(t, err)
+	ctx := context.Background()
+	getDeployment := func() *appsv1.Deployment {
+		deploy, err := clientset.AppsV1().Deployments("default").Get(ctx, "app", metav1.GetOptions{})
+		require.NoError(t, err)
+		return deploy
+	}
+
+	require.NoError(t, u.updateDeployments(ctx))
+	deploy := getDeployment()
+	assert.Equal(t, host+"/app:1.1.0", deploy.Spec.Template.Spec.Containers[0].Image)
+	assert.NotEmpty(t, deploy.Annotations[config.AnnotationCrashLoopWatchUntil])
+
+	// Old pods and other waiting reasons do not freeze rollouts
+	createWaitingPod(t, clientset, "old", host+"/app:1.0.0", crashLoopReason)
+	createWaitingPod(t, clientset, "starting", host+"/app:1.1.0", "ContainerCreating")
+	require.NoError(t, u.updateDeployments(ctx))
+	assert.Nil(t, Frozen())
+
+	createWaitingPod(t, clientset, "new", host+"/app:1.1.0", crashLoopReason)
+	pushTestImage(t, host+"/app:1.2.0")
+	require.NoError(t, u.updateDeployments(ctx))
+	state := Frozen()
+	require.NotNil(t, state)
+	assert.Equal(t, "deployment", state.Kind)
+	assert.Equal(t, "app", state.Name)
+	assert.Contains(t, state.Reason, "containers app of deployment default/app crash loop")
+	// The newer image is held back while rollouts are frozen
+	assert.Equal(t, host+"/app:1.1.0", getDeployment().Spec.Template.Spec.Containers[0].Image)
+
+	require.Len(t, payloads(), 1)
+	assert.Equal(t, hooks.PhaseFrozen, payloads()[0].Phase)
+	assert.Equal(t, state.Reason, payloads()[0].Error)
+	assert.Equal(t, []hooks.Change{{Action: "update", Container: "app", NewImage: host + "/app:1.1.0"}}, payloads()[0].Changes)
+
+	// Once unfrozen the same crash loop does not freeze rollouts again
+	unfrozen, err := Unfreeze()
+	require.NoError(t, err)
+	assert.Equal(t, state, unfrozen)
+	assert.Nil(t, Frozen())
+	require.NoError(t, u.updateDeployments(ctx))
+	assert.Nil(t, Frozen())
+	assert.Equal(t, host+"/app:1.2.0", getDeployment().Spec.Template.Spec.Containers[0].Image)
+	assert.Len(t, payloads(), 1)
+}
+
+func TestFreezeOnCrashLoopGracePeriod(t *testing.T) {
+	enableFreezeOnCrashLoop(t, time.Minute)
+	host := newTestRegistry(t, "app", "1.1.0")
+	deploy := newFreezeTestDeployment(host + "/app:1.1.0")
+	updatedAt := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	deploy.Annotations[config.AnnotationCrashLoopWatchUntil] = updatedAt.Add(time.Minute).Format(time.RFC3339)
+	u, clientset := newTestUpdater(deploy)
+	u.clock = clock.NewFake(updatedAt.Add(2 * time.Minute))
+	createWaitingPod(t, clientset, "new", host+"/app:1.1.0", crashLoopReason)
+	ctx := context.Background()
+
+	// Past the grace period the rollout is no longer watched
+	require.NoError(t, u.updateDeployments(ctx))
+	assert.Nil(t, Frozen())
+	deploy, err := clientset.AppsV1().Deployments("default").Get(ctx, "app", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.NotContains(t, deploy.Annotations, config.AnnotationCrashLoopWatchUntil)
+}
+
+func TestFreezeOnCrashLoopDuringCanary(t *testing.T) {
+	enableFreezeOnCrashLoop(t, time.Hour)
+	host := newTestRegistry(t, "app", "1.0.0", "1.1.0", "1.2.0")
+	primary := newFreezeTestDeployment(host + "/app:1.1.0")
+	u, clientset := newTestUpdater(primary, newCanaryDeployment(host+"/app:1.2.0", rollingStatus))
+	ctx := context.Background()
+	primary.Annotations[config.AnnotationCanary] = "app-canary"
+	(&canaryState{Images: map[string]string{"app": host + "/app:1.2.0"}, StartedAt: u.clock.Now()}).save(primary.Annotations)
+	primary.Annotations[config.AnnotationCrashLoopWatchUntil] = u.clock.Now().Add(time.Hour).Format(time.RFC3339)
+	_, err := clientset.AppsV1().Deployments("default").Update(ctx, primary, metav1.UpdateOptions{})
+	require.NoError(t, err)
+	createWaitingPod(t, clientset, "new", host+"/app:1.1.0", crashLoopReason)
+
+	// The primary crash looping on its last rollout freezes rollouts while its canary is in progress
+	require.NoError(t, u.updateDeployments(ctx))
+	state := Frozen()
+	require.NotNil(t, state)
+	assert.Equal(t, "app", state.Name)
+	deploy, err := clientset.AppsV1().Deployments("default").Get(ctx, "app", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, config.StatusCanaryInProgress, deploy.Annotations[config.AnnotationStatus])
+}
+
+func TestFreezeSurvivesRestart(t *testing.T) {
+	enableFreezeOnCrashLoop(t, time.Hour)
+	clientset := fake.NewSimpleClientset()
+	client := k8s.NewClient(clientset)
+	ctx := context.Background()
+	restart := func() {
+		freeze.state, freeze.watches, freeze.client = nil, nil, nil
+		require.NoError(t, LoadFreeze(ctx, client, "kube-system", "freeze"))
+	}
+
+	restart()
+	assert.Nil(t, Frozen())
+	require.True(t, freezeRollouts("watch", FreezeState{Reason: "crash loop", Kind: "deployment", Namespace: "default", Name: "app"}))
+	cm, err := clientset.CoreV1().ConfigMaps("kube-system").Get(ctx, "freeze", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Contains(t, cm.Data[freezeStateKey], "crash loop")
+
+	// A restart keeps rollouts frozen and remembers the watch that froze them
+	restart()
+	state := Frozen()
+	require.NotNil(t, state)
+	assert.Equal(t, "crash loop", state.Reason)
+
+	// Clearing the saved freeze failing keeps rollouts frozen
+	clientset.PrependReactor("update", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("forbidden")
+	})
+	_, err = Unfreeze()
+	assert.ErrorContains(t, err, "forbidden")
+	assert.NotNil(t, Frozen())
+
+	clientset.ReactionChain = clientset.ReactionChain[1:]
+	unfrozen, err := Unfreeze()
+	require.NoError(t, err)
+	assert.Equal(t, state, unfrozen)
+	restart()
+	assert.Nil(t, Frozen())
+	assert.False(t, freezeRollouts("watch", FreezeState{Reason: "crash loop"}))
+}
+
+func TestFreezePrunesExpiredWatches(t *testing.T) {
+	enableFreezeOnCrashLoop(t, time.Hour)
+	clientset := fake.NewSimpleClientset()
+	ctx := context.Background()
+	freeze.state, freeze.watches = nil, nil
+	require.NoError(t, LoadFreeze(ctx, k8s.NewClient(clientset), "kube-system", "freeze"))
+	now := time.Now().UTC()
+	expired := "prod/deployment/default/old@" + now.Add(-time.Minute).Format(time.RFC3339)
+	live := "prod/deployment/default/app@" + now.Add(time.Hour).Format(time.RFC3339)
+	watches := func() string {
+		cm, err := clientset.CoreV1().ConfigMaps("kube-system").Get(ctx, "freeze", metav1.GetOptions{})
+		require.NoError(t, err)
+		return cm.Data[freezeWatchesKey]
+	}
+
+	require.True(t, freezeRollouts(expired, FreezeState{Since: now.Add(-2 * time.Minute), Reason: "crash loop"}))
+	_, err := Unfreeze()
+	require.NoError(t, err)
+	assert.Empty(t, watches())
+
+	// The watch whose grace period ended is dropped, the one still running is kept
+	freeze.watches[expired] = true
+	require.True(t, freezeRollouts(live, FreezeState{Since: now, Reason: "crash loop"}))
+	assert.NotContains(t, watches(), expired)
+	assert.Contains(t, watches(), live)
+}
@@ -0,0 +1,104 @@
+package updater
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/monlor/k8s-image-updater/pkg/hooks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// newHookServer records the payloads posted to it and answers with the status returned by status
+func newHookServer(t *testing.T, status func(phase string) int) (string, func() []hooks.Payload) {
+	var mu sync.Mutex
+	var payloads []hooks.Payload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload hooks.Payload
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+		mu.Lock()
+		payloads = append(payloads, payload)
+		mu.Unlock()
+		w.WriteHeader(status(payload.Phase))
+	}))
+	t.Cleanup(server.Close)
+	return server.URL, func() []hooks.Payload {
+		mu.Lock()
+		defer mu.Unlock()
+		return payloads
+	}
+}
+
+func TestUpdateHooks(t *testing.T) {
+	host := newTestRegistry(t, "app", "1.0.0", "1.1.0")
+	url, payloads := newHookServer(t, func(string) int { return http.StatusOK })
+	u, clientset := newTestUpdater(newTestDeployment(nil, corev1.Container{Name: "app", Image: host + "/app:1.0.0"}))
+	var err error
+	u.hooks, err = hooks.New(&config.Config{PreUpdateHook: url, PostUpdateHook: url})
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	require.NoError(t, u.updateDeployments(ctx))
+	deploy, err := clientset.AppsV1().Deployments("default").Get(ctx, "app", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, host+"/app:1.1.0", deploy.Spec.Template.Spec.Containers[0].Image)
+
+	require.Len(t, payloads(), 2)
+	assert.Equal(t, hooks.PhasePreUpdate, payloads()[0].Phase)
+	assert.Equal(t, hooks.PhasePostUpdate, payloads()[1].Phase)
+	assert.Equal(t, "deployment", payloads()[1].Kind)
+	assert.Equal(t, "default", payloads()[1].Namespace)
+	assert.Equal(t, "app", payloads()[1].Name)
+	assert.Equal(t, []hooks.Change{{Action: "update", Container: "app", OldImage: host + "/app:1.0.0", NewImage: host + "/app:1.1.0", Mode: "release"}}, payloads()[1].Changes)
+
+	// Writes not rolling out pods run no hooks
+	require.NoError(t, u.updateDeployments(ctx))
+	assert.Len(t, payloads(), 2)
+}
+
+func TestUpdateHooksVeto(t *testing.T) {
+	host := newTestRegistry(t, "app", "1.0.0", "1.1.0")
+	url, payloads := newHookServer(t, func(phase string) int {
+		if phase == hooks.PhasePreUpdate {
+			return http.StatusForbidden
+		}
+		return http.StatusOK
+	})
+	u, clientset := newTestUpdater(newTestDeployment(nil, corev1.Container{Name: "app", Image: host + "/app:1.0.0"}))
+	var err error
+	u.hooks, err = hooks.New(&config.Config{PreUpdateHook: url, PostUpdateHook: url})
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	require.NoError(t, u.updateDeployments(ctx))
+	deploy, err := clientset.AppsV1().Deployments("default").Get(ctx, "app", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, host+"/app:1.0.0", deploy.Spec.Template.Spec.Containers[0].Image)
+	// The post-update hook does not run for an aborted update
+	require.Len(t, payloads(), 1)
+	assert.Equal(t, hooks.PhasePreUpdate, payloads()[0].Phase)
+}
+
+func TestUpdateHooksNotifyChannel(t *testing.T) {
+	host := newTestRegistry(t, "app", "1.0.0", "1.1.0")
+	defaultURL, defaultPayloads := newHookServer(t, func(string) int { return http.StatusOK })
+	channelURL, channelPayloads := newHookServer(t, func(string) int { return http.StatusOK })
+	u, _ := newTestUpdater(newTestDeployment(map[string]string{config.AnnotationNotifyChannel: "payments"},
+		corev1.Container{Name: "app", Image: host + "/app:1.0.0"}))
+	var err error
+	u.hooks, err = hooks.New(&config.Config{PostUpdateHook: defaultURL, NotifyChannels: "payments=" + channelURL})
+	require.NoError(t, err)
+
+	require.NoError(t, u.updateDeployments(context.Background()))
+	assert.Empty(t, defaultPayloads())
+	require.Len(t, channelPayloads(), 1)
+	assert.Equal(t, hooks.PhasePostUpdate, channelPayloads()[0].Phase)
+	assert.Equal(t, "payments", channelPayloads()[0].Channel)
+}
@@ -0,0 +1,24 @@
+package updater
+
+import (
+	"context"
+
+	"github.com/monlor/k8s-image-updater/config"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Update the OpenKruise workloads of a kind with auto-update annotations, like statefulsets
+func (u *Updater) updateKruiseWorkloads(ctx context.Context, kind string) error {
+	checkDebugf("Checking %s workloads for updates", kind)
+	kruiseWorkloads, err := u.k8sClient.ListKruiseWorkloads(ctx, kind, metav1.NamespaceAll, metav1.ListOptions{
+		LabelSelector: config.LabelEnabled + "=true",
+	})
+	if err != nil {
+		return err
+	}
+	workloads := make([]workload, len(kruiseWorkloads))
+	for i := range kruiseWorkloads {
+		workloads[i] = kruiseWorkload{&kruiseWorkloads[i]}
+	}
+	return u.updateWorkloads(ctx, kind, workloads)
+}
@@ -0,0 +1,91 @@
+package updater
+
+import (
+	"context"
+	"testing"
+
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/monlor/k8s-image-updater/pkg/k8s"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+// newTestKruiseWorkload returns an enabled OpenKruise workload in release mode running image
+func newTestKruiseWorkload(kind, apiVersion, name, image string, updateStrategy map[string]interface{}) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": apiVersion,
+		"kind":       kind,
+		"metadata": map[string]interface{}{
+			"name":        name,
+			"namespace":   "default",
+			"labels":      map[string]interface{}{config.LabelEnabled: "true"},
+			"annotations": map[string]interface{}{config.AnnotationMode: "release"},
+		},
+		"spec": map[string]interface{}{
+			"replicas":       int64(3),
+			"selector":       map[string]interface{}{"matchLabels": map[string]interface{}{"app": name}},
+			"updateStrategy": updateStrategy,
+			"template": map[string]interface{}{
+				"metadata": map[string]interface{}{"labels": map[string]interface{}{"app": name}},
+				"spec": map[string]interface{}{
+					"containers": []interface{}{map[string]interface{}{"name": "app", "image": image}},
+				},
+			},
+		},
+	}}
+}
+
+func TestKruiseWorkloads(t *testing.T) {
+	host := newTestRegistry(t, "app", "1.0.0", "1.1.0")
+	old := config.GlobalConfig.EnableKruise
+	config.GlobalConfig.EnableKruise = true
+	t.Cleanup(func() { config.GlobalConfig.EnableKruise = old })
+	ctx := context.Background()
+
+	cloneSetGVR := k8s.KruiseResources[k8s.KindCloneSet]
+	statefulSetGVR := k8s.KruiseResources[k8s.KindAdvancedStatefulSet]
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		cloneSetGVR:    "CloneSetList",
+		statefulSetGVR: "StatefulSetList",
+	},
+		newTestKruiseWorkload("CloneSet", "apps.kruise.io/v1alpha1", "web", host+"/app:1.0.0",
+			map[string]interface{}{"type": "InPlaceIfPossible", "partition": int64(1)}),
+		newTestKruiseWorkload("StatefulSet", "apps.kruise.io/v1beta1", "db", host+"/app:1.0.0",
+			map[string]interface{}{"rollingUpdate": map[string]interface{}{"paused": true}}),
+	)
+	u, _ := newTestUpdater()
+	u.k8sClient.SetDynamicClient(dynamicClient)
+
+	require.NoError(t, u.CheckAndUpdate(ctx))
+
+	// The CloneSet gets the new image, its other fields are kept
+	web, err := dynamicClient.Resource(cloneSetGVR).Namespace("default").Get(ctx, "web", metav1.GetOptions{})
+	require.NoError(t, err)
+	containers, _, err := unstructured.NestedSlice(web.Object, "spec", "template", "spec", "containers")
+	require.NoError(t, err)
+	require.Len(t, containers, 1)
+	assert.Equal(t, host+"/app:1.1.0", containers[0].(map[string]interface{})["image"])
+	partition, _, _ := unstructured.NestedInt64(web.Object, "spec", "updateStrategy", "partition")
+	assert.Equal(t, int64(1), partition)
+	replicas, _, _ := unstructured.NestedInt64(web.Object, "spec", "replicas")
+	assert.Equal(t, int64(3), replicas)
+	assert.Equal(t, "release", web.GetAnnotations()[config.AnnotationMode])
+
+	// The paused Advanced StatefulSet is skipped
+	db, err := dynamicClient.Resource(statefulSetGVR).Namespace("default").Get(ctx, "db", metav1.GetOptions{})
+	require.NoError(t, err)
+	containers, _, err = unstructured.NestedSlice(db.Object, "spec", "template", "spec", "containers")
+	require.NoError(t, err)
+	assert.Equal(t, host+"/app:1.0.0", containers[0].(map[string]interface{})["image"])
+
+	// The workloads are read back like the built-in kinds
+	workload, err := u.k8sClient.GetKruiseWorkload(ctx, k8s.KindCloneSet, "default", "web")
+	require.NoError(t, err)
+	assert.Equal(t, host+"/app:1.1.0", workload.Template.Spec.Containers[0].Image)
+	assert.False(t, workload.Paused)
+}
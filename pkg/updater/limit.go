@@ -0,0 +1,184 @@
+package updater
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/monlor/k8s-image-updater/pkg/audit"
+	"github.com/monlor/k8s-image-updater/pkg/hooks"
+	"github.com/monlor/k8s-image-updater/pkg/metrics"
+	"github.com/sirupsen/logrus"
+)
+
+// pendingUpdate is a resource write that rolls out new pods, held back to respect MAX_UPDATES_PER_CYCLE
+type pendingUpdate struct {
+	kind      string
+	namespace string
+	name      string
+	update    func() error
+	// Audit entries recorded once the update is applied
+	entries []audit.Entry
+	// Whether the write rolls out new pods, only rollouts run the update hooks
+	rollout bool
+	// Notify-channel annotation of the resource, routing its notifications
+	channel string
+}
+
+func (p pendingUpdate) key() string {
+	return fmt.Sprintf("%s/%s/%s", p.kind, p.namespace, p.name)
+}
+
+// applyUpdate writes a resource, or queues the write when it rolls out pods and updates are limited
+func (u *Updater) applyUpdate(ctx context.Context, rollout bool, kind, namespace, name string, annotations map[string]string, entries []audit.Entry, update func() error) {
+	p := pendingUpdate{kind: kind, namespace: namespace, name: name, update: update, entries: entries, rollout: rollout,
+		channel: annotations[config.AnnotationNotifyChannel]}
+	if rollout && u.limitUpdates {
+		u.mu.Lock()
+		u.pending = append(u.pending, p)
+		u.mu.Unlock()
+		return
+	}
+	u.apply(ctx, p)
+}
+
+// apply writes a resource, running the update hooks around rollouts
+func (u *Updater) apply(ctx context.Context, p pendingUpdate) {
+	if p.rollout && u.rolloutFrozen(ctx, p) {
+		return
+	}
+	defer u.applySlot()()
+	if p.rollout {
+		if !u.paceRollout(ctx) {
+			logrus.Warnf("Not updating %s %s/%s, the check ended while waiting UPDATE_PACING_DELAY: %v", p.kind, p.namespace, p.name, ctx.Err())
+			return
+		}
+		// Rollouts may have been frozen while waiting for the slot or the pacing delay
+		if u.rolloutFrozen(ctx, p) {
+			return
+		}
+	}
+	runHooks := p.rollout && u.hooks != nil
+	if runHooks {
+		if err := u.hooks.PreUpdate(ctx, p.hookPayload()); err != nil {
+			u.resourceErrorf("Not updating %s %s/%s, pre-update hook failed: %v", p.kind, p.namespace, p.name, err)
+			return
+		}
+	}
+
+	checkDebugf("Updating %s %s/%s", p.kind, p.namespace, p.name)
+	if err := p.update(); err != nil {
+		u.resourceErrorf("Failed to update %s %s/%s: %v", p.kind, p.namespace, p.name, err)
+		u.recordApplyFailure(ctx, p, err)
+		return
+	}
+	u.mu.Lock()
+	delete(u.applyFailures, p.key())
+	u.recordAppliedImages(p)
+	if p.rollout {
+		u.stats.updated++
+		payload := p.hookPayload()
+		u.stats.updates = append(u.stats.updates, hooks.CycleUpdate{Kind: p.kind, Namespace: p.namespace, Name: p.name, Changes: payload.Changes})
+	}
+	u.mu.Unlock()
+	logAuditEntries(p.entries)
+
+	if runHooks {
+		if err := u.hooks.PostUpdate(ctx, p.hookPayload()); err != nil {
+			logrus.Errorf("Post-update hook of %s %s/%s failed: %v", p.kind, p.namespace, p.name, err)
+		}
+	}
+}
+
+// applySlot waits for one of the APPLY_CONCURRENCY slots of the running cycle to write a resource, and returns
+// the func releasing it. Writes outside a cycle, like those of the API, are not limited.
+func (u *Updater) applySlot() func() {
+	slots := u.applySlots
+	if slots == nil {
+		return func() {}
+	}
+	slots <- struct{}{}
+	return func() { <-slots }
+}
+
+// rolloutFrozen reports whether rollouts are frozen, logging that the rollout of p is held back
+func (u *Updater) rolloutFrozen(ctx context.Context, p pendingUpdate) bool {
+	state := Frozen()
+	if state == nil {
+		return false
+	}
+	checkInfof("Not updating %s %s/%s, rollouts are frozen since %s: %s", p.kind, p.namespace, p.name, state.Since.UTC().Format(time.RFC3339), state.Reason)
+	countSkipped(ctx, metrics.SkipReasonFrozen)
+	return true
+}
+
+// paceRollout reserves the time of the next rollout of this check, UPDATE_PACING_DELAY after the one reserved
+// before, and waits for it. Rollouts written at once with APPLY_CONCURRENCY are staggered as well. It returns
+// false when ctx is done first.
+func (u *Updater) paceRollout(ctx context.Context) bool {
+	delay := config.Tuning().UpdatePacingDelay
+	now := u.clock.Now()
+	u.mu.Lock()
+	at := now
+	if u.stats.nextRollout.After(now) {
+		at = u.stats.nextRollout
+	}
+	u.stats.nextRollout = at.Add(delay)
+	u.mu.Unlock()
+	wait := at.Sub(now)
+	if delay <= 0 || wait <= 0 {
+		return true
+	}
+	checkDebugf("Waiting %s before the next rollout", wait)
+	select {
+	case <-ctx.Done():
+		return false
+	case <-u.clock.After(wait):
+		return true
+	}
+}
+
+// hookPayload describes the update to the update hooks
+func (p pendingUpdate) hookPayload() hooks.Payload {
+	payload := hooks.Payload{Kind: p.kind, Namespace: p.namespace, Name: p.name, Channel: p.channel}
+	for _, entry := range p.entries {
+		payload.Changes = append(payload.Changes, hooks.Change{
+			Action:    entry.Action,
+			Container: entry.Container,
+			OldImage:  entry.OldImage,
+			NewImage:  entry.NewImage,
+			Mode:      entry.Mode,
+		})
+	}
+	return payload
+}
+
+// applyPending applies at most limit queued rollouts. Resources deferred by the previous cycle go first,
+// then kind, namespace and name order, so a resource updating every cycle cannot starve the others.
+// The checks of the cycle are done, nothing else touches the queue.
+func (u *Updater) applyPending(ctx context.Context, limit int) {
+	pending := u.pending
+	u.pending = nil
+	slices.SortFunc(pending, func(a, b pendingUpdate) int {
+		if deferredA, deferredB := u.deferred[a.key()], u.deferred[b.key()]; deferredA != deferredB {
+			if deferredA {
+				return -1
+			}
+			return 1
+		}
+		return cmp.Or(cmp.Compare(a.kind, b.kind), cmp.Compare(a.namespace, b.namespace), cmp.Compare(a.name, b.name))
+	})
+
+	u.deferred = make(map[string]bool)
+	for i, p := range pending {
+		if i < limit {
+			u.apply(ctx, p)
+			continue
+		}
+		checkInfof("Deferring update of %s %s/%s to the next cycle, MAX_UPDATES_PER_CYCLE=%d reached", p.kind, p.namespace, p.name, limit)
+		u.deferred[p.key()] = true
+	}
+}
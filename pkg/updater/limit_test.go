@@ -0,0 +1,281 @@
+package updater
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ggcrregistry "github.com/google/go-containerregistry/pkg/registry"
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/monlor/k8s-image-updater/pkg/clock"
+	"github.com/monlor/k8s-image-updater/pkg/hooks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestMaxUpdatesPerCycle(t *testing.T) {
+	host := newTestRegistry(t, "app", "1.0.0", "1.1.0")
+	setTuning(t, func(tuning *config.Tunables) { tuning.MaxUpdatesPerCycle = 2 })
+
+	var objects []runtime.Object
+	for _, name := range []string{"c", "a", "b"} {
+		deploy := newTestDeployment(nil, corev1.Container{Name: "app", Image: host + "/app:1.0.0"})
+		deploy.Name = name
+		objects = append(objects, deploy)
+	}
+	deploy := newTestDeployment(nil, corev1.Container{Name: "app", Image: host + "/app:1.0.0"})
+	objects = append(objects, &appsv1.StatefulSet{ObjectMeta: deploy.ObjectMeta, Spec: appsv1.StatefulSetSpec{Template: deploy.Spec.Template}})
+	u, clientset := newTestUpdater(objects...)
+	ctx := context.Background()
+
+	images := func() map[string]string {
+		result := make(map[string]string)
+		deployments, err := clientset.AppsV1().Deployments("default").List(ctx, metav1.ListOptions{})
+		require.NoError(t, err)
+		for _, deploy := range deployments.Items {
+			result["deployment/"+deploy.Name] = deploy.Spec.Template.Spec.Containers[0].Image
+		}
+		sts, err := clientset.AppsV1().StatefulSets("default").Get(ctx, "app", metav1.GetOptions{})
+		require.NoError(t, err)
+		result["statefulset/app"] = sts.Spec.Template.Spec.Containers[0].Image
+		return result
+	}
+
+	// Only the first two in kind, namespace and name order are rolled out
+	require.NoError(t, u.CheckAndUpdate(ctx))
+	assert.Equal(t, map[string]string{
+		"deployment/a":    host + "/app:1.1.0",
+		"deployment/b":    host + "/app:1.1.0",
+		"deployment/c":    host + "/app:1.0.0",
+		"statefulset/app": host + "/app:1.0.0",
+	}, images())
+
+	// A new release makes a and b pending again, the resources deferred last cycle go first
+	pushTestImage(t, host+"/app:1.2.0")
+	require.NoError(t, u.CheckAndUpdate(ctx))
+	assert.Equal(t, map[string]string{
+		"deployment/a":    host + "/app:1.1.0",
+		"deployment/b":    host + "/app:1.1.0",
+		"deployment/c":    host + "/app:1.2.0",
+		"statefulset/app": host + "/app:1.2.0",
+	}, images())
+
+	require.NoError(t, u.CheckAndUpdate(ctx))
+	assert.Equal(t, map[string]string{
+		"deployment/a":    host + "/app:1.2.0",
+		"deployment/b":    host + "/app:1.2.0",
+		"deployment/c":    host + "/app:1.2.0",
+		"statefulset/app": host + "/app:1.2.0",
+	}, images())
+}
+
+func TestMaxUpdatesPerCycleStatusNotLimited(t *testing.T) {
+	host := newTestRegistry(t, "app", "1.0.0", "1.1.0")
+	setTuning(t, func(tuning *config.Tunables) { tuning.MaxUpdatesPerCycle = 1 })
+
+	var objects []runtime.Object
+	for _, name := range []string{"a", "b"} {
+		deploy := newTestDeployment(map[string]string{
+			config.AnnotationAllowTags: "regexp:^2\\.",
+		}, corev1.Container{Name: "app", Image: host + "/app:1.0.0"})
+		deploy.Name = name
+		objects = append(objects, deploy)
+	}
+	u, clientset := newTestUpdater(objects...)
+	ctx := context.Background()
+
+	// Status-only writes do not restart pods and are not capped
+	require.NoError(t, u.CheckAndUpdate(ctx))
+	for _, name := range []string{"a", "b"} {
+		deploy, err := clientset.AppsV1().Deployments("default").Get(ctx, name, metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, config.StatusNoMatchingTags, deploy.Annotations[config.AnnotationStatus])
+	}
+}
+
+func TestUpdatePacingDelay(t *testing.T) {
+	host := newTestRegistry(t, "app", "1.0.0", "1.1.0")
+	setTuning(t, func(tuning *config.Tunables) { tuning.UpdatePacingDelay = 30 * time.Second })
+
+	newUpdater := func() (*Updater, *clock.Fake, func() int) {
+		var objects []runtime.Object
+		for _, name := range []string{"a", "b", "c"} {
+			deploy := newTestDeployment(nil, corev1.Container{Name: "app", Image: host + "/app:1.0.0"})
+			deploy.Name = name
+			objects = append(objects, deploy)
+		}
+		u, clientset := newTestUpdater(objects...)
+		fakeClock := clock.NewFake(time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC))
+		u.clock = fakeClock
+		updated := func() int {
+			deployments, err := clientset.AppsV1().Deployments("default").List(context.Background(), metav1.ListOptions{})
+			require.NoError(t, err)
+			count := 0
+			for _, deploy := range deployments.Items {
+				if deploy.Spec.Template.Spec.Containers[0].Image == host+"/app:1.1.0" {
+					count++
+				}
+			}
+			return count
+		}
+		return u, fakeClock, updated
+	}
+	waiting := func(fakeClock *clock.Fake) {
+		require.Eventually(t, func() bool { return fakeClock.Waiters() == 1 }, 5*time.Second, time.Millisecond)
+	}
+
+	t.Run("paced", func(t *testing.T) {
+		u, fakeClock, updated := newUpdater()
+		done := make(chan error)
+		go func() { done <- u.updateDeployments(context.Background()) }()
+
+		// The first rollout is not delayed, the next ones wait the full delay after the previous one
+		waiting(fakeClock)
+		assert.Equal(t, 1, updated())
+		fakeClock.Advance(29 * time.Second)
+		assert.Equal(t, 1, fakeClock.Waiters())
+		assert.Equal(t, 1, updated())
+		fakeClock.Advance(time.Second)
+
+		waiting(fakeClock)
+		assert.Equal(t, 2, updated())
+		fakeClock.Advance(30 * time.Second)
+
+		require.NoError(t, <-done)
+		assert.Equal(t, 3, updated())
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		setTuning(t, func(tuning *config.Tunables) { tuning.RegistryQueryConcurrency = 3 })
+		u, fakeClock, updated := newUpdater()
+		done := make(chan error)
+		go func() { done <- u.updateDeployments(context.Background()) }()
+
+		// Rollouts ready at once are still staggered by the delay
+		require.Eventually(t, func() bool { return updated() == 1 && fakeClock.Waiters() == 2 }, 5*time.Second, time.Millisecond)
+		fakeClock.Advance(30 * time.Second)
+		require.Eventually(t, func() bool { return updated() == 2 && fakeClock.Waiters() == 1 }, 5*time.Second, time.Millisecond)
+		fakeClock.Advance(29 * time.Second)
+		assert.Equal(t, 2, updated())
+		fakeClock.Advance(time.Second)
+
+		require.NoError(t, <-done)
+		assert.Equal(t, 3, updated())
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		u, fakeClock, updated := newUpdater()
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() { done <- u.updateDeployments(ctx) }()
+
+		waiting(fakeClock)
+		cancel()
+		assert.ErrorIs(t, <-done, context.Canceled)
+		assert.Equal(t, 1, updated())
+	})
+}
+
+func TestApplyFrozenWhileWaiting(t *testing.T) {
+	enableFreezeOnCrashLoop(t, time.Hour)
+	setTuning(t, func(tuning *config.Tunables) { tuning.UpdatePacingDelay = 30 * time.Second })
+	u, _ := newTestUpdater()
+	fakeClock := clock.NewFake(time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC))
+	u.clock = fakeClock
+	u.stats.nextRollout = fakeClock.Now().Add(30 * time.Second)
+
+	written := false
+	done := make(chan struct{})
+	go func() {
+		u.apply(context.Background(), pendingUpdate{kind: "deployment", namespace: "default", name: "app", rollout: true,
+			update: func() error { written = true; return nil }})
+		close(done)
+	}()
+
+	// Rollouts are frozen while the write waits for its turn
+	require.Eventually(t, func() bool { return fakeClock.Waiters() == 1 }, 5*time.Second, time.Millisecond)
+	require.True(t, freezeRollouts("watch", FreezeState{Reason: "crash loop", Kind: "deployment", Namespace: "default", Name: "other"}))
+	fakeClock.Advance(30 * time.Second)
+	<-done
+	assert.False(t, written)
+}
+
+// inFlight counts the calls running at once, keeping the most seen
+type inFlight struct {
+	running, max atomic.Int32
+}
+
+func (f *inFlight) track(delay time.Duration) {
+	running := f.running.Add(1)
+	defer f.running.Add(-1)
+	for {
+		if most := f.max.Load(); running <= most || f.max.CompareAndSwap(most, running) {
+			break
+		}
+	}
+	time.Sleep(delay)
+}
+
+func TestRegistryQueryAndApplyConcurrency(t *testing.T) {
+	setTuning(t, func(tuning *config.Tunables) {
+		tuning.RegistryQueryConcurrency = 4
+		tuning.ApplyConcurrency = 2
+	})
+
+	// Tag lists and the pre-update hook, run before every write, are slow enough to overlap
+	var queries, applies inFlight
+	registryHandler := ggcrregistry.New(ggcrregistry.Logger(log.New(io.Discard, "", 0)))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/tags/list") {
+			queries.track(50 * time.Millisecond)
+		}
+		registryHandler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+	hookServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		applies.track(50 * time.Millisecond)
+	}))
+	defer hookServer.Close()
+
+	// Every resource has its own repository, tags listed once per cycle are not shared
+	var objects []runtime.Object
+	for i := range 8 {
+		repository := fmt.Sprintf("app%d", i)
+		pushTestImage(t, host+"/"+repository+":1.0.0")
+		pushTestImage(t, host+"/"+repository+":1.1.0")
+		deploy := newTestDeployment(nil, corev1.Container{Name: "app", Image: host + "/" + repository + ":1.0.0"})
+		deploy.Name = repository
+		objects = append(objects, deploy)
+	}
+	u, clientset := newTestUpdater(objects...)
+	var err error
+	u.hooks, err = hooks.New(&config.Config{PreUpdateHook: hookServer.URL})
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	require.NoError(t, u.CheckAndUpdate(ctx))
+	deployments, err := clientset.AppsV1().Deployments("default").List(ctx, metav1.ListOptions{})
+	require.NoError(t, err)
+	require.Len(t, deployments.Items, 8)
+	for _, deploy := range deployments.Items {
+		assert.Equal(t, host+"/"+deploy.Name+":1.1.0", deploy.Spec.Template.Spec.Containers[0].Image)
+	}
+	assert.Equal(t, 8, u.stats.checked)
+	assert.Equal(t, 8, u.stats.updated)
+
+	assert.Greater(t, queries.max.Load(), int32(1))
+	assert.LessOrEqual(t, queries.max.Load(), int32(4))
+	assert.LessOrEqual(t, applies.max.Load(), int32(2))
+}
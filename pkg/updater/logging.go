@@ -0,0 +1,53 @@
+package updater
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/monlor/k8s-image-updater/pkg/hooks"
+	"github.com/sirupsen/logrus"
+)
+
+// cycleStats counts what a check cycle did, for its LOG_SUMMARY_ONLY summary and CYCLE_WEBHOOK_URL
+type cycleStats struct {
+	// Resources enabled for auto-update that were checked
+	checked int
+	// Writes rolling out new pods
+	updated int
+	// Earliest time of the next rollout, UPDATE_PACING_DELAY after the previous one, also a failed one
+	nextRollout time.Time
+	// Errors logged while checking or writing resources
+	errors int
+	// Resources rolled out and error messages, sent to CYCLE_WEBHOOK_URL
+	updates  []hooks.CycleUpdate
+	messages []string
+}
+
+// fullLog reports whether the per-resource lines of a check cycle are logged, always at the debug level
+func fullLog() bool {
+	return !config.Tuning().LogSummaryOnly || logrus.IsLevelEnabled(logrus.DebugLevel)
+}
+
+// checkDebugf logs a detail of a check cycle, dropped with LOG_SUMMARY_ONLY unless at the debug level
+func checkDebugf(format string, args ...interface{}) {
+	if fullLog() {
+		logrus.Debugf(format, args...)
+	}
+}
+
+// checkInfof logs a routine event of the check of a resource, dropped with LOG_SUMMARY_ONLY unless at the debug level
+func checkInfof(format string, args ...interface{}) {
+	if fullLog() {
+		logrus.Infof(format, args...)
+	}
+}
+
+// resourceErrorf logs an error of the check or write of a resource, counted in the cycle summary
+func (u *Updater) resourceErrorf(format string, args ...interface{}) {
+	u.mu.Lock()
+	u.stats.errors++
+	u.stats.messages = append(u.stats.messages, fmt.Sprintf(format, args...))
+	u.mu.Unlock()
+	logrus.Errorf(format, args...)
+}
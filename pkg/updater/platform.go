@@ -0,0 +1,61 @@
+package updater
+
+import (
+	"slices"
+
+	"github.com/monlor/k8s-image-updater/config"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// resolvePlatform returns the platform, e.g. linux/arm64, whose digest is tracked in digest and latest mode.
+// The platform annotation comes first, then the architecture the pods are constrained to by their nodeSelector
+// or required node affinity, then DEFAULT_PLATFORM. An empty platform tracks the digest of the whole image.
+func resolvePlatform(annotations map[string]string, podSpec *corev1.PodSpec) string {
+	if platform := annotations[config.AnnotationPlatform]; platform != "" {
+		return platform
+	}
+
+	arch := nodeConstraint(podSpec, corev1.LabelArchStable)
+	if arch != "" {
+		nodeOS := nodeConstraint(podSpec, corev1.LabelOSStable)
+		if nodeOS == "" {
+			nodeOS = "linux"
+		}
+		return nodeOS + "/" + arch
+	}
+	return config.GlobalConfig.DefaultPlatform
+}
+
+// nodeConstraint returns the single value a node label must have for the pods to be scheduled,
+// or an empty string when several values are allowed
+func nodeConstraint(podSpec *corev1.PodSpec, label string) string {
+	if value := podSpec.NodeSelector[label]; value != "" {
+		return value
+	}
+	if podSpec.Affinity == nil || podSpec.Affinity.NodeAffinity == nil || podSpec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		return ""
+	}
+
+	// Terms are ORed, so every term must narrow the label down to the same value
+	var values []string
+	for _, term := range podSpec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms {
+		var termValues []string
+		for _, expr := range term.MatchExpressions {
+			if expr.Key == label && expr.Operator == corev1.NodeSelectorOpIn {
+				termValues = expr.Values
+			}
+		}
+		if len(termValues) == 0 {
+			return ""
+		}
+		for _, value := range termValues {
+			if !slices.Contains(values, value) {
+				values = append(values, value)
+			}
+		}
+	}
+	if len(values) != 1 {
+		return ""
+	}
+	return values[0]
+}
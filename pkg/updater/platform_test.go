@@ -0,0 +1,124 @@
+package updater
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/monlor/k8s-image-updater/pkg/registry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Require nodes with one of the values for a label, one node selector term per set of values
+func requiredNodeAffinity(label string, terms ...[]string) *corev1.Affinity {
+	selector := &corev1.NodeSelector{}
+	for _, values := range terms {
+		selector.NodeSelectorTerms = append(selector.NodeSelectorTerms, corev1.NodeSelectorTerm{
+			MatchExpressions: []corev1.NodeSelectorRequirement{{Key: label, Operator: corev1.NodeSelectorOpIn, Values: values}},
+		})
+	}
+	return &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{RequiredDuringSchedulingIgnoredDuringExecution: selector}}
+}
+
+func TestResolvePlatform(t *testing.T) {
+	oldPlatform := config.GlobalConfig.DefaultPlatform
+	config.GlobalConfig.DefaultPlatform = "linux/amd64"
+	defer func() { config.GlobalConfig.DefaultPlatform = oldPlatform }()
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		podSpec     corev1.PodSpec
+		want        string
+	}{
+		{"default", nil, corev1.PodSpec{}, "linux/amd64"},
+		{"annotation", map[string]string{config.AnnotationPlatform: "linux/arm/v7"}, corev1.PodSpec{NodeSelector: map[string]string{corev1.LabelArchStable: "arm64"}}, "linux/arm/v7"},
+		{"node selector", nil, corev1.PodSpec{NodeSelector: map[string]string{corev1.LabelArchStable: "arm64"}}, "linux/arm64"},
+		{"node selector os", nil, corev1.PodSpec{NodeSelector: map[string]string{corev1.LabelArchStable: "amd64", corev1.LabelOSStable: "windows"}}, "windows/amd64"},
+		{"affinity", nil, corev1.PodSpec{Affinity: requiredNodeAffinity(corev1.LabelArchStable, []string{"arm64"})}, "linux/arm64"},
+		{"affinity terms agree", nil, corev1.PodSpec{Affinity: requiredNodeAffinity(corev1.LabelArchStable, []string{"arm64"}, []string{"arm64"})}, "linux/arm64"},
+		{"affinity several archs", nil, corev1.PodSpec{Affinity: requiredNodeAffinity(corev1.LabelArchStable, []string{"arm64", "amd64"})}, "linux/amd64"},
+		{"affinity term without arch", nil, corev1.PodSpec{Affinity: requiredNodeAffinity(corev1.LabelArchStable, []string{"arm64"}, nil)}, "linux/amd64"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, resolvePlatform(tt.annotations, &tt.podSpec))
+		})
+	}
+
+	config.GlobalConfig.DefaultPlatform = ""
+	assert.Empty(t, resolvePlatform(nil, &corev1.PodSpec{}))
+}
+
+// Push a multi-platform image with an amd64 and an arm64 manifest, returning the digests of the index and arm64 image
+func pushTestIndex(t *testing.T, image string) (string, string) {
+	index := v1.ImageIndex(empty.Index)
+	var armDigest string
+	for _, arch := range []string{"amd64", "arm64"} {
+		img, err := random.Image(256, 1)
+		require.NoError(t, err)
+		index = mutate.AppendManifests(index, mutate.IndexAddendum{
+			Add:        img,
+			Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: arch}},
+		})
+		if arch == "arm64" {
+			digest, err := img.Digest()
+			require.NoError(t, err)
+			armDigest = digest.String()
+		}
+	}
+	ref, err := name.ParseReference(image)
+	require.NoError(t, err)
+	require.NoError(t, remote.WriteIndex(ref, index))
+	indexDigest, err := index.Digest()
+	require.NoError(t, err)
+	return indexDigest.String(), armDigest
+}
+
+func TestDigestModeNodePlatform(t *testing.T) {
+	host := newTestRegistry(t, "app")
+	indexDigest, armDigest := pushTestIndex(t, host+"/app:stable")
+	u, _ := newTestUpdater()
+	ctx := context.Background()
+
+	// Without platform the digest of the index is tracked
+	deploy := newTestDeployment(map[string]string{config.AnnotationMode: "digest", config.AnnotationAllowTags: "stable"},
+		corev1.Container{Name: "app", Image: host + "/app:stable"})
+	result, err := u.updateContainerIfNeeded(ctx, &deploy.Spec.Template.Spec.Containers[0], &deploy.Annotations, "default", "app", "deployment", &deploy.Spec.Template)
+	require.NoError(t, err)
+	assert.True(t, result.Changed)
+	assert.Equal(t, actionUpdate, result.Action)
+	assert.Equal(t, host+"/app:stable", result.OldImage)
+	assert.Equal(t, host+"/app@"+indexDigest, result.NewImage)
+	assert.Equal(t, host+"/app@"+indexDigest, deploy.Spec.Template.Spec.Containers[0].Image)
+
+	// Pods pinned to arm64 nodes track the arm64 manifest
+	deploy = newTestDeployment(map[string]string{config.AnnotationMode: "digest", config.AnnotationAllowTags: "stable"},
+		corev1.Container{Name: "app", Image: host + "/app:stable"})
+	deploy.Spec.Template.Spec.NodeSelector = map[string]string{corev1.LabelArchStable: "arm64"}
+	result, err = u.updateContainerIfNeeded(ctx, &deploy.Spec.Template.Spec.Containers[0], &deploy.Annotations, "default", "app", "deployment", &deploy.Spec.Template)
+	require.NoError(t, err)
+	assert.True(t, result.Changed)
+	assert.Equal(t, host+"/app@"+armDigest, result.NewImage)
+	assert.Equal(t, host+"/app@"+armDigest, deploy.Spec.Template.Spec.Containers[0].Image)
+
+	// The arm64 digest is up to date
+	result, err = u.updateContainerIfNeeded(ctx, &deploy.Spec.Template.Spec.Containers[0], &deploy.Annotations, "default", "app", "deployment", &deploy.Spec.Template)
+	require.NoError(t, err)
+	assert.False(t, result.Changed)
+	assert.Equal(t, actionNone, result.Action)
+	assert.Equal(t, "up to date", result.Reason)
+
+	// A platform missing from the image is an error
+	_, err = registry.NewRegistryClient("", "").GetPlatformDigest(ctx, host+"/app:stable", "linux/s390x")
+	assert.ErrorContains(t, err, "no manifest for platform linux/s390x")
+}
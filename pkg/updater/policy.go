@@ -0,0 +1,113 @@
+package updater
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/monlor/k8s-image-updater/pkg/k8s"
+	"github.com/monlor/k8s-image-updater/pkg/registry"
+	"github.com/monlor/k8s-image-updater/pkg/version"
+	"sigs.k8s.io/yaml"
+)
+
+// Key of the POLICY_CONFIGMAP holding the policy
+const policyKey = "policy.yaml"
+
+// PolicyRule sets the mode and allow-tags of the containers whose image matches Image, a glob matched like
+// GLOBAL_IMAGE_EXCLUDES patterns
+type PolicyRule struct {
+	Image     string `json:"image"`
+	Mode      string `json:"mode,omitempty"`
+	AllowTags string `json:"allowTags,omitempty"`
+}
+
+// Policy is the content of the POLICY_CONFIGMAP, the first rule matching the image of a container applies to it
+type Policy struct {
+	Rules []PolicyRule `json:"rules"`
+}
+
+// parsePolicy reads the YAML of a policy, rejecting unknown fields, invalid globs and unknown modes
+func parsePolicy(data string) (*Policy, error) {
+	var policy Policy
+	if err := yaml.UnmarshalStrict([]byte(data), &policy); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", policyKey, err)
+	}
+	for i, rule := range policy.Rules {
+		if _, err := path.Match(rule.Image, ""); rule.Image == "" || err != nil {
+			return nil, fmt.Errorf("rule %d: invalid image pattern %q", i+1, rule.Image)
+		}
+		if rule.Mode != "" && !slices.Contains(version.Modes, rule.Mode) {
+			return nil, fmt.Errorf("rule %d: unknown update mode %q, must be one of %s", i+1, rule.Mode, strings.Join(version.Modes, ", "))
+		}
+	}
+	return &policy, nil
+}
+
+// rule returns the first rule matching an image, nil when none does or there is no policy
+func (p *Policy) rule(image string) *PolicyRule {
+	if p == nil {
+		return nil
+	}
+	for i := range p.Rules {
+		if registry.MatchImage([]string{p.Rules[i].Image}, image) != "" {
+			return &p.Rules[i]
+		}
+	}
+	return nil
+}
+
+// policyAnnotation returns the value of an annotation for a container running an image: the annotation of the container
+// or the resource, else the value the policy sets for the image. Only mode and allow-tags are set by the policy.
+func policyAnnotation(policy *Policy, annotations map[string]string, key, containerName, image string) string {
+	if value := containerAnnotation(annotations, key, containerName); value != "" {
+		return value
+	}
+	rule := policy.rule(image)
+	if rule == nil {
+		return ""
+	}
+	switch key {
+	case config.AnnotationMode:
+		return rule.Mode
+	case config.AnnotationAllowTags:
+		return rule.AllowTags
+	}
+	return ""
+}
+
+// ContainerSettings returns the mode and allow-tags a container running an image is checked with, from the annotations
+// of its resource or else the policy, which may be nil
+func (p *Policy) ContainerSettings(annotations map[string]string, containerName, image string) (mode, allowTags string) {
+	return containerMode(p, annotations, containerName, image), policyAnnotation(p, annotations, config.AnnotationAllowTags, containerName, image)
+}
+
+// ReadPolicy reads the POLICY_CONFIGMAP of a cluster, nil when it is not set
+func ReadPolicy(ctx context.Context, client *k8s.Client) (*Policy, error) {
+	namespace, name, _ := config.GlobalConfig.PolicyConfigMapRef()
+	if name == "" {
+		return nil, nil
+	}
+	configMap, err := client.GetConfigMap(ctx, namespace, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy ConfigMap %s/%s: %v", namespace, name, err)
+	}
+	policy, err := parsePolicy(configMap.Data[policyKey])
+	if err != nil {
+		return nil, fmt.Errorf("invalid policy ConfigMap %s/%s: %v", namespace, name, err)
+	}
+	return policy, nil
+}
+
+// loadPolicy reads the POLICY_CONFIGMAP of the cluster for a check, keeping the previous policy when it cannot be read
+func (u *Updater) loadPolicy(ctx context.Context) {
+	policy, err := ReadPolicy(ctx, u.k8sClient)
+	if err != nil {
+		u.resourceErrorf("Keeping the previous policy%s: %v", u.clusterSuffix(), err)
+		return
+	}
+	u.policy.Store(policy)
+}
@@ -0,0 +1,140 @@
+package updater
+
+import (
+	"context"
+	"testing"
+
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newPolicyConfigMap(policy string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "policy", Namespace: "image-updater"},
+		Data:       map[string]string{policyKey: policy},
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	policy, err := parsePolicy(`
+rules:
+  - image: ghcr.io/org/*
+    mode: digest
+    allowTags: main
+  - image: nginx
+    allowTags: "regexp:^1\\.25\\."
+`)
+	require.NoError(t, err)
+	assert.Equal(t, []PolicyRule{
+		{Image: "ghcr.io/org/*", Mode: "digest", AllowTags: "main"},
+		{Image: "nginx", AllowTags: `regexp:^1\.25\.`},
+	}, policy.Rules)
+
+	policy, err = parsePolicy("")
+	require.NoError(t, err)
+	assert.Empty(t, policy.Rules)
+
+	for data, wantErr := range map[string]string{
+		"rules:\n  - image: nginx\n    tags: main":   "unknown field",
+		"rules:\n  - mode: digest":                   "invalid image pattern",
+		"rules:\n  - image: \"[\"":                   "invalid image pattern",
+		"rules:\n  - image: nginx\n    mode: newest": "unknown update mode",
+	} {
+		_, err := parsePolicy(data)
+		assert.ErrorContains(t, err, wantErr, data)
+	}
+}
+
+func TestPolicyRule(t *testing.T) {
+	policy := &Policy{Rules: []PolicyRule{
+		{Image: "ghcr.io/org/api", Mode: "digest"},
+		{Image: "ghcr.io/org/*", Mode: "alphabetical"},
+		{Image: "docker.io/library/nginx", Mode: "latest"},
+	}}
+	tests := []struct {
+		image    string
+		wantMode string
+	}{
+		// The first matching rule applies
+		{"ghcr.io/org/api:1.0.0", "digest"},
+		{"ghcr.io/org/worker:1.0.0", "alphabetical"},
+		{"ghcr.io/org/team/worker:1.0.0", ""},
+		{"nginx:1.25.0", "latest"},
+		{"ghcr.io/other/api:1.0.0", ""},
+	}
+	for _, tt := range tests {
+		rule := policy.rule(tt.image)
+		if tt.wantMode == "" {
+			assert.Nil(t, rule, tt.image)
+		} else if assert.NotNil(t, rule, tt.image) {
+			assert.Equal(t, tt.wantMode, rule.Mode, tt.image)
+		}
+	}
+	assert.Nil(t, (*Policy)(nil).rule("nginx:1.25.0"))
+}
+
+func TestPolicyAnnotationPrecedence(t *testing.T) {
+	policy := &Policy{Rules: []PolicyRule{{Image: "nginx", Mode: "digest", AllowTags: "stable"}}}
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		wantMode    string
+	}{
+		{"policy", nil, "digest"},
+		{"resource annotation", map[string]string{config.AnnotationMode: "latest"}, "latest"},
+		{"container annotation", map[string]string{config.AnnotationMode: "latest", config.AnnotationMode + ".web": "alphabetical"}, "alphabetical"},
+		{"empty annotation", map[string]string{config.AnnotationMode: ""}, "digest"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.wantMode, containerMode(policy, tt.annotations, "web", "nginx:1.25.0"))
+		})
+	}
+	// Settings the annotations leave out still come from the policy
+	annotations := map[string]string{config.AnnotationMode: "latest"}
+	assert.Equal(t, "stable", policyAnnotation(policy, annotations, config.AnnotationAllowTags, "web", "nginx:1.25.0"))
+	// Without a matching rule DEFAULT_UPDATE_MODE applies
+	assert.Equal(t, config.GlobalConfig.ResourceMode(""), containerMode(policy, nil, "web", "redis:7.0.0"))
+}
+
+func TestPolicyConfigMap(t *testing.T) {
+	old := config.GlobalConfig.PolicyConfigMap
+	config.GlobalConfig.PolicyConfigMap = "image-updater/policy"
+	t.Cleanup(func() { config.GlobalConfig.PolicyConfigMap = old })
+	host := newTestRegistry(t, "app", "1.0.0", "1.1.0", "2.0.0")
+	ctx := context.Background()
+
+	governed := newTestDeployment(map[string]string{}, corev1.Container{Name: "app", Image: host + "/app:1.0.0"})
+	governed.Name = "governed"
+	overridden := newTestDeployment(map[string]string{config.AnnotationAllowTags: `regexp:^2\.`}, corev1.Container{Name: "app", Image: host + "/app:1.0.0"})
+	overridden.Name = "overridden"
+	policyConfigMap := newPolicyConfigMap("rules:\n  - image: " + host + "/app\n    allowTags: \"regexp:^1\\\\.\"\n")
+	u, clientset := newTestUpdater(governed, overridden, policyConfigMap)
+	image := func(name string) string {
+		deploy, err := clientset.AppsV1().Deployments("default").Get(ctx, name, metav1.GetOptions{})
+		require.NoError(t, err)
+		return deploy.Spec.Template.Spec.Containers[0].Image
+	}
+
+	require.NoError(t, u.CheckAndUpdate(ctx))
+	// The policy keeps the governed deployment on 1.x, the annotation of the other one overrides it
+	assert.Equal(t, host+"/app:1.1.0", image("governed"))
+	assert.Equal(t, host+"/app:2.0.0", image("overridden"))
+	require.NotNil(t, u.policy.Load())
+
+	// An invalid policy keeps the previous one
+	policyConfigMap.Data[policyKey] = "rules: [{image: app, mode: newest}]"
+	_, err := clientset.CoreV1().ConfigMaps("image-updater").Update(ctx, policyConfigMap, metav1.UpdateOptions{})
+	require.NoError(t, err)
+	u.loadPolicy(ctx)
+	require.NotNil(t, u.policy.Load())
+	assert.Equal(t, "regexp:^1\\.", u.policy.Load().Rules[0].AllowTags)
+
+	// The policy is dropped once POLICY_CONFIGMAP is unset
+	config.GlobalConfig.PolicyConfigMap = ""
+	u.loadPolicy(ctx)
+	assert.Nil(t, u.policy.Load())
+}
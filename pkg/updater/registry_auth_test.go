@@ -0,0 +1,211 @@
+package updater
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	ggcrregistry "github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// Start an in-memory registry only answering requests with the given basic auth credentials
+func newAuthTestRegistry(t *testing.T, username, password string) string {
+	registryHandler := ggcrregistry.New(ggcrregistry.Logger(log.New(io.Discard, "", 0)))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != username || pass != password {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		registryHandler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	img, err := random.Image(256, 1)
+	require.NoError(t, err)
+	ref, err := name.ParseReference(host + "/app:1.0.0")
+	require.NoError(t, err)
+	require.NoError(t, remote.Write(ref, img, remote.WithAuth(&authn.Basic{Username: username, Password: password})))
+	return host
+}
+
+func newDockerConfigSecret(t *testing.T, name, registry, username, password string) *corev1.Secret {
+	data, err := json.Marshal(map[string]any{
+		"auths": map[string]any{registry: map[string]string{"username": username, "password": password}},
+	})
+	require.NoError(t, err)
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Type:       corev1.SecretTypeDockerConfigJson,
+		Data:       map[string][]byte{corev1.DockerConfigJsonKey: data},
+	}
+}
+
+func TestGetRegistryClientForImageEnvFallback(t *testing.T) {
+	host := newAuthTestRegistry(t, "user", "secret")
+	image := host + "/app:1.0.0"
+
+	oldAuth, oldDockerConfig := config.GlobalConfig.RegistryAuth, config.GlobalConfig.DockerConfigFile
+	defer func() {
+		config.GlobalConfig.RegistryAuth = oldAuth
+		config.GlobalConfig.DockerConfigFile = oldDockerConfig
+	}()
+	envKey := config.RegistryAuthPrefix + strings.NewReplacer(".", "_", ":", "_").Replace(host)
+
+	tests := []struct {
+		name   string
+		env    string
+		secret *corev1.Secret
+		// user:password of the registry in DOCKER_CONFIG_FILE
+		dockerConfig string
+		wantErr      bool
+	}{
+		{name: "anonymous", wantErr: true},
+		{name: "env", env: "user:secret"},
+		{name: "secret over env", env: "user:wrong", secret: newDockerConfigSecret(t, "pull", host, "user", "secret")},
+		{name: "env when secret does not match registry", env: "user:secret", secret: newDockerConfigSecret(t, "pull", "other.io", "user", "wrong")},
+		{name: "docker config file", dockerConfig: "user:secret"},
+		{name: "env over docker config file", env: "user:secret", dockerConfig: "user:wrong"},
+		{name: "docker config file when secret does not match registry", dockerConfig: "user:secret", secret: newDockerConfigSecret(t, "pull", "other.io", "user", "wrong")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.GlobalConfig.RegistryAuth = nil
+			if tt.env != "" {
+				config.GlobalConfig.RegistryAuth = config.ParseRegistryAuth([]string{envKey + "=" + tt.env})
+			}
+			config.GlobalConfig.DockerConfigFile = ""
+			if tt.dockerConfig != "" {
+				path := filepath.Join(t.TempDir(), "config.json")
+				auth := base64.StdEncoding.EncodeToString([]byte(tt.dockerConfig))
+				require.NoError(t, os.WriteFile(path, []byte(`{"auths":{"`+host+`":{"auth":"`+auth+`"}}}`), 0o600))
+				config.GlobalConfig.DockerConfigFile = path
+			}
+			var objects []runtime.Object
+			var secretNames []string
+			if tt.secret != nil {
+				objects = append(objects, tt.secret)
+				secretNames = []string{tt.secret.Name}
+			}
+			u, _ := newTestUpdater(objects...)
+
+			client, err := u.getRegistryClientForImage(context.Background(), image, "default", secretNames, nil)
+			require.NoError(t, err)
+			_, err = client.ListTags(context.Background(), image)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestPullSecretsAnnotation(t *testing.T) {
+	host := newAuthTestRegistry(t, "reader", "read-token")
+	image := host + "/app:1.0.0"
+	u, _ := newTestUpdater(
+		newDockerConfigSecret(t, "push", host, "pusher", "push-token"),
+		newDockerConfigSecret(t, "read-only", host, "reader", "read-token"),
+	)
+	spec := &corev1.PodSpec{ImagePullSecrets: []corev1.LocalObjectReference{{Name: "push"}, {Name: "read-only"}}}
+
+	tests := []struct {
+		name        string
+		annotation  string
+		wantSecrets []string
+		wantUser    string
+	}{
+		{"pod order", "", []string{"push", "read-only"}, "pusher"},
+		{"preferred secret", "read-only", []string{"read-only", "push"}, "reader"},
+		{"secret missing from the pods", " missing, read-only ", []string{"missing", "read-only", "push"}, "reader"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			secretNames := pullSecretNames(map[string]string{config.AnnotationPullSecrets: tt.annotation}, spec)
+			assert.Equal(t, tt.wantSecrets, secretNames)
+
+			client, err := u.getRegistryClientForImage(context.Background(), image, "default", secretNames, nil)
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantUser, client.Username())
+			_, err = client.ListTags(context.Background(), image)
+			assert.Equal(t, tt.wantUser == "reader", err == nil, "%v", err)
+		})
+	}
+}
+
+func TestRegistryTLSAnnotations(t *testing.T) {
+	server := httptest.NewUnstartedServer(ggcrregistry.New(ggcrregistry.Logger(log.New(io.Discard, "", 0))))
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	image := strings.TrimPrefix(server.URL, "https://") + "/app:1.0.0"
+	img, err := random.Image(256, 1)
+	require.NoError(t, err)
+	ref, err := name.ParseReference(image)
+	require.NoError(t, err)
+	require.NoError(t, remote.Write(ref, img, remote.WithTransport(server.Client().Transport)))
+
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	newSecret := func(name string, data map[string][]byte) *corev1.Secret {
+		return &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"}, Data: data}
+	}
+	u, _ := newTestUpdater(
+		newSecret("registry-ca", map[string][]byte{"ca.crt": caPEM}),
+		newSecret("no-ca", map[string][]byte{"tls.crt": caPEM}),
+		newSecret("bad-ca", map[string][]byte{"ca.crt": []byte("not a certificate")}),
+	)
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		wantErr     string
+		// Whether the registry with its self-signed certificate is reached
+		wantReached bool
+	}{
+		{name: "no annotations"},
+		{name: "insecure", annotations: map[string]string{config.AnnotationRegistryInsecure: "true"}, wantReached: true},
+		{name: "not insecure", annotations: map[string]string{config.AnnotationRegistryInsecure: "false"}},
+		{name: "CA secret", annotations: map[string]string{config.AnnotationRegistryCASecret: "registry-ca"}, wantReached: true},
+		{name: "invalid insecure", annotations: map[string]string{config.AnnotationRegistryInsecure: "yes please"}, wantErr: "must be true or false"},
+		{name: "missing CA secret", annotations: map[string]string{config.AnnotationRegistryCASecret: "missing"}, wantErr: "failed to get registry CA secret missing"},
+		{name: "CA secret without ca.crt", annotations: map[string]string{config.AnnotationRegistryCASecret: "no-ca"}, wantErr: "has no ca.crt key"},
+		{name: "CA secret without certificates", annotations: map[string]string{config.AnnotationRegistryCASecret: "bad-ca"}, wantErr: "no certificates"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := u.getRegistryClientForImage(context.Background(), image, "default", nil, tt.annotations)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			_, err = client.GetDigest(context.Background(), image)
+			if tt.wantReached {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, "certificate")
+			}
+		})
+	}
+}
@@ -0,0 +1,25 @@
+package updater
+
+import (
+	"github.com/monlor/k8s-image-updater/config"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// reportAvailableUpdate writes the images an update would roll out to the available-update annotation instead,
+// restoring the pod template and the last digest of latest mode so the resource is left untouched
+func reportAvailableUpdate(annotations, previousAnnotations map[string]string, original, template *corev1.PodTemplateSpec) {
+	available := make(map[string]string)
+	for _, change := range imageChanges(original.Spec.Containers, template.Spec.Containers) {
+		available[change.Container] = change.NewImage
+	}
+	*template = *original
+
+	// A new digest seen in latest mode stays new until it is rolled out
+	if lastDigest, ok := previousAnnotations[config.AnnotationLastDigest]; ok {
+		annotations[config.AnnotationLastDigest] = lastDigest
+	}
+
+	if len(available) > 0 {
+		annotations[config.AnnotationAvailableUpdate] = encodeImages(available)
+	}
+}
@@ -0,0 +1,78 @@
+package updater
+
+import (
+	"context"
+	"testing"
+
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func enableReportOnly(t *testing.T) {
+	old := config.GlobalConfig.ReportOnly
+	config.GlobalConfig.ReportOnly = true
+	t.Cleanup(func() { config.GlobalConfig.ReportOnly = old })
+}
+
+func TestReportOnly(t *testing.T) {
+	enableReportOnly(t)
+	host := newTestRegistry(t, "app", "1.0.0", "1.1.0")
+	u, clientset := newTestUpdater(newTestDeployment(map[string]string{config.AnnotationMode + ".worker": "alphabetical"},
+		corev1.Container{Name: "app", Image: host + "/app:1.0.0"},
+		corev1.Container{Name: "worker", Image: host + "/app:1.1.0"},
+		corev1.Container{Name: "sidecar", Image: host + "/app:1.0.0"}))
+	ctx := context.Background()
+	getDeployment := func() *appsv1.Deployment {
+		deploy, err := clientset.AppsV1().Deployments("default").Get(ctx, "app", metav1.GetOptions{})
+		require.NoError(t, err)
+		return deploy
+	}
+
+	require.NoError(t, u.updateDeployments(ctx))
+	deploy := getDeployment()
+	containers := deploy.Spec.Template.Spec.Containers
+	assert.Equal(t, host+"/app:1.0.0", containers[0].Image)
+	assert.Equal(t, host+"/app:1.1.0", containers[1].Image)
+	assert.Equal(t, host+"/app:1.0.0", containers[2].Image)
+	assert.Equal(t, "app="+host+"/app:1.1.0,sidecar="+host+"/app:1.1.0", deploy.Annotations[config.AnnotationAvailableUpdate])
+
+	// The report is not written again while it stays the same
+	clientset.ClearActions()
+	require.NoError(t, u.updateDeployments(ctx))
+	assert.Empty(t, updateActions(clientset))
+
+	// A newer tag updates the report
+	pushTestImage(t, host+"/app:1.2.0")
+	require.NoError(t, u.updateDeployments(ctx))
+	deploy = getDeployment()
+	assert.Equal(t, "app="+host+"/app:1.2.0,sidecar="+host+"/app:1.2.0,worker="+host+"/app:1.2.0", deploy.Annotations[config.AnnotationAvailableUpdate])
+	assert.Equal(t, host+"/app:1.0.0", deploy.Spec.Template.Spec.Containers[0].Image)
+
+	// Without REPORT_ONLY the images are updated and the report is cleared
+	config.GlobalConfig.ReportOnly = false
+	require.NoError(t, u.updateDeployments(ctx))
+	deploy = getDeployment()
+	assert.Equal(t, host+"/app:1.2.0", deploy.Spec.Template.Spec.Containers[0].Image)
+	assert.NotContains(t, deploy.Annotations, config.AnnotationAvailableUpdate)
+}
+
+func TestReportOnlyLatestMode(t *testing.T) {
+	enableReportOnly(t)
+	host := newTestRegistry(t, "app", "latest")
+	u, clientset := newTestUpdater(newTestDeployment(map[string]string{
+		config.AnnotationMode:       "latest",
+		config.AnnotationLastDigest: "sha256:0000000000000000000000000000000000000000000000000000000000000000",
+	}, corev1.Container{Name: "app", Image: host + "/app:latest", ImagePullPolicy: corev1.PullAlways}))
+	ctx := context.Background()
+
+	// The pods are not restarted and the new digest stays new
+	require.NoError(t, u.updateDeployments(ctx))
+	deploy, err := clientset.AppsV1().Deployments("default").Get(ctx, "app", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.NotContains(t, deploy.Spec.Template.Annotations, config.AnnotationRestart)
+	assert.Equal(t, "sha256:0000000000000000000000000000000000000000000000000000000000000000", deploy.Annotations[config.AnnotationLastDigest])
+}
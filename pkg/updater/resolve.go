@@ -0,0 +1,92 @@
+package updater
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/monlor/k8s-image-updater/pkg/registry"
+)
+
+// ErrUnknownMode is returned when resolving an image in a mode the updater does not have
+var ErrUnknownMode = errors.New("unknown update mode")
+
+// ResolveOptions are the settings an image is resolved with, the values of the annotations of the same name
+type ResolveOptions struct {
+	Mode        string
+	AllowTags   string
+	MinVersion  string
+	PinDigest   bool
+	PreserveTag bool
+	SortOrder   string
+	DateFormat  string
+	Platform    string
+}
+
+// Resolve returns the image the updater would select for image in a mode, the image itself when it is up to date,
+// without reading or changing any resource. Registry credentials come from REGISTRY_AUTH_<registry>.
+// Latest mode resolves the current digest of the tag of image.
+func (u *Updater) Resolve(ctx context.Context, image string, opts ResolveOptions) (string, error) {
+	if !registry.ImageRegistryAllowed(image) {
+		return "", fmt.Errorf("%w: image %s", ErrRegistryNotAllowed, image)
+	}
+	registryClient, err := u.getRegistryClientForImage(ctx, image, "", nil, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to get registry client: %v", err)
+	}
+	var allowTagsFilter string
+	if isTagFilter(opts.AllowTags) {
+		allowTagsFilter = opts.AllowTags
+	}
+
+	var newImage string
+	switch opts.Mode {
+	case "", "release", "review":
+		newImage, _, err = u.checkReleaseMode(ctx, image, registryClient, allowTagsFilter, "", 0, opts.MinVersion, opts.PinDigest, nil)
+	case "digest":
+		tagToCheck := "latest"
+		if opts.AllowTags != "" && allowTagsFilter == "" {
+			tagToCheck = opts.AllowTags
+		}
+		newImage, err = u.checkDigestMode(ctx, image, registryClient, tagToCheck, opts.Platform, opts.PreserveTag, nil)
+	case "latest":
+		newImage, err = resolveLatest(ctx, image, registryClient, opts.Platform)
+	case "alphabetical", "name":
+		newImage, err = u.checkAlphabeticalMode(ctx, image, registryClient, allowTagsFilter, "", 0, opts.SortOrder, nil)
+	case "date":
+		if opts.DateFormat == "" {
+			return "", fmt.Errorf("date mode requires the %s annotation", config.AnnotationDateFormat)
+		}
+		newImage, err = u.checkDateMode(ctx, image, registryClient, allowTagsFilter, "", 0, opts.DateFormat, nil)
+	default:
+		return "", fmt.Errorf("%w %s", ErrUnknownMode, opts.Mode)
+	}
+	if err != nil {
+		return "", err
+	}
+	if newImage == "" {
+		return image, nil
+	}
+	return newImage, nil
+}
+
+// resolveLatest pins the current digest of the tag of an image, empty when the image already has that digest
+func resolveLatest(ctx context.Context, image string, registryClient *registry.RegistryClient, platform string) (string, error) {
+	imageInfo, err := registry.ParseImage(image)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse image %s: %v", image, err)
+	}
+	tag := imageInfo.Tag
+	if tag == "" {
+		tag = "latest"
+	}
+	digest, err := registryClient.GetPlatformDigest(ctx, registry.BuildImageRefStyle(imageInfo, tag, "", config.ImageNameFull), platform)
+	if err != nil {
+		return "", fmt.Errorf("failed to get digest for %s: %v", image, err)
+	}
+	if sameDigest(imageInfo.Digest, digest) {
+		return "", nil
+	}
+	return registry.BuildImageRef(imageInfo, tag, digest), nil
+}
@@ -0,0 +1,61 @@
+package updater
+
+import (
+	"context"
+	"testing"
+
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolve(t *testing.T) {
+	host := newTestRegistry(t, "app", "1.0.0", "1.1.0")
+	pushTestImage(t, host+"/nightly:20240101")
+	pushTestImage(t, host+"/nightly:20240301")
+	stable := pushTestImage(t, host+"/app:stable")
+	latest := pushTestImage(t, host+"/app:latest")
+	release := pushTestImage(t, host+"/app:1.2.0")
+	u, clientset := newTestUpdater()
+	ctx := context.Background()
+
+	tests := []struct {
+		name  string
+		image string
+		opts  ResolveOptions
+		want  string
+	}{
+		{"release", host + "/app:1.0.0", ResolveOptions{Mode: "release"}, host + "/app:1.2.0"},
+		{"release default", host + "/app:1.0.0", ResolveOptions{}, host + "/app:1.2.0"},
+		{"release min version", host + "/app:1.0.0", ResolveOptions{AllowTags: "regexp:^1\\.1", MinVersion: "1.0.0"}, host + "/app:1.1.0"},
+		{"release pin digest", host + "/app:1.0.0", ResolveOptions{PinDigest: true}, host + "/app:1.2.0@" + release},
+		{"release up to date", host + "/app:1.2.0", ResolveOptions{Mode: "release"}, host + "/app:1.2.0"},
+		{"digest", host + "/app:stable", ResolveOptions{Mode: "digest", AllowTags: "stable"}, host + "/app@" + stable},
+		{"digest preserve tag", host + "/app:stable", ResolveOptions{Mode: "digest", AllowTags: "stable", PreserveTag: true}, host + "/app:stable@" + stable},
+		{"latest", host + "/app:latest", ResolveOptions{Mode: "latest"}, host + "/app:latest@" + latest},
+		{"latest up to date", host + "/app:latest@" + latest, ResolveOptions{Mode: "latest"}, host + "/app:latest@" + latest},
+		{"alphabetical", host + "/nightly:20240101", ResolveOptions{Mode: "alphabetical"}, host + "/nightly:20240301"},
+		{"date", host + "/nightly:20240101", ResolveOptions{Mode: "date", DateFormat: "20060102"}, host + "/nightly:20240301"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := u.Resolve(ctx, tt.image, tt.opts)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	_, err := u.Resolve(ctx, host+"/app:1.0.0", ResolveOptions{Mode: "nightly"})
+	assert.ErrorIs(t, err, ErrUnknownMode)
+	_, err = u.Resolve(ctx, host+"/app:1.0.0", ResolveOptions{AllowTags: "regexp:^9\\."})
+	assert.ErrorIs(t, err, ErrNoMatchingTags)
+
+	oldRegistries := config.GlobalConfig.AllowedRegistries
+	config.GlobalConfig.AllowedRegistries = "ghcr.io"
+	t.Cleanup(func() { config.GlobalConfig.AllowedRegistries = oldRegistries })
+	_, err = u.Resolve(ctx, host+"/app:1.0.0", ResolveOptions{})
+	assert.ErrorIs(t, err, ErrRegistryNotAllowed)
+
+	// No cluster resource is read or changed
+	assert.Empty(t, clientset.Actions())
+}
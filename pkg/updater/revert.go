@@ -0,0 +1,163 @@
+package updater
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/monlor/k8s-image-updater/pkg/audit"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Waiting reasons of a container whose image cannot be pulled
+var pullFailureReasons = []string{"ErrImagePull", "ImagePullBackOff"}
+
+// encodeImages writes images per container as sorted container=image pairs
+func encodeImages(images map[string]string) string {
+	var pairs []string
+	for _, container := range slices.Sorted(maps.Keys(images)) {
+		pairs = append(pairs, container+"="+images[container])
+	}
+	return strings.Join(pairs, ",")
+}
+
+// decodeImages reads container=image pairs written by encodeImages
+func decodeImages(value string) (map[string]string, error) {
+	images := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		container, image, ok := strings.Cut(pair, "=")
+		if !ok || container == "" || image == "" {
+			return nil, fmt.Errorf("invalid container=image pair %q", pair)
+		}
+		images[container] = image
+	}
+	return images, nil
+}
+
+// recordPreviousImages stores the images replaced by an update at now so a pull failure can be reverted
+func recordPreviousImages(annotations map[string]string, original, template *corev1.PodTemplateSpec, now time.Time) {
+	if !config.GlobalConfig.AutoRevertOnPullFailure {
+		return
+	}
+	previous := make(map[string]string)
+	for _, change := range imageChanges(original.Spec.Containers, template.Spec.Containers) {
+		previous[change.Container] = change.OldImage
+	}
+	if len(previous) == 0 {
+		return
+	}
+	annotations[config.AnnotationPreviousImage] = encodeImages(previous)
+	annotations[config.AnnotationUpdatedAt] = now.UTC().Format(time.RFC3339)
+	delete(annotations, config.AnnotationPullFailedImages)
+}
+
+// skipPullFailedImages puts back the original image of containers updated to an image that already failed to pull
+func skipPullFailedImages(annotations map[string]string, original, template *corev1.PodTemplateSpec) {
+	value := annotations[config.AnnotationPullFailedImages]
+	if value == "" {
+		return
+	}
+	failed, err := decodeImages(value)
+	if err != nil {
+		logrus.Warnf("Invalid %s annotation: %v", config.AnnotationPullFailedImages, err)
+		return
+	}
+	for i := range template.Spec.Containers {
+		container := &template.Spec.Containers[i]
+		if i < len(original.Spec.Containers) && container.Image != original.Spec.Containers[i].Image && failed[container.Name] == container.Image {
+			logrus.Warnf("Image %s of container %s already failed to pull, not retrying", container.Image, container.Name)
+			container.Image = original.Spec.Containers[i].Image
+			annotations[config.AnnotationStatus] = config.StatusPullFailed
+		}
+	}
+}
+
+// pullFailures returns the containers of the pods that cannot pull the image set in the template
+func pullFailures(pods []corev1.Pod, template *corev1.PodTemplateSpec, containers map[string]string) []string {
+	images := make(map[string]string)
+	for _, container := range template.Spec.Containers {
+		images[container.Name] = container.Image
+	}
+	var failing []string
+	for _, pod := range pods {
+		for _, status := range pod.Status.ContainerStatuses {
+			if _, ok := containers[status.Name]; !ok || status.State.Waiting == nil || slices.Contains(failing, status.Name) {
+				continue
+			}
+			if slices.Contains(pullFailureReasons, status.State.Waiting.Reason) && pullImage(pod, status.Name) == images[status.Name] {
+				failing = append(failing, status.Name)
+			}
+		}
+	}
+	slices.Sort(failing)
+	return failing
+}
+
+// pullImage returns the image a pod runs for a container
+func pullImage(pod corev1.Pod, name string) string {
+	for _, container := range pod.Spec.Containers {
+		if container.Name == name {
+			return container.Image
+		}
+	}
+	return ""
+}
+
+// revertOnPullFailure watches a resource updated less than PULL_FAILURE_GRACE_PERIOD ago, and restores the
+// previous images when its pods cannot pull the new ones. It returns the audit entries of a revert, which
+// the caller saves, or nil when nothing was reverted.
+func (u *Updater) revertOnPullFailure(ctx context.Context, kind string, meta *metav1.ObjectMeta, template *corev1.PodTemplateSpec, selector *metav1.LabelSelector) ([]audit.Entry, error) {
+	value := meta.Annotations[config.AnnotationPreviousImage]
+	if !config.GlobalConfig.AutoRevertOnPullFailure || value == "" {
+		return nil, nil
+	}
+	clearWatch := func() {
+		delete(meta.Annotations, config.AnnotationPreviousImage)
+		delete(meta.Annotations, config.AnnotationUpdatedAt)
+	}
+	previous, err := decodeImages(value)
+	if err != nil {
+		clearWatch()
+		return nil, fmt.Errorf("invalid %s annotation: %v", config.AnnotationPreviousImage, err)
+	}
+	updatedAt, err := time.Parse(time.RFC3339, meta.Annotations[config.AnnotationUpdatedAt])
+	if err != nil || u.clock.Now().Sub(updatedAt) > config.GlobalConfig.PullFailureGracePeriod {
+		// The new images pulled fine during the grace period
+		clearWatch()
+		return nil, nil
+	}
+
+	podSelector, err := metav1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid selector: %v", err)
+	}
+	pods, err := u.k8sClient.ListPods(ctx, meta.Namespace, metav1.ListOptions{LabelSelector: podSelector.String()})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pods: %v", err)
+	}
+	failing := pullFailures(pods, template, previous)
+	if len(failing) == 0 {
+		return nil, nil
+	}
+
+	original := template.DeepCopy()
+	failed := make(map[string]string)
+	for i := range template.Spec.Containers {
+		container := &template.Spec.Containers[i]
+		if image, ok := previous[container.Name]; ok {
+			failed[container.Name] = container.Image
+			container.Image = image
+		}
+	}
+	logrus.Warnf("Containers %v of %s %s/%s cannot pull their new image, reverting to %s", failing, kind, meta.Namespace, meta.Name, value)
+	clearWatch()
+	meta.Annotations[config.AnnotationPullFailedImages] = encodeImages(failed)
+	meta.Annotations[config.AnnotationStatus] = config.StatusPullFailed
+	return auditEntries(audit.ActionRevert, kind, meta.Namespace, meta.Name, meta.Annotations, u.policy.Load(), original, template), nil
+}
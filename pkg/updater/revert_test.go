@@ -0,0 +1,180 @@
+package updater
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/monlor/k8s-image-updater/pkg/audit"
+	"github.com/monlor/k8s-image-updater/pkg/clock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func enableAutoRevert(t *testing.T, gracePeriod time.Duration) {
+	oldEnabled, oldGracePeriod := config.GlobalConfig.AutoRevertOnPullFailure, config.GlobalConfig.PullFailureGracePeriod
+	config.GlobalConfig.AutoRevertOnPullFailure = true
+	config.GlobalConfig.PullFailureGracePeriod = gracePeriod
+	t.Cleanup(func() {
+		config.GlobalConfig.AutoRevertOnPullFailure = oldEnabled
+		config.GlobalConfig.PullFailureGracePeriod = oldGracePeriod
+	})
+}
+
+func newRevertTestDeployment(host string) *appsv1.Deployment {
+	deploy := newTestDeployment(map[string]string{config.AnnotationMode: "release"},
+		corev1.Container{Name: "app", Image: host + "/app:1.0.0"},
+		corev1.Container{Name: "sidecar", Image: "busybox:1.36"})
+	deploy.Spec.Selector = &metav1.LabelSelector{MatchLabels: map[string]string{"app": "app"}}
+	return deploy
+}
+
+// Create a pod of the deployment whose app container is waiting for the reason
+func createWaitingPod(t *testing.T, clientset *fake.Clientset, name, image, reason string) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Labels: map[string]string{"app": "app"}},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: image}}},
+		Status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{{
+			Name:  "app",
+			Image: image,
+			State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: reason}},
+		}}},
+	}
+	_, err := clientset.CoreV1().Pods("default").Create(context.Background(), pod, metav1.CreateOptions{})
+	require.NoError(t, err)
+}
+
+func TestRevertOnPullFailure(t *testing.T) {
+	enableAutoRevert(t, time.Hour)
+	var buf bytes.Buffer
+	previous := audit.SetLogger(audit.NewWriterLogger(&buf))
+	t.Cleanup(func() { audit.SetLogger(previous) })
+
+	host := newTestRegistry(t, "app", "1.0.0", "1.1.0")
+	u, clientset := newTestUpdater(newRevertTestDeployment(host))
+	ctx := context.Background()
+	getDeployment := func() *appsv1.Deployment {
+		deploy, err := clientset.AppsV1().Deployments("default").Get(ctx, "app", metav1.GetOptions{})
+		require.NoError(t, err)
+		return deploy
+	}
+
+	require.NoError(t, u.updateDeployments(ctx))
+	deploy := getDeployment()
+	assert.Equal(t, host+"/app:1.1.0", deploy.Spec.Template.Spec.Containers[0].Image)
+	assert.Equal(t, "app="+host+"/app:1.0.0", deploy.Annotations[config.AnnotationPreviousImage])
+	assert.NotEmpty(t, deploy.Annotations[config.AnnotationUpdatedAt])
+
+	// Old pods and other failures do not trigger a revert
+	createWaitingPod(t, clientset, "old", host+"/app:1.0.0", "ImagePullBackOff")
+	createWaitingPod(t, clientset, "starting", host+"/app:1.1.0", "ContainerCreating")
+	require.NoError(t, u.updateDeployments(ctx))
+	assert.Equal(t, host+"/app:1.1.0", getDeployment().Spec.Template.Spec.Containers[0].Image)
+
+	createWaitingPod(t, clientset, "new", host+"/app:1.1.0", "ImagePullBackOff")
+	require.NoError(t, u.updateDeployments(ctx))
+	deploy = getDeployment()
+	assert.Equal(t, host+"/app:1.0.0", deploy.Spec.Template.Spec.Containers[0].Image)
+	assert.Equal(t, "busybox:1.36", deploy.Spec.Template.Spec.Containers[1].Image)
+	assert.Equal(t, "app="+host+"/app:1.1.0", deploy.Annotations[config.AnnotationPullFailedImages])
+	assert.Equal(t, config.StatusPullFailed, deploy.Annotations[config.AnnotationStatus])
+	assert.NotContains(t, deploy.Annotations, config.AnnotationPreviousImage)
+	assert.NotContains(t, deploy.Annotations, config.AnnotationUpdatedAt)
+
+	// The image that failed to pull is not retried, a newer one is
+	require.NoError(t, u.updateDeployments(ctx))
+	deploy = getDeployment()
+	assert.Equal(t, host+"/app:1.0.0", deploy.Spec.Template.Spec.Containers[0].Image)
+	assert.Equal(t, config.StatusPullFailed, deploy.Annotations[config.AnnotationStatus])
+
+	pushTestImage(t, host+"/app:1.2.0")
+	require.NoError(t, u.updateDeployments(ctx))
+	deploy = getDeployment()
+	assert.Equal(t, host+"/app:1.2.0", deploy.Spec.Template.Spec.Containers[0].Image)
+	assert.NotContains(t, deploy.Annotations, config.AnnotationPullFailedImages)
+	assert.NotContains(t, deploy.Annotations, config.AnnotationStatus)
+
+	var actions []string
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry audit.Entry
+		require.NoError(t, json.Unmarshal([]byte(line), &entry))
+		actions = append(actions, entry.Action+" "+entry.NewImage)
+	}
+	assert.Equal(t, []string{
+		audit.ActionUpdate + " " + host + "/app:1.1.0",
+		audit.ActionRevert + " " + host + "/app:1.0.0",
+		audit.ActionUpdate + " " + host + "/app:1.2.0",
+	}, actions)
+}
+
+func TestRevertOnPullFailureReportOnly(t *testing.T) {
+	enableAutoRevert(t, time.Hour)
+	host := newTestRegistry(t, "app", "1.0.0", "1.1.0")
+	u, clientset := newTestUpdater(newRevertTestDeployment(host))
+	ctx := context.Background()
+	require.NoError(t, u.updateDeployments(ctx))
+
+	// With REPORT_ONLY the revert is reported and the failing image is left in place
+	enableReportOnly(t)
+	createWaitingPod(t, clientset, "new", host+"/app:1.1.0", "ImagePullBackOff")
+	require.NoError(t, u.updateDeployments(ctx))
+	deploy, err := clientset.AppsV1().Deployments("default").Get(ctx, "app", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, host+"/app:1.1.0", deploy.Spec.Template.Spec.Containers[0].Image)
+	assert.Equal(t, "app="+host+"/app:1.0.0", deploy.Annotations[config.AnnotationAvailableUpdate])
+	assert.Equal(t, "app="+host+"/app:1.0.0", deploy.Annotations[config.AnnotationPreviousImage])
+	assert.NotContains(t, deploy.Annotations, config.AnnotationPullFailedImages)
+}
+
+func TestRevertOnPullFailureGracePeriod(t *testing.T) {
+	enableAutoRevert(t, time.Minute)
+	host := newTestRegistry(t, "app", "1.1.0")
+	deploy := newRevertTestDeployment(host)
+	deploy.Spec.Template.Spec.Containers[0].Image = host + "/app:1.1.0"
+	deploy.Annotations[config.AnnotationPreviousImage] = "app=" + host + "/app:1.0.0"
+	updatedAt := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	deploy.Annotations[config.AnnotationUpdatedAt] = updatedAt.Format(time.RFC3339)
+	u, clientset := newTestUpdater(deploy)
+	u.clock = clock.NewFake(updatedAt.Add(2 * time.Minute))
+	createWaitingPod(t, clientset, "new", host+"/app:1.1.0", "ErrImagePull")
+	ctx := context.Background()
+
+	// Past the grace period the update is no longer watched
+	require.NoError(t, u.updateDeployments(ctx))
+	deploy, err := clientset.AppsV1().Deployments("default").Get(ctx, "app", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, host+"/app:1.1.0", deploy.Spec.Template.Spec.Containers[0].Image)
+	assert.NotContains(t, deploy.Annotations, config.AnnotationPreviousImage)
+	assert.NotContains(t, deploy.Annotations, config.AnnotationPullFailedImages)
+}
+
+func TestRevertOnPullFailureDisabled(t *testing.T) {
+	host := newTestRegistry(t, "app", "1.0.0", "1.1.0")
+	u, clientset := newTestUpdater(newRevertTestDeployment(host))
+	ctx := context.Background()
+
+	require.NoError(t, u.updateDeployments(ctx))
+	deploy, err := clientset.AppsV1().Deployments("default").Get(ctx, "app", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.NotContains(t, deploy.Annotations, config.AnnotationPreviousImage)
+}
+
+func TestDecodeImages(t *testing.T) {
+	images := map[string]string{"b": "ghcr.io/org/b:1.0.0", "a": "localhost:5000/a@sha256:0123"}
+	encoded := encodeImages(images)
+	assert.Equal(t, "a=localhost:5000/a@sha256:0123,b=ghcr.io/org/b:1.0.0", encoded)
+	decoded, err := decodeImages(encoded)
+	require.NoError(t, err)
+	assert.Equal(t, images, decoded)
+
+	_, err = decodeImages("app")
+	assert.Error(t, err)
+}
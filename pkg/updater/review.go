@@ -0,0 +1,47 @@
+package updater
+
+import (
+	"context"
+
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/monlor/k8s-image-updater/pkg/registry"
+)
+
+// proposeImage records newImage as the pending image of a review mode container, to be applied once approved.
+// A resource has a single pending image, the other containers wait until it is approved or cancelled.
+func (u *Updater) proposeImage(ctx context.Context, tracked trackedImage, newImage string, registryClient *registry.RegistryClient, annotations map[string]string, resourceType, namespace, resourceName string) error {
+	pendingImage := annotations[config.AnnotationPendingImage]
+	if pendingImage != "" && annotations[config.AnnotationPendingContainer] != tracked.name {
+		if newImage != "" {
+			checkInfof("[review] Image %s for container %s in %s %s/%s waits for the pending image %s to be approved", newImage, tracked.name, resourceType, namespace, resourceName, pendingImage)
+		}
+		return nil
+	}
+
+	switch {
+	case newImage == "":
+		// The container already runs the newest image, e.g. it was updated manually
+		if pendingImage != "" {
+			checkInfof("[review] Dropping pending image %s of container %s in %s %s/%s, it is up to date", pendingImage, tracked.name, resourceType, namespace, resourceName)
+			delete(annotations, config.AnnotationPendingImage)
+			delete(annotations, config.AnnotationPendingContainer)
+		}
+		return nil
+	case newImage == pendingImage:
+		annotations[config.AnnotationStatus] = config.StatusPendingApproval
+		return nil
+	case pendingImage == "" && newImage == annotations[config.AnnotationProposedImage]:
+		checkDebugf("[review] Proposal of %s for container %s in %s %s/%s was cancelled", newImage, tracked.name, resourceType, namespace, resourceName)
+		return nil
+	}
+
+	if err := u.verifyImage(ctx, newImage, registryClient, annotations, resourceType, namespace, resourceName); err != nil {
+		return err
+	}
+	checkInfof("[review] Proposing image %s for container %s in %s %s/%s, currently %s", newImage, tracked.name, resourceType, namespace, resourceName, tracked.image)
+	annotations[config.AnnotationPendingImage] = newImage
+	annotations[config.AnnotationPendingContainer] = tracked.name
+	annotations[config.AnnotationProposedImage] = newImage
+	annotations[config.AnnotationStatus] = config.StatusPendingApproval
+	return nil
+}
@@ -0,0 +1,88 @@
+package updater
+
+import (
+	"context"
+	"testing"
+
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestReviewModeProposesImage(t *testing.T) {
+	host := newTestRegistry(t, "app", "1.0.0", "1.1.0")
+	u, clientset := newTestUpdater(newTestDeployment(map[string]string{config.AnnotationMode: "review"},
+		corev1.Container{Name: "app", Image: host + "/app:1.0.0"},
+		corev1.Container{Name: "sidecar", Image: host + "/app:1.0.0"}))
+	ctx := context.Background()
+	getDeployment := func() *appsv1.Deployment {
+		deploy, err := clientset.AppsV1().Deployments("default").Get(ctx, "app", metav1.GetOptions{})
+		require.NoError(t, err)
+		return deploy
+	}
+
+	require.NoError(t, u.updateDeployments(ctx))
+	deploy := getDeployment()
+	assert.Equal(t, host+"/app:1.0.0", deploy.Spec.Template.Spec.Containers[0].Image)
+	assert.Equal(t, host+"/app:1.0.0", deploy.Spec.Template.Spec.Containers[1].Image)
+	assert.Equal(t, host+"/app:1.1.0", deploy.Annotations[config.AnnotationPendingImage])
+	// The sidecar waits for the first proposal to be approved
+	assert.Equal(t, "app", deploy.Annotations[config.AnnotationPendingContainer])
+	assert.Equal(t, config.StatusPendingApproval, deploy.Annotations[config.AnnotationStatus])
+
+	// A pending proposal is kept without writing the resource again
+	clientset.ClearActions()
+	require.NoError(t, u.updateDeployments(ctx))
+	assert.Empty(t, updateActions(clientset))
+	assert.Equal(t, config.StatusPendingApproval, getDeployment().Annotations[config.AnnotationStatus])
+
+	// Removing the pending image cancels the proposal, it is not proposed again
+	deploy = getDeployment()
+	delete(deploy.Annotations, config.AnnotationPendingImage)
+	delete(deploy.Annotations, config.AnnotationPendingContainer)
+	_, err := clientset.AppsV1().Deployments("default").Update(ctx, deploy, metav1.UpdateOptions{})
+	require.NoError(t, err)
+	require.NoError(t, u.updateDeployments(ctx))
+	deploy = getDeployment()
+	assert.Empty(t, deploy.Annotations[config.AnnotationPendingImage])
+	assert.Empty(t, deploy.Annotations[config.AnnotationStatus])
+	assert.Equal(t, host+"/app:1.0.0", deploy.Spec.Template.Spec.Containers[0].Image)
+
+	// A newer image is proposed again
+	pushTestImage(t, host+"/app:1.2.0")
+	require.NoError(t, u.updateDeployments(ctx))
+	deploy = getDeployment()
+	assert.Equal(t, host+"/app:1.2.0", deploy.Annotations[config.AnnotationPendingImage])
+	assert.Equal(t, config.StatusPendingApproval, deploy.Annotations[config.AnnotationStatus])
+	assert.Equal(t, host+"/app:1.0.0", deploy.Spec.Template.Spec.Containers[0].Image)
+}
+
+func TestReviewModeDropsStaleProposal(t *testing.T) {
+	host := newTestRegistry(t, "app", "1.0.0", "1.1.0")
+	u, clientset := newTestUpdater(newTestDeployment(map[string]string{
+		config.AnnotationMode:             "review",
+		config.AnnotationPendingImage:     host + "/app:1.1.0",
+		config.AnnotationPendingContainer: "app",
+	}, corev1.Container{Name: "app", Image: host + "/app:1.1.0"}))
+	ctx := context.Background()
+
+	require.NoError(t, u.updateDeployments(ctx))
+	deploy, err := clientset.AppsV1().Deployments("default").Get(ctx, "app", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.NotContains(t, deploy.Annotations, config.AnnotationPendingImage)
+	assert.NotContains(t, deploy.Annotations, config.AnnotationStatus)
+}
+
+func updateActions(clientset *fake.Clientset) []string {
+	var actions []string
+	for _, action := range clientset.Actions() {
+		if action.GetVerb() == "update" {
+			actions = append(actions, action.GetResource().Resource)
+		}
+	}
+	return actions
+}
@@ -0,0 +1,45 @@
+package updater
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/monlor/k8s-image-updater/config"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// istioSidecarStatus is set on a pod template by istioctl kube-inject, listing the containers it injected
+const istioSidecarStatus = "sidecar.istio.io/status"
+
+// injectedContainer reports whether a container was injected by an admission webhook: its name matches
+// IGNORED_CONTAINER_NAMES or the injected-containers annotation, or the pod template lists it as an Istio sidecar
+func injectedContainer(annotations map[string]string, podTemplate *corev1.PodTemplateSpec, name string) bool {
+	patterns, _ := config.GlobalConfig.IgnoredContainers()
+	patterns = append(patterns, strings.Split(annotations[config.AnnotationInjectedContainers], ",")...)
+	for _, pattern := range patterns {
+		if pattern = strings.TrimSpace(pattern); pattern != "" && config.ContainerMatches(pattern, name) {
+			return true
+		}
+	}
+
+	if podTemplate == nil || podTemplate.Annotations[istioSidecarStatus] == "" {
+		return false
+	}
+	var status struct {
+		Containers []string `json:"containers"`
+	}
+	if err := json.Unmarshal([]byte(podTemplate.Annotations[istioSidecarStatus]), &status); err != nil {
+		return false
+	}
+	for _, container := range status.Containers {
+		if container == name {
+			return true
+		}
+	}
+	return false
+}
+
+// skipsInjectedContainer reports whether an injected container is left alone, unless the container annotation names it
+func skipsInjectedContainer(annotations map[string]string, podTemplate *corev1.PodTemplateSpec, name string) bool {
+	return annotations[config.AnnotationContainer] != name && injectedContainer(annotations, podTemplate, name)
+}
@@ -0,0 +1,65 @@
+package updater
+
+import (
+	"context"
+	"testing"
+
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/monlor/k8s-image-updater/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestInjectedSidecars(t *testing.T) {
+	host := newTestRegistry(t, "app", "1.0.0", "1.1.0")
+	oldIgnored := config.GlobalConfig.IgnoredContainerNames
+	config.GlobalConfig.IgnoredContainerNames = "istio-proxy,linkerd-*"
+	t.Cleanup(func() { config.GlobalConfig.IgnoredContainerNames = oldIgnored })
+	ctx := context.Background()
+
+	containers := []corev1.Container{
+		{Name: "app", Image: host + "/app:1.0.0"},
+		{Name: "istio-proxy", Image: host + "/app:1.0.0"},
+		{Name: "linkerd-proxy", Image: host + "/app:1.0.0"},
+		{Name: "vault", Image: host + "/app:1.0.0"},
+		{Name: "mesh-proxy", Image: host + "/app:1.0.0"},
+	}
+	deploy := newTestDeployment(map[string]string{
+		config.AnnotationMode:               "release",
+		config.AnnotationInjectedContainers: "vault",
+	}, containers...)
+	deploy.Spec.Template.Annotations = map[string]string{istioSidecarStatus: `{"containers":["mesh-proxy"],"initContainers":["istio-init"]}`}
+	u, clientset := newTestUpdater(deploy)
+
+	skipped := metrics.SkippedUpdates.WithLabelValues(metrics.SkipReasonInjected)
+	before := testutil.ToFloat64(skipped)
+	require.NoError(t, u.updateDeployments(ctx))
+	stored, err := clientset.AppsV1().Deployments("default").Get(ctx, "app", metav1.GetOptions{})
+	require.NoError(t, err)
+	images := map[string]string{}
+	for _, container := range stored.Spec.Template.Spec.Containers {
+		images[container.Name] = container.Image
+	}
+	assert.Equal(t, map[string]string{
+		"app":           host + "/app:1.1.0",
+		"istio-proxy":   host + "/app:1.0.0",
+		"linkerd-proxy": host + "/app:1.0.0",
+		"vault":         host + "/app:1.0.0",
+		"mesh-proxy":    host + "/app:1.0.0",
+	}, images)
+	assert.Equal(t, before+4, testutil.ToFloat64(skipped))
+
+	// A sidecar named by the container annotation is updated, a glob matching it is not enough
+	check := func(target string) containerUpdate {
+		deploy := newTestDeployment(map[string]string{config.AnnotationMode: "release", config.AnnotationContainer: target},
+			corev1.Container{Name: "istio-proxy", Image: host + "/app:1.0.0"})
+		result, err := u.updateContainerIfNeeded(ctx, &deploy.Spec.Template.Spec.Containers[0], &deploy.Annotations, "default", "app", "deployment", &deploy.Spec.Template)
+		require.NoError(t, err)
+		return result
+	}
+	assert.Equal(t, host+"/app:1.1.0", check("istio-proxy").NewImage)
+	assert.Equal(t, skipUpdate(host+"/app:1.0.0", "injected sidecar"), check("*-proxy"))
+}
@@ -0,0 +1,70 @@
+package updater
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/monlor/k8s-image-updater/pkg/metrics"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// parseSizeChangeAnnotation returns the maximum relative size change of the max-size-change annotation,
+// given as a ratio like 0.5 or a percentage like 50%, 0 without annotation
+func parseSizeChangeAnnotation(annotations map[string]string) (float64, error) {
+	value := strings.TrimSpace(annotations[config.AnnotationMaxSizeChange])
+	if value == "" {
+		return 0, nil
+	}
+	number, percent := strings.CutSuffix(value, "%")
+	ratio, err := strconv.ParseFloat(strings.TrimSpace(number), 64)
+	if err != nil || ratio <= 0 {
+		return 0, fmt.Errorf("invalid %s annotation %q, expected a ratio like 0.5 or a percentage like 50%%", config.AnnotationMaxSizeChange, value)
+	}
+	if percent {
+		ratio /= 100
+	}
+	return ratio, nil
+}
+
+// checkSizeChange puts back the current image when the size of the new image differs from it by more than
+// maxSizeChange, relative to the current size, e.g. to keep a bloated or truncated build from rolling out
+func (u *Updater) checkSizeChange(ctx context.Context, tracked trackedImage, update containerUpdate, maxSizeChange float64, annotations map[string]string, namespace, resourceName, resourceType string, podTemplate *corev1.PodTemplateSpec) (containerUpdate, error) {
+	revert := func(err error) (containerUpdate, error) {
+		tracked.set(update.OldImage)
+		return skipUpdate(update.OldImage, "image size check failed"), err
+	}
+	registryClient, err := u.getRegistryClientForImage(ctx, update.NewImage, namespace, pullSecretNames(annotations, &podTemplate.Spec), annotations)
+	if err != nil {
+		return revert(fmt.Errorf("failed to get registry client: %v", err))
+	}
+	// Both images are measured for the platform the pods run on
+	platform := resolvePlatform(annotations, &podTemplate.Spec)
+	oldSize, err := registryClient.GetImageSize(ctx, update.OldImage, platform)
+	if err != nil {
+		return revert(fmt.Errorf("failed to get size of %s: %w", update.OldImage, err))
+	}
+	newSize, err := registryClient.GetImageSize(ctx, update.NewImage, platform)
+	if err != nil {
+		return revert(fmt.Errorf("failed to get size of %s: %w", update.NewImage, err))
+	}
+	// Nothing to compare to
+	if oldSize == 0 {
+		return update, nil
+	}
+
+	change := float64(newSize-oldSize) / float64(oldSize)
+	if change <= maxSizeChange && -change <= maxSizeChange {
+		checkDebugf("Size of %s changed by %.1f%% from %s, within %.1f%%", update.NewImage, change*100, update.OldImage, maxSizeChange*100)
+		return update, nil
+	}
+	logrus.Warnf("Not updating %s in %s %s/%s from %s to %s, its size changed by %.1f%% from %d to %d bytes, more than the allowed %.1f%%",
+		tracked.name, resourceType, namespace, resourceName, update.OldImage, update.NewImage, change*100, oldSize, newSize, maxSizeChange*100)
+	tracked.set(update.OldImage)
+	annotations[config.AnnotationStatus] = config.StatusSizeChangeExceeded
+	countSkipped(ctx, metrics.SkipReasonSizeChange)
+	return skipUpdate(update.OldImage, fmt.Sprintf("image size changed by %.1f%%", change*100)), nil
+}
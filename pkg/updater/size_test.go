@@ -0,0 +1,114 @@
+package updater
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Push a random image of a single layer of about size bytes to the reference
+func pushSizedImage(t *testing.T, image string, size int64) {
+	img, err := random.Image(size, 1)
+	require.NoError(t, err)
+	ref, err := name.ParseReference(image)
+	require.NoError(t, err)
+	require.NoError(t, remote.Write(ref, img))
+}
+
+// Push a multi-platform image with a manifest per architecture, each of a single layer of about the given size
+func pushSizedIndex(t *testing.T, image string, sizes map[string]int64) {
+	index := v1.ImageIndex(empty.Index)
+	for arch, size := range sizes {
+		img, err := random.Image(size, 1)
+		require.NoError(t, err)
+		index = mutate.AppendManifests(index, mutate.IndexAddendum{
+			Add:        img,
+			Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: arch}},
+		})
+	}
+	ref, err := name.ParseReference(image)
+	require.NoError(t, err)
+	require.NoError(t, remote.WriteIndex(ref, index))
+}
+
+func TestMaxSizeChange(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name          string
+		maxSizeChange string
+		newSize       int64
+		wantImage     string
+		wantStatus    string
+	}{
+		{"within limit", "50%", 4400, "1.1.0", ""},
+		{"grown too much", "50%", 20000, "1.0.0", config.StatusSizeChangeExceeded},
+		{"shrunk too much", "0.5", 500, "1.0.0", config.StatusSizeChangeExceeded},
+		{"no limit", "", 20000, "1.1.0", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := newTestRegistry(t, "app")
+			pushSizedImage(t, host+"/app:1.0.0", 4000)
+			pushSizedImage(t, host+"/app:1.1.0", tt.newSize)
+
+			annotations := map[string]string{config.AnnotationMode: "release"}
+			if tt.maxSizeChange != "" {
+				annotations[config.AnnotationMaxSizeChange] = tt.maxSizeChange
+			}
+			deploy := newTestDeployment(annotations, corev1.Container{Name: "app", Image: host + "/app:1.0.0"})
+			u, clientset := newTestUpdater(deploy)
+			require.NoError(t, u.updateDeployments(ctx))
+
+			stored, err := clientset.AppsV1().Deployments("default").Get(ctx, "app", metav1.GetOptions{})
+			require.NoError(t, err)
+			assert.Equal(t, host+"/app:"+tt.wantImage, stored.Spec.Template.Spec.Containers[0].Image)
+			assert.Equal(t, tt.wantStatus, stored.Annotations[config.AnnotationStatus])
+		})
+	}
+}
+
+func TestMaxSizeChangePlatform(t *testing.T) {
+	ctx := context.Background()
+	host := newTestRegistry(t, "app")
+	// Only the arm64 image grew
+	pushSizedIndex(t, host+"/app:1.0.0", map[string]int64{"amd64": 4000, "arm64": 4000})
+	pushSizedIndex(t, host+"/app:1.1.0", map[string]int64{"amd64": 4000, "arm64": 20000})
+
+	for arch, want := range map[string]string{"": "1.1.0", "amd64": "1.1.0", "arm64": "1.0.0"} {
+		deploy := newTestDeployment(map[string]string{config.AnnotationMode: "release", config.AnnotationMaxSizeChange: "50%"},
+			corev1.Container{Name: "app", Image: host + "/app:1.0.0"})
+		if arch != "" {
+			deploy.Spec.Template.Spec.NodeSelector = map[string]string{corev1.LabelArchStable: arch}
+		}
+		u, clientset := newTestUpdater(deploy)
+		require.NoError(t, u.updateDeployments(ctx))
+
+		// The images are measured for the architecture the pods are scheduled on, linux/amd64 by default
+		stored, err := clientset.AppsV1().Deployments("default").Get(ctx, "app", metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, host+"/app:"+want, stored.Spec.Template.Spec.Containers[0].Image, arch)
+	}
+}
+
+func TestParseSizeChangeAnnotation(t *testing.T) {
+	for value, want := range map[string]float64{"": 0, "0.25": 0.25, "50%": 0.5, "200 %": 2} {
+		got, err := parseSizeChangeAnnotation(map[string]string{config.AnnotationMaxSizeChange: value})
+		require.NoError(t, err, value)
+		assert.Equal(t, want, got, value)
+	}
+	for _, value := range []string{"big", "-0.5", "0", "%"} {
+		_, err := parseSizeChangeAnnotation(map[string]string{config.AnnotationMaxSizeChange: value})
+		assert.Error(t, err, value)
+	}
+}
@@ -0,0 +1,37 @@
+package updater
+
+import (
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/monlor/k8s-image-updater/pkg/status"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// recordStatus records the images a resource had when checked, the images selected for its containers
+// and an image pending approval in review mode, in the index served by the status endpoint
+func (u *Updater) recordStatus(kind string, meta *metav1.ObjectMeta, containers []corev1.Container, proposed map[string]string) {
+	result := status.Result{
+		Cluster:    u.cluster,
+		Kind:       kind,
+		Namespace:  meta.Namespace,
+		Name:       meta.Name,
+		Status:     meta.Annotations[config.AnnotationStatus],
+		CheckedAt:  u.clock.Now().UTC(),
+		Containers: make([]status.ContainerResult, 0, len(containers)),
+	}
+	for _, container := range containers {
+		proposedImage := proposed[container.Name]
+		if proposedImage == "" && meta.Annotations[config.AnnotationPendingContainer] == container.Name {
+			proposedImage = meta.Annotations[config.AnnotationPendingImage]
+		}
+		if proposedImage == container.Image {
+			proposedImage = ""
+		}
+		result.Containers = append(result.Containers, status.ContainerResult{
+			Container:     container.Name,
+			CurrentImage:  container.Image,
+			ProposedImage: proposedImage,
+		})
+	}
+	status.Set(result)
+}
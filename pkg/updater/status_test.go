@@ -0,0 +1,52 @@
+package updater
+
+import (
+	"context"
+	"testing"
+
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/monlor/k8s-image-updater/pkg/status"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestCheckRecordsStatus(t *testing.T) {
+	previous := status.SetIndex(status.NewIndex(0))
+	t.Cleanup(func() { status.SetIndex(previous) })
+
+	host := newTestRegistry(t, "app", "1.0.0", "1.1.0")
+	review := newTestDeployment(map[string]string{config.AnnotationMode: "review"},
+		corev1.Container{Name: "app", Image: host + "/app:1.0.0"})
+	review.Name = "review"
+	u, clientset := newTestUpdater(newTestDeployment(nil,
+		corev1.Container{Name: "app", Image: host + "/app:1.0.0"},
+		corev1.Container{Name: "sidecar", Image: host + "/app:1.1.0"}), review)
+	ctx := context.Background()
+
+	require.NoError(t, u.CheckAndUpdate(ctx))
+	results := status.List("default", "deployment")
+	require.Len(t, results, 2)
+
+	assert.Equal(t, "app", results[0].Name)
+	assert.Empty(t, results[0].Status)
+	assert.Equal(t, []status.ContainerResult{
+		{Container: "app", CurrentImage: host + "/app:1.0.0", ProposedImage: host + "/app:1.1.0"},
+		{Container: "sidecar", CurrentImage: host + "/app:1.1.0"},
+	}, results[0].Containers)
+
+	assert.Equal(t, "review", results[1].Name)
+	assert.Equal(t, config.StatusPendingApproval, results[1].Status)
+	assert.Equal(t, []status.ContainerResult{
+		{Container: "app", CurrentImage: host + "/app:1.0.0", ProposedImage: host + "/app:1.1.0"},
+	}, results[1].Containers)
+
+	// Once up to date nothing is proposed, and deleted resources are dropped
+	require.NoError(t, clientset.AppsV1().Deployments("default").Delete(ctx, "review", metav1.DeleteOptions{}))
+	require.NoError(t, u.CheckAndUpdate(ctx))
+	results = status.List("", "")
+	require.Len(t, results, 1)
+	assert.Equal(t, host+"/app:1.1.0", results[0].Containers[0].CurrentImage)
+	assert.Empty(t, results[0].Containers[0].ProposedImage)
+}
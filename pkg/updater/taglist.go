@@ -0,0 +1,57 @@
+package updater
+
+import (
+	"context"
+	"slices"
+	"sync"
+
+	"github.com/monlor/k8s-image-updater/pkg/registry"
+)
+
+// tagListMemo shares the tags listed for a repository during a check cycle, so resources using the same image
+// list its tags once. Unlike the tag caches it is dropped at the end of the cycle, every cycle lists fresh tags.
+type tagListMemo struct {
+	mu      sync.Mutex
+	entries map[string]*tagListEntry
+}
+
+type tagListEntry struct {
+	once sync.Once
+	tags []string
+	err  error
+}
+
+type tagListMemoKey struct{}
+
+// withTagListMemo returns a context whose tag lists are shared until it is done with
+func withTagListMemo(ctx context.Context) context.Context {
+	return context.WithValue(ctx, tagListMemoKey{}, &tagListMemo{entries: make(map[string]*tagListEntry)})
+}
+
+// listTags lists the tags of an image, once per repository, credentials and transport within a check cycle
+func listTags(ctx context.Context, image string, registryClient *registry.RegistryClient) ([]string, error) {
+	memo, ok := ctx.Value(tagListMemoKey{}).(*tagListMemo)
+	imageInfo, err := registry.ParseImage(image)
+	if !ok || err != nil {
+		return registryClient.ListTags(ctx, image)
+	}
+
+	// Credentials may see different repositories, or none, and a resource's TLS settings a different registry
+	key := imageInfo.Registry + "/" + imageInfo.Repository + "#" + registryClient.Identity()
+	memo.mu.Lock()
+	entry, listed := memo.entries[key]
+	if !listed {
+		entry = &tagListEntry{}
+		memo.entries[key] = entry
+	}
+	memo.mu.Unlock()
+
+	entry.once.Do(func() {
+		entry.tags, entry.err = registryClient.ListTags(ctx, image)
+	})
+	if listed {
+		checkDebugf("Reusing tags of %s/%s listed in this cycle", imageInfo.Registry, imageInfo.Repository)
+	}
+	// Callers sort the tags in place
+	return slices.Clone(entry.tags), entry.err
+}
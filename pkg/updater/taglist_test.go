@@ -0,0 +1,57 @@
+package updater
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	ggcrregistry "github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/monlor/k8s-image-updater/pkg/registry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListTagsMemo(t *testing.T) {
+	registryHandler := ggcrregistry.New(ggcrregistry.Logger(log.New(io.Discard, "", 0)))
+	var tagListRequests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/tags/list") {
+			tagListRequests.Add(1)
+		}
+		registryHandler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	host := strings.TrimPrefix(server.URL, "http://")
+	img, err := random.Image(256, 1)
+	require.NoError(t, err)
+	ref, err := name.ParseReference(host + "/app:1.0.0")
+	require.NoError(t, err)
+	require.NoError(t, remote.Write(ref, img))
+
+	transport, err := registry.TLSTransport(true, nil)
+	require.NoError(t, err)
+	ctx := withTagListMemo(context.Background())
+	client := registry.NewRegistryClient("user", "secret")
+
+	for _, c := range []*registry.RegistryClient{client, registry.NewRegistryClient("user", "secret")} {
+		tags, err := listTags(ctx, host+"/app:1.0.0", c)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"1.0.0"}, tags)
+	}
+	assert.Equal(t, int32(1), tagListRequests.Load())
+
+	// Another password or the TLS settings of another resource may see other tags
+	for _, c := range []*registry.RegistryClient{registry.NewRegistryClient("user", "other"), client.WithTransport(transport)} {
+		_, err := listTags(ctx, host+"/app:1.0.0", c)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, int32(3), tagListRequests.Load())
+}
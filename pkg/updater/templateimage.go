@@ -0,0 +1,35 @@
+package updater
+
+import (
+	"github.com/monlor/k8s-image-updater/config"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// trackTemplateAnnotation makes a tracked container image write new images to the TEMPLATE_IMAGE_ANNOTATION
+// pod template annotation as well. In instead mode only the annotation is written, and the image it holds
+// is the one tracked, the container image until it is first set.
+func trackTemplateAnnotation(tracked *trackedImage, podTemplate *corev1.PodTemplateSpec) {
+	key := config.GlobalConfig.TemplateImageAnnotation
+	if key == "" {
+		return
+	}
+	setAnnotation := func(image string) {
+		if podTemplate.Annotations == nil {
+			podTemplate.Annotations = make(map[string]string)
+		}
+		podTemplate.Annotations[key] = image
+	}
+
+	if mode, _ := config.GlobalConfig.TemplateImageMode(); mode == config.TemplateImageInstead {
+		if image := podTemplate.Annotations[key]; image != "" {
+			tracked.image = image
+		}
+		tracked.set = setAnnotation
+		return
+	}
+	setContainer := tracked.set
+	tracked.set = func(image string) {
+		setContainer(image)
+		setAnnotation(image)
+	}
+}
@@ -0,0 +1,52 @@
+package updater
+
+import (
+	"context"
+	"testing"
+
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestTemplateImageAnnotation(t *testing.T) {
+	host := newTestRegistry(t, "app", "1.0.0", "1.1.0")
+	oldKey, oldMode := config.GlobalConfig.TemplateImageAnnotation, config.GlobalConfig.TemplateImageAnnotationMode
+	t.Cleanup(func() {
+		config.GlobalConfig.TemplateImageAnnotation, config.GlobalConfig.TemplateImageAnnotationMode = oldKey, oldMode
+	})
+	config.GlobalConfig.TemplateImageAnnotation = "delivery.example.com/image"
+	ctx := context.Background()
+
+	update := func(t *testing.T) (container string, annotation string, changed bool) {
+		deploy := newTestDeployment(map[string]string{config.AnnotationMode: "release"},
+			corev1.Container{Name: "app", Image: host + "/app:1.0.0"})
+		u, clientset := newTestUpdater(deploy)
+		require.NoError(t, u.updateDeployments(ctx))
+		stored, err := clientset.AppsV1().Deployments("default").Get(ctx, "app", metav1.GetOptions{})
+		require.NoError(t, err)
+
+		// A second check finds the resource up to date
+		result, err := u.updateContainerIfNeeded(ctx, &stored.Spec.Template.Spec.Containers[0], &stored.Annotations, "default", "app", "deployment", &stored.Spec.Template)
+		require.NoError(t, err)
+		return stored.Spec.Template.Spec.Containers[0].Image, stored.Spec.Template.Annotations["delivery.example.com/image"], result.Changed
+	}
+
+	t.Run("also", func(t *testing.T) {
+		config.GlobalConfig.TemplateImageAnnotationMode = config.TemplateImageAlso
+		container, annotation, changed := update(t)
+		assert.Equal(t, host+"/app:1.1.0", container)
+		assert.Equal(t, host+"/app:1.1.0", annotation)
+		assert.False(t, changed)
+	})
+
+	t.Run("instead", func(t *testing.T) {
+		config.GlobalConfig.TemplateImageAnnotationMode = config.TemplateImageInstead
+		container, annotation, changed := update(t)
+		assert.Equal(t, host+"/app:1.0.0", container)
+		assert.Equal(t, host+"/app:1.1.0", annotation)
+		assert.False(t, changed)
+	})
+}
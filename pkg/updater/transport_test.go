@@ -0,0 +1,74 @@
+package updater
+
+import (
+	"context"
+	"encoding/pem"
+	"io"
+	"log"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	ggcrregistry "github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/monlor/k8s-image-updater/pkg/registry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The updater resolves images through the registry transport configured at startup
+func TestUpdateDeploymentsRegistryTransport(t *testing.T) {
+	server := httptest.NewUnstartedServer(ggcrregistry.New(ggcrregistry.Logger(log.New(io.Discard, "", 0))))
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	host := strings.TrimPrefix(server.URL, "https://")
+	for _, tag := range []string{"1.0.0", "1.1.0"} {
+		img, err := random.Image(256, 1)
+		require.NoError(t, err)
+		ref, err := name.ParseReference(host + "/app:" + tag)
+		require.NoError(t, err)
+		require.NoError(t, remote.Write(ref, img, remote.WithTransport(server.Client().Transport)))
+	}
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0o600))
+
+	oldConfig := *config.GlobalConfig
+	t.Cleanup(func() {
+		*config.GlobalConfig = oldConfig
+		require.NoError(t, registry.ConfigureTransport(config.GlobalConfig))
+	})
+
+	tests := []struct {
+		name     string
+		insecure string
+		caFile   string
+		want     string
+	}{
+		{name: "untrusted certificate", want: "1.0.0"},
+		{name: "insecure registry", insecure: host, want: "1.1.0"},
+		{name: "trusted CA", caFile: caFile, want: "1.1.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.GlobalConfig.InsecureRegistries = tt.insecure
+			config.GlobalConfig.RegistryCAFile = tt.caFile
+			require.NoError(t, registry.ConfigureTransport(config.GlobalConfig))
+
+			u, clientset := newTestUpdater(newTestDeployment(map[string]string{config.AnnotationMode: "release"},
+				corev1.Container{Name: "app", Image: host + "/app:1.0.0"}))
+			ctx := context.Background()
+			require.NoError(t, u.updateDeployments(ctx))
+			deploy, err := clientset.AppsV1().Deployments("default").Get(ctx, "app", metav1.GetOptions{})
+			require.NoError(t, err)
+			assert.Equal(t, host+"/app:"+tt.want, deploy.Spec.Template.Spec.Containers[0].Image)
+		})
+	}
+}
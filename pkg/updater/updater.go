@@ -4,80 +4,419 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"path"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/hashicorp/go-version"
 	"github.com/monlor/k8s-image-updater/config"
+	"github.com/monlor/k8s-image-updater/pkg/clock"
+	"github.com/monlor/k8s-image-updater/pkg/hooks"
 	"github.com/monlor/k8s-image-updater/pkg/k8s"
+	"github.com/monlor/k8s-image-updater/pkg/metrics"
 	"github.com/monlor/k8s-image-updater/pkg/registry"
+	"github.com/monlor/k8s-image-updater/pkg/status"
+	"github.com/monlor/k8s-image-updater/pkg/verify"
+	"github.com/monlor/k8s-image-updater/pkg/writeback"
 	"github.com/sirupsen/logrus"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+// ErrNoMatchingTags is returned when the allow-tags filter removes every tag of an image,
+// or none of the newer tags carries the required annotation
+var ErrNoMatchingTags = errors.New("no tags match the allow-tags filter")
+
+// ErrDigestNotAllowed is returned when no newer image has a digest of the allowed-digests annotation
+var ErrDigestNotAllowed = errors.New("digest not in the allowed-digests annotation")
+
+// ErrCheckInProgress is returned by CheckAndUpdate when the previous check has not finished yet
+var ErrCheckInProgress = errors.New("previous check still in progress")
+
+// ErrRegistryNotAllowed is returned when an image comes from a registry missing from ALLOWED_REGISTRIES
+var ErrRegistryNotAllowed = errors.New("registry is not allowed")
+
+// ErrUnparseableImage is returned for a container image that is not a valid image reference, with UNPARSEABLE_IMAGES=error
+var ErrUnparseableImage = errors.New("unparseable image")
+
+// ErrDuplicateContainerName is returned for the containers sharing the target container name, with DUPLICATE_CONTAINER_NAMES=error
+var ErrDuplicateContainerName = errors.New("duplicate container name")
+
 type Updater struct {
 	k8sClient *k8s.Client
-	registry  *registry.RegistryClient
+	// Kubeconfig context of the cluster of k8sClient, empty for the default cluster
+	cluster  string
+	registry *registry.RegistryClient
+	// When set, image updates are written back instead of applied to the cluster
+	writeBack writeback.WriteBack
+	// When set, new images are only rolled out if their signature verifies
+	verifier verify.Verifier
+	// When set, run before and after every rollout, a failing pre-update hook aborts it
+	hooks *hooks.Hooks
+	// OCI annotations of tags looked up for the require-annotation annotation
+	tagAnnotations *tagCache[map[string]string]
+	// Creation time of tags looked up for the min-tag-age annotation
+	tagCreated *tagCache[time.Time]
+	// When set, CheckAndUpdate only checks this resource
+	target *config.TargetResource
+	// Rules of POLICY_CONFIGMAP, read at the start of every check
+	policy atomic.Pointer[Policy]
+	// Time of restarts, canaries, pull failure watches and the tag caches
+	clock clock.Clock
+
+	// Held while CheckAndUpdate runs, so checks never overlap
+	cycleMu sync.Mutex
+	// Signals Start that IMAGE_UPDATE_INTERVAL was reloaded
+	intervalChanged chan struct{}
+
+	// Slots of the writes of the running cycle, at most APPLY_CONCURRENCY run at once
+	applySlots chan struct{}
+
+	// Guards the state below, shared by the resources checked at once with REGISTRY_QUERY_CONCURRENCY
+	mu sync.Mutex
+	// Rollouts are queued in pending during a cycle limited by MAX_UPDATES_PER_CYCLE,
+	// those left over are recorded in deferred and go first next cycle
+	limitUpdates bool
+	pending      []pendingUpdate
+	deferred     map[string]bool
+
+	// Consecutive failed writes of each resource, by kind/namespace/name
+	applyFailures map[string]int
+	// Images applied to each resource within FLAP_DETECTION_WINDOW, by kind/namespace/name
+	appliedImages map[string][]appliedImage
+	// Counts of the running cycle, logged with LOG_SUMMARY_ONLY
+	stats cycleStats
 }
 
-func NewUpdater() (*Updater, error) {
-	// Create Kubernetes client
-	k8sClient, err := k8s.GetClient()
+// NewUpdaters creates an updater per cluster of KUBE_CONTEXTS, or a single updater of the default cluster
+func NewUpdaters() ([]*Updater, error) {
+	// Create a Kubernetes client per cluster
+	clusters, err := k8s.GetClustersWithRetry(config.GlobalConfig.K8sClientRetryTimeout)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create kubernetes client: %v", err)
 	}
+	return newUpdaters(clusters)
+}
+
+// newUpdaters creates an updater per cluster, sharing the write-back, signature verifier and hooks
+func newUpdaters(clusters []k8s.Cluster) ([]*Updater, error) {
+	writeBack, err := writeback.New(config.GlobalConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create write-back: %v", err)
+	}
+
+	verifier, err := verify.New(config.GlobalConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create signature verifier: %v", err)
+	}
+
+	updateHooks, err := hooks.New(config.GlobalConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create update hooks: %v", err)
+	}
+
+	if _, err := config.GlobalConfig.ImageExcludes(); err != nil {
+		return nil, fmt.Errorf("invalid GLOBAL_IMAGE_EXCLUDES: %v", err)
+	}
+	if _, err := config.GlobalConfig.IgnoredContainers(); err != nil {
+		return nil, fmt.Errorf("invalid IGNORED_CONTAINER_NAMES: %v", err)
+	}
+	if _, err := config.GlobalConfig.TagChannel(); err != nil {
+		return nil, fmt.Errorf("invalid TAG_CHANNEL_PATTERN: %v", err)
+	}
+	if _, err := config.GlobalConfig.NameStyle(); err != nil {
+		return nil, fmt.Errorf("invalid IMAGE_NAME_STYLE: %v", err)
+	}
+	if _, err := config.GlobalConfig.TemplateImageMode(); err != nil {
+		return nil, fmt.Errorf("invalid TEMPLATE_IMAGE_ANNOTATION_MODE: %v", err)
+	}
+	if _, err := config.GlobalConfig.DefaultMode(); err != nil {
+		return nil, fmt.Errorf("invalid DEFAULT_UPDATE_MODE: %v", err)
+	}
+	if _, err := config.GlobalConfig.UnparseableImageMode(); err != nil {
+		return nil, fmt.Errorf("invalid UNPARSEABLE_IMAGES: %v", err)
+	}
+	if _, err := config.GlobalConfig.DuplicateContainerMode(); err != nil {
+		return nil, fmt.Errorf("invalid DUPLICATE_CONTAINER_NAMES: %v", err)
+	}
+	if _, _, err := config.GlobalConfig.PolicyConfigMapRef(); err != nil {
+		return nil, fmt.Errorf("invalid POLICY_CONFIGMAP: %v", err)
+	}
+	if _, err := config.GlobalConfig.RBACNamespaces(); err != nil {
+		return nil, err
+	}
+
+	freezeNamespace, freezeName, err := config.GlobalConfig.FreezeStateConfigMapRef()
+	if err != nil {
+		return nil, fmt.Errorf("invalid FREEZE_STATE_CONFIGMAP: %v", err)
+	}
+	// The freeze is saved in the first cluster, the one the API serves by default
+	if config.GlobalConfig.FreezeOnCrashLoop && len(clusters) > 0 {
+		if freezeNamespace == "" {
+			logrus.Warn("The namespace of the updater is not known, a restart clears a freeze of FREEZE_ON_CRASHLOOP. Set POD_NAMESPACE or FREEZE_STATE_CONFIGMAP to save it")
+		} else if err := LoadFreeze(context.Background(), clusters[0].Client, freezeNamespace, freezeName); err != nil {
+			return nil, fmt.Errorf("failed to load freeze: %v", err)
+		}
+	}
+
+	target, err := config.GlobalConfig.Target()
+	if err != nil {
+		return nil, fmt.Errorf("invalid TARGET_RESOURCE: %v", err)
+	}
+	if target != nil {
+		logrus.Infof("Only checking %s", target)
+	}
+
+	updaters := make([]*Updater, 0, len(clusters))
+	for _, cluster := range clusters {
+		u := NewUpdaterWithClient(cluster.Client)
+		u.cluster = cluster.Name
+		u.writeBack = writeBack
+		u.verifier = verifier
+		u.hooks = updateHooks
+		u.target = target
+		updaters = append(updaters, u)
+	}
+	return updaters, nil
+}
 
+// NewUpdaterWithClient creates an updater using an existing kubernetes client
+func NewUpdaterWithClient(k8sClient *k8s.Client) *Updater {
 	return &Updater{
-		k8sClient: k8sClient,
-		registry:  registry.NewRegistryClient("", ""), // Default to anonymous access
-	}, nil
+		k8sClient:       k8sClient,
+		registry:        registry.NewRegistryClient("", ""), // Default to anonymous access
+		tagAnnotations:  newTagCache[map[string]string](),
+		tagCreated:      newTagCache[time.Time](),
+		clock:           clock.Real{},
+		intervalChanged: make(chan struct{}, 1),
+	}
 }
 
-// Start the auto-update process
+// Start the auto-update process, checking every IMAGE_UPDATE_INTERVAL once STARTUP_DELAY has elapsed
 func (u *Updater) Start(ctx context.Context) {
-	ticker := time.NewTicker(config.GlobalConfig.ImageUpdateInterval)
+	if delay := config.GlobalConfig.StartupDelay; delay > 0 {
+		logrus.Infof("Waiting %s before checking for image updates%s", delay, u.clusterSuffix())
+		select {
+		case <-ctx.Done():
+			return
+		case <-u.clock.After(delay):
+		}
+	}
+
+	ticker := time.NewTicker(config.Tuning().ImageUpdateInterval)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ctx.Done():
 			return
+		case <-u.intervalChanged:
+			interval := config.Tuning().ImageUpdateInterval
+			logrus.Infof("Checking for image updates every %s%s", interval, u.clusterSuffix())
+			ticker.Reset(interval)
 		case <-ticker.C:
-			if err := u.CheckAndUpdate(ctx); err != nil {
-				logrus.Errorf("Failed to check and update images: %v", err)
+			if err := u.CheckAndUpdate(ctx); errors.Is(err, ErrCheckInProgress) {
+				logrus.Warnf("Skipping check for image updates%s: %v", u.clusterSuffix(), err)
+			} else if err != nil {
+				logrus.Errorf("Failed to check and update images%s: %v", u.clusterSuffix(), err)
 			}
 		}
 	}
 }
 
-// Check and update all resources with auto-update annotations
+// ResetInterval makes Start wait the reloaded IMAGE_UPDATE_INTERVAL before the next check
+func (u *Updater) ResetInterval() {
+	select {
+	case u.intervalChanged <- struct{}{}:
+	default:
+	}
+}
+
+// Check and update all resources with auto-update annotations. A check is cancelled after CHECK_CYCLE_TIMEOUT,
+// and ErrCheckInProgress is returned without checking while the previous check is still running.
 func (u *Updater) CheckAndUpdate(ctx context.Context) error {
-	logrus.Debug("Starting periodic check for image updates")
+	if !u.cycleMu.TryLock() {
+		return ErrCheckInProgress
+	}
+	defer u.cycleMu.Unlock()
+
+	// A reload during the check applies to the next one
+	tuning := config.Tuning()
+	timeout := tuning.CheckCycleTimeout
+	if timeout <= 0 {
+		timeout = tuning.ImageUpdateInterval
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	// Resources sharing an image list its tags once per check
+	ctx = withTagListMemo(ctx)
+
+	checkDebugf("Starting periodic check for image updates")
+
+	// Rollouts are collected and only the first MAX_UPDATES_PER_CYCLE applied
+	maxUpdates := tuning.MaxUpdatesPerCycle
+	u.limitUpdates = maxUpdates > 0
+	defer func() { u.limitUpdates = false }()
+	u.applySlots = make(chan struct{}, max(tuning.ApplyConcurrency, 1))
+	defer func() { u.applySlots = nil }()
+
+	startedAt := u.clock.Now()
+	complete := true
+	u.stats = cycleStats{}
+	u.loadPolicy(ctx)
 
 	// Check deployments
-	if err := u.updateDeployments(ctx); err != nil {
-		logrus.Errorf("Failed to update deployments: %v", err)
+	if u.targetsKind("deployment") {
+		if err := u.updateDeployments(ctx); err != nil {
+			u.resourceErrorf("Failed to update deployments: %v", err)
+			complete = false
+		}
 	}
 
 	// Check statefulsets
-	if err := u.updateStatefulSets(ctx); err != nil {
-		logrus.Errorf("Failed to update statefulsets: %v", err)
+	if u.targetsKind("statefulset") {
+		if err := u.updateStatefulSets(ctx); err != nil {
+			u.resourceErrorf("Failed to update statefulsets: %v", err)
+			complete = false
+		}
 	}
 
 	// Check daemonsets
-	if err := u.updateDaemonSets(ctx); err != nil {
-		logrus.Errorf("Failed to update daemonsets: %v", err)
+	if u.targetsKind("daemonset") {
+		if err := u.updateDaemonSets(ctx); err != nil {
+			u.resourceErrorf("Failed to update daemonsets: %v", err)
+			complete = false
+		}
 	}
 
-	logrus.Debug("Completed periodic check for image updates")
+	// Check OpenKruise workloads
+	if config.GlobalConfig.EnableKruise {
+		for _, kind := range []string{k8s.KindCloneSet, k8s.KindAdvancedStatefulSet} {
+			if !u.targetsKind(kind) {
+				continue
+			}
+			if err := u.updateKruiseWorkloads(ctx, kind); err != nil {
+				u.resourceErrorf("Failed to update %s workloads: %v", kind, err)
+				complete = false
+			}
+		}
+	}
+
+	// Resources not checked by a complete cycle were deleted or disabled, a targeted cycle checks just one
+	if complete && u.target == nil && ctx.Err() == nil {
+		status.Prune(u.cluster, startedAt)
+	}
+
+	if u.limitUpdates {
+		u.applyPending(ctx, maxUpdates)
+	}
+	if tuning.LogSummaryOnly {
+		logrus.Infof("Checked for image updates%s: checked=%d updated=%d errors=%d duration=%s",
+			u.clusterSuffix(), u.stats.checked, u.stats.updated, u.stats.errors, u.clock.Now().Sub(startedAt).Round(time.Millisecond))
+	}
+
+	var err error
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("check did not complete within %s: %w", timeout, ctx.Err())
+		u.stats.messages = append(u.stats.messages, err.Error())
+	}
+	u.postCycleSummary(ctx, startedAt)
+	if err != nil {
+		return err
+	}
+	checkDebugf("Completed periodic check for image updates")
 	return nil
 }
 
-// getRegistryClientForImage finds the right registry client (with auth) for a given image.
-// It iterates through a list of image pull secrets to find credentials.
-func (u *Updater) getRegistryClientForImage(ctx context.Context, image, namespace string, secretNames []string) (*registry.RegistryClient, error) {
+// postCycleSummary posts the stats of the cycle started at startedAt to CYCLE_WEBHOOK_URL, also when it timed out
+func (u *Updater) postCycleSummary(ctx context.Context, startedAt time.Time) {
+	if u.hooks == nil {
+		return
+	}
+	summary := hooks.CycleSummary{
+		Cluster:   u.cluster,
+		StartTime: startedAt.UTC(),
+		Duration:  u.clock.Now().Sub(startedAt).Seconds(),
+		Checked:   u.stats.checked,
+		Updated:   u.stats.updates,
+		Errors:    u.stats.messages,
+	}
+	if err := u.hooks.CycleDone(context.WithoutCancel(ctx), summary); err != nil {
+		logrus.Errorf("Failed to post cycle summary%s: %v", u.clusterSuffix(), err)
+	}
+}
+
+// clusterSuffix names the cluster of the updater in log messages, empty for the default cluster
+func (u *Updater) clusterSuffix() string {
+	if u.cluster == "" {
+		return ""
+	}
+	return " of cluster " + u.cluster
+}
+
+// targetsKind reports whether a check covers resources of a kind, all kinds unless TARGET_RESOURCE is set
+func (u *Updater) targetsKind(kind string) bool {
+	return u.target == nil || u.target.Kind == kind
+}
+
+// getRegistryClientForImage finds the right registry client (with auth) for a given image, reaching the registry with
+// the TLS settings of the registry-insecure and registry-ca-secret annotations of the resource if set.
+func (u *Updater) getRegistryClientForImage(ctx context.Context, image, namespace string, secretNames []string, annotations map[string]string) (*registry.RegistryClient, error) {
+	client, err := u.getRegistryCredentials(ctx, image, namespace, secretNames)
+	if err != nil {
+		return nil, err
+	}
+	transport, err := u.registryTransport(ctx, namespace, annotations)
+	if err != nil {
+		return nil, err
+	}
+	if transport != nil {
+		return client.WithTransport(transport), nil
+	}
+	return client, nil
+}
+
+// registryTransport returns the transport for the registry TLS annotations of a resource, nil when it has none
+func (u *Updater) registryTransport(ctx context.Context, namespace string, annotations map[string]string) (http.RoundTripper, error) {
+	insecureValue, secretName := annotations[config.AnnotationRegistryInsecure], annotations[config.AnnotationRegistryCASecret]
+	if insecureValue == "" && secretName == "" {
+		return nil, nil
+	}
+	insecure := false
+	if insecureValue != "" {
+		var err error
+		if insecure, err = strconv.ParseBool(insecureValue); err != nil {
+			return nil, fmt.Errorf("invalid %s annotation %q, must be true or false", config.AnnotationRegistryInsecure, insecureValue)
+		}
+	}
+	var caPEM []byte
+	if secretName != "" {
+		secret, err := u.k8sClient.GetSecret(ctx, namespace, secretName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get registry CA secret %s: %v", secretName, err)
+		}
+		if caPEM = secret.Data[registryCASecretKey]; len(caPEM) == 0 {
+			return nil, fmt.Errorf("registry CA secret %s has no %s key", secretName, registryCASecretKey)
+		}
+	}
+	transport, err := registry.TLSTransport(insecure, caPEM)
+	if err != nil {
+		return nil, fmt.Errorf("invalid registry CA secret %s: %v", secretName, err)
+	}
+	return transport, nil
+}
+
+// getRegistryCredentials finds the right registry client (with auth) for a given image.
+// It iterates through a list of image pull secrets in order to find credentials, then falls back to REGISTRY_AUTH_ env vars
+// and DOCKER_CONFIG_FILE.
+func (u *Updater) getRegistryCredentials(ctx context.Context, image, namespace string, secretNames []string) (*registry.RegistryClient, error) {
 	imageInfo, err := registry.ParseImage(image)
 	if err != nil {
 		// Fallback to anonymous client if parsing fails, as it might be a local image
@@ -104,7 +443,7 @@ func (u *Updater) getRegistryClientForImage(ctx context.Context, image, namespac
 		}
 
 		if secret.Type != corev1.SecretTypeDockerConfigJson {
-			logrus.Debugf("Secret %s is not of type %s, skipping", secretName, corev1.SecretTypeDockerConfigJson)
+			checkDebugf("Secret %s is not of type %s, skipping", secretName, corev1.SecretTypeDockerConfigJson)
 			continue
 		}
 
@@ -134,107 +473,312 @@ func (u *Updater) getRegistryClientForImage(ctx context.Context, image, namespac
 					password = parts[1]
 				}
 			}
-			logrus.Debugf("Found credentials for registry %s in secret %s", imageRegistry, secretName)
+			checkDebugf("Found credentials for registry %s in secret %s", imageRegistry, secretName)
+			return registry.NewRegistryClient(username, password), nil
+		}
+	}
+
+	if cred, ok := config.GlobalConfig.RegistryCredentials(imageRegistry); ok {
+		checkDebugf("Using credentials %s from %s env for registry %s", cred, config.RegistryAuthPrefix, imageRegistry)
+		return registry.NewRegistryClient(cred.Username, cred.Password), nil
+	}
+
+	if path := config.GlobalConfig.DockerConfigFile; path != "" {
+		username, password, ok, err := registry.DockerConfigCredentials(path, imageRegistry)
+		if err != nil {
+			logrus.Warnf("Failed to read credentials of registry %s from DOCKER_CONFIG_FILE, skipping: %v", imageRegistry, err)
+		} else if ok {
+			checkDebugf("Using credentials of registry %s from %s", imageRegistry, path)
 			return registry.NewRegistryClient(username, password), nil
 		}
 	}
 
-	logrus.Debugf("No credentials found for registry %s in provided secrets, using anonymous access.", imageRegistry)
+	checkDebugf("No credentials found for registry %s in provided secrets, using anonymous access.", imageRegistry)
 	return registry.NewRegistryClient("", ""), nil
 }
 
-// filterTagsByRegex filters a list of tags based on a regex pattern.
-func filterTagsByRegex(tags []string, regexStr string) ([]string, error) {
-	if regexStr == "" {
+// Key of the CA bundle in the secret of the registry-ca-secret annotation
+const registryCASecretKey = "ca.crt"
+
+// Prefixes of the allow-tags annotation selecting how tags are filtered
+const (
+	allowTagsFilterPrefix = "regexp:"
+	allowTagsGlobPrefix   = "glob:"
+)
+
+// isTagFilter reports whether an allow-tags value is a regexp: or glob: filter rather than a single tag
+func isTagFilter(allowTags string) bool {
+	return strings.HasPrefix(allowTags, allowTagsFilterPrefix) || strings.HasPrefix(allowTags, allowTagsGlobPrefix)
+}
+
+// filterTags filters a list of tags with a "regexp:" or "glob:" allow-tags filter.
+// Glob patterns support *, ? and character classes like [0-9].
+func filterTags(tags []string, filter string) ([]string, error) {
+	var match func(tag string) bool
+	switch {
+	case filter == "":
 		return tags, nil
+	case strings.HasPrefix(filter, allowTagsFilterPrefix):
+		re, err := regexp.Compile(strings.TrimPrefix(filter, allowTagsFilterPrefix))
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex for allow-tags: %v", err)
+		}
+		match = re.MatchString
+	case strings.HasPrefix(filter, allowTagsGlobPrefix):
+		pattern := strings.TrimPrefix(filter, allowTagsGlobPrefix)
+		// path.Match only reports a malformed pattern when it reaches it, check it up front
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid glob for allow-tags %q: %v", pattern, err)
+		}
+		match = func(tag string) bool {
+			matched, _ := path.Match(pattern, tag)
+			return matched
+		}
+	default:
+		return nil, fmt.Errorf("allow-tags filter %q must start with %s or %s", filter, allowTagsFilterPrefix, allowTagsGlobPrefix)
 	}
-	re, err := regexp.Compile(regexStr)
-	if err != nil {
-		return nil, fmt.Errorf("invalid regex for allow-tags: %v", err)
-	}
+
 	filteredTags := []string{}
 	for _, tag := range tags {
-		if re.MatchString(tag) {
+		if match(tag) {
 			filteredTags = append(filteredTags, tag)
 		}
 	}
-	logrus.Debugf("Filtered %d tags to %d with regex: %s", len(tags), len(filteredTags), regexStr)
+	checkDebugf("Filtered %d tags to %d with allow-tags %s", len(tags), len(filteredTags), filter)
 	return filteredTags, nil
 }
 
-// Check if an image needs to be updated based on mode
-func (u *Updater) checkReleaseMode(ctx context.Context, currentImage string, registryClient *registry.RegistryClient, allowTagsRegex string) (string, error) {
+// listCandidateTags lists the tags of an image and applies the allow-tags filter.
+// It returns ErrNoMatchingTags when the filter removed every tag.
+func listCandidateTags(ctx context.Context, currentImage string, registryClient *registry.RegistryClient, allowTagsFilter string) ([]string, error) {
+	tags, err := listTags(ctx, currentImage, registryClient)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tags for %s: %v", currentImage, err)
+	}
+	checkDebugf("Found %d tags for image %s", len(tags), currentImage)
+
+	filteredTags, err := filterTags(tags, allowTagsFilter)
+	if err != nil {
+		return nil, err
+	}
+	if len(tags) > 0 && len(filteredTags) == 0 {
+		logrus.Warnf("None of the %d tags of image %s match allow-tags %s", len(tags), currentImage, allowTagsFilter)
+		return nil, fmt.Errorf("%w: image %s, filter %s", ErrNoMatchingTags, currentImage, allowTagsFilter)
+	}
+	return filteredTags, nil
+}
+
+// newTagImage builds the reference for a selected tag, resolving and pinning its digest if requested.
+// It returns an empty string when the current image already points at that tag (and digest).
+func newTagImage(ctx context.Context, imageInfo *registry.ImageInfo, tag string, registryClient *registry.RegistryClient, pinDigest bool) (string, error) {
+	if !pinDigest {
+		if tag == imageInfo.Tag {
+			return "", nil
+		}
+		return registry.BuildImageRef(imageInfo, tag, ""), nil
+	}
+
+	image := registry.BuildImageRefStyle(imageInfo, tag, "", config.ImageNameFull)
+	digest, err := registryClient.GetDigest(ctx, image)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve digest for %s: %v", image, err)
+	}
+	if tag == imageInfo.Tag && sameDigest(imageInfo.Digest, digest) {
+		return "", nil
+	}
+	return registry.BuildImageRef(imageInfo, tag, digest), nil
+}
+
+// filterDowngrades keeps the version tags, sorted from highest to lowest, that are neither below the current tag
+// nor below minVersion. Other tags of the same precedence as the current tag, e.g. differing by build metadata,
+// are dropped as they are no update. A current tag that is not a version does not restrict the tags.
+func filterDowngrades(sortedTags []string, currentTag, minVersion string) ([]string, error) {
+	var floor *version.Version
+	if minVersion != "" {
+		var err error
+		if floor, err = registry.ParseVersionTag(minVersion); err != nil {
+			return nil, fmt.Errorf("invalid %s annotation %q: %v", config.AnnotationMinVersion, minVersion, err)
+		}
+	}
+	current, err := registry.ParseVersionTag(currentTag)
+	if err != nil {
+		current = nil
+	} else if floor == nil || current.GreaterThan(floor) {
+		floor = current
+	}
+	if floor == nil {
+		return sortedTags, nil
+	}
+
+	tags := []string{}
+	for _, tag := range sortedTags {
+		v, err := registry.ParseVersionTag(tag)
+		if err == nil && v.LessThan(floor) {
+			break
+		}
+		if err == nil && current != nil && tag != currentTag && v.Equal(current) {
+			continue
+		}
+		tags = append(tags, tag)
+	}
+	return tags, nil
+}
+
+// versionsBehind counts the distinct versions of the sorted tags newer than the current tag,
+// -1 when the current tag is not a version
+func versionsBehind(sortedTags []string, currentTag string) int {
+	current, err := registry.ParseVersionTag(currentTag)
+	if err != nil {
+		return -1
+	}
+	newer := make(map[string]bool)
+	for _, tag := range sortedTags {
+		if v, err := registry.ParseVersionTag(tag); err == nil && v.GreaterThan(current) {
+			// Build metadata does not make a distinct version
+			newer[strings.SplitN(v.String(), "+", 2)[0]] = true
+		}
+	}
+	return len(newer)
+}
+
+// recordVersionsBehind sets the versions behind gauge of a container, removing it when unknown
+func recordVersionsBehind(ctx context.Context, kind, namespace, name, container string, behind int) {
+	if !recordsMetrics(ctx) {
+		return
+	}
+	if behind < 0 {
+		metrics.VersionsBehind.DeleteLabelValues(namespace, kind, name, container)
+		return
+	}
+	metrics.VersionsBehind.WithLabelValues(namespace, kind, name, container).Set(float64(behind))
+}
+
+// Check if an image needs to be updated based on mode. It also returns the number of allowed versions
+// newer than the current image, -1 when the current tag is not a version.
+func (u *Updater) checkReleaseMode(ctx context.Context, currentImage string, registryClient *registry.RegistryClient, allowTagsFilter string, requiredAnnotation string, minTagAge time.Duration, minVersion string, pinDigest bool, allowedDigests []string) (string, int, error) {
 	imageInfo, err := registry.ParseImage(currentImage)
 	if err != nil {
-		return "", fmt.Errorf("failed to parse image %s: %v", currentImage, err)
+		return "", -1, fmt.Errorf("failed to parse image %s: %v", currentImage, err)
+	}
+
+	// A tag like nightly cannot be compared with versions, switching to one is opt-in
+	if _, err := registry.ParseVersionTag(imageInfo.Tag); imageInfo.Tag != "" && err != nil && !config.GlobalConfig.AllowSwitchFromUnversioned {
+		logrus.Warnf("Current tag %s of %s is not a version, skipping release mode update. Set ALLOW_SWITCH_FROM_UNVERSIONED=true to switch to the latest version", imageInfo.Tag, currentImage)
+		return "", -1, nil
+	}
+
+	tags, err := listCandidateTags(ctx, currentImage, registryClient, allowTagsFilter)
+	if err != nil {
+		return "", -1, err
+	}
+
+	sortedTags, err := filterDowngrades(registry.SortVersionTags(filterChannel(tags, imageInfo.Tag)), imageInfo.Tag, minVersion)
+	if err != nil {
+		return "", -1, err
+	}
+	behind := versionsBehind(sortedTags, imageInfo.Tag)
+	tag, err := u.selectTag(ctx, imageInfo, sortedTags, registryClient, requiredAnnotation, minTagAge, allowedDigests)
+	if err != nil || tag == "" {
+		return "", behind, err
+	}
+	// Keep the repo:tag@digest form of an image pinned without the annotation, admission controllers may require it
+	pinDigest = pinDigest || (imageInfo.Tag != "" && imageInfo.Digest != "")
+	newImage, err := newTagImage(ctx, imageInfo, tag, registryClient, pinDigest)
+	if err != nil {
+		return "", behind, err
 	}
+	if newImage != "" {
+		checkDebugf("Current tag: %s, Latest tag: %s", imageInfo.Tag, tag)
+	}
+	return newImage, behind, nil
+}
 
-	tags, err := registryClient.ListTags(ctx, currentImage)
+// checkAlphabeticalMode picks the first tag in sortOrder ("asc" or "desc") order
+func (u *Updater) checkAlphabeticalMode(ctx context.Context, currentImage string, registryClient *registry.RegistryClient, allowTagsFilter string, requiredAnnotation string, minTagAge time.Duration, sortOrder string, allowedDigests []string) (string, error) {
+	imageInfo, err := registry.ParseImage(currentImage)
 	if err != nil {
-		return "", fmt.Errorf("failed to list tags for %s: %v", currentImage, err)
+		return "", fmt.Errorf("failed to parse image %s: %v", currentImage, err)
 	}
-	logrus.Debugf("Found %d tags for image %s", len(tags), currentImage)
 
-	tags, err = filterTagsByRegex(tags, allowTagsRegex)
+	tags, err := listCandidateTags(ctx, currentImage, registryClient, allowTagsFilter)
 	if err != nil {
 		return "", err
 	}
 
-	sortedTags := registry.SortVersionTags(tags)
-	if len(sortedTags) > 0 && sortedTags[0] != imageInfo.Tag {
-		logrus.Debugf("Current tag: %s, Latest tag: %s", imageInfo.Tag, sortedTags[0])
-		return fmt.Sprintf("%s/%s:%s", imageInfo.Registry, imageInfo.Repository, sortedTags[0]), nil
+	var sortedTags []string
+	if sortOrder == "asc" {
+		sortedTags = registry.SortAlphabeticalTagsAsc(tags)
+	} else {
+		sortedTags = registry.SortAlphabeticalTags(tags)
+	}
+	tag, err := u.selectTag(ctx, imageInfo, sortedTags, registryClient, requiredAnnotation, minTagAge, allowedDigests)
+	if err != nil {
+		return "", err
+	}
+	if tag != "" && tag != imageInfo.Tag {
+		checkDebugf("Current tag: %s, Latest tag: %s", imageInfo.Tag, tag)
+		return registry.BuildImageRef(imageInfo, tag, ""), nil
 	}
 	return "", nil
 }
 
-func (u *Updater) checkAlphabeticalMode(ctx context.Context, currentImage string, registryClient *registry.RegistryClient, allowTagsRegex string) (string, error) {
+// checkDateMode picks the newest tag parsed as a date with layout
+func (u *Updater) checkDateMode(ctx context.Context, currentImage string, registryClient *registry.RegistryClient, allowTagsFilter string, requiredAnnotation string, minTagAge time.Duration, layout string, allowedDigests []string) (string, error) {
 	imageInfo, err := registry.ParseImage(currentImage)
 	if err != nil {
 		return "", fmt.Errorf("failed to parse image %s: %v", currentImage, err)
 	}
 
-	tags, err := registryClient.ListTags(ctx, currentImage)
+	tags, err := listCandidateTags(ctx, currentImage, registryClient, allowTagsFilter)
 	if err != nil {
-		return "", fmt.Errorf("failed to list tags for %s: %v", currentImage, err)
+		return "", err
 	}
-	logrus.Debugf("Found %d tags for image %s", len(tags), currentImage)
 
-	tags, err = filterTagsByRegex(tags, allowTagsRegex)
+	sortedTags := registry.SortDateTags(tags, layout)
+	if len(tags) > 0 && len(sortedTags) == 0 {
+		logrus.Warnf("None of the %d tags of image %s parse with date format %s", len(tags), currentImage, layout)
+	}
+	tag, err := u.selectTag(ctx, imageInfo, sortedTags, registryClient, requiredAnnotation, minTagAge, allowedDigests)
 	if err != nil {
 		return "", err
 	}
-
-	sortedTags := registry.SortAlphabeticalTags(tags)
-	if len(sortedTags) > 0 && sortedTags[0] != imageInfo.Tag {
-		logrus.Debugf("Current tag: %s, Latest tag: %s", imageInfo.Tag, sortedTags[0])
-		return fmt.Sprintf("%s/%s:%s", imageInfo.Registry, imageInfo.Repository, sortedTags[0]), nil
+	if tag != "" && tag != imageInfo.Tag {
+		checkDebugf("Current tag: %s, Latest tag: %s", imageInfo.Tag, tag)
+		return registry.BuildImageRef(imageInfo, tag, ""), nil
 	}
 	return "", nil
 }
 
-func (u *Updater) checkDigestMode(ctx context.Context, currentImage string, registryClient *registry.RegistryClient, tagToCheck string) (string, error) {
+// checkDigestMode compares the current digest with the digest of tagToCheck, for the platform if one is given
+func (u *Updater) checkDigestMode(ctx context.Context, currentImage string, registryClient *registry.RegistryClient, tagToCheck string, platform string, preserveTag bool, allowedDigests []string) (string, error) {
 	imageInfo, err := registry.ParseImage(currentImage)
 	if err != nil {
 		return "", fmt.Errorf("failed to parse image %s: %v", currentImage, err)
 	}
 
-	imageToCheck := fmt.Sprintf("%s/%s:%s", imageInfo.Registry, imageInfo.Repository, tagToCheck)
+	imageToCheck := registry.BuildImageRefStyle(imageInfo, tagToCheck, "", config.ImageNameFull)
 
-	newDigest, err := registryClient.GetDigest(ctx, imageToCheck)
+	newDigest, err := registryClient.GetPlatformDigest(ctx, imageToCheck, platform)
 	if err != nil {
 		return "", fmt.Errorf("failed to get digest for %s: %v", imageToCheck, err)
 	}
-	logrus.Debugf("Checking digest for %s. Current digest: %s, New digest from registry: %s", imageToCheck, imageInfo.Digest, newDigest)
-	if newDigest != imageInfo.Digest {
-		// We use the image base from the original image, and the new digest. The tag is not preserved.
-		return fmt.Sprintf("%s/%s@%s", imageInfo.Registry, imageInfo.Repository, newDigest), nil
+	checkDebugf("Checking digest for %s. Current digest: %s, New digest from registry: %s", imageToCheck, shortDigest(imageInfo.Digest), shortDigest(newDigest))
+	if !sameDigest(imageInfo.Digest, newDigest) {
+		if !digestAllowed(allowedDigests, newDigest) {
+			return "", fmt.Errorf("%w: digest %s of %s", ErrDigestNotAllowed, shortDigest(newDigest), imageToCheck)
+		}
+		// We use the image base from the original image, and the new digest. The tag is only kept with preserve-tag.
+		if preserveTag {
+			return registry.BuildImageRef(imageInfo, tagToCheck, newDigest), nil
+		}
+		return registry.BuildImageRef(imageInfo, "", newDigest), nil
 	}
 	return "", nil
 }
 
-func (u *Updater) checkLatestMode(ctx context.Context, currentImage string, registryClient *registry.RegistryClient, annotations *map[string]string, podTemplate *corev1.PodTemplateSpec) (bool, error) {
-	newDigest, err := registryClient.GetDigest(ctx, currentImage)
+// checkLatestMode restarts the pods when the digest of the current tag changes, for the platform if one is given
+func (u *Updater) checkLatestMode(ctx context.Context, currentImage string, registryClient *registry.RegistryClient, annotations *map[string]string, podTemplate *corev1.PodTemplateSpec, platform string, minRestartInterval time.Duration, allowedDigests []string) (bool, error) {
+	newDigest, err := registryClient.GetPlatformDigest(ctx, currentImage, platform)
 	if err != nil {
 		return false, fmt.Errorf("failed to get digest for %s: %v", currentImage, err)
 	}
@@ -247,236 +791,541 @@ func (u *Updater) checkLatestMode(ctx context.Context, currentImage string, regi
 	lastDigest := (*annotations)[config.AnnotationLastDigest]
 	if lastDigest == "" {
 		(*annotations)[config.AnnotationLastDigest] = newDigest
-		// First time seeing this image, store the digest
-		logrus.Debugf("First time seeing image %s, storing digest %s", currentImage, newDigest)
+		// First time seeing this image, store the digest without restarting the pods already running it
+		checkDebugf("First time seeing image %s, storing digest %s", currentImage, shortDigest(newDigest))
+		if !config.GlobalConfig.LatestUpdateOnFirstSeen {
+			return false, nil
+		}
+		// LATEST_UPDATE_ON_FIRST_SEEN restarts the pods to pull the digest, like a new digest does
+		if !digestAllowed(allowedDigests, newDigest) {
+			return false, fmt.Errorf("%w: digest %s of %s", ErrDigestNotAllowed, shortDigest(newDigest), currentImage)
+		}
+		(*podTemplate).Annotations[config.AnnotationRestart] = u.clock.Now().Format(time.RFC3339)
 		return true, nil
 	}
 
-	// Compare digests
-	if newDigest != lastDigest {
+	// Compare digests, a stored short or unprefixed digest is rewritten in full
+	if !sameDigest(lastDigest, newDigest) {
+		// The last digest is kept, so the restart happens on the first check after the interval
+		if restartedAt, err := time.Parse(time.RFC3339, podTemplate.Annotations[config.AnnotationRestart]); err == nil && minRestartInterval > 0 {
+			if since := u.clock.Now().Sub(restartedAt); since < minRestartInterval {
+				checkInfof("New digest detected for %s, delaying the restart: last restart %s ago, min-restart-interval is %s",
+					currentImage, since.Truncate(time.Second), minRestartInterval)
+				return false, nil
+			}
+		}
+		// The last digest is kept as well, so an approved digest pushed later is still picked up
+		if !digestAllowed(allowedDigests, newDigest) {
+			return false, fmt.Errorf("%w: digest %s of %s", ErrDigestNotAllowed, shortDigest(newDigest), currentImage)
+		}
 		(*annotations)[config.AnnotationLastDigest] = newDigest
-		(*podTemplate).Annotations["kubectl.kubernetes.io/restartedAt"] = time.Now().Format(time.RFC3339)
-		logrus.Infof(`New digest detected for %s: %s -> %s`, currentImage, lastDigest, newDigest)
+		(*podTemplate).Annotations[config.AnnotationRestart] = u.clock.Now().Format(time.RFC3339)
+		checkInfof(`New digest detected for %s: %s -> %s`, currentImage, shortDigest(lastDigest), shortDigest(newDigest))
 		return true, nil
 	}
+	if lastDigest != newDigest {
+		(*annotations)[config.AnnotationLastDigest] = newDigest
+		checkDebugf("Storing full digest %s of %s", shortDigest(newDigest), currentImage)
+	}
 	return false, nil
 }
 
+// findEnvVar returns the env var with the given name in a container, or nil if absent
+func findEnvVar(container *corev1.Container, name string) *corev1.EnvVar {
+	for i := range container.Env {
+		if container.Env[i].Name == name {
+			return &container.Env[i]
+		}
+	}
+	return nil
+}
+
+// containerAnnotation returns the <key>.<container> annotation, falling back to the resource-wide <key>
+func containerAnnotation(annotations map[string]string, key string, containerName string) string {
+	if value, ok := annotations[key+"."+containerName]; ok {
+		return value
+	}
+	return annotations[key]
+}
+
+// verifyImage checks the signature of an image about to be rolled out, recording a failure in the
+// status annotation and metrics
+func (u *Updater) verifyImage(ctx context.Context, image string, registryClient *registry.RegistryClient, annotations map[string]string, resourceType, namespace, resourceName string) error {
+	if u.verifier == nil {
+		return nil
+	}
+	if err := u.verifier.Verify(ctx, image, registryClient); err != nil {
+		annotations[config.AnnotationStatus] = config.StatusSignatureNotVerified
+		if recordsMetrics(ctx) {
+			metrics.SignatureVerificationFailures.WithLabelValues(resourceType, namespace, resourceName).Inc()
+		}
+		return fmt.Errorf("refusing to roll out %s: %w", image, err)
+	}
+	return nil
+}
+
+// SetVerifier sets the verifier images are checked with before they are rolled out, nil to roll out any image
+func (u *Updater) SetVerifier(verifier verify.Verifier) {
+	u.verifier = verifier
+}
+
+// VerifyImages checks the signatures of images an API or gRPC request sets on a resource, reaching the registry with
+// the pull secrets and registry TLS annotations of the resource. Without a verifier every image passes.
+func (u *Updater) VerifyImages(ctx context.Context, client *k8s.Client, kind, namespace, name string, images []string) error {
+	if u.verifier == nil {
+		return nil
+	}
+	meta, template, err := client.GetWorkload(ctx, kind, namespace, name)
+	if err != nil {
+		return err
+	}
+	return u.VerifyWorkloadImages(ctx, client, kind, namespace, name, meta, template, images)
+}
+
+// VerifyWorkloadImages checks the signatures of images about to be set on a resource already read from the cluster,
+// so the images are verified against the object being written. Without a verifier every image passes.
+func (u *Updater) VerifyWorkloadImages(ctx context.Context, client *k8s.Client, kind, namespace, name string, meta *metav1.ObjectMeta, template *corev1.PodTemplateSpec, images []string) error {
+	if u.verifier == nil {
+		return nil
+	}
+	// Pull and CA secrets are read from the cluster of the request
+	scoped := NewUpdaterWithClient(client)
+	secretNames := pullSecretNames(meta.Annotations, &template.Spec)
+	for _, image := range images {
+		registryClient, err := scoped.getRegistryClientForImage(ctx, image, namespace, secretNames, meta.Annotations)
+		if err != nil {
+			return fmt.Errorf("failed to get registry client: %v", err)
+		}
+		if err := u.verifier.Verify(ctx, image, registryClient); err != nil {
+			metrics.SignatureVerificationFailures.WithLabelValues(kind, namespace, name).Inc()
+			return fmt.Errorf("refusing to roll out %s: %w", image, err)
+		}
+	}
+	return nil
+}
+
+// handleCheckError records the status for recoverable check errors and decides whether to surface them
+func handleCheckError(ctx context.Context, err error, annotations map[string]string) error {
+	if errors.Is(err, ErrDigestNotAllowed) {
+		logrus.Warnf("Keeping the current image, %v", err)
+		annotations[config.AnnotationStatus] = config.StatusDigestNotAllowed
+		countSkipped(ctx, metrics.SkipReasonDigestNotAllowed)
+		return nil
+	}
+	if errors.Is(err, ErrNoMatchingTags) {
+		annotations[config.AnnotationStatus] = config.StatusNoMatchingTags
+		countSkipped(ctx, metrics.SkipReasonNoMatchingTags)
+		if !config.GlobalConfig.StrictTags {
+			return nil
+		}
+	}
+	return err
+}
+
+// pullSecretNames returns the names of the secrets searched for registry credentials in preference order: the
+// comma-separated secrets of the pull-secrets annotation, which need not be imagePullSecrets of the pods, then the
+// imagePullSecrets of the pod spec
+func pullSecretNames(annotations map[string]string, spec *corev1.PodSpec) []string {
+	var secretNames []string
+	listed := make(map[string]bool)
+	add := func(name string) {
+		if name = strings.TrimSpace(name); name != "" && !listed[name] {
+			listed[name] = true
+			secretNames = append(secretNames, name)
+		}
+	}
+	for _, name := range strings.Split(annotations[config.AnnotationPullSecrets], ",") {
+		add(name)
+	}
+	for _, secret := range spec.ImagePullSecrets {
+		add(secret.Name)
+	}
+	return secretNames
+}
+
+// unparseableImage records the status of a tracked image that cannot be parsed, skipping it or failing the
+// check as UNPARSEABLE_IMAGES decides
+func unparseableImage(ctx context.Context, image, name string, err error, annotations map[string]string) (containerUpdate, error) {
+	annotations[config.AnnotationStatus] = config.StatusUnparseableImage
+	if mode, _ := config.GlobalConfig.UnparseableImageMode(); mode == config.UnparseableImageError {
+		return skipUpdate(image, "unparseable image"), fmt.Errorf("%w %q of %s: %v", ErrUnparseableImage, image, name, err)
+	}
+	logrus.Warnf("Skipping %s, its image %q cannot be parsed: %v", name, image, err)
+	countSkipped(ctx, metrics.SkipReasonUnparseableImage)
+	return skipUpdate(image, "unparseable image"), nil
+}
+
+// sharedContainerName reports whether other containers of a pod template have the name of container, and whether
+// container is the first of them
+func sharedContainerName(container *corev1.Container, podTemplate *corev1.PodTemplateSpec) (shared, first bool) {
+	first = true
+	seen := false
+	for i := range podTemplate.Spec.Containers {
+		other := &podTemplate.Spec.Containers[i]
+		if other == container {
+			seen = true
+		} else if other.Name == container.Name {
+			shared = true
+			first = first && seen
+		}
+	}
+	return shared, first
+}
+
+// duplicateContainerName warns about a container sharing its name with other containers, which the API server rejects
+// but some tooling produces. When the container annotation targets the name, only the first of them is updated, or none
+// with DUPLICATE_CONTAINER_NAMES=error. It returns whether the container must be skipped.
+func duplicateContainerName(ctx context.Context, container *corev1.Container, target string, annotations map[string]string, namespace, resourceName, resourceType string, podTemplate *corev1.PodTemplateSpec) (bool, error) {
+	shared, first := sharedContainerName(container, podTemplate)
+	if !shared {
+		return false, nil
+	}
+	if target == "" {
+		if first {
+			logrus.Warnf("Several containers of %s %s/%s are named %s", resourceType, namespace, resourceName, container.Name)
+		}
+		return false, nil
+	}
+
+	annotations[config.AnnotationStatus] = config.StatusDuplicateContainerName
+	if mode, _ := config.GlobalConfig.DuplicateContainerMode(); mode == config.DuplicateContainerError {
+		return true, fmt.Errorf("%w: several containers of %s %s/%s are named %s", ErrDuplicateContainerName, resourceType, namespace, resourceName, container.Name)
+	}
+	if first {
+		logrus.Warnf("Several containers of %s %s/%s are named %s, only updating the first one", resourceType, namespace, resourceName, container.Name)
+		return false, nil
+	}
+	countSkipped(ctx, metrics.SkipReasonDuplicateContainer)
+	return true, nil
+}
+
 // Update container if needed
-func (u *Updater) updateContainerIfNeeded(ctx context.Context, container *corev1.Container, annotations *map[string]string, namespace string, resourceName string, resourceType string, podTemplate *corev1.PodTemplateSpec) (bool, error) {
+func (u *Updater) updateContainerIfNeeded(ctx context.Context, container *corev1.Container, annotations *map[string]string, namespace string, resourceName string, resourceType string, podTemplate *corev1.PodTemplateSpec) (containerUpdate, error) {
 	// Ensure resource annotations map exists
 	if *annotations == nil {
 		*annotations = make(map[string]string)
 	}
 
+	// The image of a resource with a ConfigMap reference is tracked in the ConfigMap
+	if (*annotations)[config.AnnotationConfigMapRef] != "" {
+		return skipUpdate(container.Image, "image tracked in configmap"), nil
+	}
+
 	containerName := (*annotations)[config.AnnotationContainer]
-	if containerName != "" && containerName != container.Name {
-		logrus.Debugf("Container %s does not match target container %s", container.Name, containerName)
-		return false, nil
+	if containerName != "" && !config.ContainerMatches(containerName, container.Name) {
+		checkDebugf("Container %s does not match target container %s", container.Name, containerName)
+		return skipUpdate(container.Image, "not the target container"), nil
+	}
+	if skip, err := duplicateContainerName(ctx, container, containerName, *annotations, namespace, resourceName, resourceType, podTemplate); skip {
+		return skipUpdate(container.Image, "duplicate container name"), err
+	}
+	if skipsInjectedContainer(*annotations, podTemplate, container.Name) {
+		checkDebugf("Skipping container %s of %s %s/%s, injected by an admission webhook", container.Name, resourceType, namespace, resourceName)
+		countSkipped(ctx, metrics.SkipReasonInjected)
+		return skipUpdate(container.Image, "injected sidecar"), nil
+	}
+
+	// The tracked image is either the container image or held in an env var
+	tracked := trackedImage{
+		name:       container.Name,
+		image:      container.Image,
+		set:        func(image string) { container.Image = image },
+		pullPolicy: container.ImagePullPolicy,
+	}
+	if envName := (*annotations)[config.AnnotationImageEnv]; envName != "" {
+		imageEnv := findEnvVar(container, envName)
+		if imageEnv == nil {
+			checkDebugf("Container %s has no env var %s, skipping", container.Name, envName)
+			return skipUpdate(container.Image, "env var "+envName+" not found"), nil
+		}
+		if imageEnv.Value == "" {
+			logrus.Warnf("Env var %s in container %s has no literal value, skipping", envName, container.Name)
+			return skipUpdate(container.Image, "env var "+envName+" has no literal value"), nil
+		}
+		tracked.image = imageEnv.Value
+		tracked.set = func(image string) { imageEnv.Value = image }
+		checkDebugf("Tracking image %s from env var %s in container %s", tracked.image, envName, container.Name)
+	}
+	trackTemplateAnnotation(&tracked, podTemplate)
+	maxSizeChange, err := parseSizeChangeAnnotation(*annotations)
+	if err != nil {
+		return skipUpdate(tracked.image, "invalid max-size-change annotation"), err
+	}
+	update, err := u.updateImageIfNeeded(ctx, tracked, annotations, namespace, resourceName, resourceType, podTemplate)
+	if err != nil || update.Action != actionUpdate || maxSizeChange == 0 {
+		return update, err
+	}
+	return u.checkSizeChange(ctx, tracked, update, maxSizeChange, *annotations, namespace, resourceName, resourceType, podTemplate)
+}
+
+// trackedImage is an image reference followed by the updater, held in a container, an env var or a ConfigMap
+type trackedImage struct {
+	// Container name, or ConfigMap key, selecting per-container annotations
+	name       string
+	image      string
+	set        func(image string)
+	pullPolicy corev1.PullPolicy
+}
+
+// Actions of a containerUpdate
+const (
+	// The image was replaced by a newer one
+	actionUpdate = "update"
+	// The image is unchanged but the pods are restarted to pull a new digest
+	actionRestart = "restart"
+	// The newer image was proposed for review
+	actionPropose = "propose"
+	// Nothing was done, Reason tells why
+	actionNone = "none"
+)
+
+// containerUpdate is the outcome of checking a tracked image for an update
+type containerUpdate struct {
+	// Whether the resource was modified and must be written back
+	Changed  bool
+	Action   string
+	OldImage string
+	NewImage string
+	Reason   string
+}
+
+// skipUpdate returns the result of a check that left the image unchanged
+func skipUpdate(image, reason string) containerUpdate {
+	return containerUpdate{Action: actionNone, OldImage: image, NewImage: image, Reason: reason}
+}
+
+// imageUpdated returns the result of a check that replaced oldImage by newImage
+func imageUpdated(oldImage, newImage, mode string) containerUpdate {
+	return containerUpdate{Changed: true, Action: actionUpdate, OldImage: oldImage, NewImage: newImage, Reason: "newer image found in " + mode + " mode"}
+}
+
+// updateImageIfNeeded selects a new image for a tracked image according to the resource annotations
+// and sets it, returning what was done
+func (u *Updater) updateImageIfNeeded(ctx context.Context, tracked trackedImage, annotations *map[string]string, namespace string, resourceName string, resourceType string, podTemplate *corev1.PodTemplateSpec) (containerUpdate, error) {
+	policy := u.policy.Load()
+	mode := containerMode(policy, *annotations, tracked.name, tracked.image)
+
+	allowTagsAnnotation := policyAnnotation(policy, *annotations, config.AnnotationAllowTags, tracked.name, tracked.image)
+	// A regexp: or glob: value filters tags in release/alphabetical/date mode, a plain value is the tag for digest mode
+	var allowTagsFilter string
+	if isTagFilter(allowTagsAnnotation) {
+		allowTagsFilter = allowTagsAnnotation
+	}
+
+	requiredAnnotation := (*annotations)[config.AnnotationRequireAnnotation]
+	minVersion := containerAnnotation(*annotations, config.AnnotationMinVersion, tracked.name)
+	currentImage, setImage := tracked.image, tracked.set
+	unchanged := skipUpdate(currentImage, "up to date")
+
+	minTagAge, err := parseDurationAnnotation(*annotations, config.AnnotationMinTagAge)
+	if err != nil {
+		return unchanged, err
+	}
+	allowedDigests, err := parseAllowedDigests(containerAnnotation(*annotations, config.AnnotationAllowedDigests, tracked.name))
+	if err != nil {
+		return unchanged, err
 	}
 
-	mode := (*annotations)[config.AnnotationMode]
-	if mode == "" {
-		mode = "release" // Default to release mode
+	if _, err := registry.ParseImage(currentImage); err != nil {
+		return unparseableImage(ctx, currentImage, tracked.name, err, *annotations)
 	}
 
-	allowTagsAnnotation := (*annotations)[config.AnnotationAllowTags]
-	var allowTagsRegex string
-	if strings.HasPrefix(allowTagsAnnotation, "regexp:") {
-		allowTagsRegex = strings.TrimPrefix(allowTagsAnnotation, "regexp:")
+	// Infrastructure images like service mesh sidecars are managed by their own controllers
+	if pattern := registry.ImageExcluded(currentImage); pattern != "" {
+		checkDebugf("Skipping image %s of %s in %s %s/%s, excluded by GLOBAL_IMAGE_EXCLUDES pattern %s", currentImage, tracked.name, resourceType, namespace, resourceName, pattern)
+		countSkipped(ctx, metrics.SkipReasonExcluded)
+		return skipUpdate(currentImage, "excluded by GLOBAL_IMAGE_EXCLUDES pattern "+pattern), nil
 	}
 
-	// Get all imagePullSecrets
-	var secretNames []string
-	for _, secret := range podTemplate.Spec.ImagePullSecrets {
-		secretNames = append(secretNames, secret.Name)
+	if !registry.ImageRegistryAllowed(currentImage) {
+		(*annotations)[config.AnnotationStatus] = config.StatusRegistryNotAllowed
+		countSkipped(ctx, metrics.SkipReasonRegistryNotAllowed)
+		return unchanged, fmt.Errorf("%w: image %s", ErrRegistryNotAllowed, currentImage)
 	}
 
-	registryClient, err := u.getRegistryClientForImage(ctx, container.Image, namespace, secretNames)
+	registryClient, err := u.getRegistryClientForImage(ctx, currentImage, namespace, pullSecretNames(*annotations, &podTemplate.Spec), *annotations)
 	if err != nil {
-		return false, fmt.Errorf("failed to get registry client: %v", err)
+		return unchanged, fmt.Errorf("failed to get registry client: %v", err)
 	}
 
-	logrus.Debugf("Using update mode %s for container %s", mode, container.Name)
+	checkDebugf("Using update mode %s for container %s", mode, tracked.name)
 
 	switch mode {
 	case "latest":
-		if container.ImagePullPolicy != corev1.PullAlways {
-			logrus.Warnf("Container %s is in latest mode but imagePullPolicy is not Always, skipping update", container.Name)
-			return false, nil
+		if tracked.pullPolicy != corev1.PullAlways {
+			logrus.Warnf("Container %s is in latest mode but imagePullPolicy is not Always, skipping update", tracked.name)
+			countSkipped(ctx, metrics.SkipReasonPullPolicy)
+			return skipUpdate(currentImage, "imagePullPolicy is not Always"), nil
 		}
-		needUpdate, err := u.checkLatestMode(ctx, container.Image, registryClient, annotations, podTemplate)
+		minRestartInterval, err := parseDurationAnnotation(*annotations, config.AnnotationMinRestartInterval)
 		if err != nil {
-			return false, err
+			return unchanged, err
+		}
+		lastDigest, restartedAt := (*annotations)[config.AnnotationLastDigest], podTemplate.Annotations[config.AnnotationRestart]
+		needUpdate, err := u.checkLatestMode(ctx, currentImage, registryClient, annotations, podTemplate, resolvePlatform(*annotations, &podTemplate.Spec), minRestartInterval, allowedDigests)
+		if err != nil {
+			return unchanged, handleCheckError(ctx, err, *annotations)
+		}
+		// The restart pulls the new digest, which must be verified first
+		if needUpdate {
+			if err := u.verifyImage(ctx, currentImage, registryClient, *annotations, resourceType, namespace, resourceName); err != nil {
+				(*annotations)[config.AnnotationLastDigest] = lastDigest
+				if lastDigest == "" {
+					delete(*annotations, config.AnnotationLastDigest)
+				}
+				podTemplate.Annotations[config.AnnotationRestart] = restartedAt
+				if restartedAt == "" {
+					delete(podTemplate.Annotations, config.AnnotationRestart)
+				}
+				return unchanged, err
+			}
 		}
 		if needUpdate {
-			logrus.Infof("[latest] Updating image for container %s in %s %s/%s to %s", container.Name, resourceType, namespace, resourceName, container.Image)
-			return true, nil
+			checkInfof("[latest] Updating image for container %s in %s %s/%s to %s", tracked.name, resourceType, namespace, resourceName, currentImage)
+			return containerUpdate{Changed: true, Action: actionRestart, OldImage: currentImage, NewImage: currentImage, Reason: "new digest found in latest mode"}, nil
 		}
 
 	case "digest":
 		tagToCheck := "latest" // default
-		if allowTagsAnnotation != "" && !strings.HasPrefix(allowTagsAnnotation, "regexp:") {
+		if allowTagsAnnotation != "" && !isTagFilter(allowTagsAnnotation) {
 			tagToCheck = allowTagsAnnotation
 		}
-		newImage, err := u.checkDigestMode(ctx, container.Image, registryClient, tagToCheck)
+		preserveTag := containerAnnotation(*annotations, config.AnnotationPreserveTag, tracked.name) == "true"
+		newImage, err := u.checkDigestMode(ctx, currentImage, registryClient, tagToCheck, resolvePlatform(*annotations, &podTemplate.Spec), preserveTag, allowedDigests)
 		if err != nil {
-			return false, err
+			return unchanged, handleCheckError(ctx, err, *annotations)
 		}
 		if newImage != "" {
-			logrus.Infof("[digest] Updating image for container %s in %s %s/%s from %s to %s", container.Name, resourceType, namespace, resourceName, container.Image, newImage)
-			container.Image = newImage
-			return true, nil
+			if err := u.verifyImage(ctx, newImage, registryClient, *annotations, resourceType, namespace, resourceName); err != nil {
+				return unchanged, err
+			}
+			checkInfof("[digest] Updating image for container %s in %s %s/%s from %s to %s", tracked.name, resourceType, namespace, resourceName, currentImage, newImage)
+			setImage(newImage)
+			return imageUpdated(currentImage, newImage, "digest"), nil
 		}
 
 	case "alphabetical", "name":
-		newImage, err := u.checkAlphabeticalMode(ctx, container.Image, registryClient, allowTagsRegex)
+		sortOrder := (*annotations)[config.AnnotationSortOrder]
+		if sortOrder != "" && sortOrder != "asc" && sortOrder != "desc" {
+			logrus.Warnf("Unknown sort order %s for container %s, using desc", sortOrder, tracked.name)
+		}
+		newImage, err := u.checkAlphabeticalMode(ctx, currentImage, registryClient, allowTagsFilter, requiredAnnotation, minTagAge, sortOrder, allowedDigests)
 		if err != nil {
-			return false, err
+			return unchanged, handleCheckError(ctx, err, *annotations)
 		}
 		if newImage != "" {
-			logrus.Infof("[alphabetical] Updating image for container %s in %s %s/%s from %s to %s", container.Name, resourceType, namespace, resourceName, container.Image, newImage)
-			container.Image = newImage
-			return true, nil
+			if err := u.verifyImage(ctx, newImage, registryClient, *annotations, resourceType, namespace, resourceName); err != nil {
+				return unchanged, err
+			}
+			checkInfof("[alphabetical] Updating image for container %s in %s %s/%s from %s to %s", tracked.name, resourceType, namespace, resourceName, currentImage, newImage)
+			setImage(newImage)
+			return imageUpdated(currentImage, newImage, "alphabetical"), nil
+		}
+
+	case "date":
+		layout := (*annotations)[config.AnnotationDateFormat]
+		if layout == "" {
+			return unchanged, fmt.Errorf("date mode requires the %s annotation", config.AnnotationDateFormat)
+		}
+		newImage, err := u.checkDateMode(ctx, currentImage, registryClient, allowTagsFilter, requiredAnnotation, minTagAge, layout, allowedDigests)
+		if err != nil {
+			return unchanged, handleCheckError(ctx, err, *annotations)
+		}
+		if newImage != "" {
+			if err := u.verifyImage(ctx, newImage, registryClient, *annotations, resourceType, namespace, resourceName); err != nil {
+				return unchanged, err
+			}
+			checkInfof("[date] Updating image for container %s in %s %s/%s from %s to %s", tracked.name, resourceType, namespace, resourceName, currentImage, newImage)
+			setImage(newImage)
+			return imageUpdated(currentImage, newImage, "date"), nil
+		}
+
+	case "review":
+		if (*annotations)[config.AnnotationImageEnv] != "" || (*annotations)[config.AnnotationConfigMapRef] != "" {
+			logrus.Warnf("Review mode only supports container images, skipping %s in %s %s/%s", tracked.name, resourceType, namespace, resourceName)
+			return skipUpdate(currentImage, "review mode only supports container images"), nil
+		}
+		pinDigest := (*annotations)[config.AnnotationPinDigest] == "true"
+		newImage, behind, err := u.checkReleaseMode(ctx, currentImage, registryClient, allowTagsFilter, requiredAnnotation, minTagAge, minVersion, pinDigest, allowedDigests)
+		if err != nil {
+			return unchanged, handleCheckError(ctx, err, *annotations)
+		}
+		recordVersionsBehind(ctx, resourceType, namespace, resourceName, tracked.name, behind)
+		if err := u.proposeImage(ctx, tracked, newImage, registryClient, *annotations, resourceType, namespace, resourceName); err != nil {
+			return unchanged, err
+		}
+		if newImage != "" {
+			return containerUpdate{Action: actionPropose, OldImage: currentImage, NewImage: newImage, Reason: "newer image proposed for review"}, nil
 		}
 
 	case "release":
-		newImage, err := u.checkReleaseMode(ctx, container.Image, registryClient, allowTagsRegex)
+		pinDigest := (*annotations)[config.AnnotationPinDigest] == "true"
+		newImage, behind, err := u.checkReleaseMode(ctx, currentImage, registryClient, allowTagsFilter, requiredAnnotation, minTagAge, minVersion, pinDigest, allowedDigests)
 		if err != nil {
-			return false, err
+			return unchanged, handleCheckError(ctx, err, *annotations)
 		}
+		recordVersionsBehind(ctx, resourceType, namespace, resourceName, tracked.name, behind)
 		if newImage != "" {
-			logrus.Infof("[release] Updating image for container %s in %s %s/%s from %s to %s", container.Name, resourceType, namespace, resourceName, container.Image, newImage)
-			container.Image = newImage
-			return true, nil
+			if err := u.verifyImage(ctx, newImage, registryClient, *annotations, resourceType, namespace, resourceName); err != nil {
+				return unchanged, err
+			}
+			checkInfof("[release] Updating image for container %s in %s %s/%s from %s to %s", tracked.name, resourceType, namespace, resourceName, currentImage, newImage)
+			setImage(newImage)
+			return imageUpdated(currentImage, newImage, "release"), nil
 		}
 
 	default:
 		logrus.Warnf("Unknown update mode: %s", mode)
+		return skipUpdate(currentImage, "unknown update mode "+mode), nil
 	}
 
-	return false, nil
+	return unchanged, nil
 }
 
 // Update deployments with auto-update annotations
 func (u *Updater) updateDeployments(ctx context.Context) error {
-	logrus.Debug("Checking deployments for updates")
-	deployments, err := u.k8sClient.ListDeployments(ctx, metav1.ListOptions{
+	checkDebugf("Checking deployments for updates")
+	deployments, err := u.k8sClient.ListDeployments(ctx, metav1.NamespaceAll, metav1.ListOptions{
 		LabelSelector: config.LabelEnabled + "=true",
 	})
 	if err != nil {
 		return err
 	}
-	logrus.Debugf("Found %d deployments enabled for auto-update", len(deployments))
-
-	for _, deploy := range deployments {
-		logrus.Debugf("Checking deployment %s/%s", deploy.Namespace, deploy.Name)
-		updated := false
-		for i := range deploy.Spec.Template.Spec.Containers {
-			container := &deploy.Spec.Template.Spec.Containers[i]
-			logrus.Debugf("Checking container %s in deployment %s/%s", container.Name, deploy.Namespace, deploy.Name)
-
-			containerUpdated, err := u.updateContainerIfNeeded(ctx, container, &deploy.Annotations, deploy.Namespace, deploy.Name, "deployment", &deploy.Spec.Template)
-			if err != nil {
-				logrus.Errorf("Failed to update container %s in deployment %s/%s: %v", container.Name, deploy.Namespace, deploy.Name, err)
-				continue
-			}
-			if containerUpdated {
-				updated = true
-			}
-		}
-
-		if updated {
-			logrus.Debugf("Updating deployment %s/%s", deploy.Namespace, deploy.Name)
-			if err := u.k8sClient.UpdateDeployment(&deploy); err != nil {
-				logrus.Errorf("Failed to update deployment %s/%s: %v", deploy.Namespace, deploy.Name, err)
-			}
-		} else {
-			logrus.Debugf("No updates needed for deployment %s/%s", deploy.Namespace, deploy.Name)
-		}
+	workloads := make([]workload, len(deployments))
+	for i := range deployments {
+		workloads[i] = deploymentWorkload{&deployments[i]}
 	}
-
-	return nil
+	return u.updateWorkloads(ctx, "deployment", workloads)
 }
 
 // Update StatefulSets with auto-update annotations
 func (u *Updater) updateStatefulSets(ctx context.Context) error {
-	logrus.Debug("Checking statefulsets for updates")
-	statefulsets, err := u.k8sClient.ListStatefulSets(ctx, metav1.ListOptions{
+	checkDebugf("Checking statefulsets for updates")
+	statefulsets, err := u.k8sClient.ListStatefulSets(ctx, metav1.NamespaceAll, metav1.ListOptions{
 		LabelSelector: config.LabelEnabled + "=true",
 	})
 	if err != nil {
 		return err
 	}
-	logrus.Debugf("Found %d statefulsets enabled for auto-update", len(statefulsets))
-
-	for _, sts := range statefulsets {
-		logrus.Debugf("Checking statefulset %s/%s", sts.Namespace, sts.Name)
-		updated := false
-		for i := range sts.Spec.Template.Spec.Containers {
-			container := &sts.Spec.Template.Spec.Containers[i]
-			logrus.Debugf("Checking container %s in statefulset %s/%s", container.Name, sts.Namespace, sts.Name)
-
-			containerUpdated, err := u.updateContainerIfNeeded(ctx, container, &sts.Annotations, sts.Namespace, sts.Name, "statefulset", &sts.Spec.Template)
-			if err != nil {
-				logrus.Errorf("Failed to update container %s in statefulset %s/%s: %v", container.Name, sts.Namespace, sts.Name, err)
-				continue
-			}
-			if containerUpdated {
-				updated = true
-			}
-		}
-
-		if updated {
-			logrus.Debugf("Updating statefulset %s/%s", sts.Namespace, sts.Name)
-			if err := u.k8sClient.UpdateStatefulSet(&sts); err != nil {
-				logrus.Errorf("Failed to update statefulset %s/%s: %v", sts.Namespace, sts.Name, err)
-			}
-		} else {
-			logrus.Debugf("No updates needed for statefulset %s/%s", sts.Namespace, sts.Name)
-		}
+	workloads := make([]workload, len(statefulsets))
+	for i := range statefulsets {
+		workloads[i] = statefulSetWorkload{&statefulsets[i]}
 	}
-
-	return nil
+	return u.updateWorkloads(ctx, "statefulset", workloads)
 }
 
 // Update DaemonSets with auto-update annotations
 func (u *Updater) updateDaemonSets(ctx context.Context) error {
-	logrus.Debug("Checking daemonsets for updates")
-	daemonsets, err := u.k8sClient.ListDaemonSets(ctx, metav1.ListOptions{
+	checkDebugf("Checking daemonsets for updates")
+	daemonsets, err := u.k8sClient.ListDaemonSets(ctx, metav1.NamespaceAll, metav1.ListOptions{
 		LabelSelector: config.LabelEnabled + "=true",
 	})
 	if err != nil {
 		return err
 	}
-	logrus.Debugf("Found %d daemonsets enabled for auto-update", len(daemonsets))
-
-	for _, ds := range daemonsets {
-		logrus.Debugf("Checking daemonset %s/%s", ds.Namespace, ds.Name)
-		updated := false
-		for i := range ds.Spec.Template.Spec.Containers {
-			container := &ds.Spec.Template.Spec.Containers[i]
-			logrus.Debugf("Checking container %s in daemonset %s/%s", container.Name, ds.Namespace, ds.Name)
-
-			containerUpdated, err := u.updateContainerIfNeeded(ctx, container, &ds.Annotations, ds.Namespace, ds.Name, "daemonset", &ds.Spec.Template)
-			if err != nil {
-				logrus.Errorf("Failed to update container %s in daemonset %s/%s: %v", container.Name, ds.Namespace, ds.Name, err)
-				continue
-			}
-			if containerUpdated {
-				updated = true
-			}
-		}
-
-		if updated {
-			logrus.Debugf("Updating daemonset %s/%s", ds.Namespace, ds.Name)
-			if err := u.k8sClient.UpdateDaemonSet(&ds); err != nil {
-				logrus.Errorf("Failed to update daemonset %s/%s: %v", ds.Namespace, ds.Name, err)
-			}
-		} else {
-			logrus.Debugf("No updates needed for daemonset %s/%s", ds.Namespace, ds.Name)
-		}
+	workloads := make([]workload, len(daemonsets))
+	for i := range daemonsets {
+		workloads[i] = daemonSetWorkload{&daemonsets[i]}
 	}
-
-	return nil
+	return u.updateWorkloads(ctx, "daemonset", workloads)
 }
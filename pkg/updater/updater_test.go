@@ -0,0 +1,873 @@
+package updater
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	ggcrregistry "github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/monlor/k8s-image-updater/pkg/k8s"
+	"github.com/monlor/k8s-image-updater/pkg/metrics"
+	"github.com/monlor/k8s-image-updater/pkg/registry"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// Start an in-memory registry serving the given tags of a single repository, each tag a distinct image
+func newTestRegistry(t *testing.T, repository string, tags ...string) string {
+	server := httptest.NewServer(ggcrregistry.New(ggcrregistry.Logger(log.New(io.Discard, "", 0))))
+	t.Cleanup(server.Close)
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	for _, tag := range tags {
+		pushTestImage(t, host+"/"+repository+":"+tag)
+	}
+	return host
+}
+
+// Push a random image to the reference and return its digest
+func pushTestImage(t *testing.T, image string) string {
+	img, err := random.Image(256, 1)
+	require.NoError(t, err)
+	ref, err := name.ParseReference(image)
+	require.NoError(t, err)
+	require.NoError(t, remote.Write(ref, img))
+	digest, err := img.Digest()
+	require.NoError(t, err)
+	return digest.String()
+}
+
+func newTestUpdater(objects ...runtime.Object) (*Updater, *fake.Clientset) {
+	clientset := fake.NewSimpleClientset(objects...)
+	return NewUpdaterWithClient(k8s.NewClient(clientset)), clientset
+}
+
+// setTuning swaps in reloadable settings changed by change, restored when the test ends
+func setTuning(t *testing.T, change func(*config.Tunables)) {
+	old := config.Tuning()
+	tuning := *old
+	change(&tuning)
+	config.SetTuning(&tuning)
+	t.Cleanup(func() { config.SetTuning(old) })
+}
+
+func newTestDeployment(annotations map[string]string, containers ...corev1.Container) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "app",
+			Namespace:   "default",
+			Labels:      map[string]string{config.LabelEnabled: "true"},
+			Annotations: annotations,
+		},
+		Spec: appsv1.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{Containers: containers},
+			},
+		},
+	}
+}
+
+func TestListCandidateTagsNoMatch(t *testing.T) {
+	host := newTestRegistry(t, "app", "1.0.0", "1.1.0")
+	client := registry.NewRegistryClient("", "")
+
+	tags, err := listCandidateTags(context.Background(), host+"/app:1.0.0", client, "regexp:^2\\.")
+	assert.ErrorIs(t, err, ErrNoMatchingTags)
+	assert.Empty(t, tags)
+
+	tags, err = listCandidateTags(context.Background(), host+"/app:1.0.0", client, "regexp:^1\\.1")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"1.1.0"}, tags)
+}
+
+func TestUpdateContainerNoMatchingTags(t *testing.T) {
+	host := newTestRegistry(t, "app", "1.0.0", "1.1.0")
+
+	for _, strict := range []bool{false, true} {
+		for _, mode := range []string{"release", "alphabetical"} {
+			t.Run(mode, func(t *testing.T) {
+				oldStrict := config.GlobalConfig.StrictTags
+				config.GlobalConfig.StrictTags = strict
+				defer func() { config.GlobalConfig.StrictTags = oldStrict }()
+
+				u, _ := newTestUpdater()
+				deploy := newTestDeployment(map[string]string{
+					config.AnnotationMode:      mode,
+					config.AnnotationAllowTags: "regexp:^2\\.",
+				}, corev1.Container{Name: "app", Image: host + "/app:1.0.0"})
+				container := &deploy.Spec.Template.Spec.Containers[0]
+
+				result, err := u.updateContainerIfNeeded(context.Background(), container, &deploy.Annotations, deploy.Namespace, deploy.Name, "deployment", &deploy.Spec.Template)
+				if strict {
+					assert.ErrorIs(t, err, ErrNoMatchingTags)
+				} else {
+					assert.NoError(t, err)
+				}
+				assert.False(t, result.Changed)
+				assert.Equal(t, host+"/app:1.0.0", result.NewImage)
+				assert.Equal(t, host+"/app:1.0.0", container.Image)
+				assert.Equal(t, config.StatusNoMatchingTags, deploy.Annotations[config.AnnotationStatus])
+			})
+		}
+	}
+}
+
+func TestUpdateDeploymentsPersistsStatus(t *testing.T) {
+	host := newTestRegistry(t, "app", "1.0.0", "1.1.0")
+	u, clientset := newTestUpdater(newTestDeployment(map[string]string{
+		config.AnnotationAllowTags: "regexp:^2\\.",
+	}, corev1.Container{Name: "app", Image: host + "/app:1.0.0"}))
+	ctx := context.Background()
+
+	require.NoError(t, u.updateDeployments(ctx))
+	deploy, err := clientset.AppsV1().Deployments("default").Get(ctx, "app", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, config.StatusNoMatchingTags, deploy.Annotations[config.AnnotationStatus])
+	assert.Equal(t, host+"/app:1.0.0", deploy.Spec.Template.Spec.Containers[0].Image)
+
+	// Once the filter matches again, the status is cleared and the image updated
+	deploy.Annotations[config.AnnotationAllowTags] = "regexp:^1\\."
+	_, err = clientset.AppsV1().Deployments("default").Update(ctx, deploy, metav1.UpdateOptions{})
+	require.NoError(t, err)
+
+	require.NoError(t, u.updateDeployments(ctx))
+	deploy, err = clientset.AppsV1().Deployments("default").Get(ctx, "app", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.NotContains(t, deploy.Annotations, config.AnnotationStatus)
+	assert.Equal(t, host+"/app:1.1.0", deploy.Spec.Template.Spec.Containers[0].Image)
+}
+
+func TestUpdateImageFromEnv(t *testing.T) {
+	host := newTestRegistry(t, "runner", "1.0.0", "1.1.0")
+	u, clientset := newTestUpdater(newTestDeployment(map[string]string{
+		config.AnnotationImageEnv: "RUNNER_IMAGE",
+	}, corev1.Container{
+		Name:  "app",
+		Image: "app:1.0.0",
+		Env: []corev1.EnvVar{
+			{Name: "OTHER", Value: "value"},
+			{Name: "RUNNER_IMAGE", Value: host + "/runner:1.0.0"},
+		},
+	}, corev1.Container{
+		Name:  "sidecar",
+		Image: "sidecar:1.0.0",
+	}))
+	ctx := context.Background()
+
+	require.NoError(t, u.updateDeployments(ctx))
+	deploy, err := clientset.AppsV1().Deployments("default").Get(ctx, "app", metav1.GetOptions{})
+	require.NoError(t, err)
+
+	containers := deploy.Spec.Template.Spec.Containers
+	assert.Equal(t, host+"/runner:1.1.0", containers[0].Env[1].Value)
+	assert.Equal(t, "value", containers[0].Env[0].Value)
+	assert.Equal(t, "app:1.0.0", containers[0].Image)
+	assert.Equal(t, "sidecar:1.0.0", containers[1].Image)
+}
+
+func TestReleaseModePinDigest(t *testing.T) {
+	host := newTestRegistry(t, "app", "1.0.0")
+	newDigest := pushTestImage(t, host+"/app:1.1.0")
+	client := registry.NewRegistryClient("", "")
+	u, _ := newTestUpdater()
+	ctx := context.Background()
+
+	// Without pinning only the tag is written
+	newImage, _, err := u.checkReleaseMode(ctx, host+"/app:1.0.0", client, "", "", 0, "", false, nil)
+	require.NoError(t, err)
+	assert.Equal(t, host+"/app:1.1.0", newImage)
+
+	// With pinning the digest of the selected tag is resolved and appended
+	newImage, _, err = u.checkReleaseMode(ctx, host+"/app:1.0.0", client, "", "", 0, "", true, nil)
+	require.NoError(t, err)
+	assert.Equal(t, host+"/app:1.1.0@"+newDigest, newImage)
+
+	// A pinned image at the latest tag and digest is up to date
+	newImage, _, err = u.checkReleaseMode(ctx, host+"/app:1.1.0@"+newDigest, client, "", "", 0, "", true, nil)
+	require.NoError(t, err)
+	assert.Empty(t, newImage)
+
+	// The tag was pushed again, so the pinned digest is updated
+	repushedDigest := pushTestImage(t, host+"/app:1.1.0")
+	newImage, _, err = u.checkReleaseMode(ctx, host+"/app:1.1.0@"+newDigest, client, "", "", 0, "", true, nil)
+	require.NoError(t, err)
+	assert.Equal(t, host+"/app:1.1.0@"+repushedDigest, newImage)
+}
+
+func TestFilterDowngrades(t *testing.T) {
+	sortedTags := []string{"v2.0.0", "1.10.0", "1.4.0", "1.2.0", "v1.0.0"}
+	tests := []struct {
+		name       string
+		current    string
+		minVersion string
+		want       []string
+	}{
+		{"no floor", "", "", sortedTags},
+		{"current is the floor", "1.4.0", "", []string{"v2.0.0", "1.10.0", "1.4.0"}},
+		{"min version", "", "1.3", []string{"v2.0.0", "1.10.0", "1.4.0"}},
+		{"min version with prefix", "", "v1.10.0", []string{"v2.0.0", "1.10.0"}},
+		{"higher of current and min version", "1.10.0", "1.2.0", []string{"v2.0.0", "1.10.0"}},
+		{"higher of min version and current", "1.2.0", "1.10.0", []string{"v2.0.0", "1.10.0"}},
+		{"current not a version", "latest", "", sortedTags},
+		{"nothing reaches the floor", "", "3.0.0", []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tags, err := filterDowngrades(sortedTags, tt.current, tt.minVersion)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, tags)
+		})
+	}
+
+	_, err := filterDowngrades(sortedTags, "1.0.0", "not-a-version")
+	assert.ErrorContains(t, err, config.AnnotationMinVersion)
+
+	// Tags only differing from the current one by build metadata or prefix are no update
+	tags, err := filterDowngrades([]string{"1.3.0", "1.2.3+build.2", "v1.2.3", "1.2.3+build.1", "1.2.2"}, "1.2.3+build.1", "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1.3.0", "1.2.3+build.1"}, tags)
+}
+
+func TestVersionsBehind(t *testing.T) {
+	sortedTags := []string{"v2.0.0", "2.0.0", "1.10.0", "1.4.0", "1.2.0", "v1.0.0"}
+	tests := []struct {
+		current string
+		want    int
+	}{
+		{"2.0.0", 0},
+		{"1.10.0", 1},
+		{"v1.2.0", 3},
+		{"1.0.0", 4},
+		{"0.9.0", 5},
+		{"latest", -1},
+		{"", -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.current, func(t *testing.T) {
+			assert.Equal(t, tt.want, versionsBehind(sortedTags, tt.current))
+		})
+	}
+
+	// Build metadata does not count as another version
+	assert.Equal(t, 1, versionsBehind([]string{"1.3.0+build.2", "1.3.0+build.1", "1.2.3+build.2"}, "1.2.3+build.1"))
+}
+
+func TestReleaseModeVersionsBehindMetric(t *testing.T) {
+	enableReportOnly(t)
+	host := newTestRegistry(t, "app", "1.0.0", "1.1.0", "1.2.0", "v1.2.0", "nightly")
+	u, _ := newTestUpdater(newTestDeployment(map[string]string{config.AnnotationAllowTags + ".pinned": "regexp:^1\\.[01]\\."},
+		corev1.Container{Name: "app", Image: host + "/app:1.0.0"},
+		corev1.Container{Name: "pinned", Image: host + "/app:1.0.0"},
+		corev1.Container{Name: "nightly", Image: host + "/app:nightly"}))
+	metrics.VersionsBehind.DeleteLabelValues("default", "deployment", "app", "nightly")
+	metrics.VersionsBehind.WithLabelValues("default", "deployment", "app", "nightly").Set(3)
+
+	// Counted in report-only mode, where the images are not updated
+	require.NoError(t, u.updateDeployments(context.Background()))
+	assert.Equal(t, 2.0, testutil.ToFloat64(metrics.VersionsBehind.WithLabelValues("default", "deployment", "app", "app")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.VersionsBehind.WithLabelValues("default", "deployment", "app", "pinned")))
+	// An unversioned tag cannot be behind, its gauge is removed
+	assert.False(t, metrics.VersionsBehind.DeleteLabelValues("default", "deployment", "app", "nightly"))
+}
+
+func TestReleaseModeNoDowngrade(t *testing.T) {
+	host := newTestRegistry(t, "app", "1.0.0", "1.2.0", "1.3.0")
+	u, clientset := newTestUpdater(newTestDeployment(map[string]string{
+		// The allow-tags filter leaves out the running 1.3.0
+		config.AnnotationAllowTags: "regexp:^1\\.[0-2]\\.",
+	}, corev1.Container{Name: "app", Image: host + "/app:1.3.0"}))
+	ctx := context.Background()
+
+	require.NoError(t, u.updateDeployments(ctx))
+	deploy, err := clientset.AppsV1().Deployments("default").Get(ctx, "app", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, host+"/app:1.3.0", deploy.Spec.Template.Spec.Containers[0].Image)
+}
+
+func TestReleaseModeUnversionedTag(t *testing.T) {
+	host := newTestRegistry(t, "app", "nightly", "latest", "1.0.0", "1.1.0")
+	client := registry.NewRegistryClient("", "")
+	u, _ := newTestUpdater()
+	ctx := context.Background()
+	old := config.GlobalConfig.AllowSwitchFromUnversioned
+	t.Cleanup(func() { config.GlobalConfig.AllowSwitchFromUnversioned = old })
+
+	for _, tag := range []string{"nightly", "latest"} {
+		t.Run(tag, func(t *testing.T) {
+			// The unversioned tag is kept by default
+			config.GlobalConfig.AllowSwitchFromUnversioned = false
+			newImage, _, err := u.checkReleaseMode(ctx, host+"/app:"+tag, client, "", "", 0, "", false, nil)
+			require.NoError(t, err)
+			assert.Empty(t, newImage)
+
+			config.GlobalConfig.AllowSwitchFromUnversioned = true
+			newImage, _, err = u.checkReleaseMode(ctx, host+"/app:"+tag, client, "", "", 0, "", false, nil)
+			require.NoError(t, err)
+			assert.Equal(t, host+"/app:1.1.0", newImage)
+		})
+	}
+
+	// Versioned tags are updated whatever the setting
+	config.GlobalConfig.AllowSwitchFromUnversioned = false
+	newImage, _, err := u.checkReleaseMode(ctx, host+"/app:1.0.0", client, "", "", 0, "", false, nil)
+	require.NoError(t, err)
+	assert.Equal(t, host+"/app:1.1.0", newImage)
+}
+
+func TestReleaseModeMinVersion(t *testing.T) {
+	host := newTestRegistry(t, "app", "1.0.0", "1.1.0", "1.2.0")
+	client := registry.NewRegistryClient("", "")
+	u, _ := newTestUpdater()
+	ctx := context.Background()
+
+	// A floor below the latest tag does not change the selection
+	newImage, _, err := u.checkReleaseMode(ctx, host+"/app:1.0.0", client, "", "", 0, "1.1.0", false, nil)
+	require.NoError(t, err)
+	assert.Equal(t, host+"/app:1.2.0", newImage)
+
+	// Tags below the floor are never selected, e.g. when filtered to an older line
+	newImage, _, err = u.checkReleaseMode(ctx, host+"/app:0.9.0", client, "regexp:^1\\.[01]\\.", "", 0, "1.2.0", false, nil)
+	require.NoError(t, err)
+	assert.Empty(t, newImage)
+
+	// A floor above every tag leaves the image as is
+	newImage, _, err = u.checkReleaseMode(ctx, host+"/app:1.0.0", client, "", "", 0, "2.0.0", false, nil)
+	require.NoError(t, err)
+	assert.Empty(t, newImage)
+
+	_, _, err = u.checkReleaseMode(ctx, host+"/app:1.0.0", client, "", "", 0, "invalid", false, nil)
+	assert.Error(t, err)
+}
+
+func TestReleaseModeKeepsReferenceFormat(t *testing.T) {
+	host := newTestRegistry(t, "app", "1.0.0")
+	oldDigest, err := registry.NewRegistryClient("", "").GetDigest(context.Background(), host+"/app:1.0.0")
+	require.NoError(t, err)
+	newDigest := pushTestImage(t, host+"/app:1.1.0")
+	client := registry.NewRegistryClient("", "")
+	u, _ := newTestUpdater()
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		current string
+		want    string
+	}{
+		{"tag only", host + "/app:1.0.0", host + "/app:1.1.0"},
+		{"digest only", host + "/app@" + oldDigest, host + "/app:1.1.0"},
+		{"tag and digest", host + "/app:1.0.0@" + oldDigest, host + "/app:1.1.0@" + newDigest},
+		{"tag and digest up to date", host + "/app:1.1.0@" + newDigest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newImage, _, err := u.checkReleaseMode(ctx, tt.current, client, "", "", 0, "", false, nil)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, newImage)
+		})
+	}
+}
+
+func TestUpdateContainerPinDigest(t *testing.T) {
+	host := newTestRegistry(t, "app", "1.0.0")
+	newDigest := pushTestImage(t, host+"/app:1.1.0")
+	u, clientset := newTestUpdater(newTestDeployment(map[string]string{
+		config.AnnotationPinDigest: "true",
+	}, corev1.Container{Name: "app", Image: host + "/app:1.0.0"}))
+	ctx := context.Background()
+
+	require.NoError(t, u.updateDeployments(ctx))
+	deploy, err := clientset.AppsV1().Deployments("default").Get(ctx, "app", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, host+"/app:1.1.0@"+newDigest, deploy.Spec.Template.Spec.Containers[0].Image)
+}
+
+func TestPerContainerMode(t *testing.T) {
+	host := newTestRegistry(t, "app", "1.0.0", "1.1.0", "build-1", "build-2")
+	u, clientset := newTestUpdater(newTestDeployment(map[string]string{
+		config.AnnotationMode:                  "release",
+		config.AnnotationAllowTags:             "regexp:^1\\.0",
+		config.AnnotationMode + ".worker":      "alphabetical",
+		config.AnnotationAllowTags + ".worker": "regexp:^build-",
+	}, corev1.Container{
+		Name:  "app",
+		Image: host + "/app:1.0.0",
+	}, corev1.Container{
+		Name:  "worker",
+		Image: host + "/app:build-1",
+	}, corev1.Container{
+		Name:  "sidecar",
+		Image: host + "/app:1.0.0",
+	}))
+	ctx := context.Background()
+
+	require.NoError(t, u.updateDeployments(ctx))
+	deploy, err := clientset.AppsV1().Deployments("default").Get(ctx, "app", metav1.GetOptions{})
+	require.NoError(t, err)
+
+	containers := deploy.Spec.Template.Spec.Containers
+	// Resource-wide release mode, the allow-tags filter keeps 1.0.0
+	assert.Equal(t, host+"/app:1.0.0", containers[0].Image)
+	// Overridden alphabetical mode and filter
+	assert.Equal(t, host+"/app:build-2", containers[1].Image)
+	assert.Equal(t, host+"/app:1.0.0", containers[2].Image)
+	assert.NotContains(t, deploy.Annotations, config.AnnotationStatus)
+}
+
+func TestDefaultUpdateMode(t *testing.T) {
+	old := config.GlobalConfig.DefaultUpdateMode
+	t.Cleanup(func() { config.GlobalConfig.DefaultUpdateMode = old })
+	host := newTestRegistry(t, "app", "1.0.0", "1.1.0")
+	latestDigest := pushTestImage(t, host+"/app:latest")
+	ctx := context.Background()
+
+	tests := []struct {
+		defaultMode string
+		annotations map[string]string
+		want        string
+	}{
+		{"", nil, host + "/app:1.1.0"},
+		{"release", nil, host + "/app:1.1.0"},
+		{"digest", nil, host + "/app@" + latestDigest},
+		// The mode annotation wins over the default
+		{"digest", map[string]string{config.AnnotationMode: "release"}, host + "/app:1.1.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.defaultMode, func(t *testing.T) {
+			config.GlobalConfig.DefaultUpdateMode = tt.defaultMode
+			u, clientset := newTestUpdater(newTestDeployment(tt.annotations, corev1.Container{Name: "app", Image: host + "/app:1.0.0"}))
+			require.NoError(t, u.updateDeployments(ctx))
+			deploy, err := clientset.AppsV1().Deployments("default").Get(ctx, "app", metav1.GetOptions{})
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, deploy.Spec.Template.Spec.Containers[0].Image)
+		})
+	}
+}
+
+func TestFilterTags(t *testing.T) {
+	tags := []string{"v1.0.0", "v1.2.0", "v2.0.0", "1.0.0", "build-7", "build-42", "latest"}
+
+	tests := []struct {
+		filter  string
+		want    []string
+		wantErr string
+	}{
+		{"", tags, ""},
+		{"regexp:^v1\\.", []string{"v1.0.0", "v1.2.0"}, ""},
+		{"glob:v1.*", []string{"v1.0.0", "v1.2.0"}, ""},
+		{"glob:*.0.0", []string{"v1.0.0", "v2.0.0", "1.0.0"}, ""},
+		{"glob:v[12].?.0", []string{"v1.0.0", "v1.2.0", "v2.0.0"}, ""},
+		{"glob:build-[0-9]", []string{"build-7"}, ""},
+		{"glob:build-[^7]*", []string{"build-42"}, ""},
+		{"glob:latest", []string{"latest"}, ""},
+		{"glob:v[1", nil, "invalid glob for allow-tags"},
+		{"regexp:v(1", nil, "invalid regex for allow-tags"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			got, err := filterTags(tags, tt.filter)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestUpdateContainerGlobFilter(t *testing.T) {
+	host := newTestRegistry(t, "app", "1.0.0", "1.1.0", "2.0.0")
+	u, clientset := newTestUpdater(newTestDeployment(map[string]string{
+		config.AnnotationAllowTags: "glob:1.*",
+	}, corev1.Container{Name: "app", Image: host + "/app:1.0.0"}))
+	ctx := context.Background()
+
+	require.NoError(t, u.updateDeployments(ctx))
+	deploy, err := clientset.AppsV1().Deployments("default").Get(ctx, "app", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, host+"/app:1.1.0", deploy.Spec.Template.Spec.Containers[0].Image)
+}
+
+func TestAlphabeticalSortOrder(t *testing.T) {
+	host := newTestRegistry(t, "app", "build-a", "build-b", "build-c")
+
+	tests := []struct {
+		sortOrder string
+		want      string
+	}{
+		{"", "build-c"},
+		{"desc", "build-c"},
+		{"asc", "build-a"},
+	}
+
+	for _, tt := range tests {
+		t.Run("order "+tt.sortOrder, func(t *testing.T) {
+			u, clientset := newTestUpdater(newTestDeployment(map[string]string{
+				config.AnnotationMode:      "alphabetical",
+				config.AnnotationSortOrder: tt.sortOrder,
+			}, corev1.Container{Name: "app", Image: host + "/app:build-b"}))
+			ctx := context.Background()
+
+			require.NoError(t, u.updateDeployments(ctx))
+			deploy, err := clientset.AppsV1().Deployments("default").Get(ctx, "app", metav1.GetOptions{})
+			require.NoError(t, err)
+			assert.Equal(t, host+"/app:"+tt.want, deploy.Spec.Template.Spec.Containers[0].Image)
+		})
+	}
+}
+
+func TestDateMode(t *testing.T) {
+	host := newTestRegistry(t, "app", "2023.12.31", "2024.06.01", "2024.06.15", "latest")
+
+	u, clientset := newTestUpdater(newTestDeployment(map[string]string{
+		config.AnnotationMode:       "date",
+		config.AnnotationDateFormat: "2006.01.02",
+	}, corev1.Container{Name: "app", Image: host + "/app:2023.12.31"}))
+	ctx := context.Background()
+
+	require.NoError(t, u.updateDeployments(ctx))
+	deploy, err := clientset.AppsV1().Deployments("default").Get(ctx, "app", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, host+"/app:2024.06.15", deploy.Spec.Template.Spec.Containers[0].Image)
+}
+
+func TestDateModeRequiresFormat(t *testing.T) {
+	host := newTestRegistry(t, "app", "2024.06.01", "2024.06.15")
+
+	deploy := newTestDeployment(map[string]string{config.AnnotationMode: "date"},
+		corev1.Container{Name: "app", Image: host + "/app:2024.06.01"})
+	u, _ := newTestUpdater(deploy)
+
+	_, err := u.updateContainerIfNeeded(context.Background(), &deploy.Spec.Template.Spec.Containers[0], &deploy.Annotations, "default", "app", "deployment", &deploy.Spec.Template)
+	assert.ErrorContains(t, err, config.AnnotationDateFormat)
+	assert.Equal(t, host+"/app:2024.06.01", deploy.Spec.Template.Spec.Containers[0].Image)
+}
+
+func TestUpdateContainerRegistryNotAllowed(t *testing.T) {
+	host := newTestRegistry(t, "app", "1.0.0", "1.1.0")
+	u, clientset := newTestUpdater(newTestDeployment(nil,
+		corev1.Container{Name: "app", Image: host + "/app:1.0.0"}))
+	ctx := context.Background()
+
+	oldRegistries := config.GlobalConfig.AllowedRegistries
+	defer func() { config.GlobalConfig.AllowedRegistries = oldRegistries }()
+
+	// Blocked registry, the image is kept and the status recorded
+	config.GlobalConfig.AllowedRegistries = "ghcr.io"
+	deploy := newTestDeployment(nil, corev1.Container{Name: "app", Image: host + "/app:1.0.0"})
+	result, err := u.updateContainerIfNeeded(ctx, &deploy.Spec.Template.Spec.Containers[0], &deploy.Annotations, "default", "app", "deployment", &deploy.Spec.Template)
+	assert.ErrorIs(t, err, ErrRegistryNotAllowed)
+	assert.False(t, result.Changed)
+	assert.Equal(t, config.StatusRegistryNotAllowed, deploy.Annotations[config.AnnotationStatus])
+
+	require.NoError(t, u.updateDeployments(ctx))
+	stored, err := clientset.AppsV1().Deployments("default").Get(ctx, "app", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, host+"/app:1.0.0", stored.Spec.Template.Spec.Containers[0].Image)
+	assert.Equal(t, config.StatusRegistryNotAllowed, stored.Annotations[config.AnnotationStatus])
+
+	// Allowed registry
+	config.GlobalConfig.AllowedRegistries = "ghcr.io," + host
+	require.NoError(t, u.updateDeployments(ctx))
+	stored, err = clientset.AppsV1().Deployments("default").Get(ctx, "app", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, host+"/app:1.1.0", stored.Spec.Template.Spec.Containers[0].Image)
+	assert.NotContains(t, stored.Annotations, config.AnnotationStatus)
+}
+
+func TestUpdateContainerUnparseableImage(t *testing.T) {
+	host := newTestRegistry(t, "app", "1.0.0", "1.1.0")
+	old := config.GlobalConfig.UnparseableImages
+	t.Cleanup(func() { config.GlobalConfig.UnparseableImages = old })
+	ctx := context.Background()
+	// Repositories must be lowercase
+	malformed := host + "/App:1.0.0"
+
+	t.Run("skip", func(t *testing.T) {
+		config.GlobalConfig.UnparseableImages = config.UnparseableImageSkip
+		u, clientset := newTestUpdater(newTestDeployment(nil,
+			corev1.Container{Name: "broken", Image: malformed},
+			corev1.Container{Name: "app", Image: host + "/app:1.0.0"}))
+		require.NoError(t, u.updateDeployments(ctx))
+
+		stored, err := clientset.AppsV1().Deployments("default").Get(ctx, "app", metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, malformed, stored.Spec.Template.Spec.Containers[0].Image)
+		// The other containers are still updated
+		assert.Equal(t, host+"/app:1.1.0", stored.Spec.Template.Spec.Containers[1].Image)
+		assert.Equal(t, config.StatusUnparseableImage, stored.Annotations[config.AnnotationStatus])
+	})
+
+	t.Run("error", func(t *testing.T) {
+		config.GlobalConfig.UnparseableImages = config.UnparseableImageError
+		u, _ := newTestUpdater()
+		for _, mode := range []string{"release", "digest", "latest"} {
+			deploy := newTestDeployment(map[string]string{config.AnnotationMode: mode},
+				corev1.Container{Name: "broken", Image: malformed, ImagePullPolicy: corev1.PullAlways})
+			result, err := u.updateContainerIfNeeded(ctx, &deploy.Spec.Template.Spec.Containers[0], &deploy.Annotations, "default", "app", "deployment", &deploy.Spec.Template)
+			assert.ErrorIs(t, err, ErrUnparseableImage, mode)
+			assert.False(t, result.Changed, mode)
+			assert.Equal(t, config.StatusUnparseableImage, deploy.Annotations[config.AnnotationStatus], mode)
+		}
+	})
+}
+
+func TestUpdateContainerDuplicateName(t *testing.T) {
+	host := newTestRegistry(t, "app", "1.0.0", "1.1.0")
+	old := config.GlobalConfig.DuplicateContainerNames
+	t.Cleanup(func() { config.GlobalConfig.DuplicateContainerNames = old })
+	ctx := context.Background()
+	image := host + "/app:1.0.0"
+	// The API server rejects duplicate names, the fake clientset does not
+	newDeployment := func(annotations map[string]string) *appsv1.Deployment {
+		return newTestDeployment(annotations,
+			corev1.Container{Name: "app", Image: image},
+			corev1.Container{Name: "app", Image: image},
+			corev1.Container{Name: "sidecar", Image: image})
+	}
+	images := func(t *testing.T, deploy *appsv1.Deployment) []string {
+		var images []string
+		for _, c := range deploy.Spec.Template.Spec.Containers {
+			images = append(images, c.Image)
+		}
+		return images
+	}
+	updateDeployment := func(t *testing.T, annotations map[string]string) *appsv1.Deployment {
+		u, clientset := newTestUpdater(newDeployment(annotations))
+		require.NoError(t, u.updateDeployments(ctx))
+		stored, err := clientset.AppsV1().Deployments("default").Get(ctx, "app", metav1.GetOptions{})
+		require.NoError(t, err)
+		return stored
+	}
+
+	t.Run("not targeted", func(t *testing.T) {
+		config.GlobalConfig.DuplicateContainerNames = config.DuplicateContainerFirst
+		stored := updateDeployment(t, nil)
+		assert.Equal(t, []string{host + "/app:1.1.0", host + "/app:1.1.0", host + "/app:1.1.0"}, images(t, stored))
+		assert.NotContains(t, stored.Annotations, config.AnnotationStatus)
+	})
+
+	t.Run("first", func(t *testing.T) {
+		config.GlobalConfig.DuplicateContainerNames = config.DuplicateContainerFirst
+		stored := updateDeployment(t, map[string]string{config.AnnotationContainer: "app"})
+		assert.Equal(t, []string{host + "/app:1.1.0", image, image}, images(t, stored))
+		assert.Equal(t, config.StatusDuplicateContainerName, stored.Annotations[config.AnnotationStatus])
+	})
+
+	t.Run("error", func(t *testing.T) {
+		config.GlobalConfig.DuplicateContainerNames = config.DuplicateContainerError
+		stored := updateDeployment(t, map[string]string{config.AnnotationContainer: "app"})
+		assert.Equal(t, []string{image, image, image}, images(t, stored))
+		assert.Equal(t, config.StatusDuplicateContainerName, stored.Annotations[config.AnnotationStatus])
+
+		u, _ := newTestUpdater()
+		deploy := newDeployment(map[string]string{config.AnnotationContainer: "app"})
+		_, err := u.updateContainerIfNeeded(ctx, &deploy.Spec.Template.Spec.Containers[0], &deploy.Annotations, "default", "app", "deployment", &deploy.Spec.Template)
+		assert.ErrorIs(t, err, ErrDuplicateContainerName)
+	})
+}
+
+func TestUpdateContainerResult(t *testing.T) {
+	host := newTestRegistry(t, "app", "1.0.0", "1.1.0")
+	image := host + "/app:1.0.0"
+	u, _ := newTestUpdater()
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		container   corev1.Container
+		want        containerUpdate
+	}{
+		{
+			name:        "update",
+			annotations: map[string]string{config.AnnotationMode: "release"},
+			container:   corev1.Container{Name: "app", Image: image},
+			want:        containerUpdate{Changed: true, Action: actionUpdate, OldImage: image, NewImage: host + "/app:1.1.0", Reason: "newer image found in release mode"},
+		},
+		{
+			name:        "propose",
+			annotations: map[string]string{config.AnnotationMode: "review"},
+			container:   corev1.Container{Name: "app", Image: image},
+			want:        containerUpdate{Action: actionPropose, OldImage: image, NewImage: host + "/app:1.1.0", Reason: "newer image proposed for review"},
+		},
+		{
+			name:        "up to date",
+			annotations: map[string]string{config.AnnotationMode: "release"},
+			container:   corev1.Container{Name: "app", Image: host + "/app:1.1.0"},
+			want:        skipUpdate(host+"/app:1.1.0", "up to date"),
+		},
+		{
+			name:        "other container",
+			annotations: map[string]string{config.AnnotationContainer: "web"},
+			container:   corev1.Container{Name: "app", Image: image},
+			want:        skipUpdate(image, "not the target container"),
+		},
+		{
+			name:        "container pattern",
+			annotations: map[string]string{config.AnnotationMode: "release", config.AnnotationContainer: "app-*"},
+			container:   corev1.Container{Name: "app-sidecar", Image: image},
+			want:        containerUpdate{Changed: true, Action: actionUpdate, OldImage: image, NewImage: host + "/app:1.1.0", Reason: "newer image found in release mode"},
+		},
+		{
+			name:        "other container pattern",
+			annotations: map[string]string{config.AnnotationContainer: "app-*"},
+			container:   corev1.Container{Name: "app", Image: image},
+			want:        skipUpdate(image, "not the target container"),
+		},
+		{
+			name:        "missing env var",
+			annotations: map[string]string{config.AnnotationImageEnv: "IMAGE"},
+			container:   corev1.Container{Name: "app", Image: image},
+			want:        skipUpdate(image, "env var IMAGE not found"),
+		},
+		{
+			name:        "latest without pull always",
+			annotations: map[string]string{config.AnnotationMode: "latest"},
+			container:   corev1.Container{Name: "app", Image: image},
+			want:        skipUpdate(image, "imagePullPolicy is not Always"),
+		},
+		{
+			name:        "unknown mode",
+			annotations: map[string]string{config.AnnotationMode: "newest"},
+			container:   corev1.Container{Name: "app", Image: image},
+			want:        skipUpdate(image, "unknown update mode newest"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deploy := newTestDeployment(tt.annotations, tt.container)
+			result, err := u.updateContainerIfNeeded(context.Background(), &deploy.Spec.Template.Spec.Containers[0], &deploy.Annotations, "default", "app", "deployment", &deploy.Spec.Template)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, result)
+		})
+	}
+}
+
+func TestUpdateContainerGlobalImageExcludes(t *testing.T) {
+	host := newTestRegistry(t, "istio/proxyv2", "1.20.0", "1.21.0")
+	pushTestImage(t, host+"/app:1.0.0")
+	pushTestImage(t, host+"/app:1.1.0")
+	oldExcludes := config.GlobalConfig.GlobalImageExcludes
+	config.GlobalConfig.GlobalImageExcludes = "*/istio/proxyv2"
+	t.Cleanup(func() { config.GlobalConfig.GlobalImageExcludes = oldExcludes })
+
+	u, clientset := newTestUpdater(newTestDeployment(map[string]string{config.AnnotationMode: "release"},
+		corev1.Container{Name: "app", Image: host + "/app:1.0.0"},
+		corev1.Container{Name: "proxy", Image: host + "/istio/proxyv2:1.20.0"}))
+	ctx := context.Background()
+
+	deploy := newTestDeployment(map[string]string{config.AnnotationMode: "release"},
+		corev1.Container{Name: "proxy", Image: host + "/istio/proxyv2:1.20.0"})
+	result, err := u.updateContainerIfNeeded(ctx, &deploy.Spec.Template.Spec.Containers[0], &deploy.Annotations, "default", "app", "deployment", &deploy.Spec.Template)
+	require.NoError(t, err)
+	assert.Equal(t, skipUpdate(host+"/istio/proxyv2:1.20.0", "excluded by GLOBAL_IMAGE_EXCLUDES pattern */istio/proxyv2"), result)
+
+	// Only the container whose image does not match is updated
+	require.NoError(t, u.updateDeployments(ctx))
+	stored, err := clientset.AppsV1().Deployments("default").Get(ctx, "app", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, host+"/app:1.1.0", stored.Spec.Template.Spec.Containers[0].Image)
+	assert.Equal(t, host+"/istio/proxyv2:1.20.0", stored.Spec.Template.Spec.Containers[1].Image)
+}
+
+func TestSkippedUpdatesMetric(t *testing.T) {
+	host := newTestRegistry(t, "app", "1.0.0", "1.1.0")
+	oldExcludes := config.GlobalConfig.GlobalImageExcludes
+	config.GlobalConfig.GlobalImageExcludes = "*/excluded"
+	t.Cleanup(func() { config.GlobalConfig.GlobalImageExcludes = oldExcludes })
+	u, _ := newTestUpdater()
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		container   corev1.Container
+		reason      string
+	}{
+		{
+			name:        "latest without pull always",
+			annotations: map[string]string{config.AnnotationMode: "latest"},
+			container:   corev1.Container{Name: "app", Image: host + "/app:1.0.0", ImagePullPolicy: corev1.PullIfNotPresent},
+			reason:      metrics.SkipReasonPullPolicy,
+		},
+		{
+			name:        "no matching tags",
+			annotations: map[string]string{config.AnnotationMode: "release", config.AnnotationAllowTags: "regexp:^2\\."},
+			container:   corev1.Container{Name: "app", Image: host + "/app:1.0.0"},
+			reason:      metrics.SkipReasonNoMatchingTags,
+		},
+		{
+			name:        "excluded",
+			annotations: map[string]string{config.AnnotationMode: "release"},
+			container:   corev1.Container{Name: "app", Image: host + "/excluded:1.0.0"},
+			reason:      metrics.SkipReasonExcluded,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			skipped := metrics.SkippedUpdates.WithLabelValues(tt.reason)
+			before := testutil.ToFloat64(skipped)
+			deploy := newTestDeployment(tt.annotations, tt.container)
+			result, err := u.updateContainerIfNeeded(context.Background(), &deploy.Spec.Template.Spec.Containers[0], &deploy.Annotations, "default", "app", "deployment", &deploy.Spec.Template)
+			require.NoError(t, err)
+			assert.False(t, result.Changed)
+			assert.Equal(t, before+1, testutil.ToFloat64(skipped))
+		})
+	}
+}
+
+func TestRespectPaused(t *testing.T) {
+	old := config.GlobalConfig.RespectPaused
+	config.GlobalConfig.RespectPaused = true
+	t.Cleanup(func() { config.GlobalConfig.RespectPaused = old })
+
+	host := newTestRegistry(t, "app", "1.0.0", "1.1.0")
+	deploy := newTestDeployment(nil, corev1.Container{Name: "app", Image: host + "/app:1.0.0"})
+	deploy.Spec.Paused = true
+	sts := &appsv1.StatefulSet{ObjectMeta: *deploy.ObjectMeta.DeepCopy(), Spec: appsv1.StatefulSetSpec{
+		Template:       *deploy.Spec.Template.DeepCopy(),
+		UpdateStrategy: appsv1.StatefulSetUpdateStrategy{Type: appsv1.OnDeleteStatefulSetStrategyType},
+	}}
+	u, clientset := newTestUpdater(deploy, sts)
+	ctx := context.Background()
+	images := func() (string, string) {
+		deploy, err := clientset.AppsV1().Deployments("default").Get(ctx, "app", metav1.GetOptions{})
+		require.NoError(t, err)
+		sts, err := clientset.AppsV1().StatefulSets("default").Get(ctx, "app", metav1.GetOptions{})
+		require.NoError(t, err)
+		return deploy.Spec.Template.Spec.Containers[0].Image, sts.Spec.Template.Spec.Containers[0].Image
+	}
+
+	// Paused deployments and OnDelete statefulsets are left alone
+	paused := testutil.ToFloat64(metrics.SkippedUpdates.WithLabelValues(metrics.SkipReasonPaused))
+	onDelete := testutil.ToFloat64(metrics.SkippedUpdates.WithLabelValues(metrics.SkipReasonOnDelete))
+	require.NoError(t, u.updateDeployments(ctx))
+	require.NoError(t, u.updateStatefulSets(ctx))
+	assert.Empty(t, updateActions(clientset))
+	assert.Equal(t, paused+1, testutil.ToFloat64(metrics.SkippedUpdates.WithLabelValues(metrics.SkipReasonPaused)))
+	assert.Equal(t, onDelete+1, testutil.ToFloat64(metrics.SkippedUpdates.WithLabelValues(metrics.SkipReasonOnDelete)))
+	deployImage, stsImage := images()
+	assert.Equal(t, host+"/app:1.0.0", deployImage)
+	assert.Equal(t, host+"/app:1.0.0", stsImage)
+
+	// Without RESPECT_PAUSED the change is queued on both
+	config.GlobalConfig.RespectPaused = false
+	require.NoError(t, u.updateDeployments(ctx))
+	require.NoError(t, u.updateStatefulSets(ctx))
+	deployImage, stsImage = images()
+	assert.Equal(t, host+"/app:1.1.0", deployImage)
+	assert.Equal(t, host+"/app:1.1.0", stsImage)
+}
@@ -0,0 +1,96 @@
+package updater
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/monlor/k8s-image-updater/pkg/metrics"
+	"github.com/monlor/k8s-image-updater/pkg/registry"
+	"github.com/monlor/k8s-image-updater/pkg/verify"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// stubVerifier accepts only the listed images
+type stubVerifier struct {
+	verified map[string]bool
+}
+
+func (s *stubVerifier) Verify(ctx context.Context, image string, registryClient *registry.RegistryClient) error {
+	if !s.verified[image] {
+		return fmt.Errorf("%w: %s", verify.ErrUnverified, image)
+	}
+	return nil
+}
+
+func TestUpdateVerifiesSignatures(t *testing.T) {
+	host := newTestRegistry(t, "app", "1.0.0", "1.1.0")
+	ctx := context.Background()
+
+	t.Run("verified", func(t *testing.T) {
+		u, clientset := newTestUpdater(newTestDeployment(nil, corev1.Container{Name: "app", Image: host + "/app:1.0.0"}))
+		u.verifier = &stubVerifier{verified: map[string]bool{host + "/app:1.1.0": true}}
+
+		require.NoError(t, u.updateDeployments(ctx))
+		deploy, err := clientset.AppsV1().Deployments("default").Get(ctx, "app", metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, host+"/app:1.1.0", deploy.Spec.Template.Spec.Containers[0].Image)
+		assert.NotContains(t, deploy.Annotations, config.AnnotationStatus)
+	})
+
+	t.Run("unverified", func(t *testing.T) {
+		u, clientset := newTestUpdater(newTestDeployment(nil, corev1.Container{Name: "app", Image: host + "/app:1.0.0"}))
+		u.verifier = &stubVerifier{}
+		failures := metrics.SignatureVerificationFailures.WithLabelValues("deployment", "default", "app")
+		before := testutil.ToFloat64(failures)
+
+		require.NoError(t, u.updateDeployments(ctx))
+		deploy, err := clientset.AppsV1().Deployments("default").Get(ctx, "app", metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, host+"/app:1.0.0", deploy.Spec.Template.Spec.Containers[0].Image)
+		assert.Equal(t, config.StatusSignatureNotVerified, deploy.Annotations[config.AnnotationStatus])
+		assert.Equal(t, before+1, testutil.ToFloat64(failures))
+	})
+
+	t.Run("unverified latest restart", func(t *testing.T) {
+		u, _ := newTestUpdater()
+		u.verifier = &stubVerifier{}
+		deploy := newTestDeployment(map[string]string{
+			config.AnnotationMode:       "latest",
+			config.AnnotationLastDigest: "sha256:old",
+		}, corev1.Container{Name: "app", Image: host + "/app:1.1.0", ImagePullPolicy: corev1.PullAlways})
+
+		result, err := u.updateContainerIfNeeded(ctx, &deploy.Spec.Template.Spec.Containers[0], &deploy.Annotations, "default", "app", "deployment", &deploy.Spec.Template)
+		assert.ErrorIs(t, err, verify.ErrUnverified)
+		assert.False(t, result.Changed)
+		// The restart is not triggered and the new digest is not recorded
+		assert.Equal(t, "sha256:old", deploy.Annotations[config.AnnotationLastDigest])
+		assert.NotContains(t, deploy.Spec.Template.Annotations, config.AnnotationRestart)
+	})
+}
+
+func TestVerifyImages(t *testing.T) {
+	u, _ := newTestUpdater(newTestDeployment(nil, corev1.Container{Name: "app", Image: "ghcr.io/org/app:1.0.0"}))
+	ctx := context.Background()
+
+	// Without a verifier every image passes
+	assert.NoError(t, u.VerifyImages(ctx, u.k8sClient, "deployment", "default", "app", []string{"ghcr.io/org/app:1.1.0"}))
+
+	u.SetVerifier(&stubVerifier{verified: map[string]bool{"ghcr.io/org/app:1.1.0": true}})
+	failures := metrics.SignatureVerificationFailures.WithLabelValues("deployment", "default", "app")
+	before := testutil.ToFloat64(failures)
+
+	assert.NoError(t, u.VerifyImages(ctx, u.k8sClient, "deployment", "default", "app", []string{"ghcr.io/org/app:1.1.0"}))
+	err := u.VerifyImages(ctx, u.k8sClient, "deployment", "default", "app", []string{"ghcr.io/org/app:1.1.0", "ghcr.io/org/app:1.2.0"})
+	assert.ErrorIs(t, err, verify.ErrUnverified)
+	assert.Equal(t, before+1, testutil.ToFloat64(failures))
+
+	err = u.VerifyImages(ctx, u.k8sClient, "deployment", "default", "missing", []string{"ghcr.io/org/app:1.1.0"})
+	assert.True(t, apierrors.IsNotFound(err), err)
+}
@@ -0,0 +1,389 @@
+package updater
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"sync"
+
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/monlor/k8s-image-updater/pkg/audit"
+	"github.com/monlor/k8s-image-updater/pkg/k8s"
+	"github.com/monlor/k8s-image-updater/pkg/metrics"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// workload gives the update pipeline access to a resource of any kind the updater checks
+type workload interface {
+	kind() string
+	meta() *metav1.ObjectMeta
+	podTemplate() *corev1.PodTemplateSpec
+	podSelector() *metav1.LabelSelector
+	// pausedReason returns why new images would not roll out and the skip reason counted for it, empty when they would
+	pausedReason() (string, string)
+	// update writes the resource
+	update(client *k8s.Client) error
+}
+
+type deploymentWorkload struct{ *appsv1.Deployment }
+
+func (w deploymentWorkload) kind() string {
+	return "deployment"
+}
+
+func (w deploymentWorkload) meta() *metav1.ObjectMeta {
+	return &w.ObjectMeta
+}
+
+func (w deploymentWorkload) podTemplate() *corev1.PodTemplateSpec {
+	return &w.Spec.Template
+}
+
+func (w deploymentWorkload) podSelector() *metav1.LabelSelector {
+	return w.Spec.Selector
+}
+
+func (w deploymentWorkload) update(client *k8s.Client) error {
+	return client.UpdateDeployment(w.Deployment)
+}
+
+func (w deploymentWorkload) pausedReason() (string, string) {
+	if w.Spec.Paused {
+		return "it is paused", metrics.SkipReasonPaused
+	}
+	return "", ""
+}
+
+type statefulSetWorkload struct{ *appsv1.StatefulSet }
+
+func (w statefulSetWorkload) kind() string {
+	return "statefulset"
+}
+
+func (w statefulSetWorkload) meta() *metav1.ObjectMeta {
+	return &w.ObjectMeta
+}
+
+func (w statefulSetWorkload) podTemplate() *corev1.PodTemplateSpec {
+	return &w.Spec.Template
+}
+
+func (w statefulSetWorkload) podSelector() *metav1.LabelSelector {
+	return w.Spec.Selector
+}
+
+func (w statefulSetWorkload) update(client *k8s.Client) error {
+	return client.UpdateStatefulSet(w.StatefulSet)
+}
+
+func (w statefulSetWorkload) pausedReason() (string, string) {
+	if w.Spec.UpdateStrategy.Type == appsv1.OnDeleteStatefulSetStrategyType {
+		return "it uses the OnDelete update strategy", metrics.SkipReasonOnDelete
+	}
+	return "", ""
+}
+
+type daemonSetWorkload struct{ *appsv1.DaemonSet }
+
+func (w daemonSetWorkload) kind() string {
+	return "daemonset"
+}
+
+func (w daemonSetWorkload) meta() *metav1.ObjectMeta {
+	return &w.ObjectMeta
+}
+
+func (w daemonSetWorkload) podTemplate() *corev1.PodTemplateSpec {
+	return &w.Spec.Template
+}
+
+func (w daemonSetWorkload) podSelector() *metav1.LabelSelector {
+	return w.Spec.Selector
+}
+
+func (w daemonSetWorkload) update(client *k8s.Client) error {
+	return client.UpdateDaemonSet(w.DaemonSet)
+}
+
+func (w daemonSetWorkload) pausedReason() (string, string) {
+	if w.Spec.UpdateStrategy.Type == appsv1.OnDeleteDaemonSetStrategyType {
+		return "it uses the OnDelete update strategy", metrics.SkipReasonOnDelete
+	}
+	return "", ""
+}
+
+type kruiseWorkload struct{ *k8s.KruiseWorkload }
+
+func (w kruiseWorkload) kind() string {
+	return w.Kind
+}
+
+func (w kruiseWorkload) meta() *metav1.ObjectMeta {
+	return &w.ObjectMeta
+}
+
+func (w kruiseWorkload) podTemplate() *corev1.PodTemplateSpec {
+	return &w.Template
+}
+
+func (w kruiseWorkload) podSelector() *metav1.LabelSelector {
+	return w.Selector
+}
+
+func (w kruiseWorkload) update(client *k8s.Client) error {
+	return client.UpdateKruiseWorkload(w.KruiseWorkload)
+}
+
+func (w kruiseWorkload) pausedReason() (string, string) {
+	if w.Paused {
+		return "its rolling update is paused", metrics.SkipReasonPaused
+	}
+	return "", ""
+}
+
+// getWorkload reads a resource of any kind the updater checks
+func (u *Updater) getWorkload(ctx context.Context, kind, namespace, name string) (workload, error) {
+	switch kind {
+	case "deployment":
+		deploy, err := u.k8sClient.GetDeployment(ctx, namespace, name)
+		if err != nil {
+			return nil, err
+		}
+		return deploymentWorkload{deploy}, nil
+	case "statefulset":
+		sts, err := u.k8sClient.GetStatefulSet(ctx, namespace, name)
+		if err != nil {
+			return nil, err
+		}
+		return statefulSetWorkload{sts}, nil
+	case "daemonset":
+		ds, err := u.k8sClient.GetDaemonSet(ctx, namespace, name)
+		if err != nil {
+			return nil, err
+		}
+		return daemonSetWorkload{ds}, nil
+	case k8s.KindCloneSet, k8s.KindAdvancedStatefulSet:
+		kruise, err := u.k8sClient.GetKruiseWorkload(ctx, kind, namespace, name)
+		if err != nil {
+			return nil, err
+		}
+		return kruiseWorkload{kruise}, nil
+	default:
+		return nil, fmt.Errorf("unsupported kind: %s", kind)
+	}
+}
+
+// updateWorkloads checks the workloads of a kind enabled for auto-update and applies their new images
+func (u *Updater) updateWorkloads(ctx context.Context, kind string, workloads []workload) error {
+	checkDebugf("Found %d %s workloads enabled for auto-update", len(workloads), kind)
+	// Up to REGISTRY_QUERY_CONCURRENCY resources are checked at once, their writes wait for an APPLY_CONCURRENCY slot
+	slots := make(chan struct{}, max(config.Tuning().RegistryQueryConcurrency, 1))
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for _, w := range workloads {
+		// Stop once the check is cancelled or timed out
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case slots <- struct{}{}:
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			u.updateWorkload(ctx, w)
+		}()
+	}
+	return nil
+}
+
+// updateWorkload runs the update pipeline of a resource: pull failures are reverted, crash loops freeze rollouts,
+// a canary in progress is promoted or rolled back, and otherwise new images are found and applied
+func (u *Updater) updateWorkload(ctx context.Context, w workload) {
+	kind, meta, template := w.kind(), w.meta(), w.podTemplate()
+	if !u.target.Matches(kind, meta.Namespace, meta.Name) {
+		return
+	}
+	u.mu.Lock()
+	u.stats.checked++
+	u.mu.Unlock()
+	checkDebugf("Checking %s %s/%s", kind, meta.Namespace, meta.Name)
+	// A new image would be queued instead of rolled out
+	if config.GlobalConfig.RespectPaused {
+		if reason, skipReason := w.pausedReason(); reason != "" {
+			checkInfof("Skipping %s %s/%s: %s, new images would not roll out", kind, meta.Namespace, meta.Name, reason)
+			countSkipped(ctx, skipReason)
+			return
+		}
+	}
+	if meta.Annotations == nil {
+		meta.Annotations = make(map[string]string)
+	}
+
+	// Status and available updates are recomputed on every check
+	previousAnnotations := maps.Clone(meta.Annotations)
+	delete(meta.Annotations, config.AnnotationStatus)
+	delete(meta.Annotations, config.AnnotationAvailableUpdate)
+	delete(meta.Annotations, config.AnnotationApplyError)
+	// New images failing to pull are reverted before any new update is considered
+	beforeRevert := template.DeepCopy()
+	if entries, err := u.revertOnPullFailure(ctx, kind, meta, template, w.podSelector()); err != nil {
+		u.resourceErrorf("Failed to check pull failures of %s %s/%s: %v", kind, meta.Namespace, meta.Name, err)
+	} else if entries != nil {
+		if config.GlobalConfig.ReportOnly {
+			// The revert is reported like an available update, the resource keeps its images
+			reverted := changedImages(beforeRevert.Spec.Containers, template.Spec.Containers)
+			u.reportWorkload(ctx, w, beforeRevert, previousAnnotations, reverted)
+			return
+		}
+		release := u.applySlot()
+		err := w.update(u.k8sClient)
+		release()
+		if err != nil {
+			u.resourceErrorf("Failed to revert %s %s/%s: %v", kind, meta.Namespace, meta.Name, err)
+		} else {
+			logAuditEntries(entries)
+		}
+		u.recordStatus(kind, meta, template.Spec.Containers, nil)
+		return
+	}
+	// Pods crash looping on the images of the last rollout freeze all rollouts
+	if err := u.freezeOnCrashLoop(ctx, kind, meta, template, w.podSelector()); err != nil {
+		u.resourceErrorf("Failed to check crash loops of %s %s/%s: %v", kind, meta.Namespace, meta.Name, err)
+	}
+
+	// A canary in progress is promoted or rolled back before any new update is considered
+	deploy, isDeployment := w.(deploymentWorkload)
+	if isDeployment && meta.Annotations[config.AnnotationCanary] != "" {
+		state, err := loadCanaryState(meta.Annotations)
+		if err != nil {
+			u.resourceErrorf("Failed to load canary state of %s %s/%s: %v", kind, meta.Namespace, meta.Name, err)
+			return
+		}
+		if state != nil && config.GlobalConfig.ReportOnly {
+			// The canary is neither promoted nor rolled back, its images are reported like an available update
+			u.reportWorkload(ctx, w, template.DeepCopy(), previousAnnotations, state.Images)
+			return
+		}
+		if state != nil {
+			original := template.DeepCopy()
+			entries, err := u.progressCanary(ctx, deploy.Deployment, state)
+			if err != nil {
+				u.resourceErrorf("Failed to progress canary of %s %s/%s: %v", kind, meta.Namespace, meta.Name, err)
+				return
+			}
+			u.recordStatus(kind, meta, template.Spec.Containers, state.Images)
+			// Promoting the canary images rolls out the primary
+			u.applyWorkload(ctx, w, original, previousAnnotations, entries)
+			return
+		}
+	}
+
+	original := template.DeepCopy()
+	updated := false
+	if meta.Annotations[config.AnnotationConfigMapRef] != "" {
+		change, err := u.updateConfigMapImageIfNeeded(ctx, &meta.Annotations, meta.Namespace, meta.Name, kind, template)
+		if err != nil {
+			u.resourceErrorf("Failed to update configmap image of %s %s/%s: %v", kind, meta.Namespace, meta.Name, err)
+		}
+		if change != nil {
+			u.applyConfigMapUpdate(ctx, change, meta.Annotations)
+		}
+	}
+	for i := range template.Spec.Containers {
+		container := &template.Spec.Containers[i]
+		checkDebugf("Checking container %s in %s %s/%s", container.Name, kind, meta.Namespace, meta.Name)
+
+		result, err := u.updateContainerIfNeeded(ctx, container, &meta.Annotations, meta.Namespace, meta.Name, kind, template)
+		if err != nil {
+			u.resourceErrorf("Failed to update container %s in %s %s/%s: %v", container.Name, kind, meta.Namespace, meta.Name, err)
+			continue
+		}
+		checkDebugf("Container %s in %s %s/%s: %s (%s)", container.Name, kind, meta.Namespace, meta.Name, result.Action, result.Reason)
+		if result.Changed {
+			updated = true
+		}
+	}
+
+	skipPullFailedImages(meta.Annotations, original, template)
+	u.skipFlappingImages(ctx, kind, meta, original, template)
+	if updated && equality.Semantic.DeepEqual(*original, *template) {
+		updated = false
+	}
+	proposed := changedImages(original.Spec.Containers, template.Spec.Containers)
+
+	if config.GlobalConfig.ReportOnly {
+		reportAvailableUpdate(meta.Annotations, previousAnnotations, original, template)
+		updated = false
+	}
+
+	if updated && u.writeBack != nil {
+		if err := u.writeBackImages(ctx, kind, meta.Namespace, meta.Name, meta.Annotations, original, template); err != nil {
+			u.resourceErrorf("Failed to write back images of %s %s/%s: %v", kind, meta.Namespace, meta.Name, err)
+		}
+		updated = false
+	}
+
+	if updated && isDeployment && meta.Annotations[config.AnnotationCanary] != "" {
+		if images := changedImages(original.Spec.Containers, template.Spec.Containers); len(images) > 0 {
+			// The primary keeps its current spec until the canary is promoted
+			*template = *original
+			entries, write, err := u.startCanary(ctx, deploy.Deployment, images)
+			if err != nil {
+				u.resourceErrorf("Failed to start canary of %s %s/%s: %v", kind, meta.Namespace, meta.Name, err)
+				return
+			}
+			u.recordStatus(kind, meta, original.Spec.Containers, proposed)
+			if write != nil {
+				// Rolling out the canary is held back and hooked like any rollout
+				u.applyUpdate(ctx, true, kind, meta.Namespace, meta.Name, meta.Annotations, entries, write)
+			} else {
+				u.applyWorkload(ctx, w, original, previousAnnotations, nil)
+			}
+			return
+		}
+	}
+
+	u.recordStatus(kind, meta, original.Spec.Containers, proposed)
+	u.applyWorkload(ctx, w, original, previousAnnotations, nil)
+}
+
+// applyWorkload writes a resource whose pod template or annotations changed since original and previousAnnotations,
+// as a rollout when the pod template changed. The audit entries default to the changed images.
+func (u *Updater) applyWorkload(ctx context.Context, w workload, original *corev1.PodTemplateSpec, previousAnnotations map[string]string, entries []audit.Entry) {
+	kind, meta, template := w.kind(), w.meta(), w.podTemplate()
+	// Only writes changing the pod template roll out new pods
+	rollout := !equality.Semantic.DeepEqual(*original, *template)
+	if !rollout && maps.Equal(meta.Annotations, previousAnnotations) {
+		checkDebugf("No updates needed for %s %s/%s", kind, meta.Namespace, meta.Name)
+		return
+	}
+	if rollout {
+		recordPreviousImages(meta.Annotations, original, template, u.clock.Now())
+		watchCrashLoops(meta.Annotations, u.clock.Now())
+	}
+	if entries == nil {
+		entries = auditEntries(audit.ActionUpdate, kind, meta.Namespace, meta.Name, meta.Annotations, u.policy.Load(), original, template)
+	}
+	u.applyUpdate(ctx, rollout, kind, meta.Namespace, meta.Name, meta.Annotations, entries, func() error { return w.update(u.k8sClient) })
+}
+
+// reportWorkload leaves the pod template and the other annotations of a resource as they were with REPORT_ONLY,
+// writing the images a revert or canary step would roll out to the available-update annotation instead
+func (u *Updater) reportWorkload(ctx context.Context, w workload, original *corev1.PodTemplateSpec, previousAnnotations map[string]string, images map[string]string) {
+	meta, template := w.meta(), w.podTemplate()
+	*template = *original
+	meta.Annotations = maps.Clone(previousAnnotations)
+	delete(meta.Annotations, config.AnnotationAvailableUpdate)
+	if len(images) > 0 {
+		meta.Annotations[config.AnnotationAvailableUpdate] = encodeImages(images)
+	}
+	u.recordStatus(w.kind(), meta, template.Spec.Containers, images)
+	u.applyWorkload(ctx, w, original, previousAnnotations, nil)
+}
@@ -0,0 +1,56 @@
+package updater
+
+import (
+	"context"
+
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/monlor/k8s-image-updater/pkg/audit"
+	"github.com/monlor/k8s-image-updater/pkg/writeback"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// imageChanges lists the container images and image env vars that differ between two pod templates
+func imageChanges(before, after []corev1.Container) []writeback.ImageChange {
+	var changes []writeback.ImageChange
+	for i := range after {
+		if i >= len(before) {
+			break
+		}
+		if before[i].Image != after[i].Image {
+			changes = append(changes, writeback.ImageChange{Container: after[i].Name, OldImage: before[i].Image, NewImage: after[i].Image})
+		}
+		for j := range after[i].Env {
+			if j < len(before[i].Env) && before[i].Env[j].Value != after[i].Env[j].Value {
+				changes = append(changes, writeback.ImageChange{Container: after[i].Name, OldImage: before[i].Env[j].Value, NewImage: after[i].Env[j].Value})
+			}
+		}
+	}
+	return changes
+}
+
+// writeBackImages writes the image changes of a resource through the write-back instead of the cluster,
+// restoring the pod template so that the resource itself is left untouched
+func (u *Updater) writeBackImages(ctx context.Context, kind, namespace, name string, annotations map[string]string, original *corev1.PodTemplateSpec, template *corev1.PodTemplateSpec) error {
+	changes := imageChanges(original.Spec.Containers, template.Spec.Containers)
+	entries := auditEntries(audit.ActionWriteBack, kind, namespace, name, annotations, u.policy.Load(), original, template)
+	*template = *original
+	if len(changes) == 0 {
+		// Restarts of latest mode have nothing to write
+		return nil
+	}
+
+	path := annotations[config.AnnotationWriteBackPath]
+	if path == "" {
+		path = config.GlobalConfig.WriteBackGitPath
+	}
+	if err := u.writeBack.WriteImages(ctx, writeback.Target{
+		Kind:      kind,
+		Namespace: namespace,
+		Name:      name,
+		Path:      path,
+	}, changes); err != nil {
+		return err
+	}
+	logAuditEntries(entries)
+	return nil
+}
@@ -0,0 +1,65 @@
+package updater
+
+import (
+	"context"
+	"testing"
+
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/monlor/k8s-image-updater/pkg/writeback"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// recordingWriteBack records the writes instead of pushing them
+type recordingWriteBack struct {
+	targets []writeback.Target
+	changes [][]writeback.ImageChange
+}
+
+func (r *recordingWriteBack) WriteImages(ctx context.Context, target writeback.Target, changes []writeback.ImageChange) error {
+	r.targets = append(r.targets, target)
+	r.changes = append(r.changes, changes)
+	return nil
+}
+
+func TestWriteBackSkipsClusterUpdate(t *testing.T) {
+	host := newTestRegistry(t, "app", "1.0.0", "1.1.0")
+	u, clientset := newTestUpdater(newTestDeployment(map[string]string{
+		config.AnnotationWriteBackPath: "apps/app.yaml",
+	}, corev1.Container{Name: "app", Image: host + "/app:1.0.0"}))
+	recorder := &recordingWriteBack{}
+	u.writeBack = recorder
+	ctx := context.Background()
+
+	require.NoError(t, u.updateDeployments(ctx))
+
+	deploy, err := clientset.AppsV1().Deployments("default").Get(ctx, "app", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, host+"/app:1.0.0", deploy.Spec.Template.Spec.Containers[0].Image)
+	for _, action := range clientset.Actions() {
+		assert.NotEqual(t, "update", action.GetVerb())
+	}
+
+	require.Len(t, recorder.targets, 1)
+	assert.Equal(t, writeback.Target{Kind: "deployment", Namespace: "default", Name: "app", Path: "apps/app.yaml"}, recorder.targets[0])
+	assert.Equal(t, []writeback.ImageChange{{Container: "app", OldImage: host + "/app:1.0.0", NewImage: host + "/app:1.1.0"}}, recorder.changes[0])
+}
+
+func TestImageChanges(t *testing.T) {
+	before := []corev1.Container{
+		{Name: "app", Image: "app:1", Env: []corev1.EnvVar{{Name: "RUNNER_IMAGE", Value: "runner:1"}}},
+		{Name: "sidecar", Image: "sidecar:1"},
+	}
+	after := []corev1.Container{
+		{Name: "app", Image: "app:1", Env: []corev1.EnvVar{{Name: "RUNNER_IMAGE", Value: "runner:2"}}},
+		{Name: "sidecar", Image: "sidecar:2"},
+	}
+
+	assert.Equal(t, []writeback.ImageChange{
+		{Container: "app", OldImage: "runner:1", NewImage: "runner:2"},
+		{Container: "sidecar", OldImage: "sidecar:1", NewImage: "sidecar:2"},
+	}, imageChanges(before, after))
+	assert.Empty(t, imageChanges(before, before))
+}
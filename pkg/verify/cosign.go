@@ -0,0 +1,157 @@
+package verify
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+	"regexp"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/monlor/k8s-image-updater/pkg/registry"
+	"github.com/sigstore/cosign/v2/cmd/cosign/cli/fulcio"
+	"github.com/sigstore/cosign/v2/pkg/cosign"
+	ociremote "github.com/sigstore/cosign/v2/pkg/oci/remote"
+	rekorclient "github.com/sigstore/rekor/pkg/client"
+	"github.com/sigstore/sigstore/pkg/cryptoutils"
+	"github.com/sigstore/sigstore/pkg/signature"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultRekorURL is the Rekor transparency log of the public Sigstore instance
+const DefaultRekorURL = "https://rekor.sigstore.dev"
+
+// CosignVerifier verifies cosign signatures with the cosign library, made with a key pair (`cosign sign --key`)
+// or keyless with a Fulcio certificate of an expected identity
+type CosignVerifier struct {
+	mu sync.Mutex
+	// Options of the verification, without the registry options of each image. nil until load succeeds.
+	opts *cosign.CheckOpts
+	load func(ctx context.Context) (*cosign.CheckOpts, error)
+}
+
+// KeylessOptions is the identity keyless signatures must be made with: the OIDC issuer and subject, e.g. an email
+// or workflow URL, of the Fulcio certificate, each given exactly or as a regexp
+type KeylessOptions struct {
+	Issuer        string
+	IssuerRegExp  string
+	Subject       string
+	SubjectRegExp string
+	// Rekor transparency log the signatures are looked up in, DefaultRekorURL when empty
+	RekorURL string
+}
+
+// NewCosignKeyVerifier creates a verifier from a PEM encoded ECDSA, RSA or Ed25519 public key. As with
+// `cosign verify --insecure-ignore-tlog`, the signatures are not looked up in the Rekor transparency log.
+func NewCosignKeyVerifier(publicKeyPEM []byte) (*CosignVerifier, error) {
+	key, err := cryptoutils.UnmarshalPEMToPublicKey(publicKeyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse cosign public key: %v", err)
+	}
+	verifier, err := signature.LoadVerifier(key, crypto.SHA256)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported cosign public key: %v", err)
+	}
+	return &CosignVerifier{opts: &cosign.CheckOpts{
+		SigVerifier:   verifier,
+		ClaimVerifier: cosign.SimpleClaimVerifier,
+		IgnoreTlog:    true,
+	}}, nil
+}
+
+// NewCosignKeylessVerifier creates a verifier of keyless signatures, whose Fulcio certificate must name the identity
+// and be logged in Rekor. The Fulcio roots and the Rekor and CT log keys of the public Sigstore instance are fetched
+// with TUF on the first verification.
+func NewCosignKeylessVerifier(opts KeylessOptions) (*CosignVerifier, error) {
+	if opts.Issuer == "" && opts.IssuerRegExp == "" {
+		return nil, fmt.Errorf("keyless verification requires a certificate OIDC issuer")
+	}
+	if opts.Subject == "" && opts.SubjectRegExp == "" {
+		return nil, fmt.Errorf("keyless verification requires a certificate identity")
+	}
+	for _, expr := range []string{opts.IssuerRegExp, opts.SubjectRegExp} {
+		if _, err := regexp.Compile(expr); err != nil {
+			return nil, fmt.Errorf("invalid regex %q: %v", expr, err)
+		}
+	}
+	if opts.RekorURL == "" {
+		opts.RekorURL = DefaultRekorURL
+	}
+	rekor, err := rekorclient.GetRekorClient(opts.RekorURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Rekor client: %v", err)
+	}
+
+	identity := cosign.Identity{Issuer: opts.Issuer, IssuerRegExp: opts.IssuerRegExp, Subject: opts.Subject, SubjectRegExp: opts.SubjectRegExp}
+	return &CosignVerifier{load: func(ctx context.Context) (*cosign.CheckOpts, error) {
+		co := &cosign.CheckOpts{
+			Identities:    []cosign.Identity{identity},
+			ClaimVerifier: cosign.SimpleClaimVerifier,
+			RekorClient:   rekor,
+		}
+		var err error
+		if co.RootCerts, err = fulcio.GetRoots(); err != nil {
+			return nil, fmt.Errorf("failed to get Fulcio roots: %v", err)
+		}
+		if co.IntermediateCerts, err = fulcio.GetIntermediates(); err != nil {
+			return nil, fmt.Errorf("failed to get Fulcio intermediates: %v", err)
+		}
+		if co.RekorPubKeys, err = cosign.GetRekorPubs(ctx); err != nil {
+			return nil, fmt.Errorf("failed to get Rekor public keys: %v", err)
+		}
+		if co.CTLogPubKeys, err = cosign.GetCTLogPubs(ctx); err != nil {
+			return nil, fmt.Errorf("failed to get CT log public keys: %v", err)
+		}
+		return co, nil
+	}}, nil
+}
+
+// checkOpts returns a copy of the options of the verification, loading them on first use
+func (v *CosignVerifier) checkOpts(ctx context.Context) (*cosign.CheckOpts, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.opts == nil {
+		opts, err := v.load(ctx)
+		if err != nil {
+			return nil, err
+		}
+		v.opts = opts
+	}
+	opts := *v.opts
+	return &opts, nil
+}
+
+// Verify succeeds when one of the image's signatures is valid and signs the image's digest
+func (v *CosignVerifier) Verify(ctx context.Context, image string, registryClient *registry.RegistryClient) error {
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return fmt.Errorf("failed to parse image reference: %v", err)
+	}
+	co, err := v.checkOpts(ctx)
+	if err != nil {
+		return err
+	}
+	co.RegistryClientOpts = []ociremote.Option{ociremote.WithRemoteOptions(registryClient.RemoteOptions(ctx, ref)...)}
+
+	if _, _, err := cosign.VerifyImageSignatures(ctx, ref, co); err != nil {
+		if unverified(err) {
+			return fmt.Errorf("%w: %s: %v", ErrUnverified, image, err)
+		}
+		return fmt.Errorf("failed to verify signatures of %s: %v", image, err)
+	}
+	logrus.Debugf("Verified signature of %s", image)
+	return nil
+}
+
+// unverified reports whether cosign failed to verify an image for lack of a valid signature, rather than failing to
+// reach the registry or transparency log
+func unverified(err error) bool {
+	var (
+		failure     *cosign.VerificationFailure
+		noSignature *cosign.ErrNoSignaturesFound
+		noMatch     *cosign.ErrNoMatchingSignatures
+		noCert      *cosign.ErrNoCertificateFoundOnSignature
+	)
+	return errors.As(err, &failure) || errors.As(err, &noSignature) || errors.As(err, &noMatch) || errors.As(err, &noCert)
+}
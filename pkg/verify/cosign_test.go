@@ -0,0 +1,133 @@
+package verify
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	ggcrregistry "github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/monlor/k8s-image-updater/pkg/registry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestKey(t *testing.T) (*ecdsa.PrivateKey, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	return key, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+// Push a random image and return its reference and digest
+func pushImage(t *testing.T, image string) string {
+	img, err := random.Image(256, 1)
+	require.NoError(t, err)
+	ref, err := name.ParseReference(image)
+	require.NoError(t, err)
+	require.NoError(t, remote.Write(ref, img))
+	digest, err := img.Digest()
+	require.NoError(t, err)
+	return digest.String()
+}
+
+// Attach a cosign signature for signedDigest to the image at digest, the way `cosign sign --key` does
+func pushSignature(t *testing.T, repository, digest, signedDigest string, key *ecdsa.PrivateKey) {
+	payload := []byte(fmt.Sprintf(`{"critical":{"identity":{"docker-reference":"%s"},"image":{"docker-manifest-digest":"%s"},"type":"cosign container image signature"},"optional":null}`, repository, signedDigest))
+	hash := sha256.Sum256(payload)
+	sig, err := ecdsa.SignASN1(rand.Reader, key, hash[:])
+	require.NoError(t, err)
+
+	layer := static.NewLayer(payload, "application/vnd.dev.cosign.simplesigning.v1+json")
+	sigImage, err := mutate.Append(mutate.MediaType(empty.Image, types.OCIManifestSchema1), mutate.Addendum{
+		Layer:       layer,
+		Annotations: map[string]string{"dev.cosignproject.cosign/signature": base64.StdEncoding.EncodeToString(sig)},
+	})
+	require.NoError(t, err)
+
+	ref, err := name.ParseReference(repository + ":" + registry.CosignSignatureTag(digest))
+	require.NoError(t, err)
+	require.NoError(t, remote.Write(ref, sigImage))
+}
+
+func TestCosignKeyVerifier(t *testing.T) {
+	server := httptest.NewServer(ggcrregistry.New(ggcrregistry.Logger(log.New(io.Discard, "", 0))))
+	t.Cleanup(server.Close)
+	repository := strings.TrimPrefix(server.URL, "http://") + "/app"
+
+	key, publicKey := newTestKey(t)
+	otherKey, _ := newTestKey(t)
+
+	signedDigest := pushImage(t, repository+":signed")
+	pushSignature(t, repository, signedDigest, signedDigest, key)
+
+	pushImage(t, repository+":unsigned")
+
+	otherKeyDigest := pushImage(t, repository+":other-key")
+	pushSignature(t, repository, otherKeyDigest, otherKeyDigest, otherKey)
+
+	// A valid signature copied from another image must not verify this one
+	copiedDigest := pushImage(t, repository+":copied")
+	pushSignature(t, repository, copiedDigest, signedDigest, key)
+
+	verifier, err := NewCosignKeyVerifier(publicKey)
+	require.NoError(t, err)
+	client := registry.NewRegistryClient("", "")
+	ctx := context.Background()
+
+	assert.NoError(t, verifier.Verify(ctx, repository+":signed", client))
+	assert.NoError(t, verifier.Verify(ctx, repository+"@"+signedDigest, client))
+
+	for _, tag := range []string{"unsigned", "other-key", "copied"} {
+		t.Run(tag, func(t *testing.T) {
+			assert.ErrorIs(t, verifier.Verify(ctx, repository+":"+tag, client), ErrUnverified)
+		})
+	}
+}
+
+func TestNewCosignKeyVerifierInvalidKey(t *testing.T) {
+	_, err := NewCosignKeyVerifier([]byte("not a key"))
+	assert.ErrorContains(t, err, "failed to parse cosign public key")
+}
+
+func TestNewCosignKeylessVerifier(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    KeylessOptions
+		wantErr string
+	}{
+		{"exact identity", KeylessOptions{Issuer: "https://token.actions.githubusercontent.com", Subject: "https://github.com/org/app/.github/workflows/release.yml@refs/heads/main"}, ""},
+		{"regexp identity", KeylessOptions{IssuerRegExp: `^https://accounts\.google\.com$`, SubjectRegExp: `@example\.com$`}, ""},
+		{"missing issuer", KeylessOptions{Subject: "dev@example.com"}, "OIDC issuer"},
+		{"missing subject", KeylessOptions{Issuer: "https://accounts.google.com"}, "certificate identity"},
+		{"invalid regexp", KeylessOptions{Issuer: "https://accounts.google.com", SubjectRegExp: "("}, "invalid regex"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewCosignKeylessVerifier(tt.opts)
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, tt.wantErr)
+			}
+		})
+	}
+}
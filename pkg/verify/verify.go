@@ -0,0 +1,49 @@
+package verify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/monlor/k8s-image-updater/config"
+	"github.com/monlor/k8s-image-updater/pkg/registry"
+)
+
+// ErrUnverified is returned when no valid signature is found for an image
+var ErrUnverified = errors.New("image signature not verified")
+
+// Verifier checks the signature of an image before it is rolled out
+type Verifier interface {
+	Verify(ctx context.Context, image string, registryClient *registry.RegistryClient) error
+}
+
+// New creates the verifier configured by VERIFY_SIGNATURES, or nil when verification is disabled
+func New(cfg *config.Config) (Verifier, error) {
+	if !cfg.VerifySignatures {
+		return nil, nil
+	}
+
+	key := []byte(cfg.CosignPublicKey)
+	if len(key) == 0 && cfg.CosignPublicKeyFile != "" {
+		var err error
+		if key, err = os.ReadFile(cfg.CosignPublicKeyFile); err != nil {
+			return nil, fmt.Errorf("failed to read cosign public key: %v", err)
+		}
+	}
+	if len(key) > 0 {
+		return NewCosignKeyVerifier(key)
+	}
+
+	keyless := KeylessOptions{
+		Issuer:        cfg.CosignCertificateOIDCIssuer,
+		IssuerRegExp:  cfg.CosignCertificateOIDCIssuerRegexp,
+		Subject:       cfg.CosignCertificateIdentity,
+		SubjectRegExp: cfg.CosignCertificateIdentityRegexp,
+		RekorURL:      cfg.CosignRekorURL,
+	}
+	if keyless == (KeylessOptions{RekorURL: cfg.CosignRekorURL}) {
+		return nil, fmt.Errorf("COSIGN_PUBLIC_KEY, COSIGN_PUBLIC_KEY_FILE or COSIGN_CERTIFICATE_IDENTITY is required to verify signatures")
+	}
+	return NewCosignKeylessVerifier(keyless)
+}
@@ -0,0 +1,41 @@
+package version
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// Build information, set at build time with
+// -ldflags "-X github.com/monlor/k8s-image-updater/pkg/version.Version=..."
+var (
+	Version   = "dev"
+	Commit    = "unknown"
+	BuildDate = "unknown"
+)
+
+// Update modes supported by the auto-updater
+var Modes = []string{"release", "digest", "latest", "alphabetical", "date", "review"}
+
+// Info describes the running build
+type Info struct {
+	Version   string   `json:"version"`
+	Commit    string   `json:"commit"`
+	BuildDate string   `json:"buildDate"`
+	GoVersion string   `json:"goVersion"`
+	Modes     []string `json:"modes"`
+}
+
+// Get returns the build information of the running binary
+func Get() Info {
+	return Info{
+		Version:   Version,
+		Commit:    Commit,
+		BuildDate: BuildDate,
+		GoVersion: runtime.Version(),
+		Modes:     Modes,
+	}
+}
+
+func (i Info) String() string {
+	return fmt.Sprintf("k8s-image-updater %s (commit %s, built %s, %s)", i.Version, i.Commit, i.BuildDate, i.GoVersion)
+}
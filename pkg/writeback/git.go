@@ -0,0 +1,197 @@
+package writeback
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// GitOptions configures the Git write-back
+type GitOptions struct {
+	RepoURL     string
+	Branch      string
+	Username    string
+	Password    string
+	AuthorName  string
+	AuthorEmail string
+}
+
+// Git writes new images into manifest files of a Git repository and pushes the commit.
+// It uses the git binary, which must be installed.
+type Git struct {
+	opts GitOptions
+	// Serializes clones and pushes to the repository
+	mu sync.Mutex
+}
+
+func NewGit(opts GitOptions) *Git {
+	if opts.Branch == "" {
+		opts.Branch = "main"
+	}
+	if opts.AuthorName == "" {
+		opts.AuthorName = "k8s-image-updater"
+	}
+	if opts.AuthorEmail == "" {
+		opts.AuthorEmail = "k8s-image-updater@localhost"
+	}
+	return &Git{opts: opts}
+}
+
+// WriteImages clones the branch, replaces the old images in the target manifest and pushes a commit.
+// Changes already present in the manifest are skipped, so repeating a write is a no-op.
+func (g *Git) WriteImages(ctx context.Context, target Target, changes []ImageChange) error {
+	if target.Path == "" {
+		return fmt.Errorf("no manifest path configured for %s %s/%s", target.Kind, target.Namespace, target.Name)
+	}
+	if !filepath.IsLocal(target.Path) {
+		return fmt.Errorf("manifest path %s must be relative to the repository root", target.Path)
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	dir, err := os.MkdirTemp("", "image-updater-git-")
+	if err != nil {
+		return fmt.Errorf("failed to create work directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := g.git(ctx, "", "clone", "--depth", "1", "--branch", g.opts.Branch, g.opts.RepoURL, dir); err != nil {
+		return err
+	}
+
+	manifest := filepath.Join(dir, target.Path)
+	data, err := os.ReadFile(manifest)
+	if err != nil {
+		return fmt.Errorf("failed to read manifest %s: %v", target.Path, err)
+	}
+
+	content := string(data)
+	var applied []string
+	for _, change := range changes {
+		switch {
+		case len(imageOffsets(content, change.OldImage)) > 0:
+			content = replaceImage(content, change.OldImage, change.NewImage)
+			applied = append(applied, fmt.Sprintf("%s: %s -> %s", change.Container, change.OldImage, change.NewImage))
+		case len(imageOffsets(content, change.NewImage)) > 0:
+			logrus.Debugf("Image %s already written to %s", change.NewImage, target.Path)
+		default:
+			return fmt.Errorf("image %s of container %s not found in manifest %s", change.OldImage, change.Container, target.Path)
+		}
+	}
+	if len(applied) == 0 {
+		return nil
+	}
+
+	if err := os.WriteFile(manifest, []byte(content), 0o644); err != nil {
+		return fmt.Errorf("failed to write manifest %s: %v", target.Path, err)
+	}
+
+	message := fmt.Sprintf("Update %s %s/%s images\n\n%s\n", target.Kind, target.Namespace, target.Name, strings.Join(applied, "\n"))
+	if err := g.git(ctx, dir, "add", target.Path); err != nil {
+		return err
+	}
+	if err := g.git(ctx, dir, "commit", "-m", message); err != nil {
+		return err
+	}
+	if err := g.git(ctx, dir, "push", "origin", "HEAD:"+g.opts.Branch); err != nil {
+		return err
+	}
+
+	logrus.Infof("Wrote %d image updates of %s %s/%s to %s in %s", len(applied), target.Kind, target.Namespace, target.Name, target.Path, g.opts.RepoURL)
+	return nil
+}
+
+// isDelimiter reports whether a character may surround an image value in a manifest
+func isDelimiter(c byte) bool {
+	return strings.IndexByte(" \t\r\n\"'=,[]{}", c) >= 0
+}
+
+// imageOffsets returns the offsets of an image in a manifest where it is a whole value, delimited by whitespace,
+// quotes or YAML flow characters, so that repo/app:1.0 is not found in repo/app:1.0.1 or repo/app:1.0-debug
+func imageOffsets(content, image string) []int {
+	var offsets []int
+	for i := 0; i <= len(content); {
+		found := strings.Index(content[i:], image)
+		if found < 0 {
+			break
+		}
+		start, end := i+found, i+found+len(image)
+		if (start == 0 || isDelimiter(content[start-1])) && (end == len(content) || isDelimiter(content[end])) {
+			offsets = append(offsets, start)
+		}
+		i = start + 1
+	}
+	return offsets
+}
+
+// replaceImage replaces an image in a manifest wherever it is a whole value
+func replaceImage(content, oldImage, newImage string) string {
+	var b strings.Builder
+	last := 0
+	for _, offset := range imageOffsets(content, oldImage) {
+		b.WriteString(content[last:offset])
+		b.WriteString(newImage)
+		last = offset + len(oldImage)
+	}
+	b.WriteString(content[last:])
+	return b.String()
+}
+
+// authHeader returns the basic authorization header sent to http(s) repositories with the credentials, empty
+// without credentials
+func (g *Git) authHeader() (string, error) {
+	if g.opts.Username == "" && g.opts.Password == "" {
+		return "", nil
+	}
+	u, err := url.Parse(g.opts.RepoURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return "", fmt.Errorf("git credentials require an http(s) repository URL")
+	}
+	return "Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(g.opts.Username+":"+g.opts.Password)), nil
+}
+
+// Run a git command, keeping the password out of the returned error. The credentials are passed as an
+// http.extraHeader in the environment, never in the arguments or the repository URL, which show in process
+// listings and git output.
+func (g *Git) git(ctx context.Context, dir string, args ...string) error {
+	header, err := g.authHeader()
+	if err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_TERMINAL_PROMPT=0",
+		"GIT_AUTHOR_NAME="+g.opts.AuthorName,
+		"GIT_AUTHOR_EMAIL="+g.opts.AuthorEmail,
+		"GIT_COMMITTER_NAME="+g.opts.AuthorName,
+		"GIT_COMMITTER_EMAIL="+g.opts.AuthorEmail,
+	)
+	if header != "" {
+		cmd.Env = append(cmd.Env, "GIT_CONFIG_COUNT=1", "GIT_CONFIG_KEY_0=http.extraHeader", "GIT_CONFIG_VALUE_0="+header)
+	}
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Run(); err != nil {
+		message := strings.TrimSpace(output.String())
+		if header != "" {
+			message = strings.ReplaceAll(message, header, "Authorization: ***")
+		}
+		if g.opts.Password != "" {
+			message = strings.ReplaceAll(message, g.opts.Password, "***")
+		}
+		return fmt.Errorf("git %s failed: %v: %s", args[0], err, message)
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package writeback
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testManifest = `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      containers:
+      - name: app
+        image: registry.example.com/app:1.0.0
+      - name: sidecar
+        image: registry.example.com/sidecar:2.0.0
+`
+
+func runGit(t *testing.T, dir string, args ...string) string {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@localhost", "GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@localhost")
+	output, err := cmd.CombinedOutput()
+	require.NoError(t, err, string(output))
+	return strings.TrimSpace(string(output))
+}
+
+// Create a bare repository whose main branch holds deploy/app.yaml
+func newBareRepo(t *testing.T) string {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	root := t.TempDir()
+	bare := filepath.Join(root, "repo.git")
+	work := filepath.Join(root, "work")
+	runGit(t, root, "init", "--bare", "--initial-branch=main", bare)
+	runGit(t, root, "clone", bare, work)
+	require.NoError(t, os.MkdirAll(filepath.Join(work, "deploy"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(work, "deploy", "app.yaml"), []byte(testManifest), 0o644))
+	runGit(t, work, "add", ".")
+	runGit(t, work, "commit", "-m", "Initial commit")
+	runGit(t, work, "push", "origin", "HEAD:main")
+	return bare
+}
+
+func TestGitWriteImages(t *testing.T) {
+	bare := newBareRepo(t)
+	g := NewGit(GitOptions{RepoURL: bare, Branch: "main"})
+	target := Target{Kind: "deployment", Namespace: "default", Name: "app", Path: "deploy/app.yaml"}
+	changes := []ImageChange{{Container: "app", OldImage: "registry.example.com/app:1.0.0", NewImage: "registry.example.com/app:1.1.0"}}
+	ctx := context.Background()
+
+	require.NoError(t, g.WriteImages(ctx, target, changes))
+
+	manifest := runGit(t, bare, "show", "main:deploy/app.yaml")
+	assert.Contains(t, manifest, "image: registry.example.com/app:1.1.0")
+	assert.NotContains(t, manifest, "registry.example.com/app:1.0.0")
+	assert.Contains(t, manifest, "image: registry.example.com/sidecar:2.0.0")
+	assert.Equal(t, "2", runGit(t, bare, "rev-list", "--count", "main"))
+	assert.Equal(t, "k8s-image-updater", runGit(t, bare, "log", "-1", "--format=%an", "main"))
+	assert.Contains(t, runGit(t, bare, "log", "-1", "--format=%B", "main"), "app: registry.example.com/app:1.0.0 -> registry.example.com/app:1.1.0")
+
+	// Writing the same change again does not create a new commit
+	require.NoError(t, g.WriteImages(ctx, target, changes))
+	assert.Equal(t, "2", runGit(t, bare, "rev-list", "--count", "main"))
+}
+
+func TestGitWriteImagesErrors(t *testing.T) {
+	bare := newBareRepo(t)
+	g := NewGit(GitOptions{RepoURL: bare})
+	ctx := context.Background()
+	changes := []ImageChange{{Container: "app", OldImage: "registry.example.com/other:1.0.0", NewImage: "registry.example.com/other:1.1.0"}}
+
+	err := g.WriteImages(ctx, Target{Path: "deploy/app.yaml"}, changes)
+	assert.ErrorContains(t, err, "not found in manifest")
+
+	err = g.WriteImages(ctx, Target{Path: "deploy/missing.yaml"}, changes)
+	assert.ErrorContains(t, err, "failed to read manifest")
+
+	err = g.WriteImages(ctx, Target{Path: "../outside.yaml"}, changes)
+	assert.ErrorContains(t, err, "must be relative")
+
+	err = g.WriteImages(ctx, Target{}, changes)
+	assert.ErrorContains(t, err, "no manifest path")
+
+	assert.Equal(t, "1", runGit(t, bare, "rev-list", "--count", "main"))
+}
+
+func TestReplaceImage(t *testing.T) {
+	manifest := `containers:
+- name: app
+  image: repo/app:1.0
+- name: debug
+  image: "repo/app:1.0-debug"
+- name: patch
+  image: repo/app:1.0.1
+  env:
+  - name: IMAGE
+    value: 'repo/app:1.0'
+  args: ["--image=repo/app:1.0", "--other=repo/app:1.0@sha256:abc"]
+`
+	assert.Len(t, imageOffsets(manifest, "repo/app:1.0"), 3)
+	assert.Empty(t, imageOffsets(manifest, "repo/app:1"))
+	assert.Empty(t, imageOffsets(manifest, "app:1.0"))
+
+	assert.Equal(t, `containers:
+- name: app
+  image: repo/app:1.1
+- name: debug
+  image: "repo/app:1.0-debug"
+- name: patch
+  image: repo/app:1.0.1
+  env:
+  - name: IMAGE
+    value: 'repo/app:1.1'
+  args: ["--image=repo/app:1.1", "--other=repo/app:1.0@sha256:abc"]
+`, replaceImage(manifest, "repo/app:1.0", "repo/app:1.1"))
+}
+
+func TestGitWriteImagesPrefixSharingTags(t *testing.T) {
+	bare := newBareRepo(t)
+	g := NewGit(GitOptions{RepoURL: bare, Branch: "main"})
+	target := Target{Kind: "deployment", Namespace: "default", Name: "app", Path: "deploy/app.yaml"}
+	ctx := context.Background()
+
+	// The sidecar runs a tag sharing its prefix with the new image of the app, which is still to be written
+	changes := []ImageChange{{Container: "sidecar", OldImage: "registry.example.com/sidecar:2.0.0", NewImage: "registry.example.com/app:1.0.0-debug"}}
+	require.NoError(t, g.WriteImages(ctx, target, changes))
+	changes = []ImageChange{{Container: "app", OldImage: "registry.example.com/app:1.0", NewImage: "registry.example.com/app:1.1"}}
+	assert.ErrorContains(t, g.WriteImages(ctx, target, changes), "not found in manifest")
+
+	changes = []ImageChange{{Container: "app", OldImage: "registry.example.com/app:1.0.0", NewImage: "registry.example.com/app:1.0"}}
+	require.NoError(t, g.WriteImages(ctx, target, changes))
+	manifest := runGit(t, bare, "show", "main:deploy/app.yaml")
+	assert.Contains(t, manifest, "image: registry.example.com/app:1.0\n")
+	assert.True(t, strings.HasSuffix(manifest, "image: registry.example.com/app:1.0.0-debug"))
+	assert.Equal(t, "3", runGit(t, bare, "rev-list", "--count", "main"))
+}
+
+func TestGitCredentialsHeader(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	var authorization, userinfo string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		if r.URL.User != nil {
+			userinfo = r.URL.User.String()
+		}
+		http.NotFound(w, r)
+	}))
+	t.Cleanup(server.Close)
+	g := NewGit(GitOptions{RepoURL: server.URL + "/repo.git", Username: "bot", Password: "s3cret"})
+
+	err := g.WriteImages(context.Background(), Target{Path: "app.yaml"}, nil)
+	require.Error(t, err)
+	assert.Equal(t, "Basic "+base64.StdEncoding.EncodeToString([]byte("bot:s3cret")), authorization)
+	assert.Empty(t, userinfo)
+	assert.NotContains(t, err.Error(), "s3cret")
+	assert.NotContains(t, err.Error(), base64.StdEncoding.EncodeToString([]byte("bot:s3cret")))
+
+	_, err = NewGit(GitOptions{RepoURL: "git@example.com:org/repo.git", Username: "bot", Password: "s3cret"}).authHeader()
+	assert.ErrorContains(t, err, "http(s) repository URL")
+}
+
+func TestGitCredentialsNotLeaked(t *testing.T) {
+	g := NewGit(GitOptions{RepoURL: "http://127.0.0.1:1/repo.git", Username: "bot", Password: "s3cret"})
+
+	err := g.WriteImages(context.Background(), Target{Path: "app.yaml"}, nil)
+	require.Error(t, err)
+	assert.NotContains(t, err.Error(), "s3cret")
+}
@@ -0,0 +1,51 @@
+package writeback
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/monlor/k8s-image-updater/config"
+)
+
+// WriteBack persists detected image updates somewhere other than the live cluster, e.g. a Git repository
+type WriteBack interface {
+	WriteImages(ctx context.Context, target Target, changes []ImageChange) error
+}
+
+// Target identifies the resource whose images changed and the manifest describing it
+type Target struct {
+	Kind      string
+	Namespace string
+	Name      string
+	// Path of the manifest file relative to the repository root
+	Path string
+}
+
+// ImageChange is a single image reference replaced by the updater
+type ImageChange struct {
+	Container string
+	OldImage  string
+	NewImage  string
+}
+
+// New creates the write-back configured by WRITE_BACK_MODE, or nil when write-back is disabled
+func New(cfg *config.Config) (WriteBack, error) {
+	switch cfg.WriteBackMode {
+	case "":
+		return nil, nil
+	case "git":
+		if cfg.WriteBackGitRepo == "" {
+			return nil, fmt.Errorf("WRITE_BACK_GIT_REPO is required for git write-back")
+		}
+		return NewGit(GitOptions{
+			RepoURL:     cfg.WriteBackGitRepo,
+			Branch:      cfg.WriteBackGitBranch,
+			Username:    cfg.WriteBackGitUsername,
+			Password:    cfg.WriteBackGitPassword,
+			AuthorName:  cfg.WriteBackGitAuthorName,
+			AuthorEmail: cfg.WriteBackGitAuthorEmail,
+		}), nil
+	default:
+		return nil, fmt.Errorf("unknown write-back mode: %s", cfg.WriteBackMode)
+	}
+}